@@ -10,9 +10,31 @@
 // Ring buffer map for syscall events
 struct {
     __uint(type, BPF_MAP_TYPE_RINGBUF);
-    __uint(max_entries, 1 << 24);
+    __uint(max_entries, SYSCALL_EVENTS_SIZE);
 } syscall_events SEC(".maps");
 
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, EVENT_CONNECT + 1);
+    __type(key, u32);
+    __type(value, struct syscall_drops_t);
+} syscall_drops SEC(".maps");
+
+// send_syscall_event sends an event and counts it in syscall_drops when it is lost or shed
+static __always_inline void send_syscall_event(struct syscall_event_t *event)
+{
+    u32 key = event->type;
+    struct syscall_drops_t *drops = bpf_map_lookup_elem(&syscall_drops, &key);
+
+    if (event->type == EVENT_OPEN && bpf_ringbuf_query(&syscall_events, BPF_RB_AVAIL_DATA) >= SYSCALL_SHED_THRESHOLD) {
+        if (drops)
+            drops->shed++;
+        return;
+    }
+    if (bpf_ringbuf_output(&syscall_events, event, sizeof(*event), 0) < 0 && drops)
+        drops->full++;
+}
+
 // -----------------------------
 // EXECUTION: execve via tracepoint
 // -----------------------------
@@ -30,7 +52,7 @@ int log_execve(struct trace_event_raw_sys_enter *ctx)
     bpf_probe_read_user_str(event.filename, sizeof(event.filename), user_filename); // reads from pointer (that reference user space ) , for example pointer to "bin/bash"
 
     
-    bpf_ringbuf_output(&syscall_events, &event, sizeof(event), 0);
+    send_syscall_event(&event);
     return 0;
 }
 
@@ -50,7 +72,7 @@ int log_execveat(struct trace_event_raw_sys_enter *ctx)
     const char *user_filename = (const char *)ctx->args[1];  // arg1 = pathname
     bpf_probe_read_user_str(event.filename, sizeof(event.filename), user_filename);
     
-    bpf_ringbuf_output(&syscall_events, &event, sizeof(event), 0);
+    send_syscall_event(&event);
     return 0;
 }
 
@@ -70,7 +92,7 @@ int log_open(struct trace_event_raw_sys_enter *ctx)
     const char *user_filename = (const char *)ctx->args[1];  // arg1 = pathname
     bpf_probe_read_user_str(event.filename, sizeof(event.filename), user_filename);
     
-    bpf_ringbuf_output(&syscall_events, &event, sizeof(event), 0);
+    send_syscall_event(&event);
     return 0;
 }
 
@@ -90,7 +112,7 @@ int log_unlink(struct trace_event_raw_sys_enter *ctx)
     const char *user_filename = (const char *)ctx->args[1];  // arg1 = pathname
     bpf_probe_read_user_str(event.filename, sizeof(event.filename), user_filename);
     
-    bpf_ringbuf_output(&syscall_events, &event, sizeof(event), 0);
+    send_syscall_event(&event);
     return 0;
 }
 
@@ -110,7 +132,7 @@ int log_chmod(struct trace_event_raw_sys_enter *ctx)
     const char *path = (const char *)ctx->args[0];  // arg0 = pathname
     bpf_probe_read_user_str(event.filename, sizeof(event.filename), path);
     
-    bpf_ringbuf_output(&syscall_events, &event, sizeof(event), 0);
+    send_syscall_event(&event);
     return 0;
 }
 
@@ -130,7 +152,7 @@ int log_mount(struct trace_event_raw_sys_enter *ctx)
     const char *target = (const char *)ctx->args[1];  // arg1 = target
     bpf_probe_read_user_str(event.filename, sizeof(event.filename), target);
     
-    bpf_ringbuf_output(&syscall_events, &event, sizeof(event), 0);
+    send_syscall_event(&event);
     return 0;
 }
 
@@ -147,7 +169,7 @@ int log_setuid(struct trace_event_raw_sys_enter *ctx)
     event.type = EVENT_SETUID;
     bpf_get_current_comm(&event.comm, sizeof(event.comm));
     
-    bpf_ringbuf_output(&syscall_events, &event, sizeof(event), 0);
+    send_syscall_event(&event);
     return 0;
 }
 
@@ -164,7 +186,7 @@ int log_socket(struct trace_event_raw_sys_enter *ctx)
     event.type = EVENT_SOCKET;
     bpf_get_current_comm(&event.comm, sizeof(event.comm));
     
-    bpf_ringbuf_output(&syscall_events, &event, sizeof(event), 0);
+    send_syscall_event(&event);
     return 0;
 }
 
@@ -181,7 +203,7 @@ int log_connect(struct trace_event_raw_sys_enter *ctx)
     event.type = EVENT_CONNECT;
     bpf_get_current_comm(&event.comm, sizeof(event.comm));
     
-    bpf_ringbuf_output(&syscall_events, &event, sizeof(event), 0);
+    send_syscall_event(&event);
     return 0;
 }
 
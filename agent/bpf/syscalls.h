@@ -19,3 +19,13 @@ struct syscall_event_t {
     char filename[256]; // Target file or path used in the syscall (e.g., file opened, binary executed)  
     u64 cgid;  
 };
+
+// records syscall_events lost , per CPU and keyed by the EVENT_* of the program
+struct syscall_drops_t {
+    u64 full;  // the ring buffer had no room for the event
+    u64 shed;  // an EVENT_OPEN skipped while the ring buffer was nearly full
+};
+
+// opens are the most frequent and the least telling , they are shed once this much is waiting for the agent
+#define SYSCALL_EVENTS_SIZE (1 << 24)
+#define SYSCALL_SHED_THRESHOLD (SYSCALL_EVENTS_SIZE / 4 * 3)
@@ -6,7 +6,17 @@
 #define TCP 6
 #define UDP 17
 #define ICMP 1
+#define ICMPV6 58
 #define ETH_P_IP 0x0800
+#define ETH_P_IPV6 0x86DD
+
+// IPv6 extension headers
+#define NEXTHDR_HOP 0
+#define NEXTHDR_ROUTING 43
+#define NEXTHDR_FRAGMENT 44
+#define NEXTHDR_AUTH 51
+#define NEXTHDR_DEST 60
+#define IPV6_MAX_EXT_HDRS 6
 
 // TC return codes
 #define TC_ACT_OK 0
@@ -15,111 +25,527 @@
 
 struct {
     __uint(type, BPF_MAP_TYPE_RINGBUF);
-    __uint(max_entries, 1 << 24); // 16 mb buffer
+    __uint(max_entries, EVENTS_SIZE); // 16 mb buffer
 } events SEC(".maps");
 
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 1 << 20);
+} dns_events SEC(".maps");
+
+// records events and dns_events lost , by the direction of the program
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 2);
+    __type(key, __u32);
+    __type(value, struct ringbuf_drops_t);
+} event_drops SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 2);
+    __type(key, __u32);
+    __type(value, struct ringbuf_drops_t);
+} dns_drops SEC(".maps");
+
+// packets whose IP headers could not be parsed , by the direction of the program
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 2);
+    __type(key, __u32);
+    __type(value, struct unparsed_t);
+} unparsed_packets SEC(".maps");
+
+// the event of the packet being parsed , a ringbuf record is only taken when it is sent
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct flow_event_t);
+} event_scratch SEC(".maps");
 
 struct {
     __uint(type, BPF_MAP_TYPE_ARRAY);
-    __uint(max_entries, 128);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct traffic_config_t);
+} traffic_config SEC(".maps");
+
+// per-flow counters , the agent reports and removes the idle ones
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_FLOWS);
+    __type(key, struct flow_key_t);
+    __type(value, struct flow_stats_t);
+} flows SEC(".maps");
+
+// TCP connections being opened or open , the agent removes the idle ones
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_CONNS);
+    __type(key, struct flow_key_t);
+    __type(value, struct conn_t);
+} conns SEC(".maps");
+
+// DPI_* of each inspected port , as the source or destination
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_DPI_PORTS);
+    __type(key, __u16);
+    __type(value, __u8);
+} dpi_ports SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct http_scratch_t);
+} http_scratch SEC(".maps");
+
+// veths whose packets are captured
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_CAPTURES);
+    __type(key, __u32);
+    __type(value, struct capture_target_t);
+} capture_targets SEC(".maps");
+
+// captured packets , a perf sample copies them from the skb without a bounded buffer
+struct {
+    __uint(type, BPF_MAP_TYPE_PERF_EVENT_ARRAY);
+    __uint(key_size, sizeof(__u32));
+    __uint(value_size, sizeof(__u32));
+} capture_events SEC(".maps");
+
+// HTTP requests waiting for their response , an entry is removed by the final response
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __uint(max_entries, MAX_HTTP_REQUESTS);
+    __type(key, struct flow_key_t);
+    __type(value, struct http_request_t);
+} http_requests SEC(".maps");
+
+
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 2 * MAX_FLOW_RULES);
     __type(key, __u32);
     __type(value, struct flow_rule_t);
 } flow_rules SEC(".maps");
 
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 2 * MAX_FLOW_RULES);
+    __type(key, struct exact_key_t);
+    __type(value, __u32);
+} exact_rules SEC(".maps");
 
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 2 * MAX_FLOW_RULES);
+    __type(key, struct port_key_t);
+    __type(value, struct rule_bucket_t);
+} port_rules SEC(".maps");
 
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, 2 * MAX_FLOW_RULES);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __type(key, struct cidr_key_t);
+    __type(value, struct rule_bucket_t);
+} src_cidr_rules SEC(".maps");
 
-static __always_inline int match_rule(struct flow_event_t *event) {
-    struct flow_rule_t *rule;
-    for (int i = 0; i < 10; i++) {
-        int count = 0;
-        rule = bpf_map_lookup_elem(&flow_rules, &(int){i});
-        if (!rule)
-            continue;
+struct {
+    __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+    __uint(max_entries, 2 * MAX_FLOW_RULES);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+    __type(key, struct cidr_key_t);
+    __type(value, struct rule_bucket_t);
+} dst_cidr_rules SEC(".maps");
 
-        if (rule->action == 0)
-            continue;
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 2);
+    __type(key, __u32);
+    __type(value, struct fallback_list_t);
+} fallback_rules SEC(".maps");
 
-        if (rule->src_ip == event->src_ip) {
-            bpf_printk("src_ip match: %x", event->src_ip);
-            count++;
-        }
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 1);
+    __type(key, __u32);
+    __type(value, struct rule_state_t);
+} rule_state SEC(".maps");
 
-        if (rule->dst_ip == event->dst_ip) {
-            bpf_printk("dst_ip match: %x", event->dst_ip);
-            count++;
-        }
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __uint(max_entries, 2 * MAX_FLOW_RULES);
+    __type(key, __u32);
+    __type(value, struct rate_state_t);
+} rate_limits SEC(".maps");
 
-        if (rule->protocol == event->protocol) {
-            bpf_printk("protocol match: %d", event->protocol);
-            count++;
-        }
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_SCOPE_ENTRIES);
+    __type(key, struct scope_key_t);
+    __type(value, __u8);
+} rule_scopes SEC(".maps");
 
-        if (rule->src_port && rule->src_port == event->src_port) {
-            bpf_printk("src_port match: %d", event->src_port);
-            count++;
-        }
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_FQDN_ENTRIES);
+    __type(key, struct fqdn_key_t);
+    __type(value, __u8);
+} fqdn_ips SEC(".maps");
 
-        if (rule->dst_port && rule->dst_port == event->dst_port) {
-            bpf_printk("dst_port match: %d", event->dst_port);
-            count++;
-        }
+// veths of the pods in an enforcing lockdown namespace
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 4096);
+    __type(key, __u32);
+    __type(value, __u8);
+} lockdown_ifaces SEC(".maps");
 
-        
-        if (rule->direction == event->direction) {
-            bpf_printk("direction match: %d , %d ", event->direction ,rule->direction );
-            count++;
-        }
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, MAX_ALLOW_ENTRIES);
+    __type(key, struct allow_key_t);
+    __type(value, __u8);
+} egress_allow SEC(".maps");
 
-        if (rule->dpi_protocol && rule->dpi_protocol == event->dpi_protocol) {
-            bpf_printk("dpi_protocol match: %d", event->dpi_protocol);
-            count++;
-        }
 
-        if (rule->icmp_type == event->icmp_type) {
-            bpf_printk("icmp_type match: %d", event->icmp_type);
-            count++;
-        }
+static __always_inline int in_range(__u16 v, __u16 min, __u16 max) {
+    return v >= min && v <= max;
+}
 
-        if (rule->query_type == event->query_type) {
-            bpf_printk("query_type match: %d", event->query_type);
-            count++;
-        }
+// sni_matches compares the SNI of an event with a rule's name , or its suffix for a wildcard
+static __always_inline int sni_matches(struct flow_rule_t *rule, struct flow_event_t *event) {
+    if (!rule->sni_wildcard)
+        return __builtin_memcmp(rule->sni, event->sni, 64) == 0;
 
-        if (rule->method[0] != 0 &&
-            __builtin_memcmp(rule->method, event->method, 8) == 0) {
-            bpf_printk("method match: %x", event->method[0]); // print first byte
-            count++;
-        }
+    int len = 0;
+    for (int i = 0; i < 64; i++) {
+        if (event->sni[i] == 0)
+            break;
+        len++;
+    }
+    int suffix = rule->sni_len;
+    // at least one label before the suffix
+    if (suffix == 0 || len <= suffix)
+        return 0;
+    for (int i = 0; i < 64; i++) {
+        if (i >= suffix)
+            break;
+        if (event->sni[(len - suffix + i) & 63] != rule->sni[i])
+            return 0;
+    }
+    return 1;
+}
 
-        if (rule->path[0] != 0 &&
-            __builtin_memcmp(rule->path, event->path, 64) == 0) {
-            bpf_printk("path match: %x", event->path[0]); // print first byte
-            count++;
-        }
+static __always_inline int in_prefix(__u8 *addr, __u8 *prefix, __u8 prefixlen) {
+    for (int i = 0; i < 16; i++) {
+        int bits = prefixlen - i * 8;
+        if (bits <= 0)
+            break;
+        __u8 mask = bits >= 8 ? 0xFF : (__u8)(0xFF << (8 - bits));
+        if ((addr[i] & mask) != prefix[i])
+            return 0;
+    }
+    return 1;
+}
 
-        if (rule->query_name[0] != 0 &&
-            __builtin_memcmp(rule->query_name, event->query_name, 64) == 0) {
-            bpf_printk("query_name match: %x", event->query_name[0]); // print first byte
-            count++;
-        }
+// flow_key_of builds the key of the event's flow , or of the opposite direction when reverse is set
+static __always_inline void flow_key_of(struct flow_event_t *evt, int reverse, struct flow_key_t *key) {
+    key->ifindex = evt->ifindex;
+    key->family = evt->family;
+    key->protocol = evt->protocol;
+    if (reverse) {
+        key->direction = !evt->direction;
+        key->src_port = evt->dst_port;
+        key->dst_port = evt->src_port;
+        __builtin_memcpy(key->src_ip, evt->dst_ip, 16);
+        __builtin_memcpy(key->dst_ip, evt->src_ip, 16);
+    } else {
+        key->direction = evt->direction;
+        key->src_port = evt->src_port;
+        key->dst_port = evt->dst_port;
+        __builtin_memcpy(key->src_ip, evt->src_ip, 16);
+        __builtin_memcpy(key->dst_ip, evt->dst_ip, 16);
+    }
+}
+
+// opens_flow reports whether a packet starts a flow rather than answers one: a TCP SYN , an ICMP
+// echo request , or another packet whose opposite direction has no flow yet
+static __always_inline int opens_flow(struct flow_event_t *event) {
+    switch (event->protocol) {
+    case TCP:
+        return (event->tcp_flags & (TCP_FLAG_SYN | TCP_FLAG_ACK)) == TCP_FLAG_SYN;
+    case ICMP:
+        return event->icmp_type == 8;
+    case ICMPV6:
+        return event->icmp_type == 128;
+    }
+    struct flow_key_t key = {};
+    flow_key_of(event, 1, &key);
+    return !bpf_map_lookup_elem(&flows, &key);
+}
+
+// rule_matches checks every field a rule sets , kept out of line so each lookup tier calls one copy
+static __noinline int rule_matches(struct flow_rule_t *rule, struct flow_event_t *event) {
+    __u32 f = rule->fields;
+
+    if (rule->action == 0)
+        return 0;
+    if ((f & RULE_F_FAMILY) && rule->family != event->family)
+        return 0;
+    if ((f & RULE_F_SRC_CIDR) && !in_prefix(event->src_ip, rule->src_ip, rule->src_prefixlen))
+        return 0;
+    if ((f & RULE_F_DST_CIDR) && !in_prefix(event->dst_ip, rule->dst_ip, rule->dst_prefixlen))
+        return 0;
+    if ((f & RULE_F_PROTOCOL) && rule->protocol != event->protocol)
+        return 0;
+    if ((f & RULE_F_SRC_PORT) && !in_range(event->src_port, rule->src_port_min, rule->src_port_max))
+        return 0;
+    if ((f & RULE_F_DST_PORT) && !in_range(event->dst_port, rule->dst_port_min, rule->dst_port_max))
+        return 0;
+    if ((f & RULE_F_DIRECTION) && rule->direction != event->direction)
+        return 0;
+    if ((f & RULE_F_DPI) && rule->dpi_protocol != event->dpi_protocol)
+        return 0;
+    if ((f & RULE_F_ICMP_TYPE) && rule->icmp_type != event->icmp_type)
+        return 0;
+    if ((f & RULE_F_QUERY_TYPE) && rule->query_type != event->query_type)
+        return 0;
+    if ((f & RULE_F_METHOD) && __builtin_memcmp(rule->method, event->method, 8) != 0)
+        return 0;
+    if ((f & RULE_F_PATH) && __builtin_memcmp(rule->path, event->path, 64) != 0)
+        return 0;
+    if ((f & RULE_F_QUERY_NAME) && __builtin_memcmp(rule->query_name, event->query_name, 64) != 0)
+        return 0;
+    if ((f & RULE_F_SNI) && !sni_matches(rule, event))
+        return 0;
+    if ((f & RULE_F_NEW_FLOW) && !opens_flow(event))
+        return 0;
+    return 1;
+}
+
+static __always_inline int check_rule(__u32 gen, __u32 id, struct flow_event_t *event) {
+    if (id >= MAX_FLOW_RULES)
+        return 0;
+    __u32 idx = gen * MAX_FLOW_RULES + id;
+    struct flow_rule_t *rule = bpf_map_lookup_elem(&flow_rules, &idx);
+    if (!rule || !rule_matches(rule, event))
+        return 0;
+    if (rule->fields & RULE_F_SCOPE) {
+        // scoped and FQDN rules never reach the exact index , every tier that can hold one comes through here
+        struct scope_key_t skey = { .gen = gen, .rule_id = id, .ifindex = event->ifindex };
+        if (!bpf_map_lookup_elem(&rule_scopes, &skey))
+            return 0;
+    }
+    if (rule->fields & RULE_F_FQDN) {
+        struct fqdn_key_t fkey = { .gen = gen, .rule_id = id, .family = event->family };
+        __builtin_memcpy(fkey.addr, event->dst_ip, 16);
+        if (!bpf_map_lookup_elem(&fqdn_ips, &fkey))
+            return 0;
+    }
+    return 1;
+}
 
-        bpf_printk("total matches: %d of required %d", count, rule->action);
+// first_in_bucket returns the lowest rule id of a bucket that matches , if lower than best
+static __always_inline __u32 first_in_bucket(__u32 gen, struct rule_bucket_t *bucket,
+                                             struct flow_event_t *event, __u32 best) {
+    if (!bucket)
+        return best;
+    for (int i = 0; i < RULE_BUCKET_SIZE; i++) {
+        if (i >= bucket->count)
+            break;
+        __u32 id = bucket->ids[i];
+        if (id >= best)
+            break;
+        if (check_rule(gen, id, event))
+            return id;
+    }
+    return best;
+}
+
+static __always_inline struct rule_bucket_t *lookup_cidr(void *trie, __u32 gen, __u8 family, __u8 *addr) {
+    struct cidr_key_t key = {};
+    key.prefixlen = 16 + 128;
+    key.gen = gen;
+    key.family = family;
+    __builtin_memcpy(key.addr, addr, 16);
+    return bpf_map_lookup_elem(trie, &key);
+}
 
-        if (count == rule->action) {
-            bpf_printk("DROP");
-            return 1;
+// find_rule returns the id of the first rule in list order that matches , or NO_RULE.
+// Each index only yields candidates , the lowest matching id over all of them wins.
+static __always_inline __u32 find_rule(struct flow_event_t *event, __u32 *gen_out) {
+    __u32 zero = 0;
+    struct rule_state_t *state = bpf_map_lookup_elem(&rule_state, &zero);
+    if (!state)
+        return NO_RULE;
+    __u32 gen = state->active_gen & 1;
+    *gen_out = gen;
+
+    __u32 best = NO_RULE;
+
+    struct exact_key_t ekey = {};
+    ekey.gen = gen;
+    ekey.family = event->family;
+    ekey.protocol = event->protocol;
+    ekey.direction = event->direction;
+    ekey.src_port = event->src_port;
+    ekey.dst_port = event->dst_port;
+    __builtin_memcpy(ekey.src_ip, event->src_ip, 16);
+    __builtin_memcpy(ekey.dst_ip, event->dst_ip, 16);
+    __u32 *exact = bpf_map_lookup_elem(&exact_rules, &ekey);
+    if (exact)
+        best = *exact;
+
+    struct port_key_t pkey = {};
+    pkey.gen = gen;
+    pkey.protocol = event->protocol;
+    pkey.direction = event->direction;
+    pkey.dst_port = event->dst_port;
+    best = first_in_bucket(gen, bpf_map_lookup_elem(&port_rules, &pkey), event, best);
+
+    best = first_in_bucket(gen, lookup_cidr(&dst_cidr_rules, gen, event->family, event->dst_ip), event, best);
+    best = first_in_bucket(gen, lookup_cidr(&src_cidr_rules, gen, event->family, event->src_ip), event, best);
+
+    struct fallback_list_t *fallback = bpf_map_lookup_elem(&fallback_rules, &gen);
+    if (fallback) {
+        for (int i = 0; i < MAX_FALLBACK_RULES; i++) {
+            if (i >= fallback->count)
+                break;
+            __u32 id = fallback->ids[i];
+            if (id >= best)
+                break;
+            if (check_rule(gen, id, event)) {
+                best = id;
+                break;
+            }
         }
     }
+    return best;
+}
+
+// take_token refills the rule's bucket for the time since the last packet and spends one token
+static __always_inline int take_token(__u32 idx, struct flow_rule_t *rule) {
+    struct rate_state_t *rate = bpf_map_lookup_elem(&rate_limits, &idx);
+    if (!rate)
+        return 1;
+
+    __u64 now = bpf_ktime_get_ns();
+    __u64 capacity = (__u64)rule->burst * NSEC_PER_SEC;
+    __u64 rate_pps = rule->rate_pps > MAX_RATE_PPS ? MAX_RATE_PPS : rule->rate_pps;
+    int ok = 0;
+
+    bpf_spin_lock(&rate->lock);
+    if (rate->last_ns == 0) {
+        rate->tokens = capacity;
+    } else {
+        __u64 elapsed = now - rate->last_ns;
+        // a full bucket needs at most burst / rate seconds , cap it so the product stays small
+        if (elapsed > 10 * NSEC_PER_SEC)
+            elapsed = 10 * NSEC_PER_SEC;
+        rate->tokens += elapsed * rate_pps;
+        if (rate->tokens > capacity)
+            rate->tokens = capacity;
+    }
+    rate->last_ns = now;
+    if (rate->tokens >= NSEC_PER_SEC) {
+        rate->tokens -= NSEC_PER_SEC;
+        ok = 1;
+    }
+    bpf_spin_unlock(&rate->lock);
+    return ok;
+}
+
+// match_rule applies the first matching rule , records it in the event and
+// returns the TC action for the packet
+static __always_inline int match_rule(struct flow_event_t *event) {
+    __u32 gen = 0;
+    __u32 id = find_rule(event, &gen);
+    event->rule_id = id;
+    event->verdict = VERDICT_PASS;
+    if (id == NO_RULE)
+        return TC_ACT_OK;
+
+    __u32 idx = gen * MAX_FLOW_RULES + id;
+    struct flow_rule_t *rule = bpf_map_lookup_elem(&flow_rules, &idx);
+    if (!rule)
+        return TC_ACT_OK;
 
-    return 0; // Allow
+    switch (rule->action) {
+    case ACTION_ALLOW:
+        event->verdict = VERDICT_ALLOW;
+        return TC_ACT_OK;
+    case ACTION_DROP:
+        event->verdict = VERDICT_DROP;
+        return TC_ACT_SHOT;
+    case ACTION_ALERT:
+        event->verdict = VERDICT_ALERT;
+        return TC_ACT_OK;
+    case ACTION_RATE_LIMIT:
+        if (take_token(idx, rule)) {
+            event->verdict = VERDICT_ALLOW;
+            return TC_ACT_OK;
+        }
+        event->verdict = VERDICT_RATE_LIMITED;
+        return TC_ACT_SHOT;
+    }
+    return TC_ACT_OK;
 }
 
 
+// lockdown_denies reports whether a packet a locked down pod sends is missing from its allow-list.
+// Only what opens a flow is checked: TCP SYNs , UDP not sent from a listen port , ICMP echo requests.
+static __always_inline int lockdown_denies(struct flow_event_t *event) {
+    if (event->direction != DIR_FROM_POD)
+        return 0;
+    __u32 ifindex = event->ifindex;
+    if (!bpf_map_lookup_elem(&lockdown_ifaces, &ifindex))
+        return 0;
+
+    struct allow_key_t key = {};
+    key.ifindex = ifindex;
+    key.protocol = event->protocol;
+
+    switch (event->protocol) {
+    case TCP:
+        if ((event->tcp_flags & (TCP_FLAG_SYN | TCP_FLAG_ACK)) != TCP_FLAG_SYN)
+            return 0;
+        break;
+    case UDP:
+        key.port = event->src_port;
+        if (bpf_map_lookup_elem(&egress_allow, &key))
+            return 0;
+        break;
+    case ICMP:
+        if (event->icmp_type != 8)
+            return 0;
+        break;
+    case ICMPV6:
+        if (event->icmp_type != 128)
+            return 0;
+        break;
+    }
+
+    key.family = event->family;
+    key.port = event->dst_port;
+    __builtin_memcpy(key.addr, event->dst_ip, 16);
+    return bpf_map_lookup_elem(&egress_allow, &key) == 0;
+}
+
 static __always_inline int check_bounds(void *ptr, void *data_end, __u64 size) {
     return ((char *)ptr + size) > (char *)data_end;
 }
 
+// is_ipv6_ext_hdr reports the extension headers parse_ipv6 skips with their length field , the fragment header has none
+static __always_inline int is_ipv6_ext_hdr(__u8 nexthdr) {
+    return nexthdr == NEXTHDR_HOP || nexthdr == NEXTHDR_ROUTING || nexthdr == NEXTHDR_AUTH || nexthdr == NEXTHDR_DEST;
+}
+
 static __always_inline int load_payload(struct __sk_buff *ctx, void *data, void *payload,
                                         void *data_end, char *buf, int max_len) {
     int avail = (int)((long)data_end - (long)payload); // This computes how many bytes are safe to read
@@ -131,30 +557,157 @@ static __always_inline int load_payload(struct __sk_buff *ctx, void *data, void
     return to_copy;
 }
 
-static __always_inline void parse_http(struct __sk_buff *ctx, void *data, void *payload,
-                                       void *data_end, struct flow_event_t *evt) {
-    char buf[256] = {};
-    int len = load_payload(ctx, data, payload, data_end, buf, sizeof(buf));
+static __always_inline __u8 dpi_kind(__u16 port) {
+    __u8 *kind = bpf_map_lookup_elem(&dpi_ports, &port);
+    return kind ? *kind : 0;
+}
+
+
+#define HTTP_MASK (HTTP_MAX_HEADER - 1)
 
-    // Extract HTTP method
-    for (int i = 0; i < 8 && i < len; i++) {
-        if (buf[i] == ' ') break;
-        evt->method[i] = buf[i];
+// header_is compares the header name at off with name , a lower case literal ending with ':'
+static __always_inline int header_is(char *data, __u32 off, const char *name, int n) {
+    for (int i = 0; i < n; i++) {
+        // ':' and '-' already have the bit set
+        if ((data[(off + i) & HTTP_MASK] | 0x20) != name[i])
+            return 0;
     }
-    
-    // Find path start (after first space)
-    int p_off = 0;
-    for (int i = 0; i < 256 && i < len; i++) {
-        if (buf[i] == ' ') { p_off = i + 1; break; }
+    return 1;
+}
+
+// copy_header copies the value of the header starting at off , up to the end of its line
+static __always_inline void copy_header(char *data, __u32 off, __u32 len, char *dst, int size) {
+    for (int i = 0; i < 8 && off < len && data[off & HTTP_MASK] == ' '; i++)
+        off++;
+    for (int i = 0; i < size - 1; i++) {
+        __u32 p = off + i;
+        if (p >= len)
+            break;
+        char c = data[p & HTTP_MASK];
+        if (c == '\r' || c == '\n')
+            break;
+        dst[i] = c;
     }
+}
 
-    // Extract path
-    for (int i = 0; i < 64 && (p_off + i) < len; i++) {
-        if (buf[p_off + i] == ' ') break;
-        evt->path[i] = buf[p_off + i];
+// parse_http_request reads the method , path , Host and User-Agent of a request
+// and remembers it for the response
+static __noinline void parse_http_request(struct http_scratch_t *scratch, __u32 len, struct flow_event_t *evt) {
+    char *data = scratch->data;
+
+    // the method is upper case letters up to a space , anything else is not a request line
+    int m = 0;
+    for (; m < 8 && m < len; m++) {
+        char c = data[m];
+        if (c == ' ')
+            break;
+        if (c < 'A' || c > 'Z')
+            return;
     }
-    
+    if (m == 0 || m == 8 || m >= len)
+        return;
+    __builtin_memcpy(evt->method, data, 8);
+    for (int i = m; i < 8; i++)
+        evt->method[i] = 0;
+
+    __u32 p_off = m + 1;
+    for (int i = 0; i < 63; i++) {
+        __u32 p = p_off + i;
+        if (p >= len)
+            break;
+        char c = data[p & HTTP_MASK];
+        if (c == ' ' || c == '\r')
+            break;
+        evt->path[i] = c;
+    }
+
+    // header names start after a \n , the headers end with an empty line
+    __u32 host_off = 0, ua_off = 0;
+    for (int i = 1; i < HTTP_MAX_HEADER; i++) {
+        if (i + 2 > len)
+            break;
+        if (data[(i - 1) & HTTP_MASK] != '\n')
+            continue;
+        char c = data[i & HTTP_MASK];
+        if (c == '\r' || c == '\n')
+            break;
+        if ((c | 0x20) == 'h' && i + 5 <= len && header_is(data, i, "host:", 5))
+            host_off = i + 5;
+        else if ((c | 0x20) == 'u' && i + 11 <= len && header_is(data, i, "user-agent:", 11))
+            ua_off = i + 11;
+    }
+    if (host_off)
+        copy_header(data, host_off, len, evt->host, sizeof(evt->host));
+    if (ua_off)
+        copy_header(data, ua_off, len, evt->user_agent, sizeof(evt->user_agent));
+
+    struct http_request_t *req = &scratch->req;
+    req->timestamp = evt->timestamp;
+    __builtin_memcpy(req->method, evt->method, sizeof(req->method));
+    __builtin_memcpy(req->path, evt->path, sizeof(req->path));
+    __builtin_memcpy(req->host, evt->host, sizeof(req->host));
+    struct flow_key_t key = {};
+    flow_key_of(evt, 0, &key);
+    bpf_map_update_elem(&http_requests, &key, req, BPF_ANY);
+}
+
+// parse_http_response reads the status of a response and copies in the method , path and host
+// of the request it answers. Only the last request of a connection is kept , so with pipelining
+// the earlier responses are not matched.
+static __always_inline void parse_http_response(struct http_scratch_t *scratch, __u32 len, struct flow_event_t *evt) {
+    char *data = scratch->data;
+    // HTTP/1.x NNN
+    if (len < 12 || data[8] != ' ')
+        return;
+    __u16 status = 0;
+    for (int i = 9; i < 12; i++) {
+        char c = data[i];
+        if (c < '0' || c > '9')
+            return;
+        status = status * 10 + (c - '0');
+    }
+    evt->http_status = status;
+
+    struct flow_key_t key = {};
+    flow_key_of(evt, 1, &key);
+    struct http_request_t *req = bpf_map_lookup_elem(&http_requests, &key);
+    if (!req)
+        return;
+    __builtin_memcpy(evt->method, req->method, sizeof(evt->method));
+    __builtin_memcpy(evt->path, req->path, sizeof(evt->path));
+    __builtin_memcpy(evt->host, req->host, sizeof(evt->host));
+    if (evt->timestamp > req->timestamp)
+        evt->http_latency_us = (evt->timestamp - req->timestamp) / 1000;
+    // a 1xx is followed by the final response
+    if (status >= 200)
+        bpf_map_delete_elem(&http_requests, &key);
+}
+
+// parse_http looks at the first HTTP_MAX_HEADER bytes of the segment starting at off ,
+// the start of a request or of a response. Headers past them are not seen.
+static __always_inline void parse_http(struct __sk_buff *ctx, __u32 off, struct flow_event_t *evt) {
     evt->dpi_protocol = 1; // HTTP
+
+    if (off >= ctx->len)
+        return;
+    __u32 len = ctx->len - off;
+    if (len > HTTP_MAX_HEADER)
+        len = HTTP_MAX_HEADER;
+    if (len < 12) // a response status line , or GET / HTTP/1.1
+        return;
+
+    __u32 zero = 0;
+    struct http_scratch_t *scratch = bpf_map_lookup_elem(&http_scratch, &zero);
+    if (!scratch)
+        return;
+    if (bpf_skb_load_bytes(ctx, off, scratch->data, len) < 0)
+        return;
+
+    char *data = scratch->data;
+    if (data[0] == 'H' && data[1] == 'T' && data[2] == 'T' && data[3] == 'P' && data[4] == '/')
+        parse_http_response(scratch, len, evt);
+    else
+        parse_http_request(scratch, len, evt);
 }
 
 static __always_inline void parse_dns(struct __sk_buff *ctx, void *data, void *payload,
@@ -184,6 +737,125 @@ static __always_inline void parse_dns(struct __sk_buff *ctx, void *data, void *p
     evt->dpi_protocol = 2; // DNS
 }
 
+static __always_inline int load_u8(struct __sk_buff *ctx, __u32 off, __u8 *v) {
+    return bpf_skb_load_bytes(ctx, off, v, 1);
+}
+
+static __always_inline int load_u16(struct __sk_buff *ctx, __u32 off, __u16 *v) {
+    __u16 raw = 0;
+    if (bpf_skb_load_bytes(ctx, off, &raw, 2) < 0)
+        return -1;
+    *v = bpf_ntohs(raw);
+    return 0;
+}
+
+// parse_tls reads the server name and the first ALPN protocol of a ClientHello starting at off.
+// Fields are read from the skb one by one , so the hello needs no stack buffer. Extensions past
+// the first segment of a hello split over several are not seen.
+static __always_inline void parse_tls(struct __sk_buff *ctx, __u32 off, struct flow_event_t *evt) {
+    __u8 hdr[6] = {};
+    if (bpf_skb_load_bytes(ctx, off, hdr, sizeof(hdr)) < 0)
+        return;
+    // handshake record , any TLS version framing , ClientHello
+    if (hdr[0] != 0x16 || hdr[1] != 0x03 || hdr[5] != 0x01)
+        return;
+    evt->dpi_protocol = 4; // TLS
+
+    __u32 end = off + 5 + (((__u32)hdr[3] << 8) | hdr[4]);
+    if (end > ctx->len)
+        end = ctx->len;
+
+    // record header , handshake header , client version , random
+    __u32 pos = off + 5 + 4 + 2 + 32;
+    __u8 len8 = 0;
+    __u16 len16 = 0;
+    if (load_u8(ctx, pos, &len8) < 0) // session id
+        return;
+    pos += 1 + len8;
+    if (load_u16(ctx, pos, &len16) < 0) // cipher suites
+        return;
+    pos += 2 + len16;
+    if (load_u8(ctx, pos, &len8) < 0) // compression methods
+        return;
+    pos += 1 + len8;
+    if (load_u16(ctx, pos, &len16) < 0) // extensions
+        return;
+    pos += 2;
+    __u32 ext_end = pos + len16;
+    if (ext_end > end)
+        ext_end = end;
+
+    for (int i = 0; i < TLS_MAX_EXTENSIONS; i++) {
+        __u16 type = 0, size = 0;
+        if (pos + 4 > ext_end)
+            break;
+        if (load_u16(ctx, pos, &type) < 0 || load_u16(ctx, pos + 2, &size) < 0)
+            break;
+        pos += 4;
+
+        if (type == 0) {
+            // server_name: list length , name type , name length , name
+            __u16 name_len = 0;
+            if (load_u16(ctx, pos + 3, &name_len) == 0) {
+                __u32 n = name_len;
+                if (n > sizeof(evt->sni) - 1)
+                    n = sizeof(evt->sni) - 1;
+                n &= 63;
+                if (n > 0)
+                    bpf_skb_load_bytes(ctx, pos + 5, evt->sni, n);
+            }
+        } else if (type == 16) {
+            // application_layer_protocol_negotiation: list length , first protocol length , protocol
+            __u8 proto_len = 0;
+            if (load_u8(ctx, pos + 2, &proto_len) == 0) {
+                __u32 n = proto_len;
+                if (n > sizeof(evt->alpn) - 1)
+                    n = sizeof(evt->alpn) - 1;
+                n &= 15;
+                if (n > 0)
+                    bpf_skb_load_bytes(ctx, pos + 3, evt->alpn, n);
+            }
+        }
+        pos += size;
+    }
+}
+
+// send_dns_response hands a DNS response sent to a pod to the agent , which parses its answers
+static __always_inline void send_dns_response(struct __sk_buff *ctx, void *data, void *payload,
+                                              struct flow_event_t *evt) {
+    if (evt->direction == DIR_FROM_POD)
+        return;
+
+    // the skb length also covers what is not in the linear data
+    __u32 off = (long)payload - (long)data;
+    if (off >= ctx->len)
+        return;
+    __u32 len = ctx->len - off;
+    if (len > DNS_MAX_PAYLOAD)
+        len = DNS_MAX_PAYLOAD;
+    if (len < 12) // DNS header
+        return;
+
+    struct dns_event_t *dns = bpf_ringbuf_reserve(&dns_events, sizeof(*dns), 0);
+    if (!dns) {
+        __u32 dir = evt->direction;
+        struct ringbuf_drops_t *drops = bpf_map_lookup_elem(&dns_drops, &dir);
+        if (drops)
+            drops->full++;
+        return;
+    }
+    dns->timestamp = evt->timestamp;
+    dns->ifindex = evt->ifindex;
+    dns->family = evt->family;
+    dns->reserved = 0;
+    dns->len = len;
+    if (bpf_skb_load_bytes(ctx, off, dns->payload, len) < 0) {
+        bpf_ringbuf_discard(dns, 0);
+        return;
+    }
+    bpf_ringbuf_submit(dns, 0);
+}
+
 // ICMP Types:
 // 0  - Echo Reply (ping reply)
 // 3  - Destination Unreachable
@@ -195,25 +867,352 @@ static __always_inline void parse_icmp(struct icmphdr *icmp, struct flow_event_t
     evt->dpi_protocol = 3; // ICMP
 }
 
-static __always_inline int emit_and_return(struct flow_event_t *evt) {
-    // bpf_printk("TC: Submitting packet event, proto=%d\n", evt->protocol);
+// send_event sends evt for the program of direction dir , the counters are per CPU so they need no atomics
+static __always_inline void send_event(struct flow_event_t *evt, __u8 dir) {
+    if (bpf_ringbuf_output(&events, evt, sizeof(*evt), 0) < 0) {
+        __u32 key = dir;
+        struct ringbuf_drops_t *drops = bpf_map_lookup_elem(&event_drops, &key);
+        if (drops)
+            drops->full++;
+    }
+}
 
-    if (match_rule(evt)) {
-        bpf_printk("TC: Matched rule for drop, discarding event and packet.\n");
-        bpf_ringbuf_discard(evt, 0); 
-        return TC_ACT_SHOT;
+// shed_event skips a low priority event , a packet or a periodic flow update that passed ,
+// while events is nearly full so the ones that matter still fit. Skipped flow updates are
+// aggregated: their counts are sent with the flow's next event.
+static __always_inline int shed_event(struct flow_event_t *evt) {
+    if (evt->verdict != VERDICT_PASS && evt->verdict != VERDICT_ALLOW)
+        return 0;
+    if (bpf_ringbuf_query(&events, BPF_RB_AVAIL_DATA) < EVENTS_SHED_THRESHOLD)
+        return 0;
+    __u32 key = evt->direction;
+    struct ringbuf_drops_t *drops = bpf_map_lookup_elem(&event_drops, &key);
+    if (drops)
+        drops->shed++;
+    return 1;
+}
+
+// has_dpi_details reports whether a packet carries what DPI parsed , an HTTP request or response ,
+// a DNS question or a TLS hello , which is sent even in the middle of a flow
+static __always_inline int has_dpi_details(struct flow_event_t *evt) {
+    return evt->method[0] != 0 || evt->http_status != 0 || evt->query_name[0] != 0 || evt->sni[0] != 0;
+}
+
+// track_flow adds the packet to the counters of its flow and sends the flow's start , its end
+// and an update every flush_ns while it has traffic. In TRAFFIC_MODE_PACKETS every packet is sent.
+static __always_inline void track_flow(struct flow_event_t *evt) {
+    __u32 zero = 0;
+    struct traffic_config_t *cfg = bpf_map_lookup_elem(&traffic_config, &zero);
+    __u64 len = evt->payload_len;
+    __u64 now = evt->timestamp;
+
+    evt->packets = 1;
+    evt->bytes = len;
+    evt->new_bytes = len;
+    evt->new_packets = 1;
+    evt->first_seen = now;
+
+    if (!cfg || cfg->mode == TRAFFIC_MODE_PACKETS) {
+        evt->event_type = EVENT_PACKET;
+        if (!has_dpi_details(evt) && shed_event(evt))
+            return;
+        send_event(evt, evt->direction);
+        return;
     }
 
-    bpf_ringbuf_submit(evt, 0);
-    return TC_ACT_OK;
+    struct flow_key_t key = {};
+    flow_key_of(evt, 0, &key);
+
+    struct flow_stats_t *stats = bpf_map_lookup_elem(&flows, &key);
+    // a SYN on the ports of a closed flow opens a new one
+    if (stats && stats->closed && (evt->tcp_flags & (TCP_FLAG_SYN | TCP_FLAG_ACK)) == TCP_FLAG_SYN) {
+        bpf_map_delete_elem(&flows, &key);
+        stats = 0;
+    }
+
+    if (!stats) {
+        struct flow_stats_t fresh = {};
+        fresh.packets = 1;
+        fresh.bytes = len;
+        fresh.reported_bytes = len;
+        fresh.reported_packets = 1;
+        fresh.first_seen = now;
+        fresh.last_seen = now;
+        fresh.last_report = now;
+        fresh.rule_id = evt->rule_id;
+        fresh.tcp_flags = evt->tcp_flags;
+        fresh.verdict = evt->verdict;
+        fresh.closed = (evt->tcp_flags & (TCP_FLAG_FIN | TCP_FLAG_RST)) != 0;
+        bpf_map_update_elem(&flows, &key, &fresh, BPF_ANY);
+
+        evt->event_type = EVENT_FLOW_START;
+        send_event(evt, evt->direction);
+        return;
+    }
+
+    __sync_fetch_and_add(&stats->packets, 1);
+    __sync_fetch_and_add(&stats->bytes, len);
+    stats->last_seen = now;
+    stats->tcp_flags |= evt->tcp_flags;
+    // the rest of the close handshake is only counted
+    if (stats->closed)
+        return;
+
+    if (evt->tcp_flags & (TCP_FLAG_FIN | TCP_FLAG_RST)) {
+        evt->event_type = EVENT_FLOW_END;
+        stats->closed = 1;
+    } else if (evt->verdict != stats->verdict || evt->rule_id != stats->rule_id || has_dpi_details(evt)) {
+        evt->event_type = EVENT_FLOW_UPDATE;
+    } else if (now - stats->last_report >= cfg->flush_ns) {
+        // the flow's counters are left as they are , the next event reports what this one would have
+        if (shed_event(evt))
+            return;
+        evt->event_type = EVENT_FLOW_UPDATE;
+    } else {
+        return;
+    }
+
+    stats->verdict = evt->verdict;
+    stats->rule_id = evt->rule_id;
+    stats->last_report = now;
+    evt->packets = stats->packets;
+    evt->bytes = stats->bytes;
+    evt->new_bytes = stats->bytes - stats->reported_bytes;
+    evt->new_packets = stats->packets - stats->reported_packets;
+    evt->first_seen = stats->first_seen;
+    stats->reported_bytes = stats->bytes;
+    stats->reported_packets = stats->packets;
+    send_event(evt, evt->direction);
+}
+
+// track_conn follows the handshake and teardown of a TCP connection and sends its lifecycle events.
+// It runs after track_flow , the event is rewritten for the connection when one is sent.
+static __always_inline void track_conn(struct flow_event_t *evt) {
+    if (evt->protocol != TCP)
+        return;
+
+    __u8 flags = evt->tcp_flags;
+    __u8 dir = evt->direction; // of the program , the event gets the connection's
+    __u64 now = evt->timestamp;
+    __u64 len = evt->payload_len;
+
+    struct flow_key_t key = {};
+    flow_key_of(evt, 0, &key);
+
+    struct conn_t *conn = bpf_map_lookup_elem(&conns, &key);
+
+    if ((flags & (TCP_FLAG_SYN | TCP_FLAG_ACK)) == TCP_FLAG_SYN) {
+        // a retransmitted SYN keeps the time of the first one , in any other state the port was reused
+        if (conn && conn->state == CONN_SYN_SENT)
+            return;
+        struct conn_t fresh = {};
+        fresh.syn_ns = now;
+        fresh.last_seen = now;
+        fresh.bytes_out = len;
+        fresh.state = CONN_SYN_SENT;
+        bpf_map_update_elem(&conns, &key, &fresh, BPF_ANY);
+        return;
+    }
+
+    int outbound = 1;
+    if (!conn) {
+        // sent by the responder , the connection is keyed by the other side
+        flow_key_of(evt, 1, &key);
+        conn = bpf_map_lookup_elem(&conns, &key);
+        if (!conn)
+            return; // opened before the agent started
+        outbound = 0;
+    }
+
+    conn->last_seen = now;
+    if (outbound)
+        __sync_fetch_and_add(&conn->bytes_out, len);
+    else
+        __sync_fetch_and_add(&conn->bytes_in, len);
+
+    __u8 type = 0; // none
+    if (conn->state == CONN_SYN_SENT) {
+        if (!outbound && (flags & (TCP_FLAG_SYN | TCP_FLAG_ACK)) == (TCP_FLAG_SYN | TCP_FLAG_ACK)) {
+            conn->state = CONN_ESTABLISHED;
+            conn->established_ns = now;
+            type = EVENT_CONN_OPENED;
+        } else if (flags & TCP_FLAG_RST) {
+            // the initiator giving up is not a refusal
+            type = outbound ? EVENT_CONN_CLOSED : EVENT_CONN_REFUSED;
+        }
+    } else if (flags & TCP_FLAG_RST) {
+        type = EVENT_CONN_CLOSED;
+    } else if (flags & TCP_FLAG_FIN) {
+        conn->fins |= outbound ? CONN_FIN_OUT : CONN_FIN_IN;
+        conn->state = CONN_CLOSING;
+        if (conn->fins == (CONN_FIN_OUT | CONN_FIN_IN))
+            type = EVENT_CONN_CLOSED;
+    }
+    if (!type)
+        return;
+
+    evt->event_type = type;
+    evt->direction = key.direction;
+    evt->src_port = key.src_port;
+    evt->dst_port = key.dst_port;
+    __builtin_memcpy(evt->src_ip, key.src_ip, 16);
+    __builtin_memcpy(evt->dst_ip, key.dst_ip, 16);
+    evt->first_seen = conn->syn_ns;
+    evt->packets = 0;
+    evt->bytes = conn->bytes_out;
+    evt->new_bytes = 0;
+    evt->new_packets = 0;
+    evt->reply_bytes = conn->bytes_in;
+    if (type != EVENT_CONN_OPENED)
+        bpf_map_delete_elem(&conns, &key);
+    send_event(evt, dir);
+}
+
+// capture_packet copies a packet of a captured veth to capture_events , dropped ones too
+static __always_inline void capture_packet(struct __sk_buff *ctx, struct flow_event_t *evt) {
+    __u32 ifindex = evt->ifindex;
+    struct capture_target_t *target = bpf_map_lookup_elem(&capture_targets, &ifindex);
+    if (!target || target->remaining <= 0)
+        return;
+    if (target->filter.fields && !rule_matches(&target->filter, evt))
+        return;
+    __sync_fetch_and_add(&target->remaining, -1);
+
+    __u32 caplen = ctx->len;
+    if (caplen > target->snaplen)
+        caplen = target->snaplen;
+    if (caplen > CAPTURE_MAX_SNAPLEN)
+        caplen = CAPTURE_MAX_SNAPLEN;
+
+    struct capture_meta_t meta = {
+        .timestamp = evt->timestamp,
+        .ifindex = ifindex,
+        .len = ctx->len,
+        .caplen = caplen,
+        .rule_id = evt->rule_id,
+        .direction = evt->direction,
+        .verdict = evt->verdict,
+    };
+    bpf_perf_event_output(ctx, &capture_events, ((__u64)caplen << 32) | BPF_F_CURRENT_CPU, &meta, sizeof(meta));
+}
+
+static __always_inline int emit_and_return(struct __sk_buff *ctx, struct flow_event_t *evt) {
+    // bpf_printk("TC: Submitting packet event, proto=%d\n", evt->protocol);
+
+    // the packet is counted whatever the verdict , so blocked flows show up too
+    int act = match_rule(evt);
+    // an explicit allow rule wins over lockdown , so does any rule that already dropped
+    if (act == TC_ACT_OK && evt->verdict != VERDICT_ALLOW && lockdown_denies(evt)) {
+        evt->verdict = VERDICT_DENIED;
+        act = TC_ACT_SHOT;
+    }
+    capture_packet(ctx, evt);
+    track_flow(evt);
+    track_conn(evt);
+    return act;
 }
 
 static __always_inline int discard_and_return(struct flow_event_t *evt) {
     bpf_printk("TC: Submitting error event, proto=%d\n", evt->protocol);
-    bpf_ringbuf_discard(evt, 0);
     return TC_ACT_OK;
 }
 
+// results of parse_ipv4 and parse_ipv6 besides 0
+#define L3_SKIP -1     // nothing to match , a non-first fragment
+#define L3_UNPARSED -2 // malformed , or more IPv6 extension headers than IPV6_MAX_EXT_HDRS
+
+// l3_info is what parse_packet needs from the IPv4 or IPv6 header
+struct l3_info {
+    void *l4;
+    __u8 protocol;
+    __u8 family;
+    __u8 saddr[16];
+    __u8 daddr[16];
+};
+
+static __always_inline int parse_ipv4(void *l3, void *data_end, struct l3_info *info) {
+    struct iphdr *ip = l3;
+    if (check_bounds(ip, data_end, sizeof(*ip)))
+        return L3_UNPARSED;
+
+    if (ip->ihl < 5)
+        return L3_UNPARSED;
+
+    if ((void *)ip + (ip->ihl * 4) > data_end)
+        return L3_UNPARSED;
+
+    info->l4 = (void *)ip + (ip->ihl * 4);
+    info->protocol = ip->protocol;
+    info->family = FAMILY_IPV4;
+    __builtin_memcpy(info->saddr, &ip->saddr, 4);
+    __builtin_memcpy(info->daddr, &ip->daddr, 4);
+    return 0;
+}
+
+// parse_ipv6 skips the extension headers up to the transport header.
+// Non-first fragments carry no transport header and are skipped , a chain that is still
+// going after IPV6_MAX_EXT_HDRS headers is unparsed.
+static __always_inline int parse_ipv6(void *l3, void *data_end, struct l3_info *info) {
+    struct ipv6hdr *ip6 = l3;
+    if (check_bounds(ip6, data_end, sizeof(*ip6)))
+        return L3_UNPARSED;
+
+    void *cur = (void *)ip6 + sizeof(*ip6);
+    __u8 nexthdr = ip6->nexthdr;
+
+    for (int i = 0; i < IPV6_MAX_EXT_HDRS; i++) {
+        if (nexthdr == NEXTHDR_FRAGMENT) {
+            struct frag_hdr *frag = cur;
+            if (check_bounds(frag, data_end, sizeof(*frag)))
+                return L3_UNPARSED;
+            if (bpf_ntohs(frag->frag_off) & 0xFFF8)
+                return L3_SKIP;
+            nexthdr = frag->nexthdr;
+            cur += sizeof(*frag);
+            continue;
+        }
+
+        if (!is_ipv6_ext_hdr(nexthdr))
+            break;
+
+        struct ipv6_opt_hdr *opt = cur;
+        if (check_bounds(opt, data_end, sizeof(*opt)))
+            return L3_UNPARSED;
+        __u8 cur_hdr = nexthdr;
+        nexthdr = opt->nexthdr;
+        // AH counts its length in 4 byte units minus 2 , the others in 8 byte units minus 1
+        if (cur_hdr == NEXTHDR_AUTH)
+            cur += (opt->hdrlen + 2) * 4;
+        else
+            cur += (opt->hdrlen + 1) * 8;
+    }
+    if (nexthdr == NEXTHDR_FRAGMENT || is_ipv6_ext_hdr(nexthdr))
+        return L3_UNPARSED;
+
+    info->l4 = cur;
+    info->protocol = nexthdr;
+    info->family = FAMILY_IPV6;
+    __builtin_memcpy(info->saddr, &ip6->saddr, 16);
+    __builtin_memcpy(info->daddr, &ip6->daddr, 16);
+    return 0;
+}
+
+// unparsed_verdict counts a packet whose IP headers could not be parsed. No rule can match it ,
+// so it is dropped on the veths of locked down pods instead of slipping past the allow-list.
+static __always_inline int unparsed_verdict(struct __sk_buff *ctx, __u8 direction) {
+    __u32 ifindex = ctx->ifindex;
+    int locked = bpf_map_lookup_elem(&lockdown_ifaces, &ifindex) != 0;
+    __u32 key = direction;
+    struct unparsed_t *unparsed = bpf_map_lookup_elem(&unparsed_packets, &key);
+    if (unparsed) {
+        if (locked)
+            unparsed->dropped++;
+        else
+            unparsed->passed++;
+    }
+    return locked ? TC_ACT_SHOT : TC_ACT_OK;
+}
+
 static __always_inline int parse_packet(struct __sk_buff *ctx, __u8 direction) {
     void *data     = (void *)(long)ctx->data;
     void *data_end = (void *)(long)ctx->data_end;
@@ -222,38 +1221,43 @@ static __always_inline int parse_packet(struct __sk_buff *ctx, __u8 direction) {
     if (check_bounds(eth, data_end, sizeof(*eth)))
         return TC_ACT_OK;
 
-    if (bpf_ntohs(eth->h_proto) != ETH_P_IP)
-        return TC_ACT_OK;
-
-    struct iphdr *ip = (void *)eth + sizeof(*eth);
-    if (check_bounds(ip, data_end, sizeof(*ip)))
-        return TC_ACT_OK;
+    struct l3_info info = {};
+    void *l3 = (void *)eth + sizeof(*eth);
+    __u16 h_proto = bpf_ntohs(eth->h_proto);
 
-    if (ip->ihl < 5)
+    int parsed;
+    if (h_proto == ETH_P_IP)
+        parsed = parse_ipv4(l3, data_end, &info);
+    else if (h_proto == ETH_P_IPV6)
+        parsed = parse_ipv6(l3, data_end, &info);
+    else
         return TC_ACT_OK;
-
-    if ((void *)ip + (ip->ihl * 4) > data_end)
+    if (parsed == L3_SKIP)
         return TC_ACT_OK;
+    if (parsed == L3_UNPARSED)
+        return unparsed_verdict(ctx, direction);
 
-    if (!(ip->protocol == TCP || ip->protocol == UDP || ip->protocol == ICMP))
+    if (!(info.protocol == TCP || info.protocol == UDP || info.protocol == ICMP || info.protocol == ICMPV6))
         return TC_ACT_OK;
 
-    struct flow_event_t *evt = bpf_ringbuf_reserve(&events, sizeof(*evt), 0);
+    __u32 zero = 0;
+    struct flow_event_t *evt = bpf_map_lookup_elem(&event_scratch, &zero);
     if (!evt)
         return TC_ACT_OK;
 
-    void *l4 = (void *)ip + (ip->ihl * 4);
+    void *l4 = info.l4;
 
     __builtin_memset(evt, 0, sizeof(*evt));
     evt->timestamp = bpf_ktime_get_ns();
     evt->payload_len = ctx->len;
     evt->direction = direction;
     evt->ifindex = ctx->ifindex;
-    evt->src_ip = ip->saddr;
-    evt->dst_ip = ip->daddr;
-    evt->protocol = ip->protocol;
+    evt->family = info.family;
+    __builtin_memcpy(evt->src_ip, info.saddr, 16);
+    __builtin_memcpy(evt->dst_ip, info.daddr, 16);
+    evt->protocol = info.protocol;
 
-    if (ip->protocol == TCP) {
+    if (info.protocol == TCP) {
         struct tcphdr *tcp = l4;
         if (check_bounds(tcp, data_end, sizeof(*tcp)))
             return discard_and_return(evt);
@@ -263,16 +1267,20 @@ static __always_inline int parse_packet(struct __sk_buff *ctx, __u8 direction) {
 
         evt->src_port = bpf_ntohs(tcp->source);
         evt->dst_port = bpf_ntohs(tcp->dest);
+        evt->tcp_flags = ((__u8 *)tcp)[13];
 
-        if (evt->dst_port == 80 || evt->src_port == 80 ||
-            evt->dst_port == 8080 || evt->src_port == 8080) {
-            void *payload = (void *)tcp + (tcp->doff * 4);
-            parse_http(ctx, data, payload, data_end, evt);
-        }
+        // HTTP both ways , TLS only towards the server
+        __u32 off = (long)tcp + (tcp->doff * 4) - (long)data;
+        __u8 dst_kind = dpi_kind(evt->dst_port);
+        __u8 src_kind = dpi_kind(evt->src_port);
+        if (dst_kind == DPI_HTTP || src_kind == DPI_HTTP)
+            parse_http(ctx, off, evt);
+        else if (dst_kind == DPI_TLS)
+            parse_tls(ctx, off, evt);
 
-        return emit_and_return(evt);
+        return emit_and_return(ctx, evt);
 
-    } else if (ip->protocol == UDP) {
+    } else if (info.protocol == UDP) {
         struct udphdr *udp = l4;
         if (check_bounds(udp, data_end, sizeof(*udp)))
             return discard_and_return(evt);
@@ -280,20 +1288,32 @@ static __always_inline int parse_packet(struct __sk_buff *ctx, __u8 direction) {
         evt->src_port = bpf_ntohs(udp->source);
         evt->dst_port = bpf_ntohs(udp->dest);
 
-        if (evt->dst_port == 53 || evt->src_port == 53) {
+        __u8 src_kind = dpi_kind(evt->src_port);
+        if (src_kind == DPI_DNS || dpi_kind(evt->dst_port) == DPI_DNS) {
             void *payload = (void *)udp + sizeof(*udp);
             parse_dns(ctx, data, payload, data_end, evt);
+            if (src_kind == DPI_DNS)
+                send_dns_response(ctx, data, payload, evt);
         }
 
-        return emit_and_return(evt);
+        return emit_and_return(ctx, evt);
 
-    } else if (ip->protocol == ICMP) {
+    } else if (info.protocol == ICMP) {
         struct icmphdr *icmp = l4;
         if (check_bounds(icmp, data_end, sizeof(*icmp)))
             return discard_and_return(evt);
 
         parse_icmp(icmp, evt);
-        return emit_and_return(evt);
+        return emit_and_return(ctx, evt);
+
+    } else if (info.protocol == ICMPV6) {
+        struct icmp6hdr *icmp6 = l4;
+        if (check_bounds(icmp6, data_end, sizeof(*icmp6)))
+            return discard_and_return(evt);
+
+        evt->icmp_type = icmp6->icmp6_type;
+        evt->dpi_protocol = 3; // ICMP
+        return emit_and_return(ctx, evt);
     }
 
     return discard_and_return(evt);
@@ -5,46 +5,372 @@
 // Main Flow Event Structure
 // ---------------------------
 
+// address families , same values as AF_INET / AF_INET6
+#define FAMILY_IPV4 2
+#define FAMILY_IPV6 10
+
 struct flow_event_t {
     __u64 timestamp;            // Nanoseconds since boot or epoch
 
-    __u32 src_ip;               // Source IP (IPv4)
-    __u32 dst_ip;               // Destination IP (IPv4)
+    __u8  src_ip[16];           // Source IP , an IPv4 address uses the first 4 bytes
+    __u8  dst_ip[16];           // Destination IP , same layout
     __u16 src_port;             // Source port
     __u16 dst_port;             // Destination port
-    __u8  protocol;             // TCP=6, UDP=17, ICMP=1, etc.
+    __u8  protocol;             // TCP=6, UDP=17, ICMP=1, ICMPv6=58
     __u8  direction;            // 0 = ingress, 1 = egress
     __u16 payload_len;          // Payload size (bytes, excluding headers)
-    __u8  dpi_protocol;         // 0=unknown, 1=HTTP, 2=DNS, 3=ICMP
-    __u8  reserved1;            // Alignment padding
+    __u8  dpi_protocol;         // 0=unknown, 1=HTTP, 2=DNS, 3=ICMP, 4=TLS
+    __u8  family;               // FAMILY_IPV4 or FAMILY_IPV6
     __u16 reserved2;            // Alignment padding
     char method[8];     // HTTP method (GET, POST, etc.)
     char path[64];      // Request path
     char query_name[64];  // DNS query name
     __u16 query_type;     // e.g., A=1, AAAA=28
     __u8 icmp_type; 
+    __u8 tcp_flags;             // flags byte of the TCP header , FIN=0x01 SYN=0x02 RST=0x04 ACK=0x10
     __u32 ifindex   ;
-    
+    __u32 rule_id;              // id of the matching rule , NO_RULE when none matched
+    __u8  verdict;              // VERDICT_* , what happened to the packet
+    __u8  event_type;           // EVENT_*
+    __u8  reserved4[2];         // Alignment padding
+    __u64 packets;              // counters of the flow up to this event , 1 packet in TRAFFIC_MODE_PACKETS
+    __u64 bytes;
+    __u64 new_bytes;            // bytes since the flow's previous event
+    __u64 first_seen;           // timestamp of the flow's first packet , of the SYN for a connection
+    __u64 reply_bytes;          // bytes the responder sent , connection events only
+    char sni[64];               // TLS ClientHello server name
+    char alpn[16];              // first ALPN protocol the client offers , e.g. h2
+    char host[64];              // HTTP Host header
+    char user_agent[64];        // HTTP User-Agent header
+    __u16 http_status;          // HTTP response status , method , path and host are then the request's
+    __u16 reserved5;
+    __u32 http_latency_us;      // from the request to its response
+    __u64 new_packets;          // packets since the flow's previous event
+};
+
+// kind of a flow event
+#define EVENT_PACKET      0 // one packet , TRAFFIC_MODE_PACKETS
+#define EVENT_FLOW_START  1
+#define EVENT_FLOW_UPDATE 2 // periodic flush , or the flow's verdict changed
+#define EVENT_FLOW_END    3 // FIN or RST , the agent sends the ones of idle flows
+// TCP connection lifecycle , src / dst are the initiator / responder whichever side sent the packet
+#define EVENT_CONN_OPENED  4 // a SYN-ACK answered the SYN
+#define EVENT_CONN_CLOSED  5 // FIN from both sides or RST , the agent sends the ones of idle connections
+#define EVENT_CONN_REFUSED 6 // a RST answered the SYN , the agent sends the unanswered ones
+
+// what the programs send to the ringbuf , written by the agent into traffic_config
+#define TRAFFIC_MODE_FLOWS   0
+#define TRAFFIC_MODE_PACKETS 1 // every packet , for debugging
+
+struct traffic_config_t {
+    __u32 mode;                 // TRAFFIC_MODE_*
+    __u32 reserved;
+    __u64 flush_ns;             // a flow with traffic is reported at least this often
+};
+
+// how the payload on a port is inspected , written by the agent into dpi_ports.
+// Same values as dpi_protocol.
+#define DPI_HTTP 1
+#define DPI_DNS  2
+#define DPI_TLS  4
+#define MAX_DPI_PORTS 64
+
+// bytes of an HTTP request or response searched for the request line , status and headers
+#define HTTP_MAX_HEADER 512
+#define MAX_HTTP_REQUESTS 16384
+
+// the last request of a connection , keyed by the flow_key_t of the side that sent it
+struct http_request_t {
+    __u64 timestamp;
+    char method[8];
+    char path[64];
+    char host[64];
+};
+
+// per-CPU scratch of parse_http , too large for the stack
+struct http_scratch_t {
+    struct http_request_t req;
+    char data[HTTP_MAX_HEADER];
+};
+
+// ClientHello extensions looked at , browsers send around 20
+#define TLS_MAX_EXTENSIONS 32
+
+#define MAX_FLOWS 65536
+
+// a flow is one direction of a connection on one interface
+struct flow_key_t {
+    __u32 ifindex;
+    __u8 family;
+    __u8 protocol;
+    __u8 direction;
+    __u8 reserved;
+    __u16 src_port;
+    __u16 dst_port;
+    __u8 src_ip[16];
+    __u8 dst_ip[16];
+};
+
+struct flow_stats_t {
+    __u64 packets;
+    __u64 bytes;
+    __u64 reported_bytes;       // bytes when the last event was sent
+    __u64 reported_packets;
+    __u64 first_seen;
+    __u64 last_seen;
+    __u64 last_report;
+    __u32 rule_id;              // of the last event , a change is reported
+    __u8 tcp_flags;             // every flag seen on the flow
+    __u8 verdict;
+    __u8 closed;                // FIN or RST seen , the end was reported
+    __u8 reserved;
+};
+
+#define MAX_CONNS 65536
+
+#define CONN_SYN_SENT    1
+#define CONN_ESTABLISHED 2
+#define CONN_CLOSING     3 // FIN from one side
+
+#define CONN_FIN_OUT 0x01 // FIN from the initiator
+#define CONN_FIN_IN  0x02 // FIN from the responder
+
+// a TCP connection , keyed by the flow_key_t of the initiator's side
+struct conn_t {
+    __u64 syn_ns;               // first SYN , a retransmission keeps it
+    __u64 established_ns;
+    __u64 last_seen;
+    __u64 bytes_out;            // sent by the initiator
+    __u64 bytes_in;             // sent by the responder
+    __u8 state;                 // CONN_*
+    __u8 fins;                  // CONN_FIN_*
+    __u8 reserved[6];
 };
 
 
+// rule slots per generation , the maps hold two generations so a new rule set
+// is written next to the active one and swapped in with a single write
+#define MAX_FLOW_RULES 4096
+#define RULE_BUCKET_SIZE 16
+#define MAX_FALLBACK_RULES 64
+#define NO_RULE 0xFFFFFFFF
+#define MAX_SCOPE_ENTRIES 65536
+
+// what a rule does with the packets it matches , 0 leaves the slot disabled.
+// DROP keeps the value 1 that meant drop before actions existed.
+#define ACTION_NONE       0
+#define ACTION_DROP       1
+#define ACTION_ALLOW      2 // pass , and stop looking at later rules
+#define ACTION_ALERT      3 // pass , but flag the event
+#define ACTION_RATE_LIMIT 4 // pass while the rule's token bucket has tokens , drop otherwise
+
+// verdict reported in every flow event
+#define VERDICT_PASS         0 // no rule matched
+#define VERDICT_DROP         1
+#define VERDICT_ALLOW        2
+#define VERDICT_ALERT        3
+#define VERDICT_RATE_LIMITED 4 // dropped by a rate limit rule
+#define VERDICT_DENIED       5 // dropped by lockdown , not on the learned allow-list
+
+// rate is capped so the refill arithmetic in nanotokens can't overflow
+#define MAX_RATE_PPS 1000000
+#define NSEC_PER_SEC 1000000000ULL
+
+// fields of a flow rule that must match , every other field is a wildcard
+#define RULE_F_SRC_CIDR   (1 << 0)
+#define RULE_F_DST_CIDR   (1 << 1)
+#define RULE_F_PROTOCOL   (1 << 2)
+#define RULE_F_SRC_PORT   (1 << 3)
+#define RULE_F_DST_PORT   (1 << 4)
+#define RULE_F_DIRECTION  (1 << 5)
+#define RULE_F_DPI        (1 << 6)
+#define RULE_F_ICMP_TYPE  (1 << 7)
+#define RULE_F_QUERY_TYPE (1 << 8)
+#define RULE_F_METHOD     (1 << 9)
+#define RULE_F_PATH       (1 << 10)
+#define RULE_F_QUERY_NAME (1 << 11)
+#define RULE_F_FAMILY     (1 << 12)
+#define RULE_F_SCOPE      (1 << 13) // only on the interfaces listed in rule_scopes
+#define RULE_F_FQDN       (1 << 14) // only to the addresses listed in fqdn_ips
+#define RULE_F_SNI        (1 << 15)
+#define RULE_F_NEW_FLOW   (1 << 16) // only packets that open a flow , so replies pass
+
+// full definition of a rule , stored at gen * MAX_FLOW_RULES + rule id.
+// The rule id is its position in the list: the lowest matching id wins.
 struct flow_rule_t {
-    __u32 src_ip;        // 4 bytes
-    __u32 dst_ip;        // 4 bytes  
-    __u16 src_port;      // 2 bytes
-    __u16 dst_port;      // 2 bytes
+    __u32 fields;        // 4 bytes , RULE_F_* bits
+    __u16 src_port_min;  // 2 bytes , inclusive range
+    __u16 src_port_max;  // 2 bytes
+    __u16 dst_port_min;  // 2 bytes
+    __u16 dst_port_max;  // 2 bytes
     __u8 protocol;       // 1 byte
     __u8 direction;      // 1 byte
     __u8 dpi_protocol;   // 1 byte
-    __u8 action;         // 1 byte
+    __u8 action;         // 1 byte , ACTION_*
     __u8 method[8];      // 8 bytes
     __u8 path[64];       // 64 bytes
     __u8 query_name[64]; // 64 bytes
     __u16 query_type;    // 2 bytes
     __u8 icmp_type;      // 1 byte
-    // Total: 155 bytes (but compiler will pad to 156 for alignment)
+    __u8 family;         // 1 byte
+    __u8 src_ip[16];     // 16 bytes , masked to src_prefixlen
+    __u8 dst_ip[16];     // 16 bytes , masked to dst_prefixlen
+    __u8 src_prefixlen;  // 1 byte
+    __u8 dst_prefixlen;  // 1 byte
+    __u16 reserved;      // 2 bytes
+    __u32 rate_pps;      // 4 bytes , ACTION_RATE_LIMIT refill rate
+    __u32 burst;         // 4 bytes , ACTION_RATE_LIMIT bucket size
+    __u8 sni[64];        // 64 bytes , the name , or the suffix from the dot of a *. wildcard
+    __u8 sni_len;        // 1 byte
+    __u8 sni_wildcard;   // 1 byte
+    __u16 reserved2;     // 2 bytes
+    // Total: 268 bytes
+};
+
+// token bucket of a rate limit rule , same index as the rule in flow_rules.
+// tokens are counted in nanotokens so a refill needs no division.
+struct rate_state_t {
+    struct bpf_spin_lock lock;
+    __u64 tokens;
+    __u64 last_ns;       // 0 until the first packet , the bucket then starts full
+};
+
+// rules on a full 5-tuple and direction , looked up with one hash access
+struct exact_key_t {
+    __u32 gen;
+    __u8 family;
+    __u8 protocol;
+    __u8 direction;
+    __u8 reserved;
+    __u16 src_port;
+    __u16 dst_port;
+    __u8 src_ip[16];
+    __u8 dst_ip[16];
+};
+
+// rules on a protocol and a single destination port
+struct port_key_t {
+    __u32 gen;
+    __u8 protocol;
+    __u8 direction;
+    __u16 dst_port;
+};
+
+// rules on a CIDR , prefixlen counts the gen and family bytes: 16 + the prefix of the address
+struct cidr_key_t {
+    __u32 prefixlen;
+    __u8 gen;
+    __u8 family;
+    __u8 addr[16];
+};
+
+// candidate rule ids , ascending. A CIDR bucket also holds the rules of the
+// shorter prefixes covering it , since an LPM lookup only returns the longest match.
+struct rule_bucket_t {
+    __u32 count;
+    __u32 ids[RULE_BUCKET_SIZE];
+};
+
+// rules that fit no index , checked in order
+struct fallback_list_t {
+    __u32 count;
+    __u32 ids[MAX_FALLBACK_RULES];
+};
+
+// a scoped rule applies on an interface when its key is present
+struct scope_key_t {
+    __u32 gen;
+    __u32 rule_id;
+    __u32 ifindex;       // host side veth of a pod in the rule's scope
+};
+
+#define MAX_FQDN_ENTRIES 65536
+
+// an address the DNS answers seen by the agent gave a name an FQDN rule targets
+struct fqdn_key_t {
+    __u32 gen;
+    __u32 rule_id;
+    __u8 family;
+    __u8 reserved[3];
+    __u8 addr[16];
+};
+
+// tc_ingress on the host side of a pod's veth sees what the pod sends
+#define DIR_FROM_POD 1
+
+#define TCP_FLAG_FIN 0x01
+#define TCP_FLAG_SYN 0x02
+#define TCP_FLAG_RST 0x04
+#define TCP_FLAG_ACK 0x10
+
+#define MAX_ALLOW_ENTRIES 65536
+
+// lockdown allow-list entry of a pod's veth. An egress entry holds the destination ,
+// a listen entry (family 0 , no address) a port the pod serves , its replies are let out.
+struct allow_key_t {
+    __u32 ifindex;
+    __u8 family;
+    __u8 protocol;
+    __u16 port;
+    __u8 addr[16];
+};
+
+// a DNS response on its way to a pod , the agent reads its answers
+#define DNS_MAX_PAYLOAD 512 // a plain UDP DNS message , longer ones are cut
+
+struct dns_event_t {
+    __u64 timestamp;
+    __u32 ifindex;              // host side veth of the pod that asked
+    __u8 family;
+    __u8 reserved;
+    __u16 len;                  // bytes of payload used
+    __u8 payload[DNS_MAX_PAYLOAD]; // the DNS message , from its header
+};
+
+struct rule_state_t {
+    __u32 active_gen;
+};
+
+#define MAX_CAPTURES 64
+#define CAPTURE_MAX_SNAPLEN 65535
+
+// a capture of the packets of a pod's veth , keyed by its ifindex
+struct capture_target_t {
+    __u32 snaplen;               // bytes copied per packet , at most CAPTURE_MAX_SNAPLEN
+    __s32 remaining;             // packets still to copy , may go below 0 when CPUs race
+    struct flow_rule_t filter;   // matched like a rule without scope or FQDN , no fields match every packet
+};
+
+// capture_meta_t precedes the caplen packet bytes of a capture_events sample
+struct capture_meta_t {
+    __u64 timestamp;
+    __u32 ifindex;
+    __u32 len;                   // of the packet
+    __u32 caplen;
+    __u32 rule_id;
+    __u8 direction;
+    __u8 verdict;
+    __u16 reserved;
+    __u32 reserved2;             // keeps the size at 32 , the packet starts there
+};
+
+// records a ring buffer lost , per CPU and keyed by the direction of the program: tc_egress
+// (DIR_TO_POD) or tc_ingress (DIR_FROM_POD)
+struct ringbuf_drops_t {
+    __u64 full;                  // the ring buffer had no room for the record
+    __u64 shed;                  // a low priority record skipped while the ring buffer was nearly full
+};
+
+// packets whose IP headers could not be parsed , per CPU and keyed by the direction of the program
+struct unparsed_t {
+    __u64 passed;                // no rule could match , passed
+    __u64 dropped;               // dropped , the veth belongs to a locked down pod
 };
 
+// low priority records are shed once this much of events is waiting for the agent
+#define EVENTS_SIZE (1 << 24)
+#define EVENTS_SHED_THRESHOLD (EVENTS_SIZE / 4 * 3)
+
 
 
 
@@ -2,6 +2,7 @@ package main
 
 import (
 	"agent/internal"
+	"agent/pkg/config"
 	"agent/pkg/kube"
 	"agent/pkg/logs"
 	"agent/pkg/utils"
@@ -17,24 +18,31 @@ import (
 
 func agent_Start(){
 	log.Println(" Starting SecureFlow agent...")
+	kube.Init()
 	logCh := make(chan logs.Producer_msg,100)
-	NetworkCh := make(chan []logs.FlowRule,20)
-	SyscallCh := make(chan []logs.SyscallEventRule,100)
-	MemoryCh := make(chan []logs.MemoryUsageRule,100)
-	DiskcCh := make(chan []logs.DiskIOUsageRule,100)
-	CPUCh := make(chan []logs.CPUUsageRule,100)
+	NetworkCh := make(chan logs.FlowRule_cmd,20)
+	SyscallCh := make(chan logs.SyscallRule_cmd,100)
+	ResourceCh := make(chan logs.ResourceRule_cmd,100)
+	LockdownCh := make(chan logs.Lockdown_cmd,20)
+	CaptureCh := make(chan logs.Capture_cmd,20)
 	logs.StartProducer(logCh)
-	logs.RabbitMQ_Consumer_Start(NetworkCh , SyscallCh , MemoryCh, DiskcCh , CPUCh )
+	logs.RabbitMQ_Consumer_Start(logCh , NetworkCh , SyscallCh , ResourceCh , LockdownCh , CaptureCh)
 	go kube.MappingTracker() 
 	go internal.StartSyscallReader(logCh , SyscallCh) 
-	go internal.StartResourceCollector(logCh , MemoryCh ,DiskcCh , CPUCh)  
-	go internal.StartTrraficCollector(logCh , NetworkCh) 
+	go internal.StartResourceCollector(logCh , ResourceCh)  
+	go internal.StartTrraficCollector(logCh , NetworkCh , LockdownCh , CaptureCh) 
 	go utils.Anomaly_log_generator(logCh)
+	go internal.StartHeartbeat(logCh)
 }
 
 
 func main() {
-	
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf(" %v", err)
+	}
+	cfg.LogEffective()
+
 	agent_Start()
 
 	// sigs := make(chan os.Signal, 1)
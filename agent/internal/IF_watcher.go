@@ -7,11 +7,11 @@ import (
 	"strings"
 	"os"
 	"path/filepath"
-	"os/exec"
-	"regexp"
 	"sync"
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 	
 	"log"
 	"net"
@@ -19,29 +19,63 @@ import (
 	
 )
 
+// IfIndex_Mapper maps the host side veth of a pod to one of its containers , guarded by ifindex_mu
 var IfIndex_Mapper = make(map[int]kube.ContainerMapping)
+var ifindex_mu sync.RWMutex
+
+// ContainerByIfindex returns the container behind a host veth
+func ContainerByIfindex(ifindex int) (kube.ContainerMapping, bool) {
+	ifindex_mu.RLock()
+	defer ifindex_mu.RUnlock()
+	container, ok := IfIndex_Mapper[ifindex]
+	return container, ok
+}
+
+// Pod_interface is one network interface inside a pod and the host side device its traffic goes through
+type Pod_interface struct {
+	Name        string // inside the pod , e.g. eth0 or net1 for a Multus network
+	Kind        string // veth or ipvlan
+	HostIfindex int    // veth peer , or the ipvlan master
+}
 
-func GetPeerIfindexFromContainerEth0(pid int) (int, error) {
-	cmd := exec.Command("nsenter", "-t", fmt.Sprint(pid), "-n", "ip", "link", "show", "eth0")
-	out, err := cmd.CombinedOutput()
+// GetPodInterfaces lists the veth and ipvlan interfaces of the network namespace of pid.
+// The namespace is opened from /proc/<pid>/ns/net and queried over netlink , without leaving the agent's namespace.
+func GetPodInterfaces(pid int) ([]Pod_interface, error) {
+	ns, err := netns.GetFromPath(fmt.Sprintf("/proc/%d/ns/net", pid))
 	if err != nil {
-		return 0, fmt.Errorf("failed to run nsenter: %w\n%s", err, string(out))
+		return nil, fmt.Errorf("open netns of PID %d: %w", pid, err)
 	}
+	defer ns.Close()
 
-	// Output will be like: "2: eth0@if12: ..."
-	// We extract the 12 using regex
-	re := regexp.MustCompile(`eth0@if(\d+)`)
-	matches := re.FindStringSubmatch(string(out))
-	if len(matches) < 2 {
-		return 0, fmt.Errorf("could not extract peer ifindex from: %s", string(out))
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, fmt.Errorf("netlink handle in netns of PID %d: %w", pid, err)
 	}
+	defer handle.Close()
 
-	peerIfindex, err := strconv.Atoi(matches[1])
+	links, err := handle.LinkList()
 	if err != nil {
-		return 0, fmt.Errorf("invalid peer ifindex: %w", err)
+		return nil, fmt.Errorf("list links of PID %d: %w", pid, err)
 	}
 
-	return peerIfindex, nil
+	var ifaces []Pod_interface
+	for _, l := range links {
+		attrs := l.Attrs()
+		kind := l.Type()
+		if kind != "veth" && kind != "ipvlan" {
+			continue
+		}
+		// IFLA_LINK: the veth peer or the ipvlan master , both live in the host namespace
+		if attrs.ParentIndex == 0 {
+			log.Printf(" %s in netns of PID %d has no host side link", attrs.Name, pid)
+			continue
+		}
+		ifaces = append(ifaces, Pod_interface{Name: attrs.Name, Kind: kind, HostIfindex: attrs.ParentIndex})
+	}
+	if len(ifaces) == 0 {
+		return nil, fmt.Errorf("no veth or ipvlan interface in netns of PID %d", pid)
+	}
+	return ifaces, nil
 }
 
 func FindHostVethByIndex(targetIfindex int) (string, error) {
@@ -112,6 +146,34 @@ func (lt *LinkTracker) GetAttachedInterfaces() []string {
 	return interfaces
 }
 
+// Attached returns a copy of ifindex -> interface name
+func (lt *LinkTracker) Attached() map[int]string {
+	lt.mu.RLock()
+	defer lt.mu.RUnlock()
+
+	attached := make(map[int]string, len(lt.attachedIfaces))
+	for ifindex, name := range lt.attachedIfaces {
+		attached[ifindex] = name
+	}
+	return attached
+}
+
+// Detach closes the links of one interface. The kernel already dropped them if the interface is gone ,
+// closing them then only releases the file descriptors.
+func (lt *LinkTracker) Detach(ifindex int) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	for i, l := range lt.attachedLinks[ifindex] {
+		if err := l.Close(); err != nil {
+			log.Printf(" Failed to close link %d for ifindex %d: %v", i, ifindex, err)
+		}
+	}
+	log.Printf(" Detached from interface: %s (index: %d)", lt.attachedIfaces[ifindex], ifindex)
+	delete(lt.attachedLinks, ifindex)
+	delete(lt.attachedIfaces, ifindex)
+}
+
 func (lt *LinkTracker) CloseAll() {
 	lt.mu.Lock()
 	defer lt.mu.Unlock()
@@ -130,92 +192,169 @@ func (lt *LinkTracker) CloseAll() {
 	lt.attachedIfaces = make(map[int]string)
 }
 
-func attachToContainers(objs *struct {
-	TcIngress *ebpf.Program `ebpf:"tc_ingress"`
-	TcEgress  *ebpf.Program `ebpf:"tc_egress"`
-	FlowRules *ebpf.Map `ebpf:"flow_rules"` 
-	Events    *ebpf.Map     `ebpf:"events"`
-}, tracker *LinkTracker) error {
-	
-	containers:= kube.GetCurrentMapping()
-	
-	if len(containers) == 0 {
-		log.Println("⚠️  No containers found")
-		return nil
-	}
+type trafficObjects struct {
+	TcIngress  *ebpf.Program `ebpf:"tc_ingress"`
+	TcEgress   *ebpf.Program `ebpf:"tc_egress"`
+	FlowRules  *ebpf.Map     `ebpf:"flow_rules"`
+	Exact      *ebpf.Map     `ebpf:"exact_rules"`
+	Port       *ebpf.Map     `ebpf:"port_rules"`
+	SrcCidrs   *ebpf.Map     `ebpf:"src_cidr_rules"`
+	DstCidrs   *ebpf.Map     `ebpf:"dst_cidr_rules"`
+	Fallback   *ebpf.Map     `ebpf:"fallback_rules"`
+	RuleState  *ebpf.Map     `ebpf:"rule_state"`
+	RateLimits *ebpf.Map     `ebpf:"rate_limits"`
+	RuleScopes *ebpf.Map     `ebpf:"rule_scopes"`
+	FqdnIPs    *ebpf.Map     `ebpf:"fqdn_ips"`
+	Events     *ebpf.Map     `ebpf:"events"`
+
+	LockdownIfaces *ebpf.Map `ebpf:"lockdown_ifaces"`
+	EgressAllow    *ebpf.Map `ebpf:"egress_allow"`
+
+	EventScratch  *ebpf.Map `ebpf:"event_scratch"`
+	TrafficConfig *ebpf.Map `ebpf:"traffic_config"`
+	Flows         *ebpf.Map `ebpf:"flows"`
+	Conns         *ebpf.Map `ebpf:"conns"`
+	DnsEvents     *ebpf.Map `ebpf:"dns_events"`
+	DpiPorts      *ebpf.Map `ebpf:"dpi_ports"`
+	HttpScratch   *ebpf.Map `ebpf:"http_scratch"`
+	HttpRequests  *ebpf.Map `ebpf:"http_requests"`
+
+	CaptureTargets *ebpf.Map `ebpf:"capture_targets"`
+	CaptureEvents  *ebpf.Map `ebpf:"capture_events"`
+
+	EventDrops *ebpf.Map `ebpf:"event_drops"`
+	DnsDrops   *ebpf.Map `ebpf:"dns_drops"`
+
+	UnparsedPackets *ebpf.Map `ebpf:"unparsed_packets"`
+}
+
+// interfaces of every container seen so far , keyed by container ID , so its netns is read once
+var podInterfaceCache = make(map[string][]Pod_interface)
 
-	log.Printf("🔍 Found %d containers", len(containers))
+// reconcileLinks makes the attached interfaces match the current containers:
+// it attaches to new host veths , detaches from veths whose pod is gone and
+// re-attaches when an ifindex was reused by another pod.
+func reconcileLinks(objs *trafficObjects, tracker *LinkTracker) {
+	containers := kube.GetCurrentMapping()
 
+	desired := make(map[int]kube.ContainerMapping)
+	seen := make(map[string]bool, len(containers))
 	for _, container := range containers {
-		// Get the peer veth interface index from container's eth0
-		ifindex, err := GetPeerIfindexFromContainerEth0(container.PID)
-		if err != nil {
-			log.Printf(" Failed to get peer ifindex for container PID %d: %v", container.PID, err)
-			continue
+		seen[container.ContainerID] = true
+
+		ifaces, ok := podInterfaceCache[container.ContainerID]
+		if !ok {
+			var err error
+			ifaces, err = GetPodInterfaces(container.PID)
+			if err != nil {
+				log.Printf(" Failed to get interfaces of container PID %d: %v", container.PID, err)
+				continue
+			}
+			podInterfaceCache[container.ContainerID] = ifaces
 		}
 
-		// Skip if already attached
-		if tracker.IsAttached(ifindex) {
-			log.Printf(" Interface with index %d already attached, skipping", ifindex)
-			continue
+		for _, iface := range ifaces {
+			// an ipvlan master carries every pod on it , its traffic can't be told apart by ifindex
+			if iface.Kind != "veth" {
+				continue
+			}
+			ifindex := iface.HostIfindex
+			// containers of one pod share the veth , keep the container it is already mapped to
+			if cur, ok := desired[ifindex]; ok {
+				if mapped, ok := ContainerByIfindex(ifindex); ok && mapped.ContainerID == cur.ContainerID {
+					continue
+				}
+			}
+			desired[ifindex] = container
+		}
+	}
+	for cid := range podInterfaceCache {
+		if !seen[cid] {
+			delete(podInterfaceCache, cid)
 		}
+	}
 
-		// Find the host veth interface name
-		ifaceName, err := FindHostVethByIndex(ifindex)
-		if err != nil {
-			log.Printf(" Failed to find host veth by index %d: %v", ifindex, err)
+	attached := tracker.Attached()
+	for ifindex, name := range attached {
+		container, wanted := desired[ifindex]
+		mapped, _ := ContainerByIfindex(ifindex)
+		current, err := net.InterfaceByIndex(ifindex)
+
+		switch {
+		case !wanted:
+			log.Printf(" Interface %s (index: %d) no longer belongs to a monitored pod", name, ifindex)
+		case err != nil || current.Name != name:
+			log.Printf(" Interface index %d was reused (was %s), re-attaching", ifindex, name)
+		case mapped.UID != container.UID:
+			log.Printf(" Interface %s (index: %d) moved from pod %s to %s, re-attaching", name, ifindex, mapped.PodName, container.PodName)
+		default:
 			continue
 		}
+		tracker.Detach(ifindex)
+		delete(attached, ifindex)
+	}
 
-		// Get interface by name
-		iface, err := net.InterfaceByName(ifaceName)
-		if err != nil {
-			log.Printf(" Failed to get interface %s: %v", ifaceName, err)
-			continue
+	ifindex_mu.Lock()
+	for ifindex := range IfIndex_Mapper {
+		if _, ok := desired[ifindex]; !ok {
+			delete(IfIndex_Mapper, ifindex)
 		}
+	}
+	for ifindex, container := range desired {
+		IfIndex_Mapper[ifindex] = container
+	}
+	ifindex_mu.Unlock()
 
-		// Attach ingress TC program
-		ingressLink, err := link.AttachTCX(link.TCXOptions{
-			Interface: iface.Index,
-			Program:   objs.TcIngress,
-			Attach:    ebpf.AttachTCXIngress,
-		})
-		if err != nil {
-			log.Printf(" Failed to attach TCX ingress to %s (index: %d): %v", ifaceName, ifindex, err)
+	// before attaching , so a new pod's scoped rules and lockdown are in place when its first packet is seen
+	refreshRuleScopes(objs)
+	if err := syncLockdown(objs); err != nil {
+		log.Printf(" Failed to update lockdown: %v", err)
+	}
+
+	for ifindex, container := range desired {
+		if _, ok := attached[ifindex]; ok {
 			continue
 		}
-
-		// Attach egress TC program
-		egressLink, err := link.AttachTCX(link.TCXOptions{
-			Interface: iface.Index,
-			Program:   objs.TcEgress,
-			Attach:    ebpf.AttachTCXEgress,
-		})
-		if err != nil {
-			log.Printf(" Failed to attach TCX egress to %s (index: %d): %v", ifaceName, ifindex, err)
-			ingressLink.Close() // Clean up ingress link
+		if err := attachInterface(objs, tracker, ifindex); err != nil {
+			log.Printf(" Failed to attach to container PID %d (index: %d): %v", container.PID, ifindex, err)
+			// read the netns again next time , the pod may have been recreated
+			delete(podInterfaceCache, container.ContainerID)
 			continue
 		}
+		log.Printf("Attached ingress+egress to interface index %d for %s/%s (PID %d)",
+			ifindex, container.Namespace, container.PodName, container.PID)
+	}
+}
 
-		if _,ok := IfIndex_Mapper[ifindex] ; !ok{
-			IfIndex_Mapper[ifindex] = container
-		}
+func attachInterface(objs *trafficObjects, tracker *LinkTracker, ifindex int) error {
+	// Find the host veth interface name
+	ifaceName, err := FindHostVethByIndex(ifindex)
+	if err != nil {
+		return err
+	}
 
-		// Track both links
-		tracker.AddLinks(ifindex, ifaceName, ingressLink, egressLink)
-		log.Printf("Attached ingress+egress to interface: %s (index: %d) for container PID: %d", 
-			ifaceName, ifindex, container.PID)
+	// Attach ingress TC program
+	ingressLink, err := link.AttachTCX(link.TCXOptions{
+		Interface: ifindex,
+		Program:   objs.TcIngress,
+		Attach:    ebpf.AttachTCXIngress,
+	})
+	if err != nil {
+		return fmt.Errorf("attach TCX ingress to %s: %w", ifaceName, err)
 	}
 
-	attachedIfaces := tracker.GetAttachedInterfaces()
-	if len(attachedIfaces) > 0 {
-		log.Printf(" Successfully attached to %d interfaces: %v", len(attachedIfaces), attachedIfaces)
-	} else {
-		log.Println(" No interfaces were successfully attached")
+	// Attach egress TC program
+	egressLink, err := link.AttachTCX(link.TCXOptions{
+		Interface: ifindex,
+		Program:   objs.TcEgress,
+		Attach:    ebpf.AttachTCXEgress,
+	})
+	if err != nil {
+		ingressLink.Close() // Clean up ingress link
+		return fmt.Errorf("attach TCX egress to %s: %w", ifaceName, err)
 	}
 
+	// Track both links
+	tracker.AddLinks(ifindex, ifaceName, ingressLink, egressLink)
 	return nil
 }
-
-
-
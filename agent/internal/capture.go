@@ -0,0 +1,330 @@
+package internal
+
+import (
+	"agent/pkg/config"
+	"agent/pkg/logs"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf/perf"
+)
+
+const (
+	// perf buffer of each CPU for captured packets
+	capturePerCPUBuffer = 4 << 20
+	// size of the Capture_chunks a pcapng file is sent in
+	captureChunkSize = 256 << 10
+)
+
+var captureMetaSize = binary.Size(logs.Capture_meta{})
+
+// capture records the packets of the veths of one pod to a pcapng file
+type capture struct {
+	req    logs.Capture_request
+	ifaces map[uint32]uint32 // veth ifindex , its pcapng interface id
+	file   *os.File
+	w      *pcapngWriter
+	// wall clock at monotonic 0 , samples are stamped with the monotonic clock
+	bootTime int64
+
+	// guarded by capture_mu
+	packets, bytes, lost uint64
+	truncated            bool
+	err                  error
+	finished             bool
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+var (
+	// running captures by veth ifindex , the veths of a pod share one
+	captures   = make(map[uint32]*capture)
+	capture_mu sync.Mutex
+)
+
+// podIfindexes lists the veths of a pod on this node
+func podIfindexes(namespace, pod string) []uint32 {
+	var ifindexes []uint32
+	ifindex_mu.RLock()
+	for ifindex, container := range IfIndex_Mapper {
+		if container.Namespace == namespace && container.PodName == pod {
+			ifindexes = append(ifindexes, uint32(ifindex))
+		}
+	}
+	ifindex_mu.RUnlock()
+	sort.Slice(ifindexes, func(i, j int) bool { return ifindexes[i] < ifindexes[j] })
+	return ifindexes
+}
+
+// startCapture starts recording the packets of the pod of req , the file is sent to logCh
+// in Capture_chunks when the capture ends
+func startCapture(req logs.Capture_request, objs *trafficObjects, logCh chan<- logs.Producer_msg) error {
+	cfg := config.Get().Capture
+	duration := cfg.MaxDuration
+	if req.DurationSeconds > 0 {
+		d := time.Duration(req.DurationSeconds) * time.Second
+		if d > duration {
+			return fmt.Errorf("capture duration %s is above capture.max_duration (%s)", d, duration)
+		}
+		duration = d
+	}
+	snaplen := uint32(logs.CAPTURE_MAX_SNAPLEN)
+	if req.Snaplen > 0 {
+		snaplen = uint32(req.Snaplen)
+	}
+	remaining := int32(math.MaxInt32)
+	if req.MaxPackets > 0 && req.MaxPackets < math.MaxInt32 {
+		remaining = int32(req.MaxPackets)
+	}
+	filter, err := req.CaptureFilter()
+	if err != nil {
+		return err
+	}
+	mono, ok := monotonicNow()
+	if !ok {
+		return fmt.Errorf("cannot read the monotonic clock")
+	}
+
+	ifindexes := podIfindexes(req.Namespace, req.Pod)
+	if len(ifindexes) == 0 {
+		return fmt.Errorf("pod %s/%s has no interface on this node", req.Namespace, req.Pod)
+	}
+
+	capture_mu.Lock()
+	defer capture_mu.Unlock()
+	for _, ifindex := range ifindexes {
+		if captures[ifindex] != nil {
+			return fmt.Errorf("pod %s/%s is already being captured by %s", req.Namespace, req.Pod, captures[ifindex].req.CaptureID)
+		}
+	}
+	if len(captures)+len(ifindexes) > logs.MAX_CAPTURES {
+		return fmt.Errorf("too many captures running: max is %d interfaces", logs.MAX_CAPTURES)
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return fmt.Errorf("capture dir: %w", err)
+	}
+	file, err := os.CreateTemp(cfg.Dir, "capture-*.pcapng")
+	if err != nil {
+		return fmt.Errorf("capture file: %w", err)
+	}
+	c := &capture{
+		req:      req,
+		ifaces:   make(map[uint32]uint32),
+		file:     file,
+		bootTime: time.Now().UnixNano() - int64(mono),
+		done:     make(chan struct{}),
+	}
+	fail := func(err error) error {
+		for ifindex := range c.ifaces {
+			objs.CaptureTargets.Delete(ifindex)
+		}
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if c.w, err = newPcapngWriter(file, "SecureFlow agent", cfg.MaxBytes); err != nil {
+		return fail(fmt.Errorf("capture file: %w", err))
+	}
+	for i, ifindex := range ifindexes {
+		name := req.Namespace + "/" + req.Pod
+		if len(ifindexes) > 1 {
+			name += fmt.Sprintf(" (ifindex %d)", ifindex)
+		}
+		if err := c.w.addInterface(name, snaplen); err != nil {
+			return fail(fmt.Errorf("capture file: %w", err))
+		}
+		c.ifaces[ifindex] = uint32(i)
+	}
+	target := logs.Capture_target{Snaplen: snaplen, Remaining: remaining, Filter: filter}
+	for _, ifindex := range ifindexes {
+		if err := objs.CaptureTargets.Put(ifindex, target); err != nil {
+			return fail(fmt.Errorf("capture_targets: %w", err))
+		}
+	}
+	for _, ifindex := range ifindexes {
+		captures[ifindex] = c
+	}
+
+	log.Printf(" Capturing %s/%s for %s (capture %s)", req.Namespace, req.Pod, duration, req.CaptureID)
+	go c.run(duration, objs, logCh)
+	return nil
+}
+
+func (c *capture) stop() {
+	c.stopOnce.Do(func() { close(c.done) })
+}
+
+// run waits for the end of the capture , then sends its file
+func (c *capture) run(duration time.Duration, objs *trafficObjects, logCh chan<- logs.Producer_msg) {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.done:
+	}
+
+	capture_mu.Lock()
+	for ifindex := range c.ifaces {
+		if err := objs.CaptureTargets.Delete(ifindex); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf(" Failed to remove capture target %d: %v", ifindex, err)
+		}
+		delete(captures, ifindex)
+	}
+	// samples still in the perf buffer are not written anymore
+	c.finished = true
+	capture_mu.Unlock()
+
+	if err := c.w.Flush(); err != nil && c.err == nil {
+		c.err = err
+	}
+	if err := c.file.Close(); err != nil && c.err == nil {
+		c.err = err
+	}
+	defer os.Remove(c.file.Name())
+	c.send(logCh)
+}
+
+// add writes a captured packet , capture_mu must be held
+func (c *capture) add(meta logs.Capture_meta, data []byte) {
+	if c.finished {
+		return
+	}
+	// the pod's view: tc_ingress sees what the pod sends
+	flags := uint32(pcapngInbound)
+	if meta.Direction == logs.DIR_FROM_POD {
+		flags = pcapngOutbound
+	}
+	comment := ""
+	switch meta.Verdict {
+	case logs.VERDICT_DROP, logs.VERDICT_RATE_LIMITED:
+		comment = fmt.Sprintf("dropped by rule %d", meta.RuleID)
+	case logs.VERDICT_DENIED:
+		comment = "denied by lockdown"
+	}
+
+	ts := time.Unix(0, c.bootTime+int64(meta.Timestamp))
+	err := c.w.packet(c.ifaces[meta.Ifindex], ts, data, meta.Len, flags, comment)
+	if errors.Is(err, errPcapngFull) {
+		c.truncated = true
+		c.stop()
+		return
+	}
+	if err != nil {
+		c.err = err
+		c.stop()
+		return
+	}
+	c.packets++
+	c.bytes += uint64(meta.Len)
+	if c.req.MaxPackets > 0 && c.packets >= uint64(c.req.MaxPackets) {
+		c.stop()
+	}
+}
+
+// send sends the file of a finished capture , or the error that ended it
+func (c *capture) send(logCh chan<- logs.Producer_msg) {
+	last := logs.Capture_chunk{
+		CaptureID: c.req.CaptureID,
+		Last:      true,
+		Packets:   c.packets,
+		Bytes:     c.bytes,
+		Lost:      c.lost,
+		Truncated: c.truncated,
+	}
+	fail := func(err error) {
+		log.Printf(" Capture %s failed: %v", c.req.CaptureID, err)
+		last.Error = err.Error()
+		logCh <- logs.Producer_msg{Body: last.Encode(), Id: 9}
+	}
+	if c.err != nil {
+		fail(c.err)
+		return
+	}
+
+	f, err := os.Open(c.file.Name())
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer f.Close()
+
+	buf := make([]byte, captureChunkSize)
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(f, buf)
+		end := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !end {
+			last.Seq = seq
+			fail(err)
+			return
+		}
+		chunk := logs.Capture_chunk{CaptureID: c.req.CaptureID, Seq: seq, Data: buf[:n]}
+		if end {
+			chunk = last
+			chunk.Seq, chunk.Data = seq, buf[:n]
+		}
+		// Encode copies the data , so buf is reused
+		logCh <- logs.Producer_msg{Body: chunk.Encode(), Id: 9}
+		if end {
+			break
+		}
+	}
+	log.Printf(" Capture %s of %s/%s done: %d packets , %d lost", c.req.CaptureID, c.req.Namespace, c.req.Pod, c.packets, c.lost)
+}
+
+// readCaptures hands the samples of capture_events to the captures of their veth until rd is closed
+func readCaptures(rd *perf.Reader) {
+	for {
+		record, err := rd.Read()
+		if err != nil {
+			if errors.Is(err, perf.ErrClosed) {
+				return
+			}
+			log.Printf(" capture perf read error: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		capture_mu.Lock()
+		if record.LostSamples > 0 {
+			// a lost sample can't be attributed , every running capture may have missed it
+			counted := make(map[*capture]bool)
+			for _, c := range captures {
+				if !counted[c] {
+					c.lost += record.LostSamples
+					counted[c] = true
+				}
+			}
+			capture_mu.Unlock()
+			continue
+		}
+		if len(record.RawSample) < captureMetaSize {
+			capture_mu.Unlock()
+			continue
+		}
+		var meta logs.Capture_meta
+		if err := binary.Read(bytes.NewReader(record.RawSample[:captureMetaSize]), binary.LittleEndian, &meta); err != nil {
+			capture_mu.Unlock()
+			continue
+		}
+		data := record.RawSample[captureMetaSize:]
+		if int(meta.Caplen) < len(data) {
+			data = data[:meta.Caplen]
+		}
+		if c := captures[meta.Ifindex]; c != nil {
+			c.add(meta, data)
+		}
+		capture_mu.Unlock()
+	}
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"agent/pkg/logs"
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// an address stays attributed at least this long , connections outlive short TTLs
+	minDomainTTL = 5 * time.Minute
+	// addresses kept per pod , later answers are skipped until entries expire
+	maxPodDomains = 4096
+)
+
+type domainEntry struct {
+	name    string
+	expires time.Time
+}
+
+var (
+	// name each pod resolved an address from , by pod UID then address
+	podDomains = make(map[string]map[netip.Addr]domainEntry)
+	domains_mu sync.RWMutex
+)
+
+// recordDNSResponse remembers the addresses a DNS response gave the pod behind its veth
+// and adds them to the FQDN rules matching the name
+func recordDNSResponse(event *logs.Dns_event, objs *trafficObjects) {
+	msg, err := event.Message()
+	if err != nil {
+		log.Printf(" %v", err)
+		return
+	}
+	name, answers, err := logs.ParseDNSResponse(msg)
+	if err != nil || len(answers) == 0 {
+		return
+	}
+	container, ok := ContainerByIfindex(int(event.Ifindex))
+	if !ok || container.UID == "" {
+		return
+	}
+
+	cacheAnswers(container.UID, name, answers)
+	// after domains_mu is released , LoadFlowRules takes it while holding rules_mu
+	resolveFQDNRules(objs, name, answers)
+}
+
+func cacheAnswers(uid, name string, answers []logs.DNS_answer) {
+	now := time.Now()
+	domains_mu.Lock()
+	defer domains_mu.Unlock()
+
+	cache := podDomains[uid]
+	if cache == nil {
+		cache = make(map[netip.Addr]domainEntry)
+		podDomains[uid] = cache
+	}
+	for _, answer := range answers {
+		if _, ok := cache[answer.Addr]; !ok && len(cache) >= maxPodDomains {
+			continue
+		}
+		ttl := max(answer.TTL, minDomainTTL)
+		cache[answer.Addr] = domainEntry{name: name, expires: now.Add(ttl)}
+	}
+}
+
+// domainOf returns the name the pod resolved addr from , empty when it did not
+func domainOf(uid string, addr netip.Addr) string {
+	domains_mu.RLock()
+	defer domains_mu.RUnlock()
+
+	entry, ok := podDomains[uid][addr]
+	if !ok || time.Now().After(entry.expires) {
+		return ""
+	}
+	return entry.name
+}
+
+// remoteDomain returns the name the pod resolved the other end of a flow from
+func remoteDomain(event *logs.FlowEvent, uid string) string {
+	if uid == "" {
+		return ""
+	}
+	ip := event.SrcIP
+	if event.Direction == logs.DIR_FROM_POD {
+		ip = event.DstIP
+	}
+	addr := netip.AddrFrom16(ip)
+	if event.Family == logs.FAMILY_IPV4 {
+		addr = netip.AddrFrom4([4]byte(ip[:4]))
+	}
+	return domainOf(uid, addr)
+}
+
+// expireDomains drops the expired entries , and the pods left without any
+func expireDomains() {
+	now := time.Now()
+	domains_mu.Lock()
+	defer domains_mu.Unlock()
+
+	for uid, cache := range podDomains {
+		for addr, entry := range cache {
+			if now.After(entry.expires) {
+				delete(cache, addr)
+			}
+		}
+		if len(cache) == 0 {
+			delete(podDomains, uid)
+		}
+	}
+}
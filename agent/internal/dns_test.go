@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"agent/pkg/logs"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRemoteDomain(t *testing.T) {
+	t.Cleanup(func() {
+		domains_mu.Lock()
+		podDomains = make(map[string]map[netip.Addr]domainEntry)
+		domains_mu.Unlock()
+	})
+	cacheAnswers("pod-a", "api.example.com", []logs.DNS_answer{
+		{Addr: netip.MustParseAddr("192.0.2.1"), TTL: time.Second},
+		{Addr: netip.MustParseAddr("2001:db8::1"), TTL: time.Hour},
+	})
+
+	pod, remote := [4]byte{10, 0, 0, 5}, [4]byte{192, 0, 2, 1}
+	v6 := netip.MustParseAddr("2001:db8::1").As16()
+	tests := []struct {
+		name  string
+		uid   string
+		event *logs.FlowEvent
+		want  string
+	}{
+		{"sent by the pod", "pod-a", flowEvent(logs.DIR_FROM_POD, 6, pod, remote, 40000, 443, 0), "api.example.com"},
+		{"received by the pod", "pod-a", flowEvent(logs.DIR_TO_POD, 6, remote, pod, 443, 40000, 0), "api.example.com"},
+		{"IPv6", "pod-a", &logs.FlowEvent{Family: logs.FAMILY_IPV6, Direction: logs.DIR_FROM_POD, DstIP: v6}, "api.example.com"},
+		{"another pod's answer", "pod-b", flowEvent(logs.DIR_FROM_POD, 6, pod, remote, 40000, 443, 0), ""},
+		{"not resolved", "pod-a", flowEvent(logs.DIR_FROM_POD, 6, pod, [4]byte{198, 51, 100, 1}, 40000, 443, 0), ""},
+		{"no pod", "", flowEvent(logs.DIR_FROM_POD, 6, pod, remote, 40000, 443, 0), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := remoteDomain(tt.event, tt.uid); got != tt.want {
+				t.Errorf("remoteDomain = %q , want %q", got, tt.want)
+			}
+		})
+	}
+
+	// a short TTL is stretched to minDomainTTL
+	domains_mu.RLock()
+	expires := podDomains["pod-a"][netip.MustParseAddr("192.0.2.1")].expires
+	domains_mu.RUnlock()
+	if time.Until(expires) < minDomainTTL-time.Minute {
+		t.Errorf("entry expires in %s , want at least %s", time.Until(expires), minDomainTTL)
+	}
+}
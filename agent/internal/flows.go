@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"agent/pkg/config"
+	"agent/pkg/logs"
+	"agent/pkg/utils"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
+)
+
+// writeTrafficConfig tells the traffic programs what to send and which ports to inspect ,
+// before they are attached
+func writeTrafficConfig(objs *trafficObjects) error {
+	cfg := config.Get().Traffic
+	mode := uint32(logs.TRAFFIC_MODE_FLOWS)
+	if cfg.Mode == "packets" {
+		mode = logs.TRAFFIC_MODE_PACKETS
+	}
+	err := objs.TrafficConfig.Put(uint32(0), logs.Traffic_config{
+		Mode:    mode,
+		FlushNs: uint64(cfg.FlushInterval),
+	})
+	if err != nil {
+		return err
+	}
+
+	for kind, ports := range map[uint8][]uint16{
+		logs.DPI_HTTP: cfg.HTTPPorts,
+		logs.DPI_TLS:  cfg.TLSPorts,
+		logs.DPI_DNS:  cfg.DNSPorts,
+	} {
+		for _, port := range ports {
+			if err := objs.DpiPorts.Put(port, kind); err != nil {
+				return fmt.Errorf("dpi port %d: %w", port, err)
+			}
+		}
+	}
+	return nil
+}
+
+// handleFlowEvent resolves the container of an event , feeds the trackers and logs it
+func handleFlowEvent(event *logs.FlowEvent, logCh chan<- logs.Producer_msg) {
+	container, _ := ContainerByIfindex(int(event.IfIndex))
+	learnFlow(event, container)
+	recordEdge(event, container)
+
+	utils.Update_uid_Map(container.UID , container)
+	utils.Update_network_Tracker(container.UID , float64(event.NewBytes))
+	if event.HTTPStatus != 0 || event.UserAgent[0] != 0 {
+		utils.Update_http_Tracker(container.UID, int(event.HTTPStatus), event.UserAgentString())
+	}
+
+	line := event.String()
+	if domain := remoteDomain(event, container.UID); domain != "" {
+		line += " [Domain: " + domain + "]"
+	}
+	if event.RuleID != logs.NO_RULE {
+		if policy := ruleOrigin(event.RuleID, event.Direction, container.UID); policy != "" {
+			line += " [NetworkPolicy: " + policy + "]"
+		}
+	}
+	msg := logs.Producer_msg{
+		Body: logs.Encode_string(line),
+		Id: 1,
+	}
+	// the flow was already counted above , only its log line can be lost
+	if event.LowPriority() {
+		sendLowPriority(logCh, msg, &trafficRingbuf)
+		return
+	}
+	sendHighPriority(logCh, msg, &trafficRingbuf)
+}
+
+// handleConnEvent publishes a connection lifecycle event with the pod it belongs to
+func handleConnEvent(event *logs.FlowEvent, timedOut bool, logCh chan<- logs.Producer_msg) {
+	container, _ := ContainerByIfindex(int(event.IfIndex))
+	conn := event.ConnEvent(timedOut)
+	conn.Pod = container.PodName
+	conn.Namespace = container.Namespace
+	conn.Domain = remoteDomain(event, container.UID)
+
+	sendHighPriority(logCh, logs.Producer_msg{Body: conn.Encode(), Id: 7}, &trafficRingbuf)
+}
+
+// monotonicNow reads the clock of bpf_ktime_get_ns
+func monotonicNow() (uint64, bool) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		log.Printf(" Failed to read the monotonic clock: %v", err)
+		return 0, false
+	}
+	return uint64(ts.Nano()), true
+}
+
+// expireFlows removes the flows idle for traffic.idle_timeout and reports the end of those
+// that did not close with a FIN or RST. Flows the LRU evicts under pressure end unreported.
+func expireFlows(objs *trafficObjects, logCh chan<- logs.Producer_msg) {
+	now, ok := monotonicNow()
+	if !ok {
+		return
+	}
+	idle := uint64(config.Get().Traffic.IdleTimeout)
+
+	var (
+		key     logs.Flow_key
+		stats   logs.Flow_stats
+		expired []logs.Flow_key
+		ended   []logs.FlowEvent
+	)
+	iter := objs.Flows.Iterate()
+	for iter.Next(&key, &stats) {
+		if now < stats.LastSeen || now-stats.LastSeen < idle {
+			continue
+		}
+		expired = append(expired, key)
+		if stats.Closed == 0 {
+			ended = append(ended, stats.EndEvent(key))
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf(" Failed to walk flows: %v", err)
+	}
+
+	for _, k := range expired {
+		if err := objs.Flows.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf(" Failed to delete flow: %v", err)
+		}
+	}
+	for i := range ended {
+		handleFlowEvent(&ended[i], logCh)
+	}
+}
+
+// expireConns removes the TCP connections idle for traffic.conn_idle_timeout , or whose SYN was not
+// answered within traffic.syn_timeout , and reports them closed or refused
+func expireConns(objs *trafficObjects, logCh chan<- logs.Producer_msg) {
+	now, ok := monotonicNow()
+	if !ok {
+		return
+	}
+	cfg := config.Get().Traffic
+
+	var (
+		key     logs.Flow_key
+		conn    logs.Conn
+		expired []logs.Flow_key
+		ended   []logs.FlowEvent
+	)
+	iter := objs.Conns.Iterate()
+	for iter.Next(&key, &conn) {
+		timeout := uint64(cfg.ConnIdleTimeout)
+		if conn.State == logs.CONN_SYN_SENT {
+			timeout = uint64(cfg.SynTimeout)
+		}
+		if now < conn.LastSeen || now-conn.LastSeen < timeout {
+			continue
+		}
+		expired = append(expired, key)
+		ended = append(ended, conn.EndEvent(key))
+	}
+	if err := iter.Err(); err != nil {
+		log.Printf(" Failed to walk conns: %v", err)
+	}
+
+	for _, k := range expired {
+		if err := objs.Conns.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf(" Failed to delete connection: %v", err)
+		}
+	}
+	for i := range ended {
+		handleConnEvent(&ended[i], true, logCh)
+	}
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"agent/pkg/logs"
+	"errors"
+	"log"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+var (
+	// FQDN rules of the active generation and the fqdn_ips entries written for them ,
+	// with their expiry. Guarded by rules_mu.
+	activeFQDNs map[uint32]logs.FQDN_pattern
+	fqdnIPs     = make(map[logs.Fqdn_key]time.Time)
+)
+
+func fqdnKey(gen, id uint32, addr netip.Addr) logs.Fqdn_key {
+	key := logs.Fqdn_key{Gen: gen, RuleID: id, Family: logs.FAMILY_IPV6}
+	if addr.Is4() {
+		key.Family = logs.FAMILY_IPV4
+	}
+	// an IPv4 address uses the first 4 bytes , as in the flow events
+	copy(key.Addr[:], addr.AsSlice())
+	return key
+}
+
+// putFQDN writes one address of a rule , keeping the later expiry. rules_mu must be held.
+func putFQDN(objs *trafficObjects, entries map[logs.Fqdn_key]time.Time, key logs.Fqdn_key, expires time.Time) error {
+	if current, ok := entries[key]; ok {
+		if expires.After(current) {
+			entries[key] = expires
+		}
+		return nil
+	}
+	// the other generation may hold as many while a new rule set is loaded
+	if len(entries) >= logs.MAX_FQDN_ENTRIES/2 {
+		return errors.New("fqdn_ips is full")
+	}
+	if err := objs.FqdnIPs.Put(key, uint8(1)); err != nil {
+		return err
+	}
+	entries[key] = expires
+	return nil
+}
+
+// seedFQDNRules writes the addresses the pods already resolved for the FQDN rules of gen ,
+// so a new rule set applies to the connections made before it was loaded. rules_mu must be held.
+func seedFQDNRules(objs *trafficObjects, gen uint32, patterns map[uint32]logs.FQDN_pattern) (map[logs.Fqdn_key]time.Time, error) {
+	entries := make(map[logs.Fqdn_key]time.Time)
+	if len(patterns) == 0 {
+		return entries, nil
+	}
+
+	now := time.Now()
+	domains_mu.RLock()
+	defer domains_mu.RUnlock()
+	for _, cache := range podDomains {
+		for addr, entry := range cache {
+			if now.After(entry.expires) {
+				continue
+			}
+			for id, pattern := range patterns {
+				if !pattern.Matches(entry.name) {
+					continue
+				}
+				if err := putFQDN(objs, entries, fqdnKey(gen, id, addr), entry.expires); err != nil {
+					return entries, err
+				}
+			}
+		}
+	}
+	return entries, nil
+}
+
+// resolveFQDNRules adds the answers of a DNS response to the active FQDN rules matching its name.
+// The answer is read after it reached the pod , so a connection made right away may
+// still miss the rule for its first packets.
+func resolveFQDNRules(objs *trafficObjects, name string, answers []logs.DNS_answer) {
+	rules_mu.Lock()
+	defer rules_mu.Unlock()
+
+	if len(activeFQDNs) == 0 {
+		return
+	}
+	now := time.Now()
+	for id, pattern := range activeFQDNs {
+		if !pattern.Matches(name) {
+			continue
+		}
+		for _, answer := range answers {
+			expires := now.Add(max(answer.TTL, minDomainTTL))
+			if err := putFQDN(objs, fqdnIPs, fqdnKey(activeRuleGen, id, answer.Addr), expires); err != nil {
+				log.Printf(" Failed to add %s to FQDN rule %d (%s): %v", answer.Addr, id, pattern, err)
+				return
+			}
+		}
+	}
+}
+
+// expireFQDNs removes the addresses whose TTL ran out from the FQDN rules
+func expireFQDNs(objs *trafficObjects) {
+	rules_mu.Lock()
+	defer rules_mu.Unlock()
+
+	now := time.Now()
+	for key, expires := range fqdnIPs {
+		if now.Before(expires) {
+			continue
+		}
+		if err := objs.FqdnIPs.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Printf(" Failed to expire an address of FQDN rule %d: %v", key.RuleID, err)
+			continue
+		}
+		delete(fqdnIPs, key)
+	}
+}
+
+// fqdnStatus lists the addresses of every active FQDN rule , for the heartbeat
+func fqdnStatus() []logs.Fqdn_rule_status {
+	rules_mu.Lock()
+	defer rules_mu.Unlock()
+
+	if len(activeFQDNs) == 0 {
+		return nil
+	}
+	ips := make(map[uint32][]string, len(activeFQDNs))
+	for key := range fqdnIPs {
+		addr := netip.AddrFrom16(key.Addr)
+		if key.Family == logs.FAMILY_IPV4 {
+			addr = netip.AddrFrom4([4]byte(key.Addr[:4]))
+		}
+		ips[key.RuleID] = append(ips[key.RuleID], addr.String())
+	}
+
+	status := make([]logs.Fqdn_rule_status, 0, len(activeFQDNs))
+	for id, pattern := range activeFQDNs {
+		list := ips[id]
+		if list == nil {
+			list = []string{}
+		}
+		sort.Strings(list)
+		status = append(status, logs.Fqdn_rule_status{RuleID: id, FQDN: string(pattern), IPs: list})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].RuleID < status[j].RuleID })
+	return status
+}
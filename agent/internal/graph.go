@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"agent/pkg/kube"
+	"agent/pkg/logs"
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// edges kept per report window , traffic of later ones waits for the next window
+const maxGraphEdges = 16384
+
+type edgeKey struct {
+	client, server netip.Addr
+	port           uint16
+	protocol       uint8
+	local          string
+}
+
+var (
+	// traffic since graphStart , sent to the server every traffic.graph_interval
+	graphEdges = make(map[edgeKey]*logs.Edge_report)
+	graphStart = time.Now()
+	graph_mu   sync.Mutex
+)
+
+// recordEdge adds what a flow event counted since the flow's previous event to its edge
+func recordEdge(event *logs.FlowEvent, container kube.ContainerMapping) {
+	if container.UID == "" || event.EventType > logs.EVENT_FLOW_END {
+		return
+	}
+	if event.NewBytes == 0 && event.NewPackets == 0 && event.EventType != logs.EVENT_FLOW_START {
+		return
+	}
+
+	src, dst := event.Endpoints()
+	// the end with the lower port serves , ephemeral ports are high
+	toServer := dst.Port() <= src.Port()
+	client, server := src, dst
+	if !toServer {
+		client, server = dst, src
+	}
+	key := edgeKey{client: client.Addr(), server: server.Addr(), port: server.Port(), protocol: event.Protocol}
+	// a pod sends what tc_ingress of its veth sees
+	if (event.Direction == logs.DIR_FROM_POD) == toServer {
+		key.local = logs.EDGE_LOCAL_CLIENT
+	} else {
+		key.local = logs.EDGE_LOCAL_SERVER
+	}
+
+	graph_mu.Lock()
+	defer graph_mu.Unlock()
+
+	edge, ok := graphEdges[key]
+	if !ok {
+		if len(graphEdges) >= maxGraphEdges {
+			return
+		}
+		edge = &logs.Edge_report{
+			Client:   key.client.String(),
+			Server:   key.server.String(),
+			Port:     key.port,
+			Protocol: key.protocol,
+			Local:    key.local,
+		}
+		graphEdges[key] = edge
+	}
+	if toServer {
+		edge.BytesToServer += event.NewBytes
+		edge.PacketsToServer += event.NewPackets
+		if event.EventType == logs.EVENT_FLOW_START {
+			edge.Connections++
+		}
+	} else {
+		edge.BytesToClient += event.NewBytes
+		edge.PacketsToClient += event.NewPackets
+	}
+}
+
+// flushGraph sends the edges of the window that ended and starts the next one
+func flushGraph(logCh chan<- logs.Producer_msg) {
+	graph_mu.Lock()
+	report := logs.Graph_report{Start: graphStart, End: time.Now()}
+	for _, edge := range graphEdges {
+		report.Edges = append(report.Edges, *edge)
+	}
+	if len(graphEdges) >= maxGraphEdges {
+		log.Printf(" Service graph window has %d edges , the traffic of later ones was not counted", maxGraphEdges)
+	}
+	graphEdges = make(map[edgeKey]*logs.Edge_report)
+	graphStart = report.End
+	graph_mu.Unlock()
+
+	if len(report.Edges) == 0 {
+		return
+	}
+	logCh <- logs.Producer_msg{Body: report.Encode(), Id: 8}
+}
@@ -0,0 +1,287 @@
+package internal
+
+import (
+	"agent/pkg/config"
+	"agent/pkg/kube"
+	"agent/pkg/logs"
+	"fmt"
+	"log"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lockdown state of one namespace
+type lockdown_ns struct {
+	mode      string
+	started   time.Time
+	until     time.Time // end of learning
+	learned   map[learnKey]*logs.Allow_entry
+	truncated bool
+	allow     []logs.Allow_entry // enforcing
+}
+
+type learnKey struct {
+	workload string
+	protocol uint8
+	addr     netip.Addr // invalid for a listen entry
+	port     uint16
+}
+
+var (
+	lockdowns   = make(map[string]*lockdown_ns)
+	lockdown_mu sync.Mutex
+	// set while a namespace is learning , so the ringbuf reader skips the lock otherwise
+	learning atomic.Bool
+)
+
+// applyLockdown switches a namespace to the requested mode
+func applyLockdown(req logs.Lockdown_request, objs *trafficObjects, logCh chan<- logs.Producer_msg) error {
+	lockdown_mu.Lock()
+	ns := lockdowns[req.Namespace]
+
+	switch req.Mode {
+	case logs.LOCKDOWN_LEARNING:
+		duration := time.Duration(req.LearnSeconds) * time.Second
+		if duration == 0 {
+			duration = config.Get().Lockdown.LearnDuration
+		}
+		now := time.Now()
+		lockdowns[req.Namespace] = &lockdown_ns{
+			mode:    logs.LOCKDOWN_LEARNING,
+			started: now,
+			until:   now.Add(duration),
+			learned: make(map[learnKey]*logs.Allow_entry),
+		}
+		log.Printf(" 🔒 Lockdown: learning the flows of namespace %s for %s", req.Namespace, duration)
+
+	case logs.LOCKDOWN_LEARNED:
+		if ns == nil || ns.mode != logs.LOCKDOWN_LEARNING {
+			lockdown_mu.Unlock()
+			return fmt.Errorf("namespace %s is not learning", req.Namespace)
+		}
+		report := finishLearning(req.Namespace, ns)
+		lockdown_mu.Unlock()
+		logCh <- logs.Producer_msg{Body: report.Encode(), Id: 6}
+		return nil
+
+	case logs.LOCKDOWN_ENFORCING:
+		lockdowns[req.Namespace] = &lockdown_ns{
+			mode:  logs.LOCKDOWN_ENFORCING,
+			allow: req.Allow,
+		}
+		log.Printf(" 🔒 Lockdown: enforcing %d allowed flows in namespace %s", len(req.Allow), req.Namespace)
+
+	case logs.LOCKDOWN_OFF:
+		delete(lockdowns, req.Namespace)
+		log.Printf(" 🔓 Lockdown: namespace %s released", req.Namespace)
+	}
+	updateLearning()
+	lockdown_mu.Unlock()
+
+	return syncLockdown(objs)
+}
+
+// updateLearning refreshes the learning flag , lockdown_mu must be held
+func updateLearning() {
+	active := false
+	for _, ns := range lockdowns {
+		if ns.mode == logs.LOCKDOWN_LEARNING {
+			active = true
+			break
+		}
+	}
+	learning.Store(active)
+}
+
+// learnFlow records a flow of a pod in a learning namespace.
+// It keeps what opens a flow , as lockdown_denies checks it: TCP SYNs , UDP and ICMP echo requests
+// sent by the pod , and the UDP ports it is asked on , whose replies are then let out.
+func learnFlow(event *logs.FlowEvent, container kube.ContainerMapping) {
+	if !learning.Load() || container.Namespace == "" {
+		return
+	}
+
+	lockdown_mu.Lock()
+	defer lockdown_mu.Unlock()
+
+	ns := lockdowns[container.Namespace]
+	if ns == nil || ns.mode != logs.LOCKDOWN_LEARNING {
+		return
+	}
+
+	src := netip.AddrFrom16(event.SrcIP)
+	dst := netip.AddrFrom16(event.DstIP)
+	if event.Family == logs.FAMILY_IPV4 {
+		src = netip.AddrFrom4([4]byte(event.SrcIP[:4]))
+		dst = netip.AddrFrom4([4]byte(event.DstIP[:4]))
+	}
+
+	var key learnKey
+	if event.Direction == logs.DIR_FROM_POD {
+		key = learnKey{workload: container.Workload, protocol: event.Protocol, addr: dst, port: event.DstPort}
+		switch event.Protocol {
+		case 6:
+			if event.TcpFlags&(logs.TCP_FLAG_SYN|logs.TCP_FLAG_ACK) != logs.TCP_FLAG_SYN {
+				return
+			}
+		case 17:
+			if _, ok := ns.learned[learnKey{workload: container.Workload, protocol: 17, port: event.SrcPort}]; ok {
+				return // a reply from a port it serves
+			}
+		case 1, 58:
+			if event.IcmpType != 8 && event.IcmpType != 128 {
+				return
+			}
+		}
+	} else {
+		if event.Protocol != 17 {
+			return
+		}
+		// the answer to something the pod asked , not a port it serves
+		if _, ok := ns.learned[learnKey{workload: container.Workload, protocol: 17, addr: src, port: event.SrcPort}]; ok {
+			return
+		}
+		key = learnKey{workload: container.Workload, protocol: 17, port: event.DstPort}
+	}
+
+	entry, ok := ns.learned[key]
+	if !ok {
+		if int64(len(ns.learned)) >= config.Get().Lockdown.MaxLearned {
+			if !ns.truncated {
+				log.Printf(" Lockdown: namespace %s reached %d learned flows , later ones are not recorded", container.Namespace, len(ns.learned))
+				ns.truncated = true
+			}
+			return
+		}
+		entry = &logs.Allow_entry{Workload: key.workload, Protocol: key.protocol}
+		if key.addr.IsValid() {
+			entry.DstIP = key.addr.String()
+			entry.DstPort = key.port
+		} else {
+			entry.ListenPort = key.port
+		}
+		ns.learned[key] = entry
+	}
+	entry.Packets++
+	entry.LastSeen = time.Now()
+}
+
+// finishLearning ends the learning phase of a namespace and builds its report , lockdown_mu must be held
+func finishLearning(namespace string, ns *lockdown_ns) logs.Lockdown_report {
+	report := logs.Lockdown_report{
+		Namespace: namespace,
+		Learned:   make([]logs.Allow_entry, 0, len(ns.learned)),
+		Truncated: ns.truncated,
+		StartedAt: ns.started,
+		EndedAt:   time.Now(),
+	}
+	for _, entry := range ns.learned {
+		report.Learned = append(report.Learned, *entry)
+	}
+	sort.Slice(report.Learned, func(i, j int) bool {
+		a, b := report.Learned[i], report.Learned[j]
+		if a.Workload != b.Workload {
+			return a.Workload < b.Workload
+		}
+		if a.DstIP != b.DstIP {
+			return a.DstIP < b.DstIP
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return a.DstPort+a.ListenPort < b.DstPort+b.ListenPort
+	})
+
+	ns.mode = logs.LOCKDOWN_LEARNED
+	ns.learned = nil
+	updateLearning()
+	log.Printf(" 🔒 Lockdown: namespace %s learned %d flows , waiting for approval", namespace, len(report.Learned))
+	return report
+}
+
+// expireLearning reports the namespaces whose learning phase is over
+func expireLearning(logCh chan<- logs.Producer_msg) {
+	if !learning.Load() {
+		return
+	}
+
+	lockdown_mu.Lock()
+	var reports []logs.Lockdown_report
+	now := time.Now()
+	for namespace, ns := range lockdowns {
+		if ns.mode == logs.LOCKDOWN_LEARNING && now.After(ns.until) {
+			reports = append(reports, finishLearning(namespace, ns))
+		}
+	}
+	lockdown_mu.Unlock()
+
+	for _, report := range reports {
+		logCh <- logs.Producer_msg{Body: report.Encode(), Id: 6}
+	}
+}
+
+// syncLockdown makes lockdown_ifaces list the veths of the pods in enforcing namespaces
+// and egress_allow hold their approved entries
+func syncLockdown(objs *trafficObjects) error {
+	ifaces := make(map[uint32]bool)
+	allowed := make(map[logs.Allow_key]bool)
+
+	// held until the maps are written , so two syncs can't interleave their diffs
+	lockdown_mu.Lock()
+	defer lockdown_mu.Unlock()
+
+	ifindex_mu.RLock()
+	for ifindex, container := range IfIndex_Mapper {
+		ns := lockdowns[container.Namespace]
+		if ns == nil || ns.mode != logs.LOCKDOWN_ENFORCING {
+			continue
+		}
+		ifaces[uint32(ifindex)] = true
+		for _, entry := range ns.allow {
+			if (entry.Workload != "" && entry.Workload != container.Workload) || (entry.Pod != "" && entry.Pod != container.PodName) {
+				continue
+			}
+			// checked when the command was decoded
+			key, _ := entry.Key(uint32(ifindex))
+			allowed[key] = true
+		}
+	}
+	ifindex_mu.RUnlock()
+
+	if len(allowed) > logs.MAX_ALLOW_ENTRIES {
+		return fmt.Errorf("lockdown allow-lists need %d entries: max is %d", len(allowed), logs.MAX_ALLOW_ENTRIES)
+	}
+
+	// new entries go in before a veth is enforced , and old ones leave after it is released
+	if err := putKeys(objs.EgressAllow, allowed); err != nil {
+		return fmt.Errorf("egress_allow: %w", err)
+	}
+	if err := deleteKeys(objs.LockdownIfaces, func(k uint32) bool { return !ifaces[k] }); err != nil {
+		return fmt.Errorf("lockdown_ifaces: %w", err)
+	}
+	if err := putKeys(objs.LockdownIfaces, ifaces); err != nil {
+		return fmt.Errorf("lockdown_ifaces: %w", err)
+	}
+	if err := deleteKeys(objs.EgressAllow, func(k logs.Allow_key) bool { return !allowed[k] }); err != nil {
+		return fmt.Errorf("egress_allow: %w", err)
+	}
+	return nil
+}
+
+// lockdownModes reports the mode of every namespace in lockdown , for the heartbeat
+func lockdownModes() map[string]string {
+	lockdown_mu.Lock()
+	defer lockdown_mu.Unlock()
+
+	if len(lockdowns) == 0 {
+		return nil
+	}
+	modes := make(map[string]string, len(lockdowns))
+	for namespace, ns := range lockdowns {
+		modes[namespace] = ns.mode
+	}
+	return modes
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"agent/pkg/kube"
+	"agent/pkg/logs"
+	"testing"
+	"time"
+)
+
+func flowEvent(direction, protocol uint8, src, dst [4]byte, sport, dport uint16, tcpFlags uint8) *logs.FlowEvent {
+	event := &logs.FlowEvent{Family: logs.FAMILY_IPV4, Direction: direction, Protocol: protocol, SrcPort: sport, DstPort: dport, TcpFlags: tcpFlags}
+	copy(event.SrcIP[:], src[:])
+	copy(event.DstIP[:], dst[:])
+	return event
+}
+
+func TestLearnFlow(t *testing.T) {
+	web1 := kube.ContainerMapping{Namespace: "shop", PodName: "web-7d4b9c8f6d-aaaaa", Workload: "web"}
+	web2 := kube.ContainerMapping{Namespace: "shop", PodName: "web-7d4b9c8f6d-bbbbb", Workload: "web"}
+	api := kube.ContainerMapping{Namespace: "shop", PodName: "api-0", Workload: "api"}
+	pod, db, dns := [4]byte{10, 0, 0, 5}, [4]byte{10, 0, 1, 7}, [4]byte{10, 96, 0, 10}
+
+	tests := []struct {
+		name   string
+		flows  []kube.ContainerMapping
+		events []*logs.FlowEvent
+		want   []logs.Allow_entry
+	}{
+		{
+			name:   "replicas share their entries",
+			flows:  []kube.ContainerMapping{web1, web2},
+			events: []*logs.FlowEvent{flowEvent(logs.DIR_FROM_POD, 6, pod, db, 40000, 5432, logs.TCP_FLAG_SYN), flowEvent(logs.DIR_FROM_POD, 6, pod, db, 40001, 5432, logs.TCP_FLAG_SYN)},
+			want:   []logs.Allow_entry{{Workload: "web", Protocol: 6, DstIP: "10.0.1.7", DstPort: 5432, Packets: 2}},
+		},
+		{
+			name:   "workloads are kept apart",
+			flows:  []kube.ContainerMapping{web1, api},
+			events: []*logs.FlowEvent{flowEvent(logs.DIR_FROM_POD, 6, pod, db, 40000, 5432, logs.TCP_FLAG_SYN), flowEvent(logs.DIR_FROM_POD, 6, pod, db, 40001, 5432, logs.TCP_FLAG_SYN)},
+			want: []logs.Allow_entry{
+				{Workload: "api", Protocol: 6, DstIP: "10.0.1.7", DstPort: 5432, Packets: 1},
+				{Workload: "web", Protocol: 6, DstIP: "10.0.1.7", DstPort: 5432, Packets: 1},
+			},
+		},
+		{
+			name:   "only SYNs open TCP flows",
+			flows:  []kube.ContainerMapping{web1},
+			events: []*logs.FlowEvent{flowEvent(logs.DIR_FROM_POD, 6, pod, db, 40000, 5432, logs.TCP_FLAG_SYN|logs.TCP_FLAG_ACK)},
+			want:   []logs.Allow_entry{},
+		},
+		{
+			name:  "a UDP answer is not a listen port",
+			flows: []kube.ContainerMapping{web1, web2},
+			events: []*logs.FlowEvent{
+				flowEvent(logs.DIR_FROM_POD, 17, pod, dns, 50000, 53, 0),
+				flowEvent(logs.DIR_TO_POD, 17, dns, pod, 53, 50000, 0),
+			},
+			want: []logs.Allow_entry{{Workload: "web", Protocol: 17, DstIP: "10.96.0.10", DstPort: 53, Packets: 1}},
+		},
+		{
+			name:   "a UDP port the pod is asked on",
+			flows:  []kube.ContainerMapping{api},
+			events: []*logs.FlowEvent{flowEvent(logs.DIR_TO_POD, 17, db, pod, 40000, 8125, 0)},
+			want:   []logs.Allow_entry{{Workload: "api", Protocol: 17, ListenPort: 8125, Packets: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lockdown_mu.Lock()
+			lockdowns = map[string]*lockdown_ns{"shop": {mode: logs.LOCKDOWN_LEARNING, learned: make(map[learnKey]*logs.Allow_entry)}}
+			updateLearning()
+			lockdown_mu.Unlock()
+			t.Cleanup(func() {
+				lockdown_mu.Lock()
+				lockdowns = make(map[string]*lockdown_ns)
+				updateLearning()
+				lockdown_mu.Unlock()
+			})
+
+			for i, event := range tt.events {
+				learnFlow(event, tt.flows[i])
+			}
+			lockdown_mu.Lock()
+			report := finishLearning("shop", lockdowns["shop"])
+			lockdown_mu.Unlock()
+
+			if len(report.Learned) != len(tt.want) {
+				t.Fatalf("learned %+v , want %+v", report.Learned, tt.want)
+			}
+			for i, entry := range report.Learned {
+				entry.LastSeen = time.Time{}
+				if entry != tt.want[i] {
+					t.Errorf("entry %d = %+v , want %+v", i, entry, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,759 @@
+package internal
+
+import (
+	"agent/pkg/config"
+	"agent/pkg/identity"
+	"agent/pkg/kube"
+	"agent/pkg/logs"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// changes closer than this , e.g. the pods of a rollout , are translated together
+const policySettle = 2 * time.Second
+
+var (
+	// the rules the server pushed and those the NetworkPolicies translate to , loaded as one list
+	// with the server's first. policyOrigins names the policy of each policy rule , "" for the
+	// isolation drops , whose policies policyIsolations names by direction and pod UID. Guarded by policy_mu.
+	serverRules      []logs.FlowRuleInput
+	policyRules      []logs.FlowRuleInput
+	policyOrigins    []string
+	policyIsolations [2]map[string]string
+	policy_mu        sync.Mutex
+)
+
+// setServerRules replaces the rules the server pushed , the NetworkPolicy rules stay after them
+func setServerRules(inputs []logs.FlowRuleInput, objs *trafficObjects) error {
+	policy_mu.Lock()
+	defer policy_mu.Unlock()
+
+	err := LoadFlowRules(slices.Concat(inputs, policyRules), len(policyRules), objs)
+	if err != nil && len(policyRules) > 0 {
+		err = fmt.Errorf("with %d NetworkPolicy rules: %w", len(policyRules), err)
+	}
+	if loaded(err) {
+		serverRules = inputs
+	}
+	return err
+}
+
+// loaded reports whether LoadFlowRules put the rule set in force , maybe without some rules
+func loaded(err error) bool {
+	var unindexed *logs.Unindexed_rules_error
+	return err == nil || errors.As(err, &unindexed)
+}
+
+// ruleOrigin names the NetworkPolicy a rule was translated from , "" for the server's rules.
+// An isolation drop is named by the policies isolating the pod in the direction of the flow.
+func ruleOrigin(id uint32, direction uint8, podUID string) string {
+	policy_mu.Lock()
+	defer policy_mu.Unlock()
+	i := int(id) - len(serverRules)
+	if i < 0 || i >= len(policyOrigins) {
+		return ""
+	}
+	if policyOrigins[i] == "" && direction < 2 {
+		return policyIsolations[direction][podUID]
+	}
+	return policyOrigins[i]
+}
+
+// enforceNetworkPolicies keeps the rules of the cluster's NetworkPolicies loaded until ctx is done
+func enforceNetworkPolicies(ctx context.Context, objs *trafficObjects) {
+	changed := make(chan struct{}, 1)
+	err := kube.WatchNetworkPolicies(func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		log.Printf(" Cannot watch NetworkPolicies , they are not enforced: %v", err)
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+		if err := syncPolicyRules(objs); err != nil {
+			log.Printf(" Failed to load NetworkPolicy rules: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(policySettle):
+		}
+	}
+}
+
+// syncPolicyRules translates the NetworkPolicies again and loads the rules if they changed
+func syncPolicyRules(objs *trafficObjects) error {
+	view, err := kube.NetworkPolicyView()
+	if err != nil {
+		return err
+	}
+	b := newPolicyBuilder(view, identity.Get().NodeName, nodeAddrs())
+	rules, origins := b.build()
+	isolations := b.isolations()
+
+	policy_mu.Lock()
+	defer policy_mu.Unlock()
+	if reflect.DeepEqual(rules, policyRules) && slices.Equal(origins, policyOrigins) && reflect.DeepEqual(isolations, policyIsolations) {
+		return nil
+	}
+	err = LoadFlowRules(slices.Concat(serverRules, rules), len(rules), objs)
+	if !loaded(err) {
+		return err
+	}
+	policyRules, policyOrigins, policyIsolations = rules, origins, isolations
+	log.Printf(" NetworkPolicies translated to %d flow rules", len(rules))
+	return err
+}
+
+// nodeAddrs lists the addresses of the node. Traffic between a pod and its node , like kubelet's
+// probes , is always allowed and comes from the address of the pod network's bridge.
+func nodeAddrs() []netip.Prefix {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf(" Cannot list the node's addresses: %v", err)
+		return nil
+	}
+	var prefixes []netip.Prefix
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ipnet.IP)
+		if !ok {
+			continue
+		}
+		addr = addr.Unmap()
+		if addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+			continue
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes
+}
+
+// policyGrant is one kind of traffic a policy allows , the zero peer is any address.
+// local , when set , is the address of the pod the grant is for.
+type policyGrant struct {
+	direction uint8
+	peer      netip.Prefix
+	local     netip.Prefix
+	protocol  uint8
+	port      logs.PortRange
+	scope     logs.Rule_scope
+}
+
+// grantKey identifies a grant , the pod_uids of a scope keep policyGrant from being a map key
+type grantKey struct {
+	direction                   uint8
+	peer, local                 netip.Prefix
+	protocol                    uint8
+	port                        logs.PortRange
+	podUID, namespace, selector string
+}
+
+func (g policyGrant) key() grantKey {
+	return grantKey{g.direction, g.peer, g.local, g.protocol, g.port, g.scope.PodUID, g.scope.Namespace, g.scope.Selector}
+}
+
+// policyPort is a port of a policy rule , a named one is resolved on the pod it belongs to
+type policyPort struct {
+	protocol uint8
+	port     logs.PortRange
+	name     string
+}
+
+type policyBuilder struct {
+	view      kube.Policy_view
+	node      string
+	nodeAddrs []netip.Prefix
+
+	nsLabels map[string]labels.Set
+	services map[string]*corev1.Service // by namespace/name
+
+	allows       []logs.FlowRuleInput
+	allowOrigins []string
+	seen         map[grantKey]bool
+
+	// by direction , the pods some policy isolates and the policies doing it , and the pods
+	// some policy allows everything to , so none of their traffic is dropped
+	isolated [2]map[types.UID][]string
+	open     [2]map[types.UID]bool
+}
+
+func newPolicyBuilder(view kube.Policy_view, node string, nodeAddrs []netip.Prefix) *policyBuilder {
+	b := &policyBuilder{
+		view:      view,
+		node:      node,
+		nodeAddrs: nodeAddrs,
+		nsLabels:  make(map[string]labels.Set),
+		services:  make(map[string]*corev1.Service),
+	}
+	for dir := range b.isolated {
+		b.isolated[dir] = make(map[types.UID][]string)
+		b.open[dir] = make(map[types.UID]bool)
+	}
+	// a stable order keeps the rule ids when nothing changed , the lists come from maps
+	byName := func(x, y metav1.Object) int {
+		return cmp.Or(cmp.Compare(x.GetNamespace(), y.GetNamespace()), cmp.Compare(x.GetName(), y.GetName()))
+	}
+	slices.SortFunc(b.view.Policies, func(x, y *networkingv1.NetworkPolicy) int { return byName(x, y) })
+	slices.SortFunc(b.view.Pods, func(x, y *corev1.Pod) int { return byName(x, y) })
+	slices.SortFunc(b.view.Slices, func(x, y *discoveryv1.EndpointSlice) int { return byName(x, y) })
+	for _, ns := range view.Namespaces {
+		b.nsLabels[ns.Name] = labels.Set(ns.Labels)
+	}
+	for _, svc := range view.Services {
+		b.services[svc.Namespace+"/"+svc.Name] = svc
+	}
+	return b
+}
+
+// build translates the policies selecting pods of this node. The allows of every policy come
+// first , then one drop per direction for every pod isolated in it: a pod is isolated by any policy
+// selecting it and receives what any of them allows. The drops only match what opens a flow ,
+// so the replies of allowed flows in the other direction pass. Whatever the number of policies ,
+// the drops and the node's grants are a few rules , and the fallback list stays short.
+func (b *policyBuilder) build() ([]logs.FlowRuleInput, []string) {
+	for _, policy := range b.view.Policies {
+		// the agent has no veth of the pods there
+		if slices.Contains(config.Get().Kube.ExcludedNamespaces, policy.Namespace) {
+			continue
+		}
+		if err := b.translate(policy); err != nil {
+			log.Printf(" Skipping NetworkPolicy %s/%s: %v", policy.Namespace, policy.Name, err)
+		}
+	}
+
+	var drops []logs.FlowRuleInput
+	for _, direction := range []uint8{logs.DIR_TO_POD, logs.DIR_FROM_POD} {
+		uids := b.isolatedPods(direction)
+		if len(uids) == 0 {
+			continue
+		}
+		scope := logs.Rule_scope{PodUIDs: uids}
+		// the node talks to its pods , like kubelet's probes
+		for _, addr := range b.nodeAddrs {
+			b.allow("", policyGrant{direction: direction, peer: addr, scope: scope})
+		}
+		drops = append(drops, logs.FlowRuleInput{
+			Direction: &direction,
+			Action:    logs.ACTION_DROP,
+			Scope:     &scope,
+			NewFlow:   true,
+		})
+	}
+	return slices.Concat(b.allows, drops), slices.Concat(b.allowOrigins, make([]string, len(drops)))
+}
+
+// isolatedPods lists the pods whose new flows in direction are dropped unless allowed
+func (b *policyBuilder) isolatedPods(direction uint8) []string {
+	var uids []string
+	for uid := range b.isolated[direction] {
+		if !b.open[direction][uid] {
+			uids = append(uids, string(uid))
+		}
+	}
+	slices.Sort(uids)
+	return uids
+}
+
+// isolations names the policies isolating each pod , by direction and pod UID
+func (b *policyBuilder) isolations() [2]map[string]string {
+	var named [2]map[string]string
+	for dir := range named {
+		named[dir] = make(map[string]string)
+		for _, uid := range b.isolatedPods(uint8(dir)) {
+			named[dir][uid] = strings.Join(b.isolated[dir][types.UID(uid)], ",")
+		}
+	}
+	return named
+}
+
+func (b *policyBuilder) translate(policy *networkingv1.NetworkPolicy) error {
+	selector, err := metav1.LabelSelectorAsSelector(&policy.Spec.PodSelector)
+	if err != nil {
+		return fmt.Errorf("podSelector: %w", err)
+	}
+	var local []*corev1.Pod
+	for _, pod := range b.view.Pods {
+		if pod.Spec.NodeName == b.node && pod.Namespace == policy.Namespace && live(pod) && selector.Matches(labels.Set(pod.Labels)) {
+			local = append(local, pod)
+		}
+	}
+	if len(local) == 0 {
+		return nil
+	}
+
+	origin := policy.Namespace + "/" + policy.Name
+	scope := logs.Rule_scope{Namespace: policy.Namespace, Selector: selector.String()}
+	ingress, egress := isolates(policy)
+
+	// resolve everything first , a policy half translated would isolate without all its allows
+	var grants []policyGrant
+	if ingress {
+		for i, rule := range policy.Spec.Ingress {
+			g, err := b.ingressGrants(rule, scope, local, policy.Namespace)
+			if err != nil {
+				return fmt.Errorf("ingress rule %d: %w", i, err)
+			}
+			grants = append(grants, g...)
+		}
+	}
+	if egress {
+		for i, rule := range policy.Spec.Egress {
+			g, err := b.egressGrants(rule, scope, policy.Namespace)
+			if err != nil {
+				return fmt.Errorf("egress rule %d: %w", i, err)
+			}
+			grants = append(grants, g...)
+		}
+	}
+
+	for _, pod := range local {
+		if ingress {
+			b.isolated[logs.DIR_TO_POD][pod.UID] = append(b.isolated[logs.DIR_TO_POD][pod.UID], origin)
+		}
+		if egress {
+			b.isolated[logs.DIR_FROM_POD][pod.UID] = append(b.isolated[logs.DIR_FROM_POD][pod.UID], origin)
+		}
+	}
+	for _, g := range grants {
+		if g.peer.IsValid() {
+			b.allow(origin, g)
+			continue
+		}
+		// everything is allowed: the pods are left out of the drop instead
+		if g.protocol == 0 && g.port.Any() {
+			for _, pod := range local {
+				b.open[g.direction][pod.UID] = true
+			}
+			continue
+		}
+		// any peer: one rule per address of the pods , so the rules of a port range , of every port
+		// of a protocol or of a full port bucket go to a CIDR trie instead of the fallback list
+		for _, pod := range local {
+			if g.scope.PodUID != "" && g.scope.PodUID != string(pod.UID) {
+				continue
+			}
+			for _, ip := range pod.Status.PodIPs {
+				if addr, err := netip.ParseAddr(ip.IP); err == nil {
+					g.local = netip.PrefixFrom(addr, addr.BitLen())
+					b.allow(origin, g)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isolates tells the directions a policy isolates its pods in , a policy without policyTypes
+// isolates egress only when it has egress rules
+func isolates(policy *networkingv1.NetworkPolicy) (ingress, egress bool) {
+	if len(policy.Spec.PolicyTypes) == 0 {
+		return true, len(policy.Spec.Egress) > 0
+	}
+	return slices.Contains(policy.Spec.PolicyTypes, networkingv1.PolicyTypeIngress),
+		slices.Contains(policy.Spec.PolicyTypes, networkingv1.PolicyTypeEgress)
+}
+
+// allow adds the rule of a grant unless an earlier policy added the same
+func (b *policyBuilder) allow(origin string, g policyGrant) {
+	if b.seen == nil {
+		b.seen = make(map[grantKey]bool)
+	}
+	if b.seen[g.key()] {
+		return
+	}
+	b.seen[g.key()] = true
+
+	direction, scope := g.direction, g.scope
+	in := logs.FlowRuleInput{
+		Protocol:  g.protocol,
+		DstPort:   g.port,
+		Direction: &direction,
+		Action:    logs.ACTION_ALLOW,
+		Scope:     &scope,
+	}
+	if g.peer.IsValid() {
+		if direction == logs.DIR_TO_POD {
+			in.SrcIP = g.peer.String()
+		} else {
+			in.DstIP = g.peer.String()
+		}
+	}
+	if g.local.IsValid() {
+		if direction == logs.DIR_TO_POD {
+			in.DstIP = g.local.String()
+		} else {
+			in.SrcIP = g.local.String()
+		}
+	}
+	b.allows = append(b.allows, in)
+	b.allowOrigins = append(b.allowOrigins, origin)
+}
+
+// ingressGrants allows the sources of a rule to the ports of the policy's pods
+func (b *policyBuilder) ingressGrants(rule networkingv1.NetworkPolicyIngressRule, scope logs.Rule_scope,
+	local []*corev1.Pod, namespace string) ([]policyGrant, error) {
+	peers, _, err := b.peers(rule.From, namespace)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := policyPorts(rule.Ports)
+	if err != nil {
+		return nil, err
+	}
+
+	var grants []policyGrant
+	for _, port := range ports {
+		for _, peer := range peers {
+			if port.name == "" {
+				grants = append(grants, policyGrant{direction: logs.DIR_TO_POD, peer: peer, protocol: port.protocol, port: port.port, scope: scope})
+				continue
+			}
+			// the number can differ between the pods , each gets its own rule
+			for _, pod := range local {
+				number, ok := namedPort(pod, port.name, port.protocol)
+				if !ok {
+					continue
+				}
+				grants = append(grants, policyGrant{
+					direction: logs.DIR_TO_POD,
+					peer:      peer,
+					protocol:  port.protocol,
+					port:      logs.PortRange{Min: number, Max: number},
+					scope:     logs.Rule_scope{PodUID: string(pod.UID)},
+				})
+			}
+		}
+	}
+	return grants, nil
+}
+
+// egressGrants allows the policy's pods to the ports of a rule's destinations , and to the
+// cluster IPs of the services the destination pods back
+func (b *policyBuilder) egressGrants(rule networkingv1.NetworkPolicyEgressRule, scope logs.Rule_scope,
+	namespace string) ([]policyGrant, error) {
+	peers, pods, err := b.peers(rule.To, namespace)
+	if err != nil {
+		return nil, err
+	}
+	ports, err := policyPorts(rule.Ports)
+	if err != nil {
+		return nil, err
+	}
+	// any destination: the numbered ports are allowed to every address , a named one is each pod's
+	anyPeer := len(rule.To) == 0
+	if anyPeer && slices.ContainsFunc(ports, func(p policyPort) bool { return p.name != "" }) {
+		pods = make(map[netip.Addr]*corev1.Pod)
+		for _, pod := range b.view.Pods {
+			if !live(pod) {
+				continue
+			}
+			for _, ip := range pod.Status.PodIPs {
+				if addr, err := netip.ParseAddr(ip.IP); err == nil {
+					pods[addr] = pod
+				}
+			}
+		}
+	}
+
+	var grants []policyGrant
+	for _, port := range ports {
+		if port.name == "" {
+			for _, peer := range peers {
+				grants = append(grants, policyGrant{direction: logs.DIR_FROM_POD, peer: peer, protocol: port.protocol, port: port.port, scope: scope})
+			}
+			continue
+		}
+		// a named port is the destination pod's , addresses outside the cluster have none
+		for addr, pod := range pods {
+			if number, ok := namedPort(pod, port.name, port.protocol); ok {
+				grants = append(grants, policyGrant{
+					direction: logs.DIR_FROM_POD,
+					peer:      netip.PrefixFrom(addr, addr.BitLen()),
+					protocol:  port.protocol,
+					port:      logs.PortRange{Min: number, Max: number},
+					scope:     scope,
+				})
+			}
+		}
+	}
+	// map iteration made the named port grants unordered
+	slices.SortStableFunc(grants, func(x, y policyGrant) int { return x.peer.Addr().Compare(y.peer.Addr()) })
+
+	allowed := func(pod *corev1.Pod, protocol uint8, number uint16) bool {
+		for _, port := range ports {
+			if port.protocol != 0 && port.protocol != protocol {
+				continue
+			}
+			if port.name != "" {
+				if n, ok := namedPort(pod, port.name, protocol); ok && n == number {
+					return true
+				}
+				continue
+			}
+			if !anyPeer && (port.port.Any() || (port.port.Min <= number && number <= port.port.Max)) {
+				return true
+			}
+		}
+		return false
+	}
+	return append(grants, b.serviceGrants(pods, allowed, scope)...), nil
+}
+
+// serviceGrants allows the cluster IPs and ports of the services whose endpoints include pods on
+// allowed ports. A pod's packets reach its veth before kube-proxy translates the cluster IP.
+func (b *policyBuilder) serviceGrants(pods map[netip.Addr]*corev1.Pod,
+	allowed func(pod *corev1.Pod, protocol uint8, number uint16) bool, scope logs.Rule_scope) []policyGrant {
+	if len(pods) == 0 {
+		return nil
+	}
+	var grants []policyGrant
+	for _, slice := range b.view.Slices {
+		svc := b.services[slice.Namespace+"/"+slice.Labels[discoveryv1.LabelServiceName]]
+		if svc == nil || svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == corev1.ClusterIPNone {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			for _, ip := range endpoint.Addresses {
+				addr, err := netip.ParseAddr(ip)
+				if err != nil {
+					continue
+				}
+				pod, ok := pods[addr]
+				if !ok {
+					continue
+				}
+				for _, sp := range slice.Ports {
+					if sp.Port == nil {
+						continue
+					}
+					protocol := protocolNumber(sp.Protocol)
+					if !allowed(pod, protocol, uint16(*sp.Port)) {
+						continue
+					}
+					grants = append(grants, servicePortGrants(svc, sp, protocol, scope)...)
+				}
+			}
+		}
+	}
+	return grants
+}
+
+// servicePortGrants allows the service port a slice port is the target of , on every cluster IP
+func servicePortGrants(svc *corev1.Service, sp discoveryv1.EndpointPort, protocol uint8, scope logs.Rule_scope) []policyGrant {
+	name := ""
+	if sp.Name != nil {
+		name = *sp.Name
+	}
+	var grants []policyGrant
+	for _, port := range svc.Spec.Ports {
+		if port.Name != name || protocolNumber(&port.Protocol) != protocol {
+			continue
+		}
+		for _, ip := range svc.Spec.ClusterIPs {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				continue
+			}
+			grants = append(grants, policyGrant{
+				direction: logs.DIR_FROM_POD,
+				peer:      netip.PrefixFrom(addr, addr.BitLen()),
+				protocol:  protocol,
+				port:      logs.PortRange{Min: uint16(port.Port), Max: uint16(port.Port)},
+				scope:     scope,
+			})
+		}
+	}
+	return grants
+}
+
+// peers resolves the peers of a rule to prefixes , and the pods among them by address.
+// No peers means any address , given as the zero prefix.
+func (b *policyBuilder) peers(peers []networkingv1.NetworkPolicyPeer, namespace string) ([]netip.Prefix, map[netip.Addr]*corev1.Pod, error) {
+	if len(peers) == 0 {
+		return []netip.Prefix{{}}, nil, nil
+	}
+	var prefixes []netip.Prefix
+	pods := make(map[netip.Addr]*corev1.Pod)
+	for _, peer := range peers {
+		if peer.IPBlock != nil {
+			block, err := ipBlockPrefixes(peer.IPBlock)
+			if err != nil {
+				return nil, nil, err
+			}
+			prefixes = append(prefixes, block...)
+			continue
+		}
+
+		podSelector, nsSelector := labels.Everything(), labels.Nothing()
+		var err error
+		if peer.PodSelector != nil {
+			if podSelector, err = metav1.LabelSelectorAsSelector(peer.PodSelector); err != nil {
+				return nil, nil, fmt.Errorf("podSelector: %w", err)
+			}
+		}
+		if peer.NamespaceSelector != nil {
+			if nsSelector, err = metav1.LabelSelectorAsSelector(peer.NamespaceSelector); err != nil {
+				return nil, nil, fmt.Errorf("namespaceSelector: %w", err)
+			}
+		}
+		for _, pod := range b.view.Pods {
+			if !live(pod) || !podSelector.Matches(labels.Set(pod.Labels)) {
+				continue
+			}
+			// without a namespaceSelector the peers are in the policy's namespace
+			if peer.NamespaceSelector == nil && pod.Namespace != namespace {
+				continue
+			}
+			if ns, ok := b.nsLabels[pod.Namespace]; peer.NamespaceSelector != nil && (!ok || !nsSelector.Matches(ns)) {
+				continue
+			}
+			for _, ip := range pod.Status.PodIPs {
+				if addr, err := netip.ParseAddr(ip.IP); err == nil {
+					pods[addr] = pod
+				}
+			}
+		}
+	}
+
+	addrs := make([]netip.Addr, 0, len(pods))
+	for addr := range pods {
+		addrs = append(addrs, addr)
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	for _, addr := range addrs {
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, pods, nil
+}
+
+// live reports whether a pod has addresses of its own that can be reached
+func live(pod *corev1.Pod) bool {
+	return !pod.Spec.HostNetwork && len(pod.Status.PodIPs) > 0 &&
+		pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed
+}
+
+// ipBlockPrefixes lists the prefixes covering an ipBlock's CIDR without its exceptions
+func ipBlockPrefixes(block *networkingv1.IPBlock) ([]netip.Prefix, error) {
+	cidr, err := netip.ParsePrefix(block.CIDR)
+	if err != nil {
+		return nil, fmt.Errorf("ipBlock: %w", err)
+	}
+	prefixes := []netip.Prefix{cidr.Masked()}
+	for _, s := range block.Except {
+		except, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("ipBlock except: %w", err)
+		}
+		var rest []netip.Prefix
+		for _, p := range prefixes {
+			rest = append(rest, excludePrefix(p, except.Masked())...)
+		}
+		prefixes = rest
+	}
+	return prefixes, nil
+}
+
+// excludePrefix splits p into the prefixes covering it without except , one per bit
+// between their lengths
+func excludePrefix(p, except netip.Prefix) []netip.Prefix {
+	if !p.Overlaps(except) {
+		return []netip.Prefix{p}
+	}
+	if except.Bits() <= p.Bits() {
+		return nil
+	}
+	bits := p.Bits()
+	addr := p.Addr().AsSlice()
+	low := netip.PrefixFrom(p.Addr(), bits+1)
+	addr[bits/8] |= 0x80 >> (bits % 8)
+	highAddr, _ := netip.AddrFromSlice(addr)
+	high := netip.PrefixFrom(highAddr, bits+1)
+	return append(excludePrefix(low, except), excludePrefix(high, except)...)
+}
+
+// policyPorts converts the ports of a rule , no ports means every protocol and port
+func policyPorts(ports []networkingv1.NetworkPolicyPort) ([]policyPort, error) {
+	if len(ports) == 0 {
+		return []policyPort{{}}, nil
+	}
+	var converted []policyPort
+	for _, p := range ports {
+		port := policyPort{protocol: protocolNumber(p.Protocol)}
+		switch {
+		case p.Port == nil:
+		case p.Port.Type == intstr.String:
+			port.name = p.Port.StrVal
+		default:
+			if p.Port.IntVal < 1 || p.Port.IntVal > 65535 {
+				return nil, fmt.Errorf("invalid port %d", p.Port.IntVal)
+			}
+			port.port = logs.PortRange{Min: uint16(p.Port.IntVal), Max: uint16(p.Port.IntVal)}
+			if p.EndPort != nil {
+				if *p.EndPort < p.Port.IntVal || *p.EndPort > 65535 {
+					return nil, fmt.Errorf("invalid endPort %d", *p.EndPort)
+				}
+				port.port.Max = uint16(*p.EndPort)
+			}
+		}
+		converted = append(converted, port)
+	}
+	return converted, nil
+}
+
+// protocolNumber converts a Kubernetes protocol , TCP when unset
+func protocolNumber(protocol *corev1.Protocol) uint8 {
+	if protocol == nil {
+		return 6
+	}
+	switch *protocol {
+	case corev1.ProtocolUDP:
+		return 17
+	case corev1.ProtocolSCTP:
+		return 132
+	}
+	return 6
+}
+
+// namedPort finds the number of a container port of pod by name
+func namedPort(pod *corev1.Pod, name string, protocol uint8) (uint16, bool) {
+	for _, c := range pod.Spec.Containers {
+		for _, port := range c.Ports {
+			if port.Name == name && protocolNumber(&port.Protocol) == protocol {
+				return uint16(port.ContainerPort), true
+			}
+		}
+	}
+	return 0, false
+}
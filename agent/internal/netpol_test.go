@@ -0,0 +1,371 @@
+package internal
+
+import (
+	"agent/pkg/kube"
+	"agent/pkg/logs"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const testNode = "node-1"
+
+func testPod(namespace, name, ip string, podLabels map[string]string, ports ...corev1.ContainerPort) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID(namespace + "-" + name), Labels: podLabels},
+		Spec:       corev1.PodSpec{NodeName: testNode, Containers: []corev1.Container{{Name: "main", Ports: ports}}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIPs: []corev1.PodIP{{IP: ip}}},
+	}
+}
+
+func testPolicy(namespace, name string, podLabels map[string]string, types []networkingv1.PolicyType,
+	ingress []networkingv1.NetworkPolicyIngressRule, egress []networkingv1.NetworkPolicyEgressRule) *networkingv1.NetworkPolicy {
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: podLabels},
+			PolicyTypes: types,
+			Ingress:     ingress,
+			Egress:      egress,
+		},
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func tcpPort(port int32, endPort *int32) networkingv1.NetworkPolicyPort {
+	return networkingv1.NetworkPolicyPort{Protocol: ptr(corev1.ProtocolTCP), Port: ptr(intstr.FromInt32(port)), EndPort: endPort}
+}
+
+var bothTypes = []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress}
+
+// ruleString is a short form of a translated rule
+func ruleString(in logs.FlowRuleInput) string {
+	parts := []string{in.Action.String(), fmt.Sprintf("dir=%d", *in.Direction)}
+	if in.SrcIP != "" {
+		parts = append(parts, "src="+in.SrcIP)
+	}
+	if in.DstIP != "" {
+		parts = append(parts, "dst="+in.DstIP)
+	}
+	if in.Protocol != 0 {
+		parts = append(parts, fmt.Sprintf("proto=%d", in.Protocol))
+	}
+	if !in.DstPort.Any() {
+		parts = append(parts, fmt.Sprintf("port=%d-%d", in.DstPort.Min, in.DstPort.Max))
+	}
+	if s := in.Scope; s != nil {
+		switch {
+		case s.PodUID != "":
+			parts = append(parts, "pod="+s.PodUID)
+		case len(s.PodUIDs) > 0:
+			parts = append(parts, "pods="+strings.Join(s.PodUIDs, ","))
+		default:
+			parts = append(parts, "scope="+s.Namespace+"/"+s.Selector)
+		}
+	}
+	if in.NewFlow {
+		parts = append(parts, "new")
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestPolicyBuilder(t *testing.T) {
+	web := map[string]string{"app": "web"}
+	db := map[string]string{"app": "db"}
+	webPod := testPod("shop", "web", "10.0.0.5", web, corev1.ContainerPort{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP})
+	webPod2 := testPod("shop", "web-2", "10.0.0.6", web, corev1.ContainerPort{Name: "http", ContainerPort: 9090, Protocol: corev1.ProtocolTCP})
+	dbPod := testPod("shop", "db", "10.0.1.7", db, corev1.ContainerPort{Name: "pg", ContainerPort: 5432, Protocol: corev1.ProtocolTCP})
+	remote := testPod("shop", "remote", "10.0.9.9", db)
+	remote.Spec.NodeName = "node-2"
+	node := []netip.Prefix{netip.MustParsePrefix("192.168.0.10/32")}
+
+	tests := []struct {
+		name  string
+		view  kube.Policy_view
+		want  []string
+		isols [2]map[string]string
+	}{
+		{
+			name: "default deny",
+			view: kube.Policy_view{
+				Pods:     []*corev1.Pod{webPod, dbPod},
+				Policies: []*networkingv1.NetworkPolicy{testPolicy("shop", "deny", nil, bothTypes, nil, nil)},
+			},
+			want: []string{
+				"allow dir=0 src=192.168.0.10/32 pods=shop-db,shop-web",
+				"allow dir=1 dst=192.168.0.10/32 pods=shop-db,shop-web",
+				"drop dir=0 pods=shop-db,shop-web new",
+				"drop dir=1 pods=shop-db,shop-web new",
+			},
+			isols: [2]map[string]string{
+				{"shop-db": "shop/deny", "shop-web": "shop/deny"},
+				{"shop-db": "shop/deny", "shop-web": "shop/deny"},
+			},
+		},
+		{
+			name: "no policyTypes isolates ingress , and egress with egress rules",
+			view: kube.Policy_view{
+				Pods:     []*corev1.Pod{webPod},
+				Policies: []*networkingv1.NetworkPolicy{testPolicy("shop", "in", web, nil, nil, nil)},
+			},
+			want: []string{
+				"allow dir=0 src=192.168.0.10/32 pods=shop-web",
+				"drop dir=0 pods=shop-web new",
+			},
+		},
+		{
+			name: "pods of other nodes are left out",
+			view: kube.Policy_view{
+				Pods:     []*corev1.Pod{remote},
+				Policies: []*networkingv1.NetworkPolicy{testPolicy("shop", "deny", nil, bothTypes, nil, nil)},
+			},
+		},
+		{
+			name: "allow all opens the pods",
+			view: kube.Policy_view{
+				Pods: []*corev1.Pod{webPod, dbPod},
+				Policies: []*networkingv1.NetworkPolicy{
+					testPolicy("shop", "deny", nil, bothTypes, nil, nil),
+					testPolicy("shop", "web-open", web, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+						[]networkingv1.NetworkPolicyIngressRule{{}}, nil),
+				},
+			},
+			want: []string{
+				"allow dir=0 src=192.168.0.10/32 pods=shop-db",
+				"allow dir=1 dst=192.168.0.10/32 pods=shop-db,shop-web",
+				"drop dir=0 pods=shop-db new",
+				"drop dir=1 pods=shop-db,shop-web new",
+			},
+		},
+		{
+			name: "pod peers and a port",
+			view: kube.Policy_view{
+				Pods: []*corev1.Pod{webPod, dbPod},
+				Policies: []*networkingv1.NetworkPolicy{testPolicy("shop", "db", db, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+					[]networkingv1.NetworkPolicyIngressRule{{
+						From:  []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: web}}},
+						Ports: []networkingv1.NetworkPolicyPort{tcpPort(5432, nil)},
+					}}, nil)},
+			},
+			want: []string{
+				"allow dir=0 src=10.0.0.5/32 proto=6 port=5432-5432 scope=shop/app=db",
+				"allow dir=0 src=192.168.0.10/32 pods=shop-db",
+				"drop dir=0 pods=shop-db new",
+			},
+		},
+		{
+			name: "an endPort range from anywhere is pinned to the pod addresses",
+			view: kube.Policy_view{
+				Pods: []*corev1.Pod{webPod, webPod2},
+				Policies: []*networkingv1.NetworkPolicy{testPolicy("shop", "range", web, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+					[]networkingv1.NetworkPolicyIngressRule{{Ports: []networkingv1.NetworkPolicyPort{tcpPort(30000, ptr(int32(32767)))}}}, nil)},
+			},
+			want: []string{
+				"allow dir=0 dst=10.0.0.5/32 proto=6 port=30000-32767 scope=shop/app=web",
+				"allow dir=0 dst=10.0.0.6/32 proto=6 port=30000-32767 scope=shop/app=web",
+				"allow dir=0 src=192.168.0.10/32 pods=shop-web,shop-web-2",
+				"drop dir=0 pods=shop-web,shop-web-2 new",
+			},
+		},
+		{
+			name: "a named port is resolved on each pod",
+			view: kube.Policy_view{
+				Pods: []*corev1.Pod{webPod, webPod2},
+				Policies: []*networkingv1.NetworkPolicy{testPolicy("shop", "named", web, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+					[]networkingv1.NetworkPolicyIngressRule{{Ports: []networkingv1.NetworkPolicyPort{{Port: ptr(intstr.FromString("http"))}}}}, nil)},
+			},
+			want: []string{
+				"allow dir=0 dst=10.0.0.5/32 proto=6 port=8080-8080 pod=shop-web",
+				"allow dir=0 dst=10.0.0.6/32 proto=6 port=9090-9090 pod=shop-web-2",
+				"allow dir=0 src=192.168.0.10/32 pods=shop-web,shop-web-2",
+				"drop dir=0 pods=shop-web,shop-web-2 new",
+			},
+		},
+		{
+			name: "egress to a pod is also allowed to its service",
+			view: kube.Policy_view{
+				Pods: []*corev1.Pod{webPod, dbPod},
+				Policies: []*networkingv1.NetworkPolicy{testPolicy("shop", "web-out", web, []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+					nil, []networkingv1.NetworkPolicyEgressRule{{
+						To:    []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: db}}},
+						Ports: []networkingv1.NetworkPolicyPort{{Protocol: ptr(corev1.ProtocolTCP), Port: ptr(intstr.FromString("pg"))}},
+					}})},
+				Services: []*corev1.Service{{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "db"},
+					Spec: corev1.ServiceSpec{ClusterIP: "10.96.0.20", ClusterIPs: []string{"10.96.0.20"},
+						Ports: []corev1.ServicePort{{Name: "pg", Port: 5432, Protocol: corev1.ProtocolTCP}}},
+				}},
+				Slices: []*discoveryv1.EndpointSlice{{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "db-abc", Labels: map[string]string{discoveryv1.LabelServiceName: "db"}},
+					Endpoints:  []discoveryv1.Endpoint{{Addresses: []string{"10.0.1.7"}}},
+					Ports:      []discoveryv1.EndpointPort{{Name: ptr("pg"), Port: ptr(int32(5432)), Protocol: ptr(corev1.ProtocolTCP)}},
+				}},
+			},
+			want: []string{
+				"allow dir=1 dst=10.0.1.7/32 proto=6 port=5432-5432 scope=shop/app=web",
+				"allow dir=1 dst=10.96.0.20/32 proto=6 port=5432-5432 scope=shop/app=web",
+				"allow dir=1 dst=192.168.0.10/32 pods=shop-web",
+				"drop dir=1 pods=shop-web new",
+			},
+		},
+		{
+			name: "ipBlock with an exception",
+			view: kube.Policy_view{
+				Pods: []*corev1.Pod{webPod},
+				Policies: []*networkingv1.NetworkPolicy{testPolicy("shop", "out", web, []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+					nil, []networkingv1.NetworkPolicyEgressRule{{
+						To: []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/30", Except: []string{"10.0.0.0/32"}}}},
+					}})},
+			},
+			want: []string{
+				"allow dir=1 dst=10.0.0.1/32 scope=shop/app=web",
+				"allow dir=1 dst=10.0.0.2/31 scope=shop/app=web",
+				"allow dir=1 dst=192.168.0.10/32 pods=shop-web",
+				"drop dir=1 pods=shop-web new",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newPolicyBuilder(tt.view, testNode, node)
+			rules, origins := b.build()
+			var got []string
+			for _, rule := range rules {
+				got = append(got, ruleString(rule))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("rules:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if len(origins) != len(rules) {
+				t.Errorf("%d origins for %d rules", len(origins), len(rules))
+			}
+			if tt.isols[0] != nil {
+				if isols := b.isolations(); fmt.Sprint(isols) != fmt.Sprint(tt.isols) {
+					t.Errorf("isolations = %v , want %v", isols, tt.isols)
+				}
+			}
+			if _, err := logs.CompileFlowRules(rules); err != nil {
+				t.Errorf("compile: %v", err)
+			}
+		})
+	}
+}
+
+// Default deny namespaces must not fill the fallback list whatever their number
+func TestPolicyBuilderManyNamespaces(t *testing.T) {
+	var view kube.Policy_view
+	for i := range 200 {
+		namespace := fmt.Sprintf("team-%d", i)
+		view.Pods = append(view.Pods, testPod(namespace, "app", fmt.Sprintf("10.1.%d.%d", i/250, i%250+1), nil))
+		view.Policies = append(view.Policies,
+			testPolicy(namespace, "deny", nil, bothTypes, nil, nil),
+			testPolicy(namespace, "nodeports", nil, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+				[]networkingv1.NetworkPolicyIngressRule{{Ports: []networkingv1.NetworkPolicyPort{tcpPort(30000, ptr(int32(32767)))}}}, nil),
+			testPolicy(namespace, "web", nil, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+				[]networkingv1.NetworkPolicyIngressRule{{Ports: []networkingv1.NetworkPolicyPort{tcpPort(80, nil)}}}, nil))
+	}
+	b := newPolicyBuilder(view, testNode, []netip.Prefix{netip.MustParsePrefix("192.168.0.10/32")})
+	rules, _ := b.build()
+	set, err := logs.CompileFlowRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Stats.Fallback != 2 || set.Stats.Unindexed != 0 {
+		t.Errorf("stats = %+v , want the two drops in the fallback list", set.Stats)
+	}
+}
+
+func TestIsolates(t *testing.T) {
+	egressRule := []networkingv1.NetworkPolicyEgressRule{{}}
+	tests := []struct {
+		name        string
+		types       []networkingv1.PolicyType
+		egress      []networkingv1.NetworkPolicyEgressRule
+		wantIngress bool
+		wantEgress  bool
+	}{
+		{"no types", nil, nil, true, false},
+		{"no types , egress rules", nil, egressRule, true, true},
+		{"ingress", []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}, egressRule, true, false},
+		{"egress", []networkingv1.PolicyType{networkingv1.PolicyTypeEgress}, nil, false, true},
+		{"both", bothTypes, nil, true, true},
+	}
+	for _, tt := range tests {
+		ingress, egress := isolates(testPolicy("shop", "p", nil, tt.types, nil, tt.egress))
+		if ingress != tt.wantIngress || egress != tt.wantEgress {
+			t.Errorf("%s: isolates = %v , %v , want %v , %v", tt.name, ingress, egress, tt.wantIngress, tt.wantEgress)
+		}
+	}
+}
+
+func TestIPBlockPrefixes(t *testing.T) {
+	tests := []struct {
+		cidr    string
+		except  []string
+		want    []string
+		wantErr bool
+	}{
+		{cidr: "10.0.0.0/8", want: []string{"10.0.0.0/8"}},
+		{cidr: "10.1.2.3/8", want: []string{"10.0.0.0/8"}},
+		{cidr: "10.0.0.0/24", except: []string{"10.0.0.0/25"}, want: []string{"10.0.0.128/25"}},
+		{cidr: "10.0.0.0/24", except: []string{"10.0.0.64/26"}, want: []string{"10.0.0.0/26", "10.0.0.128/25"}},
+		{cidr: "10.0.0.0/30", except: []string{"10.0.0.1/32", "10.0.0.2/32"}, want: []string{"10.0.0.0/32", "10.0.0.3/32"}},
+		{cidr: "10.0.0.0/24", except: []string{"192.168.0.0/16"}, want: []string{"10.0.0.0/24"}},
+		{cidr: "10.0.0.0/24", except: []string{"10.0.0.0/8"}, want: nil},
+		{cidr: "fd00::/126", except: []string{"fd00::/127"}, want: []string{"fd00::2/127"}},
+		{cidr: "10.0.0.0/33", wantErr: true},
+		{cidr: "10.0.0.0/8", except: []string{"nope"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ipBlockPrefixes(&networkingv1.IPBlock{CIDR: tt.cidr, Except: tt.except})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s except %v: err = %v , want error %v", tt.cidr, tt.except, err, tt.wantErr)
+			continue
+		}
+		var strs []string
+		for _, p := range got {
+			strs = append(strs, p.String())
+		}
+		if !slices.Equal(strs, tt.want) {
+			t.Errorf("%s except %v = %v , want %v", tt.cidr, tt.except, strs, tt.want)
+		}
+	}
+}
+
+func TestPolicyPorts(t *testing.T) {
+	udp := corev1.ProtocolUDP
+	tests := []struct {
+		name    string
+		ports   []networkingv1.NetworkPolicyPort
+		want    []policyPort
+		wantErr bool
+	}{
+		{"none is everything", nil, []policyPort{{}}, false},
+		{"number", []networkingv1.NetworkPolicyPort{tcpPort(443, nil)}, []policyPort{{protocol: 6, port: logs.PortRange{Min: 443, Max: 443}}}, false},
+		{"range", []networkingv1.NetworkPolicyPort{tcpPort(8000, ptr(int32(8080)))}, []policyPort{{protocol: 6, port: logs.PortRange{Min: 8000, Max: 8080}}}, false},
+		{"protocol only", []networkingv1.NetworkPolicyPort{{Protocol: &udp}}, []policyPort{{protocol: 17}}, false},
+		{"named", []networkingv1.NetworkPolicyPort{{Port: ptr(intstr.FromString("dns")), Protocol: &udp}}, []policyPort{{protocol: 17, name: "dns"}}, false},
+		{"range below its port", []networkingv1.NetworkPolicyPort{tcpPort(8080, ptr(int32(8000)))}, nil, true},
+		{"port 0", []networkingv1.NetworkPolicyPort{tcpPort(0, nil)}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := policyPorts(tt.ports)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v , want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s = %+v , want %+v", tt.name, got, tt.want)
+		}
+	}
+}
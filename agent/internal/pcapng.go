@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// pcapng blocks and options written by pcapngWriter
+const (
+	pcapngSectionHeader  = 0x0A0D0D0A
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1A2B3C4D
+
+	pcapngOptEnd      = 0
+	pcapngOptComment  = 1
+	pcapngOptUserAppl = 4 // shb_userappl
+	pcapngOptIfName   = 2 // if_name
+	pcapngOptTsresol  = 9 // if_tsresol
+	pcapngOptEpbFlags = 2 // epb_flags
+
+	// epb_flags direction bits
+	pcapngInbound  = 1
+	pcapngOutbound = 2
+
+	linktypeEthernet = 1
+)
+
+// errPcapngFull is returned for a block that would make the file larger than its limit
+var errPcapngFull = errors.New("pcapng file is full")
+
+// pcapngWriter writes one little endian pcapng section , packet timestamps are in nanoseconds
+type pcapngWriter struct {
+	w     *bufio.Writer
+	size  int64
+	limit int64 // no limit when 0
+}
+
+func newPcapngWriter(w io.Writer, app string, limit int64) (*pcapngWriter, error) {
+	p := &pcapngWriter{w: bufio.NewWriter(w), limit: limit}
+	body := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	body = binary.LittleEndian.AppendUint16(body, 1) // version 1.0
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = binary.LittleEndian.AppendUint64(body, ^uint64(0)) // section length not known
+	body = appendPcapngOption(body, pcapngOptUserAppl, []byte(app))
+	body = appendPcapngOption(body, pcapngOptEnd, nil)
+	return p, p.block(pcapngSectionHeader, body)
+}
+
+// addInterface describes the next interface , the first one gets id 0
+func (p *pcapngWriter) addInterface(name string, snaplen uint32) error {
+	body := binary.LittleEndian.AppendUint16(nil, linktypeEthernet)
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = binary.LittleEndian.AppendUint32(body, snaplen)
+	body = appendPcapngOption(body, pcapngOptIfName, []byte(name))
+	body = appendPcapngOption(body, pcapngOptTsresol, []byte{9})
+	body = appendPcapngOption(body, pcapngOptEnd, nil)
+	return p.block(pcapngInterface, body)
+}
+
+// packet writes an enhanced packet block , flags and comment are left out when empty
+func (p *pcapngWriter) packet(iface uint32, ts time.Time, data []byte, origLen uint32, flags uint32, comment string) error {
+	ns := uint64(ts.UnixNano())
+	body := binary.LittleEndian.AppendUint32(nil, iface)
+	body = binary.LittleEndian.AppendUint32(body, uint32(ns>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ns))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(data)))
+	body = binary.LittleEndian.AppendUint32(body, origLen)
+	body = append(body, data...)
+	body = padPcapng(body)
+	if flags != 0 {
+		body = appendPcapngOption(body, pcapngOptEpbFlags, binary.LittleEndian.AppendUint32(nil, flags))
+	}
+	if comment != "" {
+		body = appendPcapngOption(body, pcapngOptComment, []byte(comment))
+	}
+	if flags != 0 || comment != "" {
+		body = appendPcapngOption(body, pcapngOptEnd, nil)
+	}
+	return p.block(pcapngEnhancedPacket, body)
+}
+
+// block writes the type , the total length around body , body must be padded to 4 bytes
+func (p *pcapngWriter) block(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	if p.limit > 0 && p.size+int64(total) > p.limit {
+		return errPcapngFull
+	}
+	buf := binary.LittleEndian.AppendUint32(make([]byte, 0, total), blockType)
+	buf = binary.LittleEndian.AppendUint32(buf, total)
+	buf = append(buf, body...)
+	buf = binary.LittleEndian.AppendUint32(buf, total)
+	if _, err := p.w.Write(buf); err != nil {
+		return err
+	}
+	p.size += int64(total)
+	return nil
+}
+
+func (p *pcapngWriter) Flush() error {
+	return p.w.Flush()
+}
+
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return padPcapng(append(b, value...))
+}
+
+func padPcapng(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+// readPcapng splits a file into its blocks , checking both lengths of each
+func readPcapng(t *testing.T, b []byte) []pcapngBlock {
+	t.Helper()
+	var blocks []pcapngBlock
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("%d bytes left , less than a block", len(b))
+		}
+		total := binary.LittleEndian.Uint32(b[4:])
+		if total%4 != 0 || int(total) > len(b) {
+			t.Fatalf("block length %d , %d bytes left", total, len(b))
+		}
+		if trailer := binary.LittleEndian.Uint32(b[total-4:]); trailer != total {
+			t.Fatalf("block length %d , trailer says %d", total, trailer)
+		}
+		blocks = append(blocks, pcapngBlock{binary.LittleEndian.Uint32(b), b[8 : total-4]})
+		b = b[total:]
+	}
+	return blocks
+}
+
+// readOptions returns the options of a block body by code , checking they end with opt_endofopt
+func readOptions(t *testing.T, b []byte) map[uint16][]byte {
+	t.Helper()
+	options := make(map[uint16][]byte)
+	for len(b) >= 4 {
+		code, length := binary.LittleEndian.Uint16(b), binary.LittleEndian.Uint16(b[2:])
+		if code == pcapngOptEnd {
+			return options
+		}
+		padded := (int(length) + 3) &^ 3
+		if 4+padded > len(b) {
+			t.Fatalf("option %d of %d bytes overruns the block", code, length)
+		}
+		options[code] = b[4 : 4+length]
+		b = b[4+padded:]
+	}
+	t.Fatalf("options without opt_endofopt")
+	return nil
+}
+
+func TestPcapngWriter(t *testing.T) {
+	ts := time.Unix(1700000000, 123456789)
+	tests := []struct {
+		name    string
+		data    []byte
+		origLen uint32
+		flags   uint32
+		comment string
+	}{
+		{"no options", []byte{1, 2, 3, 4}, 4, 0, ""},
+		{"padded data", []byte{1, 2, 3, 4, 5}, 1500, 0, ""},
+		{"flags", []byte{0xaa}, 1, pcapngInbound, ""},
+		{"flags and comment", []byte{0xbb, 0xcc}, 2, pcapngOutbound, "dropped by rule 7"},
+		{"comment", nil, 60, 0, "denied by lockdown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := newPcapngWriter(&buf, "test", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.addInterface("shop/web", 128); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.packet(0, ts, tt.data, tt.origLen, tt.flags, tt.comment); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if int64(buf.Len()) != w.size {
+				t.Errorf("wrote %d bytes , size says %d", buf.Len(), w.size)
+			}
+
+			blocks := readPcapng(t, buf.Bytes())
+			if len(blocks) != 3 {
+				t.Fatalf("%d blocks , want 3", len(blocks))
+			}
+
+			shb := blocks[0]
+			if shb.blockType != pcapngSectionHeader || binary.LittleEndian.Uint32(shb.body) != pcapngByteOrderMagic {
+				t.Errorf("section header = %x", shb.body)
+			}
+			if app := readOptions(t, shb.body[16:])[pcapngOptUserAppl]; string(app) != "test" {
+				t.Errorf("shb_userappl = %q", app)
+			}
+
+			idb := blocks[1]
+			if idb.blockType != pcapngInterface || binary.LittleEndian.Uint16(idb.body) != linktypeEthernet ||
+				binary.LittleEndian.Uint32(idb.body[4:]) != 128 {
+				t.Errorf("interface = %x", idb.body)
+			}
+			options := readOptions(t, idb.body[8:])
+			if string(options[pcapngOptIfName]) != "shop/web" || !bytes.Equal(options[pcapngOptTsresol], []byte{9}) {
+				t.Errorf("interface options = %q", options)
+			}
+
+			epb := blocks[2]
+			if epb.blockType != pcapngEnhancedPacket {
+				t.Fatalf("block type %x , want an enhanced packet", epb.blockType)
+			}
+			le := binary.LittleEndian
+			ns := uint64(le.Uint32(epb.body[4:]))<<32 | uint64(le.Uint32(epb.body[8:]))
+			caplen, origLen := le.Uint32(epb.body[12:]), le.Uint32(epb.body[16:])
+			if le.Uint32(epb.body) != 0 || ns != uint64(ts.UnixNano()) || caplen != uint32(len(tt.data)) || origLen != tt.origLen {
+				t.Errorf("packet header: iface %d , ts %d , caplen %d , len %d", le.Uint32(epb.body), ns, caplen, origLen)
+			}
+			if data := epb.body[20 : 20+caplen]; !bytes.Equal(data, tt.data) {
+				t.Errorf("data = %x , want %x", data, tt.data)
+			}
+			rest := epb.body[20+(caplen+3)&^3:]
+			if tt.flags == 0 && tt.comment == "" {
+				if len(rest) != 0 {
+					t.Errorf("options %x , want none", rest)
+				}
+				return
+			}
+			options = readOptions(t, rest)
+			if flags, ok := options[pcapngOptEpbFlags]; (tt.flags != 0) != ok || (ok && le.Uint32(flags) != tt.flags) {
+				t.Errorf("epb_flags = %x , want %d", flags, tt.flags)
+			}
+			if comment := options[pcapngOptComment]; string(comment) != tt.comment {
+				t.Errorf("comment = %q , want %q", comment, tt.comment)
+			}
+		})
+	}
+}
+
+func TestPcapngWriterLimit(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := newPcapngWriter(&buf, "test", 16); !errors.Is(err, errPcapngFull) {
+		t.Fatalf("section header over the limit: err = %v", err)
+	}
+
+	w, err := newPcapngWriter(&buf, "test", 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.addInterface("eth0", 128); err != nil {
+		t.Fatal(err)
+	}
+	packets := 0
+	for {
+		err := w.packet(0, time.Now(), make([]byte, 20), 20, 0, "")
+		if errors.Is(err, errPcapngFull) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets++
+	}
+	w.Flush()
+	if w.size > 200 || int64(buf.Len()) != w.size {
+		t.Errorf("size %d , wrote %d , limit 200", w.size, buf.Len())
+	}
+	// header 32 + interface 40 + packets of 52 bytes
+	if packets != 2 {
+		t.Errorf("%d packets fit , want 2", packets)
+	}
+	if blocks := readPcapng(t, buf.Bytes()); len(blocks) != 2+packets {
+		t.Errorf("%d blocks , want %d", len(blocks), 2+packets)
+	}
+}
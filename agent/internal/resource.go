@@ -211,7 +211,89 @@ func GetDiskIOUsage(containerID string, pid int) (*logs.DiskIOUsage, error) {
 }
 
 
-func StartResourceCollector(logCh chan logs.Producer_msg) {
+var (
+	resourceRules   logs.ResourceRules
+	resourceRulesMu sync.RWMutex
+)
+
+// LoadResourceRules replaces the active resource rule set
+func LoadResourceRules(rules logs.ResourceRules) error {
+	resourceRulesMu.Lock()
+	resourceRules = rules
+	resourceRulesMu.Unlock()
+	fmt.Printf(" Loaded resource rules: %d memory, %d disk, %d cpu\n", len(rules.Memory), len(rules.Disk), len(rules.CPU))
+	return nil
+}
+
+func ruleApplies(ruleUID string, action int, container kube.ContainerMapping) bool {
+	return action != 0 && (ruleUID == "" || ruleUID == container.UID)
+}
+
+// checkMemoryRules returns an alert for every memory rule the sample exceeds
+func checkMemoryRules(container kube.ContainerMapping, cur *logs.MemoryUsage) []string {
+	resourceRulesMu.RLock()
+	defer resourceRulesMu.RUnlock()
+
+	var alerts []string
+	for _, r := range resourceRules.Memory {
+		if !ruleApplies(r.UID, r.Action, container) {
+			continue
+		}
+		if (r.UsedMemory > 0 && cur.UsedMemory > r.UsedMemory) ||
+			(r.RSS > 0 && cur.RSS > r.RSS) ||
+			(r.MemoryUsageRate > 0 && cur.MemoryUsageRate > r.MemoryUsageRate) {
+			alerts = append(alerts, fmt.Sprintf("🚨 Memory rule exceeded [Pod=%s/%s] used=%d bytes rate=%.2f%%",
+				container.Namespace, container.PodName, cur.UsedMemory, cur.MemoryUsageRate*100))
+		}
+	}
+	return alerts
+}
+
+// checkCPURules compares the tracked CPU usage (in cores) against the CPU rules
+func checkCPURules(container kube.ContainerMapping, cur *logs.CPUUsage) []string {
+	resourceRulesMu.RLock()
+	defer resourceRulesMu.RUnlock()
+
+	tracker, _ := utils.GetCPUTracker(container.UID)
+	cores := tracker.CPUUsage / 1e9
+
+	var alerts []string
+	for _, r := range resourceRules.CPU {
+		if !ruleApplies(r.UID, r.Action, container) {
+			continue
+		}
+		if (r.CPUUsageRate > 0 && cores > r.CPUUsageRate) ||
+			(r.CPUTime > 0 && cur.CPUTime > r.CPUTime) {
+			alerts = append(alerts, fmt.Sprintf("🚨 CPU rule exceeded [Pod=%s/%s] usage=%.2f cores",
+				container.Namespace, container.PodName, cores))
+		}
+	}
+	return alerts
+}
+
+// checkDiskRules compares the tracked disk throughput (bytes/sec) against the disk rules
+func checkDiskRules(container kube.ContainerMapping, cur *logs.DiskIOUsage) []string {
+	resourceRulesMu.RLock()
+	defer resourceRulesMu.RUnlock()
+
+	tracker, _ := utils.GetDiskTracker(container.UID)
+
+	var alerts []string
+	for _, r := range resourceRules.Disk {
+		if !ruleApplies(r.UID, r.Action, container) {
+			continue
+		}
+		if (r.DiskUsageRate > 0 && tracker.DiskIOUsage > r.DiskUsageRate) ||
+			(r.DiskReadBytes > 0 && cur.DiskReadBytes > r.DiskReadBytes) ||
+			(r.DiskWriteBytes > 0 && cur.DiskWriteBytes > r.DiskWriteBytes) {
+			alerts = append(alerts, fmt.Sprintf("🚨 Disk rule exceeded [Pod=%s/%s] throughput=%.0f bytes/s",
+				container.Namespace, container.PodName, tracker.DiskIOUsage))
+		}
+	}
+	return alerts
+}
+
+func StartResourceCollector(logCh chan logs.Producer_msg, ResourceCh chan logs.ResourceRule_cmd) {
 	mappingCh := make(chan struct{}, 1) // Buffered so sender never blocks
 
 	go func() {
@@ -226,31 +308,46 @@ func StartResourceCollector(logCh chan logs.Producer_msg) {
 			case <-mappingCh:
 				mappings = kube.GetCurrentMapping()
 
+			case cmd := <-ResourceCh:
+				cmd.Result <- LoadResourceRules(cmd.Rules)
+
 			case <-ticker.C:
 				for _, m := range mappings {
+					var alerts []string
+
 					if cpu, err := CollectAndUpdateCPU(m, m.PID); err != nil {
 						fmt.Printf(" CPU update failed for %s: %v\n", m.ContainerID, err)
 					} else {
 						logCh <- logs.Producer_msg{
-							Body: logs.Encode_string(cpu),
+							Body: logs.Encode_string(cpu.String()),
 							Id:   1,
 						}
+						alerts = append(alerts, checkCPURules(m, cpu)...)
 					}
 
 					if mem, err := CollectAndUpdateMemory(m, m.PID); err != nil {
 						fmt.Printf(" Memory update failed for %s: %v\n", m.ContainerID, err)
 					} else {
 						logCh <- logs.Producer_msg{
-							Body: logs.Encode_string(mem),
+							Body: logs.Encode_string(mem.String()),
 							Id:   1,
 						}
+						alerts = append(alerts, checkMemoryRules(m, mem)...)
 					}
 
 					if disk, err := CollectAndUpdateDisk(m, m.PID); err != nil {
 						fmt.Printf(" Disk update failed for %s: %v\n", m.ContainerID, err)
 					} else {
 						logCh <- logs.Producer_msg{
-							Body: logs.Encode_string(disk),
+							Body: logs.Encode_string(disk.String()),
+							Id:   1,
+						}
+						alerts = append(alerts, checkDiskRules(m, disk)...)
+					}
+
+					for _, alert := range alerts {
+						logCh <- logs.Producer_msg{
+							Body: logs.Encode_string(alert),
 							Id:   1,
 						}
 					}
@@ -275,11 +372,11 @@ func StartResourceCollector(logCh chan logs.Producer_msg) {
 	}()
 }
 
-func CollectAndUpdateCPU(container kube.ContainerMapping , pid int) (string,error){
+func CollectAndUpdateCPU(container kube.ContainerMapping , pid int) (*logs.CPUUsage,error){
 	cur, err := GetCPUUsage(container.ContainerID, pid)
 	if err != nil {
 		fmt.Printf(" CPU collect error for %s: %v", container.ContainerID, err)
-		return "",err
+		return nil,err
 	}
 	
 
@@ -297,14 +394,14 @@ func CollectAndUpdateCPU(container kube.ContainerMapping , pid int) (string,erro
 
 
 	
-	return cur.String() , nil
+	return cur , nil
 }
 
-func CollectAndUpdateDisk(container kube.ContainerMapping, pid int) (string,error) {
+func CollectAndUpdateDisk(container kube.ContainerMapping, pid int) (*logs.DiskIOUsage,error) {
 	cur, err := GetDiskIOUsage(container.ContainerID, pid)
 	if err != nil {
 		fmt.Printf(" Disk I/O collect error for %s: %v\n", container.ContainerID, err)
-		return "" , err
+		return nil , err
 	}
 	
 
@@ -318,15 +415,15 @@ func CollectAndUpdateDisk(container kube.ContainerMapping, pid int) (string,erro
 	// send to server
 	
 
-	return cur.String() , nil
+	return cur , nil
 }
 
 
-func CollectAndUpdateMemory(container kube.ContainerMapping, pid int) (string,error){
+func CollectAndUpdateMemory(container kube.ContainerMapping, pid int) (*logs.MemoryUsage,error){
 	cur, err := GetMemoryUsage(container.ContainerID, pid)
 	if err != nil {
 		fmt.Printf(" Memory collect error for %s: %v\n", container.ContainerID, err)
-		return "",err
+		return nil,err
 	}
 	utils.Update_uid_Map(container.UID , container)
 	utils.Update_memory_Tracker(container.UID , logs.MemoryTracker{
@@ -337,5 +434,5 @@ func CollectAndUpdateMemory(container kube.ContainerMapping, pid int) (string,er
 
 	
 
-	return cur.String() , nil
+	return cur , nil
 }
\ No newline at end of file
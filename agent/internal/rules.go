@@ -4,9 +4,6 @@ import(
 	"net"
 	"fmt"
 	"encoding/binary"
-	"agent/pkg/logs"
-	"github.com/cilium/ebpf"
-	"log"
 )
 
 
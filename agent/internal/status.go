@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"agent/pkg/config"
+	"agent/pkg/identity"
+	"agent/pkg/kube"
+	"agent/pkg/logs"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// ringbufCounters are updated by the ring buffer readers and reported in the heartbeat
+type ringbufCounters struct {
+	read         atomic.Uint64
+	readErrors   atomic.Uint64
+	decodeErrors atomic.Uint64
+	dropped      atomic.Uint64
+	timedOut     atomic.Uint64
+}
+
+func (c *ringbufCounters) snapshot() logs.Ringbuf_stats {
+	return logs.Ringbuf_stats{
+		Read:         c.read.Load(),
+		ReadErrors:   c.readErrors.Load(),
+		DecodeErrors: c.decodeErrors.Load(),
+		Dropped:      c.dropped.Load(),
+		TimedOut:     c.timedOut.Load(),
+	}
+}
+
+// sendLowPriority hands a low priority record to the producer unless it is behind. A reader
+// waiting on logCh lets its ring buffer fill up , and BPF then loses records of any priority.
+func sendLowPriority(logCh chan<- logs.Producer_msg, msg logs.Producer_msg, counters *ringbufCounters) {
+	select {
+	case logCh <- msg:
+	default:
+		counters.dropped.Add(1)
+	}
+}
+
+// highPriorityWait bounds how long a reader waits on the producer for a high priority record
+const highPriorityWait = 250 * time.Millisecond
+
+// sendHighPriority hands a record to the producer , waiting at most highPriorityWait for it to
+// catch up. A record it gives up on is counted , so a stalled producer costs records we know of
+// instead of the whole ring buffer.
+func sendHighPriority(logCh chan<- logs.Producer_msg, msg logs.Producer_msg, counters *ringbufCounters) {
+	select {
+	case logCh <- msg:
+		return
+	default:
+	}
+	timer := time.NewTimer(highPriorityWait)
+	defer timer.Stop()
+	select {
+	case logCh <- msg:
+	case <-timer.C:
+		counters.timedOut.Add(1)
+	}
+}
+
+// dropCounters are the per-CPU counters BPF keeps of the records a ring buffer lost , and the program of each key
+type dropCounters struct {
+	m        *ebpf.Map
+	programs map[uint32]string
+}
+
+// read adds the counters of every CPU to stats
+func (d dropCounters) read(stats *logs.Ringbuf_stats) {
+	stats.Full = make(map[string]uint64)
+	stats.Shed = make(map[string]uint64)
+	for key, program := range d.programs {
+		var perCPU []logs.Ringbuf_drops
+		if err := d.m.Lookup(key, &perCPU); err != nil {
+			log.Printf(" Failed to read the drop counters of %s: %v", program, err)
+			continue
+		}
+		total := sumDrops(perCPU)
+		stats.Full[program] += total.Full
+		stats.Shed[program] += total.Shed
+	}
+}
+
+// sumDrops adds up the counters of every CPU
+func sumDrops(perCPU []logs.Ringbuf_drops) logs.Ringbuf_drops {
+	var total logs.Ringbuf_drops
+	for _, c := range perCPU {
+		total.Full += c.Full
+		total.Shed += c.Shed
+	}
+	return total
+}
+
+// readUnparsed adds the unparsed packet counters of every CPU , by program
+func readUnparsed(m *ebpf.Map, programs map[uint32]string) map[string]logs.Unparsed_packets {
+	unparsed := make(map[string]logs.Unparsed_packets)
+	for key, program := range programs {
+		var perCPU []logs.Unparsed_packets
+		if err := m.Lookup(key, &perCPU); err != nil {
+			log.Printf(" Failed to read the unparsed packets of %s: %v", program, err)
+			continue
+		}
+		unparsed[program] = sumUnparsed(perCPU)
+	}
+	return unparsed
+}
+
+// sumUnparsed adds up the counters of every CPU
+func sumUnparsed(perCPU []logs.Unparsed_packets) logs.Unparsed_packets {
+	var total logs.Unparsed_packets
+	for _, c := range perCPU {
+		total.Passed += c.Passed
+		total.Dropped += c.Dropped
+	}
+	return total
+}
+
+var (
+	trafficRingbuf ringbufCounters
+	dnsRingbuf     ringbufCounters
+	syscallRingbuf ringbufCounters
+
+	statusMu       sync.RWMutex
+	activeTracker  *LinkTracker
+	loadedPrograms = make(map[string]*ebpf.Program)
+	// drop counters by ring buffer
+	ringbufDrops = make(map[string]dropCounters)
+	// unparsed packet counters of the traffic programs
+	unparsedPackets dropCounters
+)
+
+// recordProgram remembers a loaded program so the heartbeat can report it
+func recordProgram(name string, prog *ebpf.Program) {
+	if prog == nil {
+		return
+	}
+	statusMu.Lock()
+	loadedPrograms[name] = prog
+	statusMu.Unlock()
+}
+
+// recordDropCounters makes the heartbeat report the drop counters of a ring buffer
+func recordDropCounters(ringbuf string, m *ebpf.Map, programs map[uint32]string) {
+	if m == nil {
+		return
+	}
+	statusMu.Lock()
+	ringbufDrops[ringbuf] = dropCounters{m: m, programs: programs}
+	statusMu.Unlock()
+}
+
+// recordUnparsedCounters makes the heartbeat report the packets the traffic programs could not parse
+func recordUnparsedCounters(m *ebpf.Map, programs map[uint32]string) {
+	if m == nil {
+		return
+	}
+	statusMu.Lock()
+	unparsedPackets = dropCounters{m: m, programs: programs}
+	statusMu.Unlock()
+}
+
+var flowRuleStats atomic.Pointer[logs.Flow_rule_stats]
+
+func setFlowRuleStats(stats logs.Flow_rule_stats) {
+	flowRuleStats.Store(&stats)
+}
+
+func setActiveTracker(tracker *LinkTracker) {
+	statusMu.Lock()
+	activeTracker = tracker
+	statusMu.Unlock()
+}
+
+func kernelVersion() string {
+	data, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// BuildHeartbeat snapshots the agent's current state
+func BuildHeartbeat() logs.Heartbeat {
+	self := identity.Get()
+	hb := logs.Heartbeat{
+		AgentID:             self.ID,
+		NodeName:            self.NodeName,
+		Version:             self.Version,
+		KernelVersion:       kernelVersion(),
+		Interfaces:          []string{},
+		Programs:            []logs.BPF_program{},
+		MonitoredContainers: len(kube.GetCurrentMapping()),
+		Ringbufs: map[string]logs.Ringbuf_stats{
+			"events":         trafficRingbuf.snapshot(),
+			"dns_events":     dnsRingbuf.snapshot(),
+			"syscall_events": syscallRingbuf.snapshot(),
+		},
+		Spool:           logs.Producer_stats(),
+		FlowRules:       flowRuleStats.Load(),
+		Lockdown:        lockdownModes(),
+		FQDNRules:       fqdnStatus(),
+		IntervalSeconds: int(config.Get().Agent.HeartbeatInterval / time.Second),
+		Timestamp:       time.Now(),
+	}
+
+	statusMu.RLock()
+	defer statusMu.RUnlock()
+
+	if activeTracker != nil {
+		hb.Interfaces = activeTracker.GetAttachedInterfaces()
+		sort.Strings(hb.Interfaces)
+	}
+	for name, drops := range ringbufDrops {
+		stats := hb.Ringbufs[name]
+		drops.read(&stats)
+		hb.Ringbufs[name] = stats
+	}
+	if unparsedPackets.m != nil {
+		hb.Unparsed = readUnparsed(unparsedPackets.m, unparsedPackets.programs)
+	}
+	for name, prog := range loadedPrograms {
+		p := logs.BPF_program{Name: name}
+		if info, err := prog.Info(); err == nil {
+			if id, ok := info.ID(); ok {
+				p.ID = uint32(id)
+			}
+		}
+		hb.Programs = append(hb.Programs, p)
+	}
+	sort.Slice(hb.Programs, func(i, j int) bool { return hb.Programs[i].Name < hb.Programs[j].Name })
+
+	return hb
+}
+
+// StartHeartbeat publishes a heartbeat right away and then every agent.heartbeat_interval
+func StartHeartbeat(logCh chan logs.Producer_msg) {
+	log.Println(" Starting heartbeat...")
+	ticker := time.NewTicker(config.Get().Agent.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		logCh <- logs.Producer_msg{
+			Body: BuildHeartbeat().Encode(),
+			Id:   5,
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"agent/pkg/logs"
+	"testing"
+)
+
+func TestSumDrops(t *testing.T) {
+	tests := []struct {
+		name   string
+		perCPU []logs.Ringbuf_drops
+		want   logs.Ringbuf_drops
+	}{
+		{"no CPUs", nil, logs.Ringbuf_drops{}},
+		{"one CPU", []logs.Ringbuf_drops{{Full: 3, Shed: 7}}, logs.Ringbuf_drops{Full: 3, Shed: 7}},
+		{"every CPU counts", []logs.Ringbuf_drops{{Full: 1, Shed: 0}, {Full: 0, Shed: 5}, {Full: 2, Shed: 2}, {}}, logs.Ringbuf_drops{Full: 3, Shed: 7}},
+		{"large counters", []logs.Ringbuf_drops{{Full: 1 << 40, Shed: 1 << 41}, {Full: 1 << 40, Shed: 1}}, logs.Ringbuf_drops{Full: 1 << 41, Shed: 1<<41 + 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sumDrops(tt.perCPU); got != tt.want {
+				t.Errorf("sumDrops() = %+v , want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSumUnparsed(t *testing.T) {
+	tests := []struct {
+		name   string
+		perCPU []logs.Unparsed_packets
+		want   logs.Unparsed_packets
+	}{
+		{"no CPUs", nil, logs.Unparsed_packets{}},
+		{"every CPU counts", []logs.Unparsed_packets{{Passed: 2}, {Dropped: 3}, {Passed: 1, Dropped: 1}}, logs.Unparsed_packets{Passed: 3, Dropped: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sumUnparsed(tt.perCPU); got != tt.want {
+				t.Errorf("sumUnparsed() = %+v , want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendPriorities(t *testing.T) {
+	tests := []struct {
+		name         string
+		buffer       int
+		send         func(chan<- logs.Producer_msg, logs.Producer_msg, *ringbufCounters)
+		wantSent     int
+		wantDropped  uint64
+		wantTimedOut uint64
+	}{
+		{"low priority with room", 1, sendLowPriority, 1, 0, 0},
+		{"low priority behind", 0, sendLowPriority, 0, 1, 0},
+		{"high priority with room", 1, sendHighPriority, 1, 0, 0},
+		{"high priority stalled", 0, sendHighPriority, 0, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var counters ringbufCounters
+			logCh := make(chan logs.Producer_msg, tt.buffer)
+			tt.send(logCh, logs.Producer_msg{Id: 1}, &counters)
+			if len(logCh) != tt.wantSent {
+				t.Errorf("sent %d , want %d", len(logCh), tt.wantSent)
+			}
+			stats := counters.snapshot()
+			if stats.Dropped != tt.wantDropped || stats.TimedOut != tt.wantTimedOut {
+				t.Errorf("dropped %d , timed out %d , want %d and %d", stats.Dropped, stats.TimedOut, tt.wantDropped, tt.wantTimedOut)
+			}
+		})
+	}
+}
+
+func TestSendHighPriorityWaits(t *testing.T) {
+	var counters ringbufCounters
+	logCh := make(chan logs.Producer_msg)
+	received := make(chan logs.Producer_msg)
+	go func() { received <- <-logCh }()
+
+	sendHighPriority(logCh, logs.Producer_msg{Id: 7}, &counters)
+	if msg := <-received; msg.Id != 7 {
+		t.Errorf("received message %d , want 7", msg.Id)
+	}
+	if timedOut := counters.timedOut.Load(); timedOut != 0 {
+		t.Errorf("timed out %d , want 0", timedOut)
+	}
+}
@@ -3,8 +3,12 @@ package internal
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"log"
+	"strings"
+	"sync"
 
+	"agent/pkg/config"
 	"agent/pkg/kube"
 	"agent/pkg/logs"
 	"agent/pkg/utils"
@@ -19,8 +23,56 @@ import (
 	
 
 
-func StartSyscallReader(logCh chan logs.Producer_msg ,Sysch chan , ) {
-	spec, err := ebpf.LoadCollectionSpec("bpf/syscalls.bpf.o")
+var (
+	syscallRules   []logs.SyscallEventRule
+	syscallRulesMu sync.RWMutex
+)
+
+// LoadSyscallRules replaces the active syscall rule set
+func LoadSyscallRules(rules []logs.SyscallEventRule) error {
+	for i, r := range rules {
+		if r.Action < 0 || r.Action > 2 {
+			return fmt.Errorf("rule %d: unknown action %d", i, r.Action)
+		}
+	}
+	syscallRulesMu.Lock()
+	syscallRules = rules
+	syscallRulesMu.Unlock()
+	log.Printf(" Loaded %d syscall rules", len(rules))
+	return nil
+}
+
+// matchSyscallRule returns the first enabled rule matching the event
+func matchSyscallRule(event logs.RawSyscallEvent) (logs.SyscallEventRule, bool) {
+	syscallRulesMu.RLock()
+	defer syscallRulesMu.RUnlock()
+
+	comm := string(bytes.TrimRight(event.Comm[:], "\x00"))
+	filename := string(bytes.TrimRight(event.Filename[:], "\x00"))
+
+	for _, r := range syscallRules {
+		if r.Action == 0 {
+			continue
+		}
+		if r.Type != 0 && r.Type != event.Type {
+			continue
+		}
+		if r.Pid != 0 && r.Pid != event.Pid {
+			continue
+		}
+		if r.Comm != "" && r.Comm != comm {
+			continue
+		}
+		if r.Filename != "" && !strings.HasPrefix(filename, r.Filename) {
+			continue
+		}
+		return r, true
+	}
+	return logs.SyscallEventRule{}, false
+}
+
+func StartSyscallReader(logCh chan logs.Producer_msg , SyscallCh chan logs.SyscallRule_cmd) {
+	spec, err := ebpf.LoadCollectionSpec(config.Get().BPF.SyscallsObject)
 	if err != nil {
 		log.Fatalf("❌ Failed to load BPF spec: %v", err)
 	}
@@ -36,12 +88,28 @@ func StartSyscallReader(logCh chan logs.Producer_msg ,Sysch chan , ) {
 		LogSocket     *ebpf.Program `ebpf:"log_socket"`
 		LogConnect    *ebpf.Program `ebpf:"log_connect"`
 		SyscallEvents *ebpf.Map     `ebpf:"syscall_events"`
+		SyscallDrops  *ebpf.Map     `ebpf:"syscall_drops"`
 	}{}
 
 	if err := spec.LoadAndAssign(&objs, nil); err != nil {
 		log.Fatalf("❌ Failed to assign BPF programs: %v", err)
 	}
 	defer objs.SyscallEvents.Close()
+	defer objs.SyscallDrops.Close()
+	recordProgram("log_execve", objs.LogExecve)
+	recordProgram("log_execveat", objs.LogExecveat)
+	recordProgram("log_open", objs.LogOpen)
+	recordProgram("log_unlink", objs.LogUnlink)
+	recordProgram("log_chmod", objs.LogChmod)
+	recordProgram("log_mount", objs.LogMount)
+	recordProgram("log_setuid", objs.LogSetuid)
+	recordProgram("log_socket", objs.LogSocket)
+	recordProgram("log_connect", objs.LogConnect)
+	// the drop counters are keyed by the event type of the program
+	recordDropCounters("syscall_events", objs.SyscallDrops, map[uint32]string{
+		1: "log_execve", 2: "log_execveat", 3: "log_open", 4: "log_unlink", 5: "log_chmod",
+		6: "log_mount", 7: "log_setuid", 8: "log_socket", 9: "log_connect",
+	})
 
 	// Attach tracepoints
 	links := []link.Link{}
@@ -75,16 +143,25 @@ func StartSyscallReader(logCh chan logs.Producer_msg ,Sysch chan , ) {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt)
 
+	go func() {
+		for cmd := range SyscallCh {
+			cmd.Result <- LoadSyscallRules(cmd.Rules)
+		}
+	}()
+
 	go func() {
 		for {
 			record, err := rd.Read()
 			if err != nil {
+				syscallRingbuf.readErrors.Add(1)
 				log.Printf("⚠️ Ringbuf read error: %v", err)
 				return
 			}
+			syscallRingbuf.read.Add(1)
 
 			var event logs.RawSyscallEvent
 			if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &event); err != nil {
+				syscallRingbuf.decodeErrors.Add(1)
 				log.Printf("❌ Decode error: %v", err)
 				continue
 			}
@@ -96,10 +173,24 @@ func StartSyscallReader(logCh chan logs.Producer_msg ,Sysch chan , ) {
 			}
 			utils.Update_uid_Map(container.UID , container)
 			utils.Update_syscall_Tracker(container.UID)
-			logCh <- logs.Producer_msg{
+			msg := logs.Producer_msg{
 				Body: logs.Encode_string(event.String()),
 				Id: 1,
-			}			
+			}
+			if event.Type == logs.SYSCALL_OPEN {
+				sendLowPriority(logCh, msg, &syscallRingbuf)
+			} else {
+				sendHighPriority(logCh, msg, &syscallRingbuf)
+			}
+
+			if _, ok := matchSyscallRule(event); ok {
+				alert := fmt.Sprintf("🚨 Syscall rule matched [Pod=%s/%s] %s", container.Namespace, container.PodName, event.String())
+				log.Println(alert)
+				sendHighPriority(logCh, logs.Producer_msg{
+					Body: logs.Encode_string(alert),
+					Id: 1,
+				}, &syscallRingbuf)
+			}
 		}
 	}()
 
@@ -1,13 +1,15 @@
 package internal
 
 import (
+	"agent/pkg/config"
 	"agent/pkg/kube"
 	"agent/pkg/logs"
-	"agent/pkg/utils"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"context"
@@ -16,25 +18,21 @@ import (
 	"syscall"
 
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/perf"
 	"github.com/cilium/ebpf/ringbuf"
 )
 
 
 
 
-func StartTrraficCollector(logCh chan logs.Producer_msg , NetworkCh chan []logs.FlowRule) {
+func StartTrraficCollector(logCh chan logs.Producer_msg , NetworkCh chan logs.FlowRule_cmd , LockdownCh chan logs.Lockdown_cmd , CaptureCh chan logs.Capture_cmd) {
 	// Load eBPF program
-	spec, err := ebpf.LoadCollectionSpec("bpf/traffic.bpf.o")
+	spec, err := ebpf.LoadCollectionSpec(config.Get().BPF.TrafficObject)
 	if err != nil {
 		log.Fatalf(" LoadCollectionSpec: %v", err)
 	}
 	
-	objs := struct {
-		TcIngress *ebpf.Program `ebpf:"tc_ingress"`
-		TcEgress  *ebpf.Program `ebpf:"tc_egress"`
-		FlowRules *ebpf.Map `ebpf:"flow_rules"` 
-		Events    *ebpf.Map     `ebpf:"events"`
-	}{}
+	objs := trafficObjects{}
 	
 	if err := spec.LoadAndAssign(&objs, nil); err != nil {
 		log.Fatalf(" LoadAndAssign: %v", err)
@@ -43,15 +41,47 @@ func StartTrraficCollector(logCh chan logs.Producer_msg , NetworkCh chan []logs.
 	defer objs.TcEgress.Close()
 	defer objs.Events.Close()
 	defer objs.FlowRules.Close()
+	defer objs.Exact.Close()
+	defer objs.Port.Close()
+	defer objs.SrcCidrs.Close()
+	defer objs.DstCidrs.Close()
+	defer objs.Fallback.Close()
+	defer objs.RuleState.Close()
+	defer objs.RateLimits.Close()
+	defer objs.RuleScopes.Close()
+	defer objs.LockdownIfaces.Close()
+	defer objs.EgressAllow.Close()
+	defer objs.EventScratch.Close()
+	defer objs.TrafficConfig.Close()
+	defer objs.Flows.Close()
+	defer objs.Conns.Close()
+	defer objs.DnsEvents.Close()
+	defer objs.FqdnIPs.Close()
+	defer objs.CaptureTargets.Close()
+	defer objs.CaptureEvents.Close()
+	defer objs.EventDrops.Close()
+	defer objs.DnsDrops.Close()
+	defer objs.UnparsedPackets.Close()
+	recordProgram("tc_ingress", objs.TcIngress)
+	recordProgram("tc_egress", objs.TcEgress)
+	// the drop counters are keyed by the direction the program sees
+	tcPrograms := map[uint32]string{logs.DIR_TO_POD: "tc_egress", logs.DIR_FROM_POD: "tc_ingress"}
+	recordDropCounters("events", objs.EventDrops, tcPrograms)
+	recordDropCounters("dns_events", objs.DnsDrops, tcPrograms)
+	recordUnparsedCounters(objs.UnparsedPackets, tcPrograms)
+
+	if err := writeTrafficConfig(&objs); err != nil {
+		log.Fatalf(" traffic_config: %v", err)
+	}
+	log.Printf(" Traffic mode: %s", config.Get().Traffic.Mode)
 
 	// Initialize link tracker
 	tracker := NewLinkTracker()
 	defer tracker.CloseAll()
+	setActiveTracker(tracker)
 
-	// Attach to containers
-	if err := attachToContainers(&objs, tracker); err != nil {
-		log.Fatalf("❌ Failed to attach to containers: %v", err)
-	}
+	// Attach to the containers running now , later changes are picked up by the main loop
+	reconcileLinks(&objs, tracker)
 
 	// Setup ringbuf reader
 	rd, err := ringbuf.NewReader(objs.Events)
@@ -60,6 +90,18 @@ func StartTrraficCollector(logCh chan logs.Producer_msg , NetworkCh chan []logs.
 	}
 	defer rd.Close()
 
+	dnsRd, err := ringbuf.NewReader(objs.DnsEvents)
+	if err != nil {
+		log.Fatalf(" Failed to open dns ringbuf: %v", err)
+	}
+	defer dnsRd.Close()
+
+	captureRd, err := perf.NewReader(objs.CaptureEvents, capturePerCPUBuffer)
+	if err != nil {
+		log.Fatalf(" Failed to open capture perf buffer: %v", err)
+	}
+	defer captureRd.Close()
+
 	log.Println(" Listening to ring buffer...")
 
 	// Setup signal handling for graceful shutdown
@@ -71,47 +113,100 @@ func StartTrraficCollector(logCh chan logs.Producer_msg , NetworkCh chan []logs.
 
 
 	
-	// Start reading from ringbuf in a goroutine
+	if config.Get().Kube.NetworkPolicies {
+		go enforceNetworkPolicies(ctx, &objs)
+	}
+
+	// Apply rule sets pushed through the command channel
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case <- NetworkCh:
-				err := LoadFlowRules( <-NetworkCh, objs.FlowRules)
-				if err != nil{
-					log.Println("some happend " ,err)
+			case cmd := <-NetworkCh:
+				err := setServerRules(cmd.Rules, &objs)
+				if err != nil {
+					log.Printf(" Failed to load flow rules: %v", err)
+				}
+				cmd.Result <- err
+			case cmd := <-LockdownCh:
+				err := applyLockdown(cmd.Request, &objs, logCh)
+				if err != nil {
+					log.Printf(" Failed to apply lockdown: %v", err)
+				}
+				cmd.Result <- err
+			case cmd := <-CaptureCh:
+				err := startCapture(cmd.Request, &objs, logCh)
+				if err != nil {
+					log.Printf(" Failed to start capture: %v", err)
 				}
+				cmd.Result <- err
+			}
+		}
+	}()
+
+	// Start reading from ringbuf in a goroutine
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
 			default:
 				record, err := rd.Read()
 				if err != nil {
 					if ctx.Err() != nil {
 						return
 					}
+					trafficRingbuf.readErrors.Add(1)
 					log.Printf(" ringbuf read error: %v", err)
 					time.Sleep(100 * time.Millisecond)
 					continue
 				}
 
+				trafficRingbuf.read.Add(1)
+
 				var event logs.FlowEvent
 				if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &event); err != nil {
+					trafficRingbuf.decodeErrors.Add(1)
 					log.Printf(" Failed to parse event: %v", err)
 					continue
 				}
-				container := IfIndex_Mapper[int(event.IfIndex)]
-
-				utils.Update_uid_Map(container.UID , container)
-				utils.Update_network_Tracker(container.UID , float64(event.PayloadLen))
-
+				if event.EventType >= logs.EVENT_CONN_OPENED {
+					handleConnEvent(&event, false, logCh)
+				} else {
+					handleFlowEvent(&event, logCh)
+				}
+			}
+		}
+	}()
 
-				logCh <- logs.Producer_msg{
-					Body: logs.Encode_string(event.String()),
-					Id: 1,
+	// DNS responses sent to pods , their answers attribute flows to domains
+	go func() {
+		for {
+			record, err := dnsRd.Read()
+			if err != nil {
+				if ctx.Err() != nil || errors.Is(err, ringbuf.ErrClosed) {
+					return
 				}
+				dnsRingbuf.readErrors.Add(1)
+				log.Printf(" dns ringbuf read error: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			dnsRingbuf.read.Add(1)
+
+			var event logs.Dns_event
+			if err := binary.Read(bytes.NewBuffer(record.RawSample), binary.LittleEndian, &event); err != nil {
+				dnsRingbuf.decodeErrors.Add(1)
+				continue
 			}
+			recordDNSResponse(&event, &objs)
 		}
 	}()
 
+	// packets of the pods being captured
+	go readCaptures(captureRd)
+
 	// Main event loop
 	mappingCh := make(chan struct{}, 1)
 	// Goroutine that waits for cond to signal
@@ -129,6 +224,22 @@ func StartTrraficCollector(logCh chan logs.Producer_msg , NetworkCh chan []logs.
 		}
 	}()
 
+	// veths that were not up yet when their pod was mapped are retried on this tick
+	resync := time.NewTicker(config.Get().Kube.RescanInterval)
+	defer resync.Stop()
+
+	// ends the learning phase of lockdown namespaces
+	learnTick := time.NewTicker(5 * time.Second)
+	defer learnTick.Stop()
+
+	// reports the end of idle flows and connections , in packets mode the flows map stays empty
+	flowTick := time.NewTicker(config.Get().Traffic.FlushInterval)
+	defer flowTick.Stop()
+
+	// sends the traffic between pods and their peers for the service graph
+	graphTick := time.NewTicker(config.Get().Traffic.GraphInterval)
+	defer graphTick.Stop()
+
 	for {
 		select {
 		case <-stop:
@@ -136,8 +247,22 @@ func StartTrraficCollector(logCh chan logs.Producer_msg , NetworkCh chan []logs.
 			goto cleanup
 
 		case <-mappingCh:
-			log.Println(" Rescanning for new containers...")
+			reconcileLinks(&objs, tracker)
+
+		case <-resync.C:
+			reconcileLinks(&objs, tracker)
 
+		case <-learnTick.C:
+			expireLearning(logCh)
+
+		case <-flowTick.C:
+			expireFlows(&objs, logCh)
+			expireConns(&objs, logCh)
+			expireDomains()
+			expireFQDNs(&objs)
+
+		case <-graphTick.C:
+			flushGraph(logCh)
 		}
 	}
 
@@ -148,52 +273,222 @@ cleanup:
 	// Close all links (defer will also handle this)
 	tracker.CloseAll()
 	rd.Close()
+	dnsRd.Close()
+	captureRd.Close()
 	
 	log.Println(" Cleanup complete")
 }
 
 
-// LoadFlowRules loads the given list of rules into the BPF map.
-func LoadFlowRules(rules []logs.FlowRule, bpfMap *ebpf.Map) error {
-    if len(rules) > 128 {
-        return fmt.Errorf("too many rules: max is 128")
-    }
+var (
+	// generation of the rule maps the packets use and the scopes of its rules , guarded by rules_mu
+	activeRuleGen uint32
+	activeScopes  map[uint32]logs.Pod_scope
+	rules_mu      sync.Mutex
+)
 
-    // Debug: Check map info
-    info, err := bpfMap.Info()
+// LoadFlowRules compiles the given list of rules into the BPF maps.
+// The new list is written to the inactive generation and swapped in by one write to
+// rule_state , so packets see either the whole old or the whole new rule set.
+// The old generation is cleared afterwards. The last policyRules of inputs are translated from NetworkPolicies.
+// A set with rules that fit no index is loaded without them , and a *logs.Unindexed_rules_error lists them.
+func LoadFlowRules(inputs []logs.FlowRuleInput, policyRules int, objs *trafficObjects) error {
+    set, err := logs.CompileFlowRules(inputs)
     if err != nil {
-        log.Printf(" Failed to get map info: %v", err)
-    } else {
-        log.Printf(" Map info - KeySize: %d, ValueSize: %d, MaxEntries: %d", 
-            info.KeySize, info.ValueSize, info.MaxEntries)
+        return err
     }
 
+    rules_mu.Lock()
+    defer rules_mu.Unlock()
 
+    next := activeRuleGen ^ 1
+    // leftovers of a load that failed halfway
+    if err := clearRuleGeneration(objs, next); err != nil {
+        return err
+    }
 
-    for i, rule := range rules {
-        idx := uint32(i)
-        
-        // Debug the rule being inserted
-        log.Printf("🔍 Inserting rule %d: %+v", i, rule)
-        
-        if err := bpfMap.Put(idx, rule); err != nil {
-            log.Printf(" Failed to insert rule %d: %v", i, err)
-            log.Printf(" Rule data: %+v", rule)
+    for i, rule := range set.Rules {
+        idx := next*logs.MAX_FLOW_RULES + uint32(i)
+        if err := objs.FlowRules.Put(idx, rule); err != nil {
             return fmt.Errorf("failed to insert rule %d: %w", i, err)
         }
-        
-        // Verify the rule was actually inserted
-        var retrieved logs.FlowRule
-        if err := bpfMap.Lookup(idx, &retrieved); err != nil {
-            log.Printf(" Failed to verify rule %d: %v", i, err)
-        } else {
-            log.Printf(" Verified rule %d: %+v", i, retrieved)
+        // a rate limit starts with a full bucket , not with what the slot's last rule left
+        if logs.Rule_action(rule.Action) == logs.ACTION_RATE_LIMIT {
+            if err := objs.RateLimits.Put(idx, logs.Rate_state{}); err != nil {
+                return fmt.Errorf("rate_limits: %w", err)
+            }
+        }
+    }
+    for key, id := range set.Exact {
+        key.Gen = next
+        if err := objs.Exact.Put(key, id); err != nil {
+            return fmt.Errorf("exact_rules: %w", err)
+        }
+    }
+    for key, bucket := range set.Port {
+        key.Gen = next
+        if err := objs.Port.Put(key, bucket); err != nil {
+            return fmt.Errorf("port_rules: %w", err)
         }
     }
+    for trie, buckets := range map[*ebpf.Map]map[logs.CIDR_key]logs.Rule_bucket{
+        objs.DstCidrs: set.DstCIDRs,
+        objs.SrcCidrs: set.SrcCIDRs,
+    } {
+        for key, bucket := range buckets {
+            key.Gen = uint8(next)
+            if err := trie.Put(key, bucket); err != nil {
+                return fmt.Errorf("cidr rules: %w", err)
+            }
+        }
+    }
+    if err := objs.Fallback.Put(next, set.Fallback); err != nil {
+        return fmt.Errorf("fallback_rules: %w", err)
+    }
+    if err := syncRuleScopes(objs, next, set.Scopes); err != nil {
+        return err
+    }
+    fqdns, err := seedFQDNRules(objs, next, set.FQDNs)
+    if err != nil {
+        return fmt.Errorf("fqdn_ips: %w", err)
+    }
 
-    log.Printf(" Successfully loaded %d flow rules into BPF map", len(rules))
+    if err := objs.RuleState.Put(uint32(0), logs.Rule_state{ActiveGen: next}); err != nil {
+        return fmt.Errorf("swap rule generation: %w", err)
+    }
+    old := activeRuleGen
+    activeRuleGen = next
+    activeScopes = set.Scopes
+    activeFQDNs = set.FQDNs
+    fqdnIPs = fqdns
+
+    if err := clearRuleGeneration(objs, old); err != nil {
+        log.Printf(" Failed to clear rule generation %d: %v", old, err)
+    }
+
+    stats := set.Stats
+    stats.Policy = policyRules
+    stats.Generation = next
+    stats.LoadedAt = time.Now()
+    setFlowRuleStats(stats)
+
+    log.Printf(" Loaded %d flow rules (exact %d , port %d , dst cidr %d , src cidr %d , fallback %d , disabled %d , scoped %d , fqdn %d , policy %d)",
+        stats.Total, stats.Exact, stats.Port, stats.DstCIDR, stats.SrcCIDR, stats.Fallback, stats.Disabled, stats.Scoped, stats.FQDN, stats.Policy)
+    if len(set.Unindexed) > 0 {
+        return &logs.Unindexed_rules_error{IDs: set.Unindexed}
+    }
     return nil
 }
 
+// syncRuleScopes makes the rule_scopes entries of gen list the veths of the pods each scoped rule selects
+func syncRuleScopes(objs *trafficObjects, gen uint32, scopes map[uint32]logs.Pod_scope) error {
+    desired := make(map[logs.Scope_key]bool)
+    ifindex_mu.RLock()
+    for ifindex, container := range IfIndex_Mapper {
+        for id, scope := range scopes {
+            if scope.Matches(container.UID, container.Namespace, container.PodLabels) {
+                desired[logs.Scope_key{Gen: gen, RuleID: id, Ifindex: uint32(ifindex)}] = true
+            }
+        }
+    }
+    ifindex_mu.RUnlock()
+
+    // the other generation may hold as many while a new rule set is loaded
+    if len(desired) > logs.MAX_SCOPE_ENTRIES/2 {
+        return fmt.Errorf("scoped rules select %d rule/interface pairs: max is %d", len(desired), logs.MAX_SCOPE_ENTRIES/2)
+    }
 
+    err := deleteKeys(objs.RuleScopes, func(k logs.Scope_key) bool {
+        if k.Gen != gen {
+            return false
+        }
+        if desired[k] {
+            delete(desired, k) // already there
+            return false
+        }
+        return true
+    })
+    if err != nil {
+        return fmt.Errorf("rule_scopes: %w", err)
+    }
+    for key := range desired {
+        if err := objs.RuleScopes.Put(key, uint8(1)); err != nil {
+            return fmt.Errorf("rule_scopes: %w", err)
+        }
+    }
+    return nil
+}
 
+// refreshRuleScopes re-resolves the scopes of the active rules after the pods on the node changed
+func refreshRuleScopes(objs *trafficObjects) {
+    rules_mu.Lock()
+    defer rules_mu.Unlock()
+
+    if len(activeScopes) == 0 {
+        return
+    }
+    if err := syncRuleScopes(objs, activeRuleGen, activeScopes); err != nil {
+        log.Printf(" Failed to update scoped flow rules: %v", err)
+    }
+}
+
+// clearRuleGeneration removes the index entries of one generation.
+// Its flow_rules slots are left as they are , nothing points at them any more.
+func clearRuleGeneration(objs *trafficObjects, gen uint32) error {
+    if err := deleteKeys(objs.Exact, func(k logs.Exact_key) bool { return k.Gen == gen }); err != nil {
+        return fmt.Errorf("exact_rules: %w", err)
+    }
+    if err := deleteKeys(objs.Port, func(k logs.Port_key) bool { return k.Gen == gen }); err != nil {
+        return fmt.Errorf("port_rules: %w", err)
+    }
+    for _, trie := range []*ebpf.Map{objs.DstCidrs, objs.SrcCidrs} {
+        if err := deleteKeys(trie, func(k logs.CIDR_key) bool { return uint32(k.Gen) == gen }); err != nil {
+            return fmt.Errorf("cidr rules: %w", err)
+        }
+    }
+    if err := objs.Fallback.Put(gen, logs.Fallback_list{}); err != nil {
+        return fmt.Errorf("fallback_rules: %w", err)
+    }
+    if err := deleteKeys(objs.RuleScopes, func(k logs.Scope_key) bool { return k.Gen == gen }); err != nil {
+        return fmt.Errorf("rule_scopes: %w", err)
+    }
+    if err := deleteKeys(objs.FqdnIPs, func(k logs.Fqdn_key) bool { return k.Gen == gen }); err != nil {
+        return fmt.Errorf("fqdn_ips: %w", err)
+    }
+    return nil
+}
+
+// putKeys sets every key of keys in m , the value only marks presence
+func putKeys[K comparable](m *ebpf.Map, keys map[K]bool) error {
+    for k := range keys {
+        if err := m.Put(k, uint8(1)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// deleteKeys removes the keys of m selected by match , collected first since deleting while iterating restarts the walk
+func deleteKeys[K comparable](m *ebpf.Map, match func(K) bool) error {
+    var (
+        key   K
+        value []byte
+        keys  []K
+    )
+    iter := m.Iterate()
+    for iter.Next(&key, &value) {
+        if match(key) {
+            keys = append(keys, key)
+        }
+    }
+    if err := iter.Err(); err != nil {
+        return err
+    }
+
+    for _, k := range keys {
+        if err := m.Delete(k); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+            return err
+        }
+    }
+    return nil
+}
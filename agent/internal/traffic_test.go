@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"agent/pkg/logs"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+// loadTrafficObjects loads traffic.bpf.o , built by make , the test is skipped without it or without the privileges to load it
+func loadTrafficObjects(tb testing.TB) *trafficObjects {
+	path := os.Getenv("TRAFFIC_BPF_OBJECT")
+	if path == "" {
+		path = "../bpf/traffic.bpf.o"
+	}
+	spec, err := ebpf.LoadCollectionSpec(path)
+	if err != nil {
+		tb.Skipf("no traffic object (run make , or set TRAFFIC_BPF_OBJECT): %v", err)
+	}
+	objs := &trafficObjects{}
+	if err := spec.LoadAndAssign(objs, nil); err != nil {
+		tb.Skipf("cannot load the traffic object , BPF_PROG_TEST_RUN needs root: %v", err)
+	}
+	tb.Cleanup(func() {
+		objs.TcIngress.Close()
+		objs.TcEgress.Close()
+		for _, m := range []*ebpf.Map{objs.FlowRules, objs.Exact, objs.Port, objs.SrcCidrs, objs.DstCidrs, objs.Fallback,
+			objs.RuleState, objs.RateLimits, objs.RuleScopes, objs.FqdnIPs, objs.Events, objs.LockdownIfaces, objs.EgressAllow,
+			objs.EventScratch, objs.TrafficConfig, objs.Flows, objs.Conns, objs.DnsEvents, objs.DpiPorts, objs.HttpScratch,
+			objs.HttpRequests, objs.CaptureTargets, objs.CaptureEvents, objs.EventDrops, objs.DnsDrops, objs.UnparsedPackets} {
+			m.Close()
+		}
+	})
+	return objs
+}
+
+// tcpFrame is an ethernet frame of a TCP SYN from 10.0.0.1:40000 to 10.0.0.2:dport
+func tcpFrame(dport uint16) []byte {
+	frame := make([]byte, 14+20+20)
+	binary.BigEndian.PutUint16(frame[12:], 0x0800)
+	ip := frame[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], 40)
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], []byte{10, 0, 0, 1})
+	copy(ip[16:], []byte{10, 0, 0, 2})
+	tcp := ip[20:]
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], dport)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x02 // SYN
+	return frame
+}
+
+// ipv6Frame is an ethernet frame of a TCP SYN to [fd00::2]:dport behind the extension headers
+// exts , each given as its type and its bytes after the next header field
+func ipv6Frame(dport uint16, exts ...[]byte) []byte {
+	var ext []byte
+	next := uint8(6)
+	for i := len(exts) - 1; i >= 0; i-- {
+		ext = append(append([]byte{next}, exts[i][1:]...), ext...)
+		next = exts[i][0]
+	}
+	frame := make([]byte, 14+40, 14+40+len(ext)+20)
+	binary.BigEndian.PutUint16(frame[12:], 0x86DD)
+	ip := frame[14:]
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(ext)+20))
+	ip[6] = next
+	ip[7] = 64
+	ip[8], ip[23] = 0xfd, 1
+	ip[24], ip[39] = 0xfd, 2
+	frame = append(frame, ext...)
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], dport)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x02 // SYN
+	return append(frame, tcp...)
+}
+
+// destOptions is a Destination Options header of 8 bytes , hopByHop the same for Hop-by-Hop
+var (
+	destOptions = []byte{60, 0, 1, 4, 0, 0, 0, 0}
+	hopByHop    = []byte{0, 0, 1, 4, 0, 0, 0, 0}
+	// AH with 4 bytes of ICV , 16 bytes in all: its length field says 16/4 - 2 = 2
+	authHeader = []byte{51, 2, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1, 0xaa, 0xbb, 0xcc, 0xdd}
+)
+
+func TestTrafficIPv6ExtensionHeaders(t *testing.T) {
+	objs := loadTrafficObjects(t)
+	if err := LoadFlowRules([]logs.FlowRuleInput{{Protocol: 6, DstPort: logs.PortRange{Min: 80, Max: 80}, Action: logs.ACTION_DROP}}, 0, objs); err != nil {
+		t.Fatal(err)
+	}
+	// BPF_PROG_TEST_RUN runs on the loopback device
+	lo := uint32(1)
+
+	tests := []struct {
+		name         string
+		frame        []byte
+		locked       bool
+		want         uint32
+		wantUnparsed logs.Unparsed_packets
+	}{
+		{"no extension headers", ipv6Frame(80), false, 2, logs.Unparsed_packets{}},
+		{"rule past hop-by-hop and AH", ipv6Frame(80, hopByHop, authHeader), false, 2, logs.Unparsed_packets{}},
+		{"rule past AH and destination options", ipv6Frame(80, authHeader, destOptions), false, 2, logs.Unparsed_packets{}},
+		{"other port passes", ipv6Frame(443, hopByHop, authHeader), false, 0, logs.Unparsed_packets{}},
+		{"chain too long passes", ipv6Frame(443, destOptions, destOptions, destOptions, destOptions, destOptions, destOptions, destOptions), false, 0, logs.Unparsed_packets{Passed: 1}},
+		{"chain too long is dropped in lockdown", ipv6Frame(443, destOptions, destOptions, destOptions, destOptions, destOptions, destOptions, destOptions), true, 2, logs.Unparsed_packets{Dropped: 1}},
+		{"truncated header is dropped in lockdown", ipv6Frame(443, hopByHop)[:14+40+1], true, 2, logs.Unparsed_packets{Dropped: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objs.LockdownIfaces.Delete(lo)
+			if tt.locked {
+				if err := objs.LockdownIfaces.Put(lo, uint8(1)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			before := readUnparsed(objs.UnparsedPackets, map[uint32]string{logs.DIR_FROM_POD: "tc_ingress"})["tc_ingress"]
+
+			ret, err := objs.TcIngress.Run(&ebpf.RunOptions{Data: tt.frame})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ret != tt.want {
+				t.Errorf("tc_ingress = %d , want %d", ret, tt.want)
+			}
+			after := readUnparsed(objs.UnparsedPackets, map[uint32]string{logs.DIR_FROM_POD: "tc_ingress"})["tc_ingress"]
+			if got := (logs.Unparsed_packets{Passed: after.Passed - before.Passed, Dropped: after.Dropped - before.Dropped}); got != tt.wantUnparsed {
+				t.Errorf("unparsed %+v , want %+v", got, tt.wantUnparsed)
+			}
+		})
+	}
+}
+
+// BenchmarkTrafficRuleLookup runs tc_ingress on a packet no rule matches , the worst case of the lookup.
+// The fallback set of 10 rules is the rule loop the indexes replaced.
+func BenchmarkTrafficRuleLookup(b *testing.B) {
+	objs := loadTrafficObjects(b)
+	frame := tcpFrame(9999)
+
+	sets := []struct {
+		name   string
+		inputs func(n int) []logs.FlowRuleInput
+		sizes  []int
+	}{
+		{"fallback", func(n int) []logs.FlowRuleInput {
+			inputs := make([]logs.FlowRuleInput, n)
+			for i := range inputs {
+				inputs[i] = logs.FlowRuleInput{Protocol: 17, SrcPort: logs.PortRange{Min: uint16(1000 + i), Max: uint16(1000 + i)}, Action: logs.ACTION_DROP}
+			}
+			return inputs
+		}, []int{10, logs.MAX_FALLBACK_RULES}},
+		{"indexed", func(n int) []logs.FlowRuleInput {
+			inputs := make([]logs.FlowRuleInput, n)
+			for i := range inputs {
+				port := uint16(1 + i%4000)
+				inputs[i] = logs.FlowRuleInput{Protocol: 6, DstPort: logs.PortRange{Min: port, Max: port}, DstIP: fmt.Sprintf("10.%d.%d.0/24", i/250, i%250), Action: logs.ACTION_DROP}
+			}
+			return inputs
+		}, []int{10, 100, 1000, logs.MAX_FLOW_RULES}},
+	}
+	for _, set := range sets {
+		for _, n := range set.sizes {
+			b.Run(fmt.Sprintf("%s/%d", set.name, n), func(b *testing.B) {
+				if err := LoadFlowRules(set.inputs(n), 0, objs); err != nil {
+					b.Fatal(err)
+				}
+				_, duration, err := objs.TcIngress.Benchmark(frame, b.N, b.ResetTimer)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportMetric(float64(duration.Nanoseconds()), "ns/run")
+			})
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package cri
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// DEFAULT_ENDPOINTS are tried in order when no endpoint is configured
+var DEFAULT_ENDPOINTS = []string{
+	"/run/containerd/containerd.sock",
+	"/run/k3s/containerd/containerd.sock",
+	"/var/run/crio/crio.sock",
+	"/var/run/cri-dockerd.sock",
+}
+
+// CALL_TIMEOUT bounds every unary call to the runtime
+const CALL_TIMEOUT = 5 * time.Second
+
+type Runtime struct {
+	Endpoint string
+	Name     string
+	Version  string
+
+	conn   *grpc.ClientConn
+	client runtimeapi.RuntimeServiceClient
+}
+
+// Container_info is what the agent needs to know about a running container
+type Container_info struct {
+	ID          string
+	Name        string
+	Image       string
+	PID         int
+	CgroupsPath string
+	Labels      map[string]string
+}
+
+// Container_event is a container lifecycle change pushed by the runtime
+type Container_event struct {
+	ContainerID   string
+	Type          runtimeapi.ContainerEventType
+	PodName       string
+	PodNamespace  string
+	PodUID        string
+	PodLabels     map[string]string
+	ContainerName string
+	Labels        map[string]string
+}
+
+// Connect dials endpoint , or when it is empty the first of DEFAULT_ENDPOINTS that answers
+func Connect(endpoint string) (*Runtime, error) {
+	if endpoint != "" {
+		return dial(endpoint)
+	}
+
+	var errs []error
+	for _, candidate := range DEFAULT_ENDPOINTS {
+		if _, err := os.Stat(candidate); err != nil {
+			continue
+		}
+		rt, err := dial(candidate)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return rt, nil
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no CRI socket found in %s", strings.Join(DEFAULT_ENDPOINTS, ", "))
+	}
+	return nil, errors.Join(errs...)
+}
+
+func dial(endpoint string) (*Runtime, error) {
+	target := endpoint
+	if !strings.Contains(target, "://") {
+		target = "unix://" + target
+	}
+
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", endpoint, err)
+	}
+	rt := &Runtime{Endpoint: endpoint, conn: conn, client: runtimeapi.NewRuntimeServiceClient(conn)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CALL_TIMEOUT)
+	defer cancel()
+	version, err := rt.client.Version(ctx, &runtimeapi.VersionRequest{})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %w", endpoint, err)
+	}
+	rt.Name = version.RuntimeName
+	rt.Version = version.RuntimeVersion
+	return rt, nil
+}
+
+func (rt *Runtime) Close() error {
+	return rt.conn.Close()
+}
+
+// ContainerID strips the runtime prefix of a Kubernetes container ID , e.g. containerd:// or docker://
+func ContainerID(id string) string {
+	if i := strings.Index(id, "://"); i >= 0 {
+		return id[i+3:]
+	}
+	return id
+}
+
+// the verbose "info" key of ContainerStatus , containerd , CRI-O and cri-dockerd all report these fields
+type verboseInfo struct {
+	Pid         int `json:"pid"`
+	RuntimeSpec struct {
+		Linux struct {
+			CgroupsPath string `json:"cgroupsPath"`
+		} `json:"linux"`
+	} `json:"runtimeSpec"`
+}
+
+// Inspect resolves the PID , cgroup path and labels of a container
+func (rt *Runtime) Inspect(id string) (*Container_info, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), CALL_TIMEOUT)
+	defer cancel()
+
+	resp, err := rt.client.ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{
+		ContainerId: ContainerID(id),
+		Verbose:     true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("container status: %w", err)
+	}
+	if resp.Status == nil {
+		return nil, fmt.Errorf("container %s: empty status", id)
+	}
+
+	info := &Container_info{
+		ID:     resp.Status.Id,
+		Labels: resp.Status.Labels,
+	}
+	if resp.Status.Metadata != nil {
+		info.Name = resp.Status.Metadata.Name
+	}
+	if resp.Status.Image != nil {
+		info.Image = resp.Status.Image.Image
+	}
+
+	raw, ok := resp.Info["info"]
+	if !ok {
+		return nil, fmt.Errorf("container %s: runtime %s returned no verbose info", id, rt.Name)
+	}
+	var verbose verboseInfo
+	if err := json.Unmarshal([]byte(raw), &verbose); err != nil {
+		return nil, fmt.Errorf("parse verbose info: %w", err)
+	}
+	if verbose.Pid == 0 {
+		return nil, fmt.Errorf("container %s has no PID , not running?", id)
+	}
+	info.PID = verbose.Pid
+	info.CgroupsPath = verbose.RuntimeSpec.Linux.CgroupsPath
+	return info, nil
+}
+
+// ErrEventsUnsupported is returned by Events when the runtime has no GetContainerEvents
+var ErrEventsUnsupported = errors.New("runtime does not stream container events")
+
+// Events streams container lifecycle events to handle until ctx is done or the stream breaks
+func (rt *Runtime) Events(ctx context.Context, handle func(Container_event)) error {
+	stream, err := rt.client.GetContainerEvents(ctx, &runtimeapi.GetEventsRequest{})
+	if err != nil {
+		return eventsErr(err)
+	}
+
+	log.Printf(" Subscribed to %s container events", rt.Name)
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF || ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return eventsErr(err)
+		}
+
+		event := Container_event{
+			ContainerID: resp.ContainerId,
+			Type:        resp.ContainerEventType,
+		}
+		if sandbox := resp.PodSandboxStatus; sandbox != nil && sandbox.Metadata != nil {
+			event.PodName = sandbox.Metadata.Name
+			event.PodNamespace = sandbox.Metadata.Namespace
+			event.PodUID = sandbox.Metadata.Uid
+			event.PodLabels = sandbox.Labels
+		}
+		for _, cs := range resp.ContainersStatuses {
+			if cs.Id == resp.ContainerId {
+				if cs.Metadata != nil {
+					event.ContainerName = cs.Metadata.Name
+				}
+				event.Labels = cs.Labels
+			}
+		}
+		handle(event)
+	}
+}
+
+func eventsErr(err error) error {
+	if status.Code(err) == codes.Unimplemented {
+		return ErrEventsUnsupported
+	}
+	return fmt.Errorf("container events: %w", err)
+}
@@ -0,0 +1,100 @@
+package identity
+
+import (
+	"agent/pkg/config"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AGENT_VERSION is reported in registration and stamped on every message
+const AGENT_VERSION = "0.1.0"
+
+// ID_FILE , inside the state dir , keeps the generated part of the agent ID across restarts
+const ID_FILE = "agent-id"
+
+type Agent_identity struct {
+	ID        string    `json:"id" bson:"id"`
+	NodeName  string    `json:"node_name" bson:"node_name"`
+	Group     string    `json:"group" bson:"group"`
+	Version   string    `json:"version" bson:"version"`
+	StartedAt time.Time `json:"started_at" bson:"started_at"`
+}
+
+var (
+	self Agent_identity
+	once sync.Once
+)
+
+// Get returns this agent's identity , building it on first use
+func Get() Agent_identity {
+	once.Do(func() {
+		self = build()
+		log.Printf(" Agent identity: id=%s node=%s group=%q version=%s", self.ID, self.NodeName, self.Group, self.Version)
+	})
+	return self
+}
+
+func build() Agent_identity {
+	node := nodeName()
+	return Agent_identity{
+		ID:        node + "-" + generatedID()[:8],
+		NodeName:  node,
+		Group:     config.Get().Agent.Group,
+		Version:   AGENT_VERSION,
+		StartedAt: time.Now(),
+	}
+}
+
+// nodeName prefers the configured name (NODE_NAME , set through the downward API in the daemonset) over the hostname
+func nodeName() string {
+	if n := config.Get().Agent.NodeName; n != "" {
+		return n
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		log.Printf(" Failed to read hostname: %v", err)
+		return "unknown"
+	}
+	return host
+}
+
+// generatedID reads the persisted ID or generates and persists a new one
+func generatedID() string {
+	idFile := filepath.Join(config.Get().Agent.StateDir, ID_FILE)
+	if data, err := os.ReadFile(idFile); err == nil {
+		if id := strings.TrimSpace(string(data)); len(id) >= 8 {
+			return id
+		}
+	}
+
+	id := uuid.NewString()
+	if err := os.MkdirAll(filepath.Dir(idFile), 0o755); err != nil {
+		log.Printf(" Could not persist agent ID, it will change on restart: %v", err)
+		return id
+	}
+	if err := os.WriteFile(idFile, []byte(id+"\n"), 0o644); err != nil {
+		log.Printf(" Could not persist agent ID, it will change on restart: %v", err)
+	}
+	return id
+}
+
+// RoutingKeys are the command exchange keys this agent's queue is bound to:
+// everything , its node , its group (if any) and its own ID.
+func (a Agent_identity) RoutingKeys() []string {
+	keys := []string{"all", "node." + a.NodeName, "agent." + a.ID}
+	if a.Group != "" {
+		keys = append(keys, "group."+a.Group)
+	}
+	return keys
+}
+
+// CommandQueue is the name of this agent's own command queue
+func (a Agent_identity) CommandQueue() string {
+	return "agent." + a.ID + ".commands"
+}
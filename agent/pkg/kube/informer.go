@@ -0,0 +1,399 @@
+package kube
+
+import (
+	"agent/pkg/config"
+	"agent/pkg/cri"
+	"agent/pkg/identity"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+var (
+	clientset    *kubernetes.Clientset
+	criRuntime   *cri.Runtime
+	informerStop chan struct{}
+
+	// containers of every pod on this node , keyed by pod UID
+	pod_containers = make(map[types.UID][]ContainerMapping)
+	// cgroup id of every mapped container , so it can be dropped from Cgroup_mapping
+	container_cgroups = make(map[string]uint64)
+	pods_mu           sync.Mutex
+)
+
+// GetClientset returns the agent's API client , built once from the in-cluster service account
+// or , outside a cluster , from the configured kubeconfig
+func GetClientset() (*kubernetes.Clientset, error) {
+	if clientset != nil {
+		return clientset, nil
+	}
+
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		log.Printf(" Not running in a cluster (%v), using kubeconfig %s", err, config.Get().Kube.Kubeconfig)
+		restConfig, err = clientcmd.BuildConfigFromFlags("", config.Get().Kube.Kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load kubeconfig: %w", err)
+		}
+	}
+
+	cs, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create clientset: %w", err)
+	}
+	clientset = cs
+	return clientset, nil
+}
+
+// startInformer watches the pods scheduled on this node and blocks until the first list is applied
+func startInformer() error {
+	cs, err := GetClientset()
+	if err != nil {
+		return err
+	}
+
+	node := identity.Get().NodeName
+	factory := informers.NewSharedInformerFactoryWithOptions(cs, config.Get().Kube.RescanInterval,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", node).String()
+		}),
+	)
+
+	podInformer := factory.Core().V1().Pods().Informer()
+	_, err = podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				updatePod(pod)
+			}
+		},
+		// also called on every resync , which retries containers whose PID could not be resolved yet
+		UpdateFunc: func(_, obj any) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				updatePod(pod)
+			}
+		},
+		DeleteFunc: func(obj any) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if pod, ok := obj.(*corev1.Pod); ok {
+				deletePod(pod.UID)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot register pod handler: %w", err)
+	}
+
+	informerStop = make(chan struct{})
+	log.Printf(" Watching pods on node %s...", node)
+	factory.Start(informerStop)
+	if !cache.WaitForCacheSync(informerStop, podInformer.HasSynced) {
+		return fmt.Errorf("pod informer did not sync")
+	}
+	log.Printf(" Pod informer synced , %d containers mapped", len(GetCurrentMapping()))
+	return nil
+}
+
+func stopInformer() {
+	if informerStop != nil {
+		close(informerStop)
+		informerStop = nil
+	}
+	stopPolicyWatch()
+}
+
+// updatePod maps the running containers of pod , reusing the mappings it already has.
+// The runtime is asked about new containers before pods_mu is taken , so a slow one
+// does not hold up the other handlers and lookups.
+func updatePod(pod *corev1.Pod) {
+	if slices.Contains(config.Get().Kube.ExcludedNamespaces, pod.Namespace) {
+		return
+	}
+
+	pods_mu.Lock()
+	mapped := make(map[string]bool)
+	for _, c := range pod_containers[pod.UID] {
+		mapped[c.ContainerID] = true
+	}
+	pods_mu.Unlock()
+
+	resolved := make(map[string]resolvedContainer)
+	for _, status := range pod.Status.ContainerStatuses {
+		cid := cri.ContainerID(status.ContainerID)
+		if status.State.Running == nil || cid == "" || mapped[cid] {
+			continue
+		}
+		if r, ok := resolveContainer(pod.Name, pod.Namespace, string(pod.UID), status.Name, cid, pod.Labels); ok {
+			resolved[cid] = r
+		}
+	}
+
+	pods_mu.Lock()
+	defer pods_mu.Unlock()
+
+	known := make(map[string]ContainerMapping)
+	for _, c := range pod_containers[pod.UID] {
+		known[c.ContainerID] = c
+	}
+
+	var containers []ContainerMapping
+	changed := false
+	statuses := make(map[string]corev1.ContainerStatus)
+	for _, status := range pod.Status.ContainerStatuses {
+		statuses[status.Name] = status
+		cid := cri.ContainerID(status.ContainerID)
+		if status.State.Running == nil || cid == "" {
+			continue
+		}
+
+		if c, ok := known[cid]; ok {
+			// relabeling a pod changes which scoped network rules apply to it
+			if !maps.Equal(c.PodLabels, pod.Labels) {
+				c.PodLabels = pod.Labels
+				c.Workload = podWorkload(c.PodName, pod.Labels)
+				registerContainer(resolvedContainer{mapping: c})
+				changed = true
+			}
+			containers = append(containers, c)
+			delete(known, cid)
+			continue
+		}
+
+		r, ok := resolved[cid]
+		if !ok {
+			continue
+		}
+		// labels may have changed while the runtime was asked
+		r.mapping.PodLabels = pod.Labels
+		r.mapping.Workload = podWorkload(pod.Name, pod.Labels)
+		registerContainer(r)
+		containers = append(containers, r.mapping)
+		changed = true
+	}
+
+	for cid, c := range known {
+		// started by a runtime event and the pod status has not caught up yet
+		if status, ok := statuses[c.ContainerName]; ok && status.State.Running == nil && cri.ContainerID(status.ContainerID) != cid {
+			containers = append(containers, c)
+			continue
+		}
+		// restarted or stopped
+		forgetContainer(cid)
+		changed = true
+	}
+
+	if len(containers) == 0 {
+		delete(pod_containers, pod.UID)
+	} else {
+		pod_containers[pod.UID] = containers
+	}
+	if changed {
+		publishMapping()
+	}
+}
+
+// resolvedContainer is a container the runtime was asked about , cgroupID is 0 when it is not known
+type resolvedContainer struct {
+	mapping  ContainerMapping
+	cgroupID uint64
+}
+
+// resolveContainer asks the runtime for the PID and cgroup of a container , without pods_mu
+func resolveContainer(podName, namespace, podUID, containerName, cid string, podLabels map[string]string) (resolvedContainer, bool) {
+	if criRuntime == nil {
+		return resolvedContainer{}, false
+	}
+
+	info, err := criRuntime.Inspect(cid)
+	if err != nil {
+		log.Printf(" Failed to inspect container %s (%s/%s): %v", containerName, namespace, podName, err)
+		return resolvedContainer{}, false
+	}
+
+	r := resolvedContainer{mapping: ContainerMapping{
+		PodName:       podName,
+		Namespace:     namespace,
+		ContainerID:   cid,
+		ContainerName: containerName,
+		PID:           info.PID,
+		UID:           podUID,
+		Cgroup:        info.CgroupsPath,
+		Image:         info.Image,
+		Labels:        info.Labels,
+		PodLabels:     podLabels,
+		Workload:      podWorkload(podName, podLabels),
+	}}
+	log.Printf(" Added mapping: %s/%s → PID %d", namespace, podName, info.PID)
+
+	cgroupID, err := GetContainerCgroupID(info.PID)
+	if err != nil {
+		log.Printf(" Couldn't get cgroup of %s/%s: %v", namespace, podName, err)
+		return r, true
+	}
+	r.cgroupID = cgroupID
+	return r, true
+}
+
+// registerContainer makes the cgroup of a container resolve to its mapping , also after the
+// mapping changed. pods_mu must be held.
+func registerContainer(r resolvedContainer) {
+	cid := r.mapping.ContainerID
+	cgroupID := r.cgroupID
+	if cgroupID == 0 {
+		cgroupID = container_cgroups[cid]
+	}
+	if cgroupID == 0 {
+		return
+	}
+	container_cgroups[cid] = cgroupID
+	cgroup_mu.Lock()
+	Cgroup_mapping[cgroupID] = r.mapping
+	cgroup_mu.Unlock()
+}
+
+// handleContainerEvent applies a runtime event without waiting for the pod status update
+func handleContainerEvent(event cri.Container_event) {
+	if event.PodUID == "" || slices.Contains(config.Get().Kube.ExcludedNamespaces, event.PodNamespace) {
+		return
+	}
+	uid := types.UID(event.PodUID)
+	isEvent := func(c ContainerMapping) bool { return c.ContainerID == event.ContainerID }
+
+	switch event.Type {
+	case runtimeapi.ContainerEventType_CONTAINER_STARTED_EVENT:
+		pods_mu.Lock()
+		mapped := slices.ContainsFunc(pod_containers[uid], isEvent)
+		pods_mu.Unlock()
+		if mapped {
+			return
+		}
+		r, ok := resolveContainer(event.PodName, event.PodNamespace, event.PodUID, event.ContainerName, event.ContainerID, event.PodLabels)
+		if !ok {
+			return
+		}
+
+		pods_mu.Lock()
+		defer pods_mu.Unlock()
+		containers := pod_containers[uid]
+		// the pod informer mapped it while the runtime was asked
+		if slices.ContainsFunc(containers, isEvent) {
+			return
+		}
+		registerContainer(r)
+		pod_containers[uid] = append(containers, r.mapping)
+
+	case runtimeapi.ContainerEventType_CONTAINER_STOPPED_EVENT, runtimeapi.ContainerEventType_CONTAINER_DELETED_EVENT:
+		pods_mu.Lock()
+		defer pods_mu.Unlock()
+		containers := pod_containers[uid]
+		idx := slices.IndexFunc(containers, isEvent)
+		if idx < 0 {
+			return
+		}
+		forgetContainer(event.ContainerID)
+		containers = slices.Delete(containers, idx, idx+1)
+		if len(containers) == 0 {
+			delete(pod_containers, uid)
+		} else {
+			pod_containers[uid] = containers
+		}
+
+	default:
+		return
+	}
+	publishMapping()
+}
+
+// the event stream is retried after this , doubling up to maxEventsBackoff while it keeps failing
+const (
+	minEventsBackoff = time.Second
+	maxEventsBackoff = 30 * time.Second
+)
+
+// watchContainerEvents follows the runtime's event stream , reconnecting until ctx is done.
+// Runtimes without the stream are left to the pod informer.
+func watchContainerEvents(ctx context.Context) {
+	backoff := minEventsBackoff
+	for {
+		started := time.Now()
+		received := false
+		err := criRuntime.Events(ctx, func(event cri.Container_event) {
+			received = true
+			handleContainerEvent(event)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, cri.ErrEventsUnsupported) {
+			log.Printf(" %s does not stream container events , relying on the pod informer", criRuntime.Name)
+			return
+		}
+		// a stream that worked for a while starts over from the shortest wait
+		if received || time.Since(started) >= maxEventsBackoff {
+			backoff = minEventsBackoff
+		}
+		log.Printf(" Container event stream ended: %v , retrying in %s", err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxEventsBackoff)
+	}
+}
+
+func deletePod(uid types.UID) {
+	pods_mu.Lock()
+	defer pods_mu.Unlock()
+
+	containers, ok := pod_containers[uid]
+	if !ok {
+		return
+	}
+	for _, c := range containers {
+		forgetContainer(c.ContainerID)
+		log.Printf(" Removed mapping: %s/%s (%s)", c.Namespace, c.PodName, c.ContainerName)
+	}
+	delete(pod_containers, uid)
+	publishMapping()
+}
+
+func forgetContainer(cid string) {
+	if cgroupID, ok := container_cgroups[cid]; ok {
+		cgroup_mu.Lock()
+		delete(Cgroup_mapping, cgroupID)
+		cgroup_mu.Unlock()
+		delete(container_cgroups, cid)
+	}
+}
+
+// publishMapping rebuilds Cur_Map and wakes the collectors , pods_mu must be held
+func publishMapping() {
+	var cur []ContainerMapping
+	for _, containers := range pod_containers {
+		cur = append(cur, containers...)
+	}
+	setTracker(cur)
+
+	mu.Lock()
+	cond.Broadcast()
+	mu.Unlock()
+}
@@ -1,22 +1,19 @@
 package kube
 
 import (
+	"agent/pkg/config"
+	"agent/pkg/cri"
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"syscall"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	// "k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 	"os/signal"
 	"sync"
-	"time"
 	
 )
 
@@ -28,113 +25,59 @@ type ContainerMapping struct {
 	PID           int    `json:"pid" bson:"pid"`
 	UID           string `json:"uid" bson:"uid"`
 	Cgroup        string `json:"cgroup" bson:"cgroup"`
+	Image         string            `json:"image,omitempty" bson:"image,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`
+	PodLabels     map[string]string `json:"pod_labels,omitempty" bson:"pod_labels,omitempty"`
+	Workload      string            `json:"workload,omitempty" bson:"workload,omitempty"` // see podWorkload
+}
+
+// podWorkload names the controller of a pod from its name and labels , so the pods the runtime reports
+// before the informer lists them get the same name. A deployment's pods drop their pod-template-hash and
+// random suffix , a job's pods take the job name , statefulset and daemonset pods drop their last name segment.
+func podWorkload(podName string, labels map[string]string) string {
+	if hash := labels["pod-template-hash"]; hash != "" {
+		if i := strings.LastIndex(podName, "-"+hash+"-"); i > 0 {
+			return podName[:i]
+		}
+	}
+	if job := labels["job-name"]; job != "" {
+		return job
+	}
+	if labels["controller-revision-hash"] != "" {
+		if i := strings.LastIndex(podName, "-"); i > 0 {
+			return podName[:i]
+		}
+	}
+	return podName
 }
 
 var Cgroup_mapping = make(map[uint64]ContainerMapping)
 var Pid_toContainer_Map = make(map[int]ContainerMapping) // TODO , need to pass it to the main server  , container id and the namespace for every log 
 
 var (
-	Cur_Map ,_= FetchContainerMappings() 
+	Cur_Map []ContainerMapping
 	mu      sync.RWMutex
 	cgroup_mu sync.RWMutex
 	cond = sync.NewCond(&mu)
 )
 
 
-// FetchContainerMappings connects to the Kubernetes API and maps container IDs to PIDs
-func FetchContainerMappings() ([]ContainerMapping, error) {
-	
-	config, err := clientcmd.BuildConfigFromFlags("", "/etc/rancher/k3s/k3s.yaml")
+// Init starts watching the pods of this node and waits for the first list ,
+// so the collectors start with the containers already running
+func Init() {
+	rt, err := cri.Connect(config.Get().Kube.CRIEndpoint)
 	if err != nil {
-		return nil, fmt.Errorf("Cannot load kubeconfig: %w", err)
+		log.Printf(" Cannot reach the container runtime: %v", err)
+	} else {
+		log.Printf(" Connected to %s %s at %s", rt.Name, rt.Version, rt.Endpoint)
+		criRuntime = rt
 	}
 
-	log.Println(" Creating Kubernetes clientset...")
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf(" Cannot create clientset: %w", err)
-	}
-
-	log.Println(" Fetching all pods from cluster...")
-	pods, err := clientset.CoreV1().Pods("").List(context.Background(), metav1.ListOptions{})
-	if err != nil {
-		return nil, fmt.Errorf(" Failed to list pods: %w", err)
-	}
-
-	var results []ContainerMapping
-	log.Printf(" Found %d pods, iterating...",len(pods.Items))
-	for _, pod := range pods.Items {
-		if pod.Namespace == "kube-system" || pod.Namespace == "kube-public" || pod.Namespace == "kube-node-lease" {
-			continue
-		}
-		for _, status := range pod.Status.ContainerStatuses {
-			cid := strings.TrimPrefix(status.ContainerID, "containerd://")
-			if cid == "" {
-				log.Printf(" Empty ContainerID for container %s in pod %s/%s", status.Name, pod.Namespace, pod.Name)
-				continue
-			}	
-
-			log.Printf(" Resolving PID for container %s (%s/%s)...", status.Name, pod.Namespace, pod.Name)
-			pid, err := getPidFromCrictl(cid)
-			if err != nil {
-				log.Printf(" Failed to get PID for container %s (%s): %v", cid, status.Name, err)
-				continue
-			}
-
-			container := ContainerMapping{
-				PodName:       pod.Name,
-				Namespace:     pod.Namespace,
-				ContainerID:   cid,
-				ContainerName: status.Name,
-				PID:           pid,
-				UID:           string(pod.UID) ,
-			}
-			results = append(results,container)
-			log.Printf(" Added mapping: %s/%s → PID %d", pod.Namespace, pod.Name, pid)
-
-
-			cgroupID , err:= GetContainerCgroupID(pid)
-
-			if err != nil {
-				fmt.Println("coudnt get cgroup nooooo  ",err)
-				continue
-			}
-			cgroup_mu.Lock()
-			if _ , ok := Cgroup_mapping[cgroupID] ; !ok {
-				Cgroup_mapping[cgroupID] = container 
-				fmt.Printf("pod is %s with pid %d and the cgroup id is %d \n ",container.PodName,container.PID ,cgroupID)
-			}
-			cgroup_mu.Unlock()
-		}
+	if err := startInformer(); err != nil {
+		log.Printf(" Cannot watch pods: %v", err)
 	}
-
-	log.Printf("Total container mappings collected: %d", len(results))
-	return results, nil
 }
 
-// getPidFromCrictl uses `crictl inspect` to extract the PID of a container
-func getPidFromCrictl(containerID string) (int, error) {
-	// Remove the "cri-o://" or "containerd://" prefix if present
-	containerID = strings.TrimPrefix(containerID, "cri-o://")
-	containerID = strings.TrimPrefix(containerID, "containerd://")
-
-	out, err := exec.Command("crictl", "inspect", containerID).Output()
-	if err != nil {
-		return 0, fmt.Errorf("crictl inspect failed: %w", err)
-	}
-
-	// Parse JSON and extract .info.pid
-	var result struct {
-		Info struct {
-			Pid int `json:"pid"`
-		} `json:"info"`
-	}
-	if err := json.Unmarshal(out, &result); err != nil {
-		return 0, fmt.Errorf("failed to parse crictl inspect output: %w", err)
-	}
-
-	return result.Info.Pid, nil
-}
 func PidToUid(pid int) string {
 	return Pid_toContainer_Map[pid].UID 
 }
@@ -180,32 +123,19 @@ func KillPod(clientset *kubernetes.Clientset, namespace, podName string) error {
 
 
 
+// MappingTracker keeps the pod informer running until the agent is stopped
 func MappingTracker() {
-    rescanTicker := time.NewTicker(30 * time.Second)
-    defer rescanTicker.Stop()
-
     stop := make(chan os.Signal, 1)
     signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-    for {
-        select {
-        case <-stop:
-            return
-
-        case <-rescanTicker.C:
-            updated_map, err := FetchContainerMappings()
-            if err != nil {
-                fmt.Println("Couldn't get containers:", err)
-                continue
-            }
-
-            setTracker(updated_map)
-
-            mu.Lock()
-            cond.Broadcast()
-            mu.Unlock()
-        }
+    ctx, cancel := context.WithCancel(context.Background())
+    if criRuntime != nil {
+        go watchContainerEvents(ctx)
     }
+
+    <-stop
+    cancel()
+    stopInformer()
 }
 
 func Get_Cgroup_mapping(cgroup uint64)(ContainerMapping , bool){
@@ -0,0 +1,27 @@
+package kube
+
+import "testing"
+
+func TestPodWorkload(t *testing.T) {
+	tests := []struct {
+		name   string
+		pod    string
+		labels map[string]string
+		want   string
+	}{
+		{"deployment", "web-7d4b9c8f6d-x2k9p", map[string]string{"pod-template-hash": "7d4b9c8f6d"}, "web"},
+		{"deployment with dashes", "shop-api-v2-5f6c7d-abcde", map[string]string{"pod-template-hash": "5f6c7d"}, "shop-api-v2"},
+		{"hash not in the name", "web-x2k9p", map[string]string{"pod-template-hash": "7d4b9c8f6d"}, "web-x2k9p"},
+		{"statefulset", "db-2", map[string]string{"controller-revision-hash": "db-6c9f8", "statefulset.kubernetes.io/pod-name": "db-2"}, "db"},
+		{"daemonset", "node-exporter-qz7lm", map[string]string{"controller-revision-hash": "5b8d7"}, "node-exporter"},
+		{"job", "migrate-8xk2d", map[string]string{"job-name": "migrate"}, "migrate"},
+		{"bare pod", "debug", nil, "debug"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podWorkload(tt.pod, tt.labels); got != tt.want {
+				t.Errorf("podWorkload(%q) = %q , want %q", tt.pod, got, tt.want)
+			}
+		})
+	}
+}
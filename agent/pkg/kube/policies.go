@@ -0,0 +1,112 @@
+package kube
+
+import (
+	"agent/pkg/config"
+	"fmt"
+	"log"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Policy_view is what NetworkPolicies are resolved against: the policies , pods and namespaces
+// of the whole cluster and the services pods are reached through. The objects are shared with
+// the informer caches and must not be modified.
+type Policy_view struct {
+	Policies   []*networkingv1.NetworkPolicy
+	Pods       []*corev1.Pod
+	Namespaces []*corev1.Namespace
+	Services   []*corev1.Service
+	Slices     []*discoveryv1.EndpointSlice
+}
+
+var (
+	policyFactory informers.SharedInformerFactory
+	policyStop    chan struct{}
+	policy_mu     sync.Mutex
+)
+
+// WatchNetworkPolicies watches the objects of a Policy_view and calls onChange after any of them changed ,
+// also on every resync. It blocks until the first lists are applied.
+func WatchNetworkPolicies(onChange func()) error {
+	cs, err := GetClientset()
+	if err != nil {
+		return err
+	}
+	factory := informers.NewSharedInformerFactory(cs, config.Get().Kube.RescanInterval)
+	synced := []cache.InformerSynced{}
+	for _, informer := range []cache.SharedIndexInformer{
+		factory.Networking().V1().NetworkPolicies().Informer(),
+		factory.Core().V1().Pods().Informer(),
+		factory.Core().V1().Namespaces().Informer(),
+		factory.Core().V1().Services().Informer(),
+		factory.Discovery().V1().EndpointSlices().Informer(),
+	} {
+		_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(any) { onChange() },
+			UpdateFunc: func(_, _ any) { onChange() },
+			DeleteFunc: func(any) { onChange() },
+		})
+		if err != nil {
+			return fmt.Errorf("Cannot register NetworkPolicy handler: %w", err)
+		}
+		synced = append(synced, informer.HasSynced)
+	}
+
+	stop := make(chan struct{})
+	log.Printf(" Watching NetworkPolicies...")
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, synced...) {
+		close(stop)
+		return fmt.Errorf("NetworkPolicy informers did not sync")
+	}
+
+	policy_mu.Lock()
+	policyFactory, policyStop = factory, stop
+	policy_mu.Unlock()
+	return nil
+}
+
+func stopPolicyWatch() {
+	policy_mu.Lock()
+	defer policy_mu.Unlock()
+	if policyStop != nil {
+		close(policyStop)
+		policyStop, policyFactory = nil, nil
+	}
+}
+
+// NetworkPolicyView lists what the watch started by WatchNetworkPolicies holds
+func NetworkPolicyView() (Policy_view, error) {
+	policy_mu.Lock()
+	factory := policyFactory
+	policy_mu.Unlock()
+	if factory == nil {
+		return Policy_view{}, fmt.Errorf("NetworkPolicies are not watched")
+	}
+
+	var view Policy_view
+	var err error
+	all := labels.Everything()
+	if view.Policies, err = factory.Networking().V1().NetworkPolicies().Lister().List(all); err != nil {
+		return Policy_view{}, err
+	}
+	if view.Pods, err = factory.Core().V1().Pods().Lister().List(all); err != nil {
+		return Policy_view{}, err
+	}
+	if view.Namespaces, err = factory.Core().V1().Namespaces().Lister().List(all); err != nil {
+		return Policy_view{}, err
+	}
+	if view.Services, err = factory.Core().V1().Services().Lister().List(all); err != nil {
+		return Policy_view{}, err
+	}
+	if view.Slices, err = factory.Discovery().V1().EndpointSlices().Lister().List(all); err != nil {
+		return Policy_view{}, err
+	}
+	return view, nil
+}
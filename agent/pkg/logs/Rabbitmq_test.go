@@ -0,0 +1,77 @@
+package logs
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestHandleNetworkCommand(t *testing.T) {
+	body := []byte(`[{"protocol": 6, "dst_port": 80, "action": 1}, {"protocol": 6, "dst_port": 443, "action": 1}, {"protocol": 17, "action": 1}]`)
+	tests := []struct {
+		name        string
+		result      error
+		wantStatus  string
+		wantApplied int
+		wantSkipped []uint32
+	}{
+		{"applied", nil, "applied", 3, nil},
+		{"server rule left out", &Unindexed_rules_error{IDs: []uint32{2}}, "partial", 2, []uint32{2}},
+		{"policy rules left out", &Unindexed_rules_error{IDs: []uint32{3, 4}}, "partial", 3, []uint32{3, 4}},
+		{"both left out", &Unindexed_rules_error{IDs: []uint32{1, 2, 7}}, "partial", 1, []uint32{1, 2, 7}},
+		{"failed", errors.New("rule_state: no space"), "failed", 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			networkCh := make(chan FlowRule_cmd, 1)
+			go func() {
+				cmd := <-networkCh
+				cmd.Result <- tt.result
+			}()
+			msg := amqp.Delivery{
+				CorrelationId: "cmd-1",
+				Headers:       amqp.Table{"arg": int32(CommandNetwork), "version": int32(COMMAND_VERSION)},
+				Body:          body,
+			}
+			ack := handle_command(msg, networkCh, nil, nil, nil, nil)
+			if ack.Status != tt.wantStatus || ack.Applied != tt.wantApplied || !slices.Equal(ack.Skipped, tt.wantSkipped) {
+				t.Errorf("ack = %s , applied %d , skipped %v , want %s , %d , %v", ack.Status, ack.Applied, ack.Skipped, tt.wantStatus, tt.wantApplied, tt.wantSkipped)
+			}
+			if (tt.result == nil) != (ack.Error == "") {
+				t.Errorf("ack error = %q , want the result's", ack.Error)
+			}
+		})
+	}
+}
+
+func TestProducerLost(t *testing.T) {
+	spool, err := OpenSpool(t.TempDir(), 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	defer func() { producerSpool, producerWindow = nil, nil }()
+	producerSpool = spool
+
+	for i := 0; i < 3; i++ {
+		spool.Append(spoolMsg(i))
+	}
+	// message 0 is confirmed , 1 and 2 are waiting for their confirms , 3 and 4 were published live after them
+	_, first, _ := spool.Next()
+	spool.Commit(first)
+	for i := 1; i < 3; i++ {
+		_, pos, _ := spool.Next()
+		producerWindow = append(producerWindow, unconfirmed{spooled: true, pos: pos})
+	}
+	producerWindow = append(producerWindow, unconfirmed{msg: spoolMsg(3)}, unconfirmed{msg: spoolMsg(4)})
+
+	producerLost()
+	if len(producerWindow) != 0 || producerUp {
+		t.Errorf("window of %d , up %v after the connection was lost", len(producerWindow), producerUp)
+	}
+	if got := drain(t, spool); !slices.Equal(got, bodies(1, 5)) {
+		t.Errorf("replayed %q , want %q", got, bodies(1, 5))
+	}
+}
@@ -0,0 +1,58 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+func (c Capture_chunk) Encode() []byte {
+	body, err := json.Marshal(c)
+	if err != nil {
+		log.Printf(" JSON marshal failed: %v", err)
+		return nil
+	}
+	return body
+}
+
+// DecodeCaptureRequest decodes a capture command body , rejecting limits and filters that can't be applied
+func DecodeCaptureRequest(data []byte) (Capture_request, error) {
+	var req Capture_request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return Capture_request{}, fmt.Errorf("invalid capture request: %w", err)
+	}
+	if req.CaptureID == "" || req.Namespace == "" || req.Pod == "" {
+		return Capture_request{}, fmt.Errorf("capture request needs a capture_id , a namespace and a pod")
+	}
+	if req.DurationSeconds < 0 || req.MaxPackets < 0 {
+		return Capture_request{}, fmt.Errorf("duration_seconds and max_packets must not be negative")
+	}
+	if req.Snaplen < 0 || req.Snaplen > CAPTURE_MAX_SNAPLEN {
+		return Capture_request{}, fmt.Errorf("snaplen must be between 0 and %d", CAPTURE_MAX_SNAPLEN)
+	}
+	if req.Filter != nil {
+		if _, err := req.CaptureFilter(); err != nil {
+			return Capture_request{}, err
+		}
+	}
+	return req, nil
+}
+
+// CaptureFilter converts the filter of a request to the rule capture_packet matches
+func (r Capture_request) CaptureFilter() (FlowRule, error) {
+	if r.Filter == nil {
+		return FlowRule{}, nil
+	}
+	filter := *r.Filter
+	// scope and fqdn are checked with their own maps , which only hold rules
+	if filter.Scope != nil || filter.FQDN != "" {
+		return FlowRule{}, fmt.Errorf("capture filter: scope and fqdn are not supported")
+	}
+	// rule_matches skips rules without an action
+	filter.Action = ACTION_ALERT
+	set, err := CompileFlowRules([]FlowRuleInput{filter})
+	if err != nil {
+		return FlowRule{}, fmt.Errorf("capture filter: %w", err)
+	}
+	return set.Rules[0], nil
+}
@@ -0,0 +1,104 @@
+package logs
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS_answer is an address a DNS response resolved a name to
+type DNS_answer struct {
+	Addr netip.Addr
+	TTL  time.Duration
+}
+
+// ParseDNSResponse returns the question name of a DNS response and the A / AAAA records
+// answering it , CNAMEs in between are followed through the answer section.
+// Names may use compression pointers , dnsmessage resolves them against the whole message.
+func ParseDNSResponse(msg []byte) (string, []DNS_answer, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil {
+		return "", nil, err
+	}
+	if !header.Response || header.RCode != dnsmessage.RCodeSuccess {
+		return "", nil, nil
+	}
+
+	question, err := p.Question()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return "", nil, err
+	}
+
+	// names that stand for the question , it and the CNAMEs it leads to
+	names := map[string]bool{strings.ToLower(question.Name.String()): true}
+	var answers []DNS_answer
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err == nil {
+			err = readAnswer(&p, h, names, &answers)
+		}
+		if err != nil {
+			// a response cut at DNS_MAX_PAYLOAD still gives the answers before the cut
+			if len(answers) > 0 {
+				break
+			}
+			return "", nil, err
+		}
+	}
+
+	return strings.TrimSuffix(strings.ToLower(question.Name.String()), "."), answers, nil
+}
+
+// readAnswer reads the record of h , keeping the addresses and CNAMEs of the names
+func readAnswer(p *dnsmessage.Parser, h dnsmessage.ResourceHeader, names map[string]bool, answers *[]DNS_answer) error {
+	owner := names[strings.ToLower(h.Name.String())]
+	ttl := time.Duration(h.TTL) * time.Second
+
+	switch h.Type {
+	case dnsmessage.TypeA:
+		r, err := p.AResource()
+		if err != nil {
+			return err
+		}
+		if owner {
+			*answers = append(*answers, DNS_answer{Addr: netip.AddrFrom4(r.A), TTL: ttl})
+		}
+	case dnsmessage.TypeAAAA:
+		r, err := p.AAAAResource()
+		if err != nil {
+			return err
+		}
+		if owner {
+			*answers = append(*answers, DNS_answer{Addr: netip.AddrFrom16(r.AAAA), TTL: ttl})
+		}
+	case dnsmessage.TypeCNAME:
+		r, err := p.CNAMEResource()
+		if err != nil {
+			return err
+		}
+		if owner {
+			names[strings.ToLower(r.CNAME.String())] = true
+		}
+	default:
+		return p.SkipAnswer()
+	}
+	return nil
+}
+
+// Message returns the DNS message of the event
+func (e *Dns_event) Message() ([]byte, error) {
+	if int(e.Len) > len(e.Payload) {
+		return nil, fmt.Errorf("dns event of %d bytes , max is %d", e.Len, len(e.Payload))
+	}
+	return e.Payload[:e.Len], nil
+}
@@ -0,0 +1,151 @@
+package logs
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsRecord is an answer record of a test response
+type dnsRecord struct {
+	name  string
+	ttl   uint32
+	a     string // A or AAAA when set
+	cname string
+}
+
+// dnsResponse builds a compressed DNS response to a question for name
+func dnsResponse(t *testing.T, rcode dnsmessage.RCode, name string, records ...dnsRecord) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, Response: true, RCode: rcode})
+	b.EnableCompression()
+	must := func(err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(b.StartQuestions())
+	must(b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}))
+	must(b.StartAnswers())
+	for _, r := range records {
+		h := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(r.name), Class: dnsmessage.ClassINET, TTL: r.ttl}
+		switch {
+		case r.cname != "":
+			must(b.CNAMEResource(h, dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(r.cname)}))
+		case netip.MustParseAddr(r.a).Is4():
+			must(b.AResource(h, dnsmessage.AResource{A: netip.MustParseAddr(r.a).As4()}))
+		default:
+			must(b.AAAAResource(h, dnsmessage.AAAAResource{AAAA: netip.MustParseAddr(r.a).As16()}))
+		}
+	}
+	msg, err := b.Finish()
+	must(err)
+	return msg
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      func(t *testing.T) []byte
+		wantName string
+		want     []DNS_answer
+		wantErr  bool
+	}{
+		{
+			name: "A and AAAA",
+			msg: func(t *testing.T) []byte {
+				return dnsResponse(t, dnsmessage.RCodeSuccess, "API.Example.com.",
+					dnsRecord{name: "api.example.com.", ttl: 60, a: "93.184.216.34"},
+					dnsRecord{name: "api.example.com.", ttl: 30, a: "2606:2800:220:1::248"})
+			},
+			wantName: "api.example.com",
+			want: []DNS_answer{
+				{Addr: netip.MustParseAddr("93.184.216.34"), TTL: time.Minute},
+				{Addr: netip.MustParseAddr("2606:2800:220:1::248"), TTL: 30 * time.Second},
+			},
+		},
+		{
+			name: "CNAME chain",
+			msg: func(t *testing.T) []byte {
+				return dnsResponse(t, dnsmessage.RCodeSuccess, "www.example.com.",
+					dnsRecord{name: "www.example.com.", ttl: 300, cname: "edge.cdn.net."},
+					dnsRecord{name: "edge.cdn.net.", ttl: 300, cname: "pop1.cdn.net."},
+					dnsRecord{name: "pop1.cdn.net.", ttl: 20, a: "198.51.100.7"})
+			},
+			wantName: "www.example.com",
+			want:     []DNS_answer{{Addr: netip.MustParseAddr("198.51.100.7"), TTL: 20 * time.Second}},
+		},
+		{
+			name: "records of other names are left out",
+			msg: func(t *testing.T) []byte {
+				return dnsResponse(t, dnsmessage.RCodeSuccess, "api.example.com.",
+					dnsRecord{name: "evil.example.org.", ttl: 60, a: "203.0.113.9"},
+					dnsRecord{name: "api.example.com.", ttl: 60, a: "192.0.2.1"})
+			},
+			wantName: "api.example.com",
+			want:     []DNS_answer{{Addr: netip.MustParseAddr("192.0.2.1"), TTL: time.Minute}},
+		},
+		{
+			name: "NXDOMAIN",
+			msg: func(t *testing.T) []byte {
+				return dnsResponse(t, dnsmessage.RCodeNameError, "missing.example.com.")
+			},
+		},
+		{
+			name: "query",
+			msg: func(t *testing.T) []byte {
+				b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1})
+				b.StartQuestions()
+				b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("api.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+				msg, _ := b.Finish()
+				return msg
+			},
+		},
+		{
+			name: "cut after the first answer",
+			msg: func(t *testing.T) []byte {
+				msg := dnsResponse(t, dnsmessage.RCodeSuccess, "api.example.com.",
+					dnsRecord{name: "api.example.com.", ttl: 60, a: "192.0.2.1"},
+					dnsRecord{name: "api.example.com.", ttl: 60, a: "192.0.2.2"})
+				return msg[:len(msg)-3]
+			},
+			wantName: "api.example.com",
+			want:     []DNS_answer{{Addr: netip.MustParseAddr("192.0.2.1"), TTL: time.Minute}},
+		},
+		{
+			name:    "too short",
+			msg:     func(t *testing.T) []byte { return []byte{0, 1, 0x80} },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, answers, err := ParseDNSResponse(tt.msg(t))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v , want error %v", err, tt.wantErr)
+			}
+			if name != tt.wantName {
+				t.Errorf("name = %q , want %q", name, tt.wantName)
+			}
+			if !slices.Equal(answers, tt.want) {
+				t.Errorf("answers = %v , want %v", answers, tt.want)
+			}
+		})
+	}
+}
+
+func TestDnsEventMessage(t *testing.T) {
+	var event Dns_event
+	event.Len = 3
+	copy(event.Payload[:], "abc")
+	if msg, err := event.Message(); err != nil || string(msg) != "abc" {
+		t.Errorf("Message() = %q , %v", msg, err)
+	}
+	event.Len = uint16(len(event.Payload) + 1)
+	if _, err := event.Message(); err == nil {
+		t.Error("Message() of a length past the payload did not fail")
+	}
+}
@@ -0,0 +1,547 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// UnmarshalJSON accepts a port number , or a string holding a port or a "min-max" range
+func (p *PortRange) UnmarshalJSON(data []byte) error {
+	var port uint16
+	if err := json.Unmarshal(data, &port); err == nil {
+		*p = PortRange{Min: port, Max: port}
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("port must be a number or a \"min-max\" string")
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		*p = PortRange{}
+		return nil
+	}
+
+	lo, hi, isRange := strings.Cut(s, "-")
+	min, err := strconv.ParseUint(strings.TrimSpace(lo), 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", s)
+	}
+	max := min
+	if isRange {
+		if max, err = strconv.ParseUint(strings.TrimSpace(hi), 10, 16); err != nil {
+			return fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	if min > max {
+		return fmt.Errorf("invalid port range %q , min is above max", s)
+	}
+	*p = PortRange{Min: uint16(min), Max: uint16(max)}
+	return nil
+}
+
+func (p PortRange) Any() bool {
+	return p.Min == 0 && p.Max == 0
+}
+
+var actionNames = map[Rule_action]string{
+	ACTION_NONE:       "none",
+	ACTION_DROP:       "drop",
+	ACTION_ALLOW:      "allow",
+	ACTION_ALERT:      "alert",
+	ACTION_RATE_LIMIT: "rate_limit",
+}
+
+func (a Rule_action) String() string {
+	if name, ok := actionNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("action_%d", uint8(a))
+}
+
+// UnmarshalJSON accepts an action name , or its number as rules were sent before actions had names
+func (a *Rule_action) UnmarshalJSON(data []byte) error {
+	var n uint8
+	if err := json.Unmarshal(data, &n); err == nil {
+		*a = Rule_action(n)
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("action must be a name or a number")
+	}
+	name := strings.ToLower(strings.TrimSpace(s))
+	if name == "" {
+		*a = ACTION_NONE
+		return nil
+	}
+	for action, known := range actionNames {
+		if known == name {
+			*a = action
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown action %q", s)
+}
+
+func (a Rule_action) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// Pod_scope is a Rule_scope with its selector parsed
+type Pod_scope struct {
+	PodUID    string
+	PodUIDs   map[string]bool // nil when the scope has none
+	Namespace string
+	Selector  labels.Selector // nil when the scope has none
+}
+
+func parseScope(scope Rule_scope) (Pod_scope, error) {
+	if scope.PodUID == "" && len(scope.PodUIDs) == 0 && scope.Namespace == "" && strings.TrimSpace(scope.Selector) == "" {
+		return Pod_scope{}, fmt.Errorf("scope needs a pod_uid , pod_uids , a namespace or a selector")
+	}
+	parsed := Pod_scope{PodUID: scope.PodUID, Namespace: scope.Namespace}
+	if len(scope.PodUIDs) > 0 {
+		parsed.PodUIDs = make(map[string]bool, len(scope.PodUIDs))
+		for _, uid := range scope.PodUIDs {
+			parsed.PodUIDs[uid] = true
+		}
+	}
+	if strings.TrimSpace(scope.Selector) != "" {
+		selector, err := labels.Parse(scope.Selector)
+		if err != nil {
+			return Pod_scope{}, fmt.Errorf("scope selector: %w", err)
+		}
+		parsed.Selector = selector
+	}
+	return parsed, nil
+}
+
+// Matches reports whether a pod is in the scope
+func (s Pod_scope) Matches(podUID, namespace string, podLabels map[string]string) bool {
+	if s.PodUID != "" && s.PodUID != podUID {
+		return false
+	}
+	if s.PodUIDs != nil && !s.PodUIDs[podUID] {
+		return false
+	}
+	if s.Namespace != "" && s.Namespace != namespace {
+		return false
+	}
+	return s.Selector == nil || s.Selector.Matches(labels.Set(podLabels))
+}
+
+// FQDN_pattern is a lower case domain name without the final dot.
+// "*.example.com" matches every name under example.com , but not example.com itself.
+type FQDN_pattern string
+
+func parseFQDN(s string) (FQDN_pattern, error) {
+	name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+	parts := strings.Split(strings.TrimPrefix(name, "*."), ".")
+	if len(name) > 253 || len(parts) < 2 {
+		return "", fmt.Errorf("fqdn %q: want a name like api.example.com or *.example.com", s)
+	}
+	for _, label := range parts {
+		if label == "" || len(label) > 63 || strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+			return "", fmt.Errorf("fqdn %q: invalid label %q , * is only allowed as the whole first label", s, label)
+		}
+	}
+	return FQDN_pattern(name), nil
+}
+
+// Matches reports whether a resolved name is covered by the pattern
+func (p FQDN_pattern) Matches(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if suffix, ok := strings.CutPrefix(string(p), "*"); ok {
+		return strings.HasSuffix(name, suffix)
+	}
+	return name == string(p)
+}
+
+// setSNI makes a rule match the TLS server name pattern , a wildcard keeps its suffix from the dot
+func setSNI(rule *FlowRule, pattern FQDN_pattern) error {
+	name := string(pattern)
+	if suffix, ok := strings.CutPrefix(name, "*"); ok {
+		name = suffix
+		rule.SniWildcard = 1
+	}
+	// the traffic program keeps 63 bytes of the name
+	if len(name) >= len(rule.SNI) {
+		return fmt.Errorf("sni %q is longer than %d bytes", pattern, len(rule.SNI)-1)
+	}
+	rule.Fields |= RULE_F_SNI
+	rule.SNI = StringToFixed64(name)
+	rule.SniLen = uint8(len(name))
+	return nil
+}
+
+// parsePrefix accepts a CIDR or a single address , which becomes a /32 or /128
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			if !prefix.IsValid() {
+				return netip.Prefix{}, fmt.Errorf("invalid IPv4-mapped prefix %q", s)
+			}
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func prefixFamily(p netip.Prefix) uint8 {
+	if p.Addr().Is4() {
+		return FAMILY_IPV4
+	}
+	return FAMILY_IPV6
+}
+
+// ConvertToFlowRule converts every field of a rule except its CIDRs to the BPF layout
+func ConvertToFlowRule(in FlowRuleInput) FlowRule {
+	rule := FlowRule{
+		Protocol:    in.Protocol,
+		DpiProtocol: in.DpiProtocol,
+		Action:      uint8(in.Action),
+		Method:      StringToFixed8(in.Method),
+		Path:        StringToFixed64(in.Path),
+		QueryName:   StringToFixed64(in.QueryName),
+		QueryType:   in.QueryType,
+	}
+	if in.Action == ACTION_RATE_LIMIT {
+		rule.RatePPS = in.RatePPS
+		rule.Burst = in.Burst
+		if rule.Burst == 0 {
+			rule.Burst = in.RatePPS
+		}
+	}
+
+	if in.Protocol != 0 {
+		rule.Fields |= RULE_F_PROTOCOL
+	}
+	if !in.SrcPort.Any() {
+		rule.Fields |= RULE_F_SRC_PORT
+		rule.SrcPortMin, rule.SrcPortMax = in.SrcPort.Min, in.SrcPort.Max
+	}
+	if !in.DstPort.Any() {
+		rule.Fields |= RULE_F_DST_PORT
+		rule.DstPortMin, rule.DstPortMax = in.DstPort.Min, in.DstPort.Max
+	}
+	if in.Direction != nil {
+		rule.Fields |= RULE_F_DIRECTION
+		rule.Direction = *in.Direction
+	}
+	if in.DpiProtocol != 0 {
+		rule.Fields |= RULE_F_DPI
+	}
+	if in.IcmpType != nil {
+		rule.Fields |= RULE_F_ICMP_TYPE
+		rule.IcmpType = *in.IcmpType
+	}
+	if in.QueryType != 0 {
+		rule.Fields |= RULE_F_QUERY_TYPE
+	}
+	if in.Method != "" {
+		rule.Fields |= RULE_F_METHOD
+	}
+	if in.Path != "" {
+		rule.Fields |= RULE_F_PATH
+	}
+	if in.QueryName != "" {
+		rule.Fields |= RULE_F_QUERY_NAME
+	}
+	if in.NewFlow {
+		rule.Fields |= RULE_F_NEW_FLOW
+	}
+	return rule
+}
+
+// the fields an exact rule may set , all of them must be set with a single value
+const exactFields = RULE_F_SRC_CIDR | RULE_F_DST_CIDR | RULE_F_PROTOCOL | RULE_F_SRC_PORT |
+	RULE_F_DST_PORT | RULE_F_DIRECTION | RULE_F_FAMILY
+
+type cidrCandidate struct {
+	id     uint32
+	prefix netip.Prefix
+}
+
+// CompileFlowRules converts rules to the BPF layout and indexes them.
+// Rule i goes to slot i and , when enabled , to the first index it fits:
+// the exact 5-tuple hash , the destination port buckets , the destination CIDR trie ,
+// the source CIDR trie , and otherwise the ordered fallback list.
+// Rules past the MAX_FALLBACK_RULES first of the fallback list never match , they are listed in Unindexed.
+// Scoped and FQDN rules are left out of the exact index , its hits skip the rule_scopes and fqdn_ips checks.
+func CompileFlowRules(inputs []FlowRuleInput) (*Flow_ruleset, error) {
+	if len(inputs) > MAX_FLOW_RULES {
+		return nil, fmt.Errorf("too many rules: max is %d", MAX_FLOW_RULES)
+	}
+
+	set := &Flow_ruleset{
+		Rules:  make([]FlowRule, 0, len(inputs)),
+		Exact:  make(map[Exact_key]uint32),
+		Port:   make(map[Port_key]Rule_bucket),
+		Scopes: make(map[uint32]Pod_scope),
+		FQDNs:  make(map[uint32]FQDN_pattern),
+	}
+	set.Stats.Total = len(inputs)
+
+	var (
+		dstCands, srcCands []cidrCandidate
+		srcPrefixes        = make(map[uint32]netip.Prefix)
+		fallback           []uint32
+	)
+
+	for i, in := range inputs {
+		id := uint32(i)
+		if err := validateAction(in); err != nil {
+			return nil, fmt.Errorf("network rule %d: %w", i, err)
+		}
+		rule := ConvertToFlowRule(in)
+		if in.Scope != nil {
+			scope, err := parseScope(*in.Scope)
+			if err != nil {
+				return nil, fmt.Errorf("network rule %d: %w", i, err)
+			}
+			rule.Fields |= RULE_F_SCOPE
+			set.Scopes[id] = scope
+			set.Stats.Scoped++
+		}
+		if in.FQDN != "" {
+			pattern, err := parseFQDN(in.FQDN)
+			if err != nil {
+				return nil, fmt.Errorf("network rule %d: %w", i, err)
+			}
+			rule.Fields |= RULE_F_FQDN
+			set.FQDNs[id] = pattern
+			set.Stats.FQDN++
+		}
+		if in.SNI != "" {
+			pattern, err := parseFQDN(in.SNI)
+			if err != nil {
+				return nil, fmt.Errorf("network rule %d: sni: %w", i, err)
+			}
+			if err := setSNI(&rule, pattern); err != nil {
+				return nil, fmt.Errorf("network rule %d: %w", i, err)
+			}
+		}
+
+		var prefixes [2]netip.Prefix
+		for side, value := range []string{in.SrcIP, in.DstIP} {
+			if value == "" {
+				continue
+			}
+			prefix, err := parsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("network rule %d: %s: %w", i, []string{"src_ip", "dst_ip"}[side], err)
+			}
+			family := prefixFamily(prefix)
+			if rule.Fields&RULE_F_FAMILY != 0 && rule.Family != family {
+				return nil, fmt.Errorf("network rule %d: src_ip and dst_ip are of different families", i)
+			}
+			rule.Fields |= RULE_F_FAMILY
+			rule.Family = family
+			prefixes[side] = prefix
+
+			addr := prefix.Addr().AsSlice()
+			if side == 0 {
+				rule.Fields |= RULE_F_SRC_CIDR
+				copy(rule.SrcIP[:], addr)
+				rule.SrcPrefixlen = uint8(prefix.Bits())
+			} else {
+				rule.Fields |= RULE_F_DST_CIDR
+				copy(rule.DstIP[:], addr)
+				rule.DstPrefixlen = uint8(prefix.Bits())
+			}
+		}
+		set.Rules = append(set.Rules, rule)
+
+		if rule.Action == 0 {
+			set.Stats.Disabled++
+			continue
+		}
+
+		src, dst := prefixes[0], prefixes[1]
+		switch {
+		case isExact(rule, src, dst):
+			key := Exact_key{
+				Family:    rule.Family,
+				Protocol:  rule.Protocol,
+				Direction: rule.Direction,
+				SrcPort:   rule.SrcPortMin,
+				DstPort:   rule.DstPortMin,
+				SrcIP:     rule.SrcIP,
+				DstIP:     rule.DstIP,
+			}
+			// an earlier rule on the same tuple always wins
+			if _, ok := set.Exact[key]; !ok {
+				set.Exact[key] = id
+			}
+			set.Stats.Exact++
+			continue
+
+		case rule.Fields&RULE_F_PROTOCOL != 0 && rule.Fields&RULE_F_DST_PORT != 0 && rule.DstPortMin == rule.DstPortMax:
+			if addToPortBuckets(set.Port, rule, id) {
+				set.Stats.Port++
+				continue
+			}
+		}
+
+		if src.IsValid() {
+			srcPrefixes[id] = src
+		}
+		switch {
+		case dst.IsValid():
+			dstCands = append(dstCands, cidrCandidate{id, dst})
+		case src.IsValid():
+			srcCands = append(srcCands, cidrCandidate{id, src})
+		default:
+			fallback = append(fallback, id)
+		}
+	}
+
+	var demoted []uint32
+	set.DstCIDRs, demoted = buildCIDRBuckets(dstCands)
+	set.Stats.DstCIDR = len(dstCands) - len(demoted)
+	for _, id := range demoted {
+		if src, ok := srcPrefixes[id]; ok {
+			srcCands = append(srcCands, cidrCandidate{id, src})
+		} else {
+			fallback = append(fallback, id)
+		}
+	}
+
+	set.SrcCIDRs, demoted = buildCIDRBuckets(srcCands)
+	set.Stats.SrcCIDR = len(srcCands) - len(demoted)
+	fallback = append(fallback, demoted...)
+
+	slices.Sort(fallback)
+	// the fallback list keeps the first rules , the others are left out of the set instead of failing it
+	if len(fallback) > MAX_FALLBACK_RULES {
+		set.Unindexed = fallback[MAX_FALLBACK_RULES:]
+		fallback = fallback[:MAX_FALLBACK_RULES]
+		set.Stats.Unindexed = len(set.Unindexed)
+	}
+	set.Fallback.Count = uint32(len(fallback))
+	copy(set.Fallback.Ids[:], fallback)
+	set.Stats.Fallback = len(fallback)
+	return set, nil
+}
+
+// Unindexed_rules_error reports the rules a set was loaded without , they fit no index and the
+// fallback list was full. The rest of the set is in force.
+type Unindexed_rules_error struct {
+	IDs []uint32 // indexes in the loaded list , the server's rules come first
+}
+
+func (e *Unindexed_rules_error) Error() string {
+	return fmt.Sprintf("%d flow rules left out , they fit no index and the fallback list is full (max %d): %v",
+		len(e.IDs), MAX_FALLBACK_RULES, e.IDs)
+}
+
+func validateAction(in FlowRuleInput) error {
+	if _, ok := actionNames[in.Action]; !ok {
+		return fmt.Errorf("unknown action %d", uint8(in.Action))
+	}
+	if in.Action != ACTION_RATE_LIMIT {
+		return nil
+	}
+	if in.RatePPS == 0 || in.RatePPS > MAX_RATE_PPS {
+		return fmt.Errorf("rate_limit needs a rate_pps between 1 and %d", MAX_RATE_PPS)
+	}
+	return nil
+}
+
+// isExact reports whether a rule sets exactly one value for every field of the 5-tuple and nothing else
+func isExact(rule FlowRule, src, dst netip.Prefix) bool {
+	return rule.Fields == exactFields &&
+		src.IsSingleIP() && dst.IsSingleIP() &&
+		rule.SrcPortMin == rule.SrcPortMax && rule.DstPortMin == rule.DstPortMax
+}
+
+// addToPortBuckets adds a rule to the bucket of its port , for both directions when it sets none.
+// It reports false , adding nothing , when a bucket is full.
+func addToPortBuckets(buckets map[Port_key]Rule_bucket, rule FlowRule, id uint32) bool {
+	directions := []uint8{0, 1}
+	if rule.Fields&RULE_F_DIRECTION != 0 {
+		directions = []uint8{rule.Direction}
+	}
+
+	keys := make([]Port_key, 0, len(directions))
+	for _, dir := range directions {
+		key := Port_key{Protocol: rule.Protocol, Direction: dir, DstPort: rule.DstPortMin}
+		if buckets[key].Count >= RULE_BUCKET_SIZE {
+			return false
+		}
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		bucket := buckets[key]
+		bucket.Ids[bucket.Count] = id
+		bucket.Count++
+		buckets[key] = bucket
+	}
+	return true
+}
+
+// buildCIDRBuckets gives every prefix a bucket holding the rules of all prefixes covering it.
+// When a bucket overflows its highest rule id is demoted , the caller moves it to the next index.
+func buildCIDRBuckets(cands []cidrCandidate) (map[CIDR_key]Rule_bucket, []uint32) {
+	var demoted []uint32
+	for {
+		buckets := make(map[CIDR_key]Rule_bucket)
+		overflow := -1
+		for _, p := range cands {
+			key := cidrKey(p.prefix)
+			if _, done := buckets[key]; done {
+				continue
+			}
+
+			var ids []uint32
+			for _, q := range cands {
+				if q.prefix.Bits() <= p.prefix.Bits() && q.prefix.Addr().BitLen() == p.prefix.Addr().BitLen() &&
+					q.prefix.Contains(p.prefix.Addr()) {
+					ids = append(ids, q.id)
+				}
+			}
+			slices.Sort(ids)
+			ids = slices.Compact(ids)
+
+			if len(ids) > RULE_BUCKET_SIZE {
+				overflow = int(ids[len(ids)-1])
+				break
+			}
+			var bucket Rule_bucket
+			bucket.Count = uint32(len(ids))
+			copy(bucket.Ids[:], ids)
+			buckets[key] = bucket
+		}
+
+		if overflow < 0 {
+			return buckets, demoted
+		}
+		demoted = append(demoted, uint32(overflow))
+		cands = slices.DeleteFunc(cands, func(c cidrCandidate) bool { return c.id == uint32(overflow) })
+	}
+}
+
+func cidrKey(p netip.Prefix) CIDR_key {
+	key := CIDR_key{Prefixlen: uint32(16 + p.Bits()), Family: prefixFamily(p)}
+	copy(key.Addr[:], p.Addr().AsSlice())
+	return key
+}
@@ -0,0 +1,484 @@
+package logs
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func dir(d uint8) *uint8 { return &d }
+
+func TestCompileFlowRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		inputs  []FlowRuleInput
+		want    Flow_rule_stats
+		wantErr string
+	}{
+		{
+			name: "exact 5-tuple",
+			inputs: []FlowRuleInput{{
+				SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: PortRange{1000, 1000}, DstPort: PortRange{80, 80},
+				Protocol: 6, Direction: dir(DIR_FROM_POD), Action: ACTION_DROP,
+			}},
+			want: Flow_rule_stats{Total: 1, Exact: 1},
+		},
+		{
+			name: "scoped 5-tuple is not exact",
+			inputs: []FlowRuleInput{{
+				SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: PortRange{1000, 1000}, DstPort: PortRange{80, 80},
+				Protocol: 6, Direction: dir(DIR_FROM_POD), Action: ACTION_DROP, Scope: &Rule_scope{Namespace: "shop"},
+			}},
+			want: Flow_rule_stats{Total: 1, Port: 1, Scoped: 1},
+		},
+		{
+			name:   "single port",
+			inputs: []FlowRuleInput{{Protocol: 6, DstPort: PortRange{443, 443}, Action: ACTION_ALLOW}},
+			want:   Flow_rule_stats{Total: 1, Port: 1},
+		},
+		{
+			name:   "port range goes to the destination trie",
+			inputs: []FlowRuleInput{{Protocol: 6, DstIP: "10.0.0.0/8", DstPort: PortRange{1000, 2000}, Action: ACTION_DROP}},
+			want:   Flow_rule_stats{Total: 1, DstCIDR: 1},
+		},
+		{
+			name:   "source CIDR",
+			inputs: []FlowRuleInput{{SrcIP: "fd00::/8", Action: ACTION_ALERT}},
+			want:   Flow_rule_stats{Total: 1, SrcCIDR: 1},
+		},
+		{
+			name:   "no index",
+			inputs: []FlowRuleInput{{Protocol: 17, Action: ACTION_DROP}},
+			want:   Flow_rule_stats{Total: 1, Fallback: 1},
+		},
+		{
+			name:   "disabled",
+			inputs: []FlowRuleInput{{Protocol: 17}},
+			want:   Flow_rule_stats{Total: 1, Disabled: 1},
+		},
+		{
+			name:   "fqdn",
+			inputs: []FlowRuleInput{{FQDN: "*.example.com", Protocol: 6, DstPort: PortRange{443, 443}, Action: ACTION_ALLOW}},
+			want:   Flow_rule_stats{Total: 1, Port: 1, FQDN: 1},
+		},
+		{
+			name:   "full port bucket spills to fallback",
+			inputs: slices.Repeat([]FlowRuleInput{{Protocol: 6, DstPort: PortRange{80, 80}, Action: ACTION_DROP}}, RULE_BUCKET_SIZE+1),
+			want:   Flow_rule_stats{Total: RULE_BUCKET_SIZE + 1, Port: RULE_BUCKET_SIZE, Fallback: 1},
+		},
+		{
+			name:   "full fallback list leaves rules out",
+			inputs: slices.Repeat([]FlowRuleInput{{Protocol: 17, Action: ACTION_DROP}}, MAX_FALLBACK_RULES+3),
+			want:   Flow_rule_stats{Total: MAX_FALLBACK_RULES + 3, Fallback: MAX_FALLBACK_RULES, Unindexed: 3},
+		},
+		{
+			name:    "too many rules",
+			inputs:  make([]FlowRuleInput, MAX_FLOW_RULES+1),
+			wantErr: "too many rules",
+		},
+		{
+			name:    "unknown action",
+			inputs:  []FlowRuleInput{{Action: 9}},
+			wantErr: "unknown action 9",
+		},
+		{
+			name:    "rate limit without a rate",
+			inputs:  []FlowRuleInput{{Action: ACTION_RATE_LIMIT}},
+			wantErr: "rate_pps",
+		},
+		{
+			name:    "mixed families",
+			inputs:  []FlowRuleInput{{SrcIP: "10.0.0.1", DstIP: "fd00::1", Action: ACTION_DROP}},
+			wantErr: "different families",
+		},
+		{
+			name:    "bad CIDR",
+			inputs:  []FlowRuleInput{{DstIP: "10.0.0.0/33", Action: ACTION_DROP}},
+			wantErr: "dst_ip",
+		},
+		{
+			name:    "bad fqdn",
+			inputs:  []FlowRuleInput{{FQDN: "api.*.com", Action: ACTION_DROP}},
+			wantErr: "network rule 0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := CompileFlowRules(tt.inputs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v , want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if set.Stats != tt.want {
+				t.Errorf("stats = %+v , want %+v", set.Stats, tt.want)
+			}
+			if int(set.Fallback.Count) != tt.want.Fallback || len(set.Unindexed) != tt.want.Unindexed {
+				t.Errorf("fallback %d , unindexed %v", set.Fallback.Count, set.Unindexed)
+			}
+			if !slices.IsSorted(set.Fallback.Ids[:set.Fallback.Count]) {
+				t.Errorf("fallback ids not in order: %v", set.Fallback.Ids[:set.Fallback.Count])
+			}
+		})
+	}
+}
+
+func TestCompileFlowRulesKeepsFirstFallbackRules(t *testing.T) {
+	inputs := slices.Repeat([]FlowRuleInput{{Protocol: 17, Action: ACTION_DROP}}, MAX_FALLBACK_RULES+2)
+	set, err := CompileFlowRules(inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{MAX_FALLBACK_RULES, MAX_FALLBACK_RULES + 1}; !slices.Equal(set.Unindexed, want) {
+		t.Errorf("unindexed = %v , want %v", set.Unindexed, want)
+	}
+	if set.Fallback.Ids[0] != 0 || set.Fallback.Ids[MAX_FALLBACK_RULES-1] != MAX_FALLBACK_RULES-1 {
+		t.Errorf("fallback = %v", set.Fallback.Ids)
+	}
+}
+
+func TestCIDRBucketsHoldCoveringRules(t *testing.T) {
+	set, err := CompileFlowRules([]FlowRuleInput{
+		{DstIP: "10.0.0.0/8", Action: ACTION_DROP},
+		{DstIP: "10.1.0.0/16", Action: ACTION_ALLOW},
+		{DstIP: "10.1.2.0/24", Action: ACTION_ALERT},
+		{DstIP: "192.168.0.0/16", Action: ACTION_DROP},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		prefix string
+		want   []uint32
+	}{
+		{"10.0.0.0/8", []uint32{0}},
+		{"10.1.0.0/16", []uint32{0, 1}},
+		{"10.1.2.0/24", []uint32{0, 1, 2}},
+		{"192.168.0.0/16", []uint32{3}},
+	}
+	for _, tt := range tests {
+		bucket, ok := set.DstCIDRs[cidrKey(netip.MustParsePrefix(tt.prefix))]
+		if !ok {
+			t.Errorf("%s has no bucket", tt.prefix)
+			continue
+		}
+		if got := bucket.Ids[:bucket.Count]; !slices.Equal(got, tt.want) {
+			t.Errorf("%s: bucket = %v , want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestPortRangeUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PortRange
+		wantErr bool
+	}{
+		{`443`, PortRange{443, 443}, false},
+		{`"8080"`, PortRange{8080, 8080}, false},
+		{`"1000-2000"`, PortRange{1000, 2000}, false},
+		{`" 1000 - 2000 "`, PortRange{1000, 2000}, false},
+		{`""`, PortRange{}, false},
+		{`"2000-1000"`, PortRange{}, true},
+		{`"70000"`, PortRange{}, true},
+		{`"http"`, PortRange{}, true},
+		{`true`, PortRange{}, true},
+	}
+	for _, tt := range tests {
+		var got PortRange
+		err := got.UnmarshalJSON([]byte(tt.in))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v , want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("%s = %+v , want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// testPacket is the 5-tuple of a flow_event_t
+type testPacket struct {
+	protocol, direction uint8
+	src, dst            netip.Addr
+	sport, dport        uint16
+}
+
+// matches is rule_matches of traffic.bpf.c for the fields the tests set
+func (p testPacket) matches(r FlowRule) bool {
+	f := r.Fields
+	family := FAMILY_IPV6
+	if p.src.Is4() {
+		family = FAMILY_IPV4
+	}
+	in := func(addr netip.Addr, ip [16]byte, bits uint8) bool {
+		prefix := netip.PrefixFrom(netip.AddrFrom16(ip), int(bits))
+		if family == FAMILY_IPV4 {
+			prefix = netip.PrefixFrom(netip.AddrFrom4([4]byte(ip[:4])), int(bits))
+		}
+		return prefix.Contains(addr)
+	}
+	return r.Action != 0 &&
+		(f&RULE_F_FAMILY == 0 || r.Family == uint8(family)) &&
+		(f&RULE_F_SRC_CIDR == 0 || in(p.src, r.SrcIP, r.SrcPrefixlen)) &&
+		(f&RULE_F_DST_CIDR == 0 || in(p.dst, r.DstIP, r.DstPrefixlen)) &&
+		(f&RULE_F_PROTOCOL == 0 || r.Protocol == p.protocol) &&
+		(f&RULE_F_SRC_PORT == 0 || (p.sport >= r.SrcPortMin && p.sport <= r.SrcPortMax)) &&
+		(f&RULE_F_DST_PORT == 0 || (p.dport >= r.DstPortMin && p.dport <= r.DstPortMax)) &&
+		(f&RULE_F_DIRECTION == 0 || r.Direction == p.direction)
+}
+
+// linearLookup is the rule loop the indexes replaced
+func linearLookup(set *Flow_ruleset, p testPacket) uint32 {
+	for id, rule := range set.Rules {
+		if p.matches(rule) && !slices.Contains(set.Unindexed, uint32(id)) {
+			return uint32(id)
+		}
+	}
+	return NO_RULE
+}
+
+// indexedLookup is find_rule of traffic.bpf.c
+func indexedLookup(set *Flow_ruleset, p testPacket) uint32 {
+	best := uint32(NO_RULE)
+	first := func(ids []uint32) {
+		for _, id := range ids {
+			if id >= best {
+				return
+			}
+			if p.matches(set.Rules[id]) {
+				best = id
+				return
+			}
+		}
+	}
+	family := uint8(FAMILY_IPV6)
+	if p.src.Is4() {
+		family = FAMILY_IPV4
+	}
+	key := Exact_key{Family: family, Protocol: p.protocol, Direction: p.direction, SrcPort: p.sport, DstPort: p.dport}
+	copy(key.SrcIP[:], p.src.AsSlice())
+	copy(key.DstIP[:], p.dst.AsSlice())
+	if id, ok := set.Exact[key]; ok {
+		best = id
+	}
+	bucket := set.Port[Port_key{Protocol: p.protocol, Direction: p.direction, DstPort: p.dport}]
+	first(bucket.Ids[:bucket.Count])
+	for _, trie := range []struct {
+		buckets map[CIDR_key]Rule_bucket
+		addr    netip.Addr
+	}{{set.DstCIDRs, p.dst}, {set.SrcCIDRs, p.src}} {
+		if len(trie.buckets) == 0 {
+			continue
+		}
+		// the longest prefix match of the LPM trie
+		for bits := trie.addr.BitLen(); bits >= 0; bits-- {
+			if bucket, ok := trie.buckets[cidrKey(netip.PrefixFrom(trie.addr, bits).Masked())]; ok {
+				first(bucket.Ids[:bucket.Count])
+				break
+			}
+		}
+	}
+	first(set.Fallback.Ids[:set.Fallback.Count])
+	return best
+}
+
+var (
+	testAddrs    = []string{"10.0.0.1", "10.0.0.2", "10.1.2.3", "10.1.9.9", "192.168.1.10", "172.16.0.5"}
+	testPrefixes = []string{"10.0.0.0/8", "10.0.0.0/24", "10.1.0.0/16", "192.168.1.0/24", "10.0.0.1", "0.0.0.0/0"}
+	testPorts    = []uint16{53, 80, 443, 8080}
+)
+
+// randomRules makes n rules over a few addresses and ports , so that they overlap
+func randomRules(r *rand.Rand, n int) []FlowRuleInput {
+	pick := func(s []string) string { return s[r.IntN(len(s))] }
+	inputs := make([]FlowRuleInput, n)
+	for i := range inputs {
+		in := FlowRuleInput{Action: Rule_action(1 + r.IntN(3))}
+		if r.IntN(2) == 0 {
+			in.Protocol = []uint8{6, 17}[r.IntN(2)]
+		}
+		switch r.IntN(4) {
+		case 0:
+			port := testPorts[r.IntN(len(testPorts))]
+			in.DstPort = PortRange{port, port}
+		case 1:
+			in.DstPort = PortRange{1, 1024}
+		}
+		if r.IntN(3) == 0 {
+			in.Direction = dir(uint8(r.IntN(2)))
+		}
+		if r.IntN(2) == 0 {
+			in.DstIP = pick(testPrefixes)
+		}
+		if r.IntN(3) == 0 {
+			in.SrcIP = pick(testPrefixes)
+		}
+		if r.IntN(8) == 0 {
+			port := testPorts[r.IntN(len(testPorts))]
+			in = FlowRuleInput{
+				SrcIP: pick(testAddrs), DstIP: pick(testAddrs), SrcPort: PortRange{port, port}, DstPort: PortRange{port, port},
+				Protocol: 6, Direction: dir(uint8(r.IntN(2))), Action: in.Action,
+			}
+		}
+		inputs[i] = in
+	}
+	return inputs
+}
+
+func randomPackets(r *rand.Rand, n int) []testPacket {
+	packets := make([]testPacket, n)
+	for i := range packets {
+		packets[i] = testPacket{
+			protocol:  []uint8{6, 17}[r.IntN(2)],
+			direction: uint8(r.IntN(2)),
+			src:       netip.MustParseAddr(testAddrs[r.IntN(len(testAddrs))]),
+			dst:       netip.MustParseAddr(testAddrs[r.IntN(len(testAddrs))]),
+			sport:     testPorts[r.IntN(len(testPorts))],
+			dport:     testPorts[r.IntN(len(testPorts))],
+		}
+	}
+	return packets
+}
+
+// The indexes must pick the rule the linear loop picks for every packet
+func TestIndexedLookupMatchesLinearLookup(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for _, n := range []int{1, 10, 100, 1000} {
+		t.Run(fmt.Sprint(n, " rules"), func(t *testing.T) {
+			set, err := CompileFlowRules(randomRules(r, n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range randomPackets(r, 2000) {
+				if got, want := indexedLookup(set, p), linearLookup(set, p); got != want {
+					t.Fatalf("%+v: indexed lookup found rule %d , the loop rule %d", p, got, want)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCompileFlowRules(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, MAX_FLOW_RULES} {
+		inputs := randomRules(rand.New(rand.NewPCG(1, 2)), n)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for b.Loop() {
+				if _, err := CompileFlowRules(inputs); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFlowRuleLookup(b *testing.B) {
+	r := rand.New(rand.NewPCG(1, 2))
+	packets := randomPackets(r, 1024)
+	for _, n := range []int{10, 100, 1000, MAX_FLOW_RULES} {
+		set, err := CompileFlowRules(randomRules(r, n))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, lookup := range []struct {
+			name string
+			find func(*Flow_ruleset, testPacket) uint32
+		}{{"indexed", indexedLookup}, {"linear", linearLookup}} {
+			b.Run(fmt.Sprintf("%s/%d", lookup.name, n), func(b *testing.B) {
+				i := 0
+				for b.Loop() {
+					lookup.find(set, packets[i%len(packets)])
+					i++
+				}
+			})
+		}
+	}
+}
+
+func TestParseFQDN(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    FQDN_pattern
+		wantErr bool
+	}{
+		{"api.example.com", "api.example.com", false},
+		{" API.Example.COM. ", "api.example.com", false},
+		{"*.amazonaws.com", "*.amazonaws.com", false},
+		{"_srv.example.com", "_srv.example.com", false},
+		{"localhost", "", true},
+		{"*.com", "", true},
+		{"api.*.com", "", true},
+		{"*api.example.com", "", true},
+		{"api..example.com", "", true},
+		{"api example.com", "", true},
+		{strings.Repeat("a", 64) + ".com", "", true},
+		{strings.Repeat(strings.Repeat("a", 60)+".", 5) + "com", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseFQDN(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFQDN(%q): err = %v , want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseFQDN(%q) = %q , want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFQDNPatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern FQDN_pattern
+		name    string
+		want    bool
+	}{
+		{"api.example.com", "api.example.com", true},
+		{"api.example.com", "API.example.com.", true},
+		{"api.example.com", "www.example.com", false},
+		{"api.example.com", "xapi.example.com", false},
+		{"*.example.com", "api.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+	}
+	for _, tt := range tests {
+		if got := tt.pattern.Matches(tt.name); got != tt.want {
+			t.Errorf("%q.Matches(%q) = %v , want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetSNI(t *testing.T) {
+	tests := []struct {
+		pattern  FQDN_pattern
+		name     string
+		wildcard uint8
+		wantErr  bool
+	}{
+		{"api.example.com", "api.example.com", 0, false},
+		{"*.example.com", ".example.com", 1, false},
+		{FQDN_pattern(strings.Repeat("a", 60) + ".com"), "", 0, true},
+	}
+	for _, tt := range tests {
+		var rule FlowRule
+		err := setSNI(&rule, tt.pattern)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("setSNI(%q): err = %v , want error %v", tt.pattern, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if rule.Fields&RULE_F_SNI == 0 || rule.SniWildcard != tt.wildcard || int(rule.SniLen) != len(tt.name) ||
+			string(rule.SNI[:rule.SniLen]) != tt.name || rule.SNI[rule.SniLen] != 0 {
+			t.Errorf("setSNI(%q) = %+v", tt.pattern, rule)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package logs
+
+import (
+	"encoding/json"
+	"log"
+	"net/netip"
+	"time"
+)
+
+// EndEvent builds the event reporting the end of an idle flow
+func (s Flow_stats) EndEvent(key Flow_key) FlowEvent {
+    return FlowEvent{
+        Timestamp: s.LastSeen,
+        SrcIP:     key.SrcIP,
+        DstIP:     key.DstIP,
+        SrcPort:   key.SrcPort,
+        DstPort:   key.DstPort,
+        Protocol:  key.Protocol,
+        Direction: key.Direction,
+        Family:    key.Family,
+        TcpFlags:  s.TcpFlags,
+        IfIndex:   key.Ifindex,
+        RuleID:    s.RuleID,
+        Verdict:   s.Verdict,
+        EventType: EVENT_FLOW_END,
+        Packets:   s.Packets,
+        Bytes:     s.Bytes,
+        NewBytes:  s.Bytes - s.ReportedBytes,
+        NewPackets: s.Packets - s.ReportedPackets,
+        FirstSeen: s.FirstSeen,
+    }
+}
+
+// EndEvent builds the event reporting the end of an idle connection , or its SYN left unanswered
+func (c Conn) EndEvent(key Flow_key) FlowEvent {
+    eventType := uint8(EVENT_CONN_CLOSED)
+    if c.State == CONN_SYN_SENT {
+        eventType = EVENT_CONN_REFUSED
+    }
+    return FlowEvent{
+        Timestamp:  c.LastSeen,
+        SrcIP:      key.SrcIP,
+        DstIP:      key.DstIP,
+        SrcPort:    key.SrcPort,
+        DstPort:    key.DstPort,
+        Protocol:   key.Protocol,
+        Direction:  key.Direction,
+        Family:     key.Family,
+        IfIndex:    key.Ifindex,
+        RuleID:     NO_RULE,
+        EventType:  eventType,
+        Bytes:      c.BytesOut,
+        FirstSeen:  c.SynNs,
+        ReplyBytes: c.BytesIn,
+    }
+}
+
+// ConnEvent turns an EVENT_CONN_* event into what is published , without the pod.
+// timedOut marks the events the agent builds for idle connections.
+func (event *FlowEvent) ConnEvent(timedOut bool) Conn_event {
+    conn := Conn_event{
+        Outbound:      event.Direction == DIR_FROM_POD,
+        Src:           netip.AddrPortFrom(ipToAddr(event.Family, event.SrcIP), event.SrcPort).String(),
+        Dst:           netip.AddrPortFrom(ipToAddr(event.Family, event.DstIP), event.DstPort).String(),
+        DurationMs:    int64(time.Duration(event.Timestamp - event.FirstSeen) / time.Millisecond),
+        BytesSent:     event.Bytes,
+        BytesReceived: event.ReplyBytes,
+        Timestamp:     time.Now(),
+    }
+    switch event.EventType {
+    case EVENT_CONN_OPENED:
+        conn.Type = CONN_OPENED
+    case EVENT_CONN_CLOSED:
+        conn.Type = CONN_CLOSED
+    case EVENT_CONN_REFUSED:
+        conn.Type = CONN_REFUSED
+    }
+    switch {
+    case event.EventType == EVENT_CONN_OPENED:
+    case timedOut:
+        conn.Reason = CONN_REASON_TIMEOUT
+    case event.TcpFlags&TCP_FLAG_RST != 0:
+        conn.Reason = CONN_REASON_RST
+    default:
+        conn.Reason = CONN_REASON_FIN
+    }
+    return conn
+}
+
+// Endpoints returns the source and destination of the event
+func (event *FlowEvent) Endpoints() (netip.AddrPort, netip.AddrPort) {
+    src := netip.AddrPortFrom(ipToAddr(event.Family, event.SrcIP), event.SrcPort)
+    dst := netip.AddrPortFrom(ipToAddr(event.Family, event.DstIP), event.DstPort)
+    return src, dst
+}
+
+// LowPriority reports whether an event only accounts for traffic that passed: a packet or a
+// flow update without DPI details. The agent stops sending these first when it falls behind ,
+// as shed_event in traffic.bpf.c does while events is nearly full.
+func (event *FlowEvent) LowPriority() bool {
+    if event.Verdict != VERDICT_PASS && event.Verdict != VERDICT_ALLOW {
+        return false
+    }
+    if event.EventType != EVENT_PACKET && event.EventType != EVENT_FLOW_UPDATE {
+        return false
+    }
+    return event.Method[0] == 0 && event.HTTPStatus == 0 && event.QueryName[0] == 0 && event.SNI[0] == 0
+}
+
+// UserAgentString returns the User-Agent header of an HTTP request , empty for other events
+func (event *FlowEvent) UserAgentString() string {
+    return nullTerminatedString(event.UserAgent[:])
+}
+
+func (c Conn_event) Encode() []byte {
+    body, err := json.Marshal(c)
+    if err != nil {
+        log.Printf(" JSON marshal failed: %v", err)
+        return nil
+    }
+    return body
+}
@@ -0,0 +1,45 @@
+package logs
+
+import (
+    "encoding/json"
+    "log"
+    "time"
+)
+
+// which end of an Edge_report is the pod the agent saw the traffic on
+const (
+    EDGE_LOCAL_CLIENT = "client"
+    EDGE_LOCAL_SERVER = "server"
+)
+
+// Edge_report is the traffic between two addresses seen on one pod's veth during a report window.
+// The server resolves the addresses to pods and services. The client is the end with the higher
+// port , the server's port is the service port.
+type Edge_report struct {
+    Client          string `json:"client"`
+    Server          string `json:"server"`
+    Port            uint16 `json:"port"`
+    Protocol        uint8  `json:"protocol"`
+    Local           string `json:"local"` // EDGE_LOCAL_*
+    BytesToServer   uint64 `json:"bytes_to_server"`
+    BytesToClient   uint64 `json:"bytes_to_client"`
+    PacketsToServer uint64 `json:"packets_to_server"`
+    PacketsToClient uint64 `json:"packets_to_client"`
+    Connections     uint64 `json:"connections"` // flows the client started
+}
+
+// Graph_report is what an agent publishes (id = 8) every traffic.graph_interval
+type Graph_report struct {
+    Start time.Time     `json:"start"`
+    End   time.Time     `json:"end"`
+    Edges []Edge_report `json:"edges"`
+}
+
+func (r Graph_report) Encode() []byte {
+    body, err := json.Marshal(r)
+    if err != nil {
+        log.Printf(" JSON marshal failed: %v", err)
+        return nil
+    }
+    return body
+}
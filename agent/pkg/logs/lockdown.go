@@ -0,0 +1,75 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/netip"
+)
+
+func (r Lockdown_report) Encode() []byte {
+	body, err := json.Marshal(r)
+	if err != nil {
+		log.Printf(" JSON marshal failed: %v", err)
+		return nil
+	}
+	return body
+}
+
+// DecodeLockdownRequest decodes a lockdown command body , rejecting entries that can't be enforced
+func DecodeLockdownRequest(data []byte) (Lockdown_request, error) {
+	var req Lockdown_request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return Lockdown_request{}, fmt.Errorf("invalid lockdown request: %w", err)
+	}
+	if req.Namespace == "" {
+		return Lockdown_request{}, fmt.Errorf("lockdown request without namespace")
+	}
+	switch req.Mode {
+	case LOCKDOWN_LEARNING, LOCKDOWN_LEARNED, LOCKDOWN_OFF:
+	case LOCKDOWN_ENFORCING:
+		for i, entry := range req.Allow {
+			if _, err := entry.Key(0); err != nil {
+				return Lockdown_request{}, fmt.Errorf("allow entry %d: %w", i, err)
+			}
+		}
+	default:
+		return Lockdown_request{}, fmt.Errorf("unknown lockdown mode %q", req.Mode)
+	}
+	if req.LearnSeconds < 0 {
+		return Lockdown_request{}, fmt.Errorf("learn_seconds must not be negative")
+	}
+	return req, nil
+}
+
+// Key converts an entry to its allow_key_t on the veth ifindex
+func (e Allow_entry) Key(ifindex uint32) (Allow_key, error) {
+	key := Allow_key{Ifindex: ifindex, Protocol: e.Protocol}
+	if e.Protocol == 0 {
+		return Allow_key{}, fmt.Errorf("protocol is required")
+	}
+
+	if e.ListenPort != 0 {
+		if e.DstIP != "" || e.DstPort != 0 {
+			return Allow_key{}, fmt.Errorf("an entry is either a listen port or a destination")
+		}
+		if e.Protocol != 17 {
+			return Allow_key{}, fmt.Errorf("listen entries are for UDP , TCP replies are never checked")
+		}
+		key.Port = e.ListenPort
+		return key, nil
+	}
+
+	addr, err := netip.ParseAddr(e.DstIP)
+	if err != nil {
+		return Allow_key{}, fmt.Errorf("dst_ip: %w", err)
+	}
+	addr = addr.Unmap()
+	key.Family = FAMILY_IPV6
+	if addr.Is4() {
+		key.Family = FAMILY_IPV4
+	}
+	copy(key.Addr[:], addr.AsSlice())
+	key.Port = e.DstPort
+	return key, nil
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/netip"
 	"time"
 	
 	"bytes"
@@ -129,23 +130,42 @@ func (e RawSyscallEvent) String() string {
 }
 
 func (event *FlowEvent) String() string {
-	srcIP := ipToString(event.SrcIP)
-	dstIP := ipToString(event.DstIP)
+	src := netip.AddrPortFrom(ipToAddr(event.Family, event.SrcIP), event.SrcPort)
+	dst := netip.AddrPortFrom(ipToAddr(event.Family, event.DstIP), event.DstPort)
 	proto := protocolToString(event.Protocol)
 	dir := directionToString(event.Direction)
 	dpi := dpiProtocolToString(event.DpiProtocol)
 
 	// Base info
-	result := fmt.Sprintf("📦 [%s] %s %s:%d -> %s:%d (%s) Len=%d",
-		dir, proto, srcIP, event.SrcPort, dstIP, event.DstPort, dpi, event.PayloadLen)
+	result := fmt.Sprintf("📦 [%s] %s %s -> %s (%s) Len=%d",
+		dir, proto, src, dst, dpi, event.PayloadLen)
 
 	// Protocol-specific fields
 	switch event.DpiProtocol {
 	case 1: // HTTP
-		if event.Method[0] != 0 {
-			method := nullTerminatedString(event.Method[:])
-			path := nullTerminatedString(event.Path[:])
-			result += fmt.Sprintf(" [%s %s]", method, path)
+		if event.Method[0] != 0 || event.HTTPStatus != 0 {
+			result += " ["
+			if event.HTTPStatus != 0 {
+				result += fmt.Sprintf("%d ", event.HTTPStatus)
+			}
+			if event.Method[0] != 0 {
+				method := nullTerminatedString(event.Method[:])
+				path := nullTerminatedString(event.Path[:])
+				result += fmt.Sprintf("%s %s", method, path)
+			} else {
+				result += "no request"
+			}
+			if event.Host[0] != 0 {
+				result += fmt.Sprintf(" Host: %s", nullTerminatedString(event.Host[:]))
+			}
+			if event.UserAgent[0] != 0 {
+				result += fmt.Sprintf(" UA: %q", event.UserAgentString())
+			}
+			if event.HTTPStatus != 0 && event.Method[0] != 0 {
+				latency := time.Duration(event.HTTPLatencyUs) * time.Microsecond
+				result += fmt.Sprintf(" in %s", latency)
+			}
+			result += "]"
 		}
 	case 2: // DNS
 		if event.QueryName[0] != 0 {
@@ -154,6 +174,29 @@ func (event *FlowEvent) String() string {
 		}
 	case 3: // ICMP
 		result += fmt.Sprintf(" [Type: %d]", event.IcmpType)
+	case 4: // TLS
+		if event.SNI[0] != 0 {
+			result += fmt.Sprintf(" [SNI: %s", nullTerminatedString(event.SNI[:]))
+			if event.ALPN[0] != 0 {
+				result += fmt.Sprintf(" ALPN: %s", nullTerminatedString(event.ALPN[:]))
+			}
+			result += "]"
+		}
+	}
+
+	if event.RuleID != NO_RULE {
+		result += fmt.Sprintf(" {%s rule=%d}", verdictToString(event.Verdict), event.RuleID)
+	} else if event.Verdict == VERDICT_DENIED {
+		result += " {DENIED lockdown}"
+	}
+
+	switch event.EventType {
+	case EVENT_FLOW_START:
+		result += " <flow start>"
+	case EVENT_FLOW_UPDATE, EVENT_FLOW_END:
+		duration := time.Duration(event.Timestamp - event.FirstSeen)
+		result += fmt.Sprintf(" <flow %s Packets=%d Bytes=%d Duration=%s>",
+			eventTypeToString(event.EventType), event.Packets, event.Bytes, duration.Round(time.Millisecond))
 	}
 
 	result += fmt.Sprintf(" @%d", event.Timestamp)
@@ -161,9 +204,12 @@ func (event *FlowEvent) String() string {
 }
 
 
-func ipToString(ip uint32) string {
-	return fmt.Sprintf("%d.%d.%d.%d",
-		byte(ip), byte(ip>>8), byte(ip>>16), byte(ip>>24))
+// ipToAddr reads an address in the BPF layout , IPv4 is stored in the first 4 bytes
+func ipToAddr(family uint8, ip [16]byte) netip.Addr {
+	if family == FAMILY_IPV4 {
+		return netip.AddrFrom4([4]byte(ip[:4]))
+	}
+	return netip.AddrFrom16(ip)
 }
 
 func protocolToString(proto uint8) string {
@@ -174,6 +220,8 @@ func protocolToString(proto uint8) string {
 		return "TCP"
 	case 17:
 		return "UDP"
+	case 58:
+		return "ICMPv6"
 	default:
 		return fmt.Sprintf("Proto_%d", proto)
 	}
@@ -189,11 +237,47 @@ func dpiProtocolToString(dpi uint8) string {
 		return "DNS"
 	case 3:
 		return "ICMP"
+	case 4:
+		return "TLS"
 	default:
 		return fmt.Sprintf("DPI_%d", dpi)
 	}
 }
 
+func verdictToString(verdict uint8) string {
+	switch verdict {
+	case VERDICT_PASS:
+		return "PASS"
+	case VERDICT_DROP:
+		return "DROP"
+	case VERDICT_ALLOW:
+		return "ALLOW"
+	case VERDICT_ALERT:
+		return "ALERT"
+	case VERDICT_RATE_LIMITED:
+		return "RATE_LIMITED"
+	case VERDICT_DENIED:
+		return "DENIED"
+	default:
+		return fmt.Sprintf("VERDICT_%d", verdict)
+	}
+}
+
+func eventTypeToString(eventType uint8) string {
+	switch eventType {
+	case EVENT_PACKET:
+		return "packet"
+	case EVENT_FLOW_START:
+		return "start"
+	case EVENT_FLOW_UPDATE:
+		return "update"
+	case EVENT_FLOW_END:
+		return "end"
+	default:
+		return fmt.Sprintf("EVENT_%d", eventType)
+	}
+}
+
 func directionToString(dir uint8) string {
 	if dir == 0 {
 		return "Egress"
@@ -225,6 +309,57 @@ func (a Anomaly_log) String() string {
 }
 
 
+func (a Command_ack) Encode() []byte {
+	body, err := json.Marshal(a)
+	if err != nil {
+		log.Printf(" JSON marshal failed: %v", err)
+		return nil
+	}
+	return body
+}
+
+func (h Heartbeat) Encode() []byte {
+	body, err := json.Marshal(h)
+	if err != nil {
+		log.Printf(" JSON marshal failed: %v", err)
+		return nil
+	}
+	return body
+}
+
+// DecodeFlowRuleInputs decodes a network command body , rejecting rules that can't be compiled
+func DecodeFlowRuleInputs(data []byte) ([]FlowRuleInput, error) {
+	var inputs []FlowRuleInput
+	if err := json.Unmarshal(data, &inputs); err != nil {
+		return nil, fmt.Errorf("invalid network rules: %w", err)
+	}
+	if _, err := CompileFlowRules(inputs); err != nil {
+		return nil, err
+	}
+	return inputs, nil
+}
+
+func DecodeSyscallRules(data []byte) ([]SyscallEventRule, error) {
+	var rules []SyscallEventRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid syscall rules: %w", err)
+	}
+	for i, r := range rules {
+		if r.Action != 0 && r.Action != 1 {
+			return nil, fmt.Errorf("syscall rule %d: unknown action %d , 0 disables and 1 alerts", i, r.Action)
+		}
+	}
+	return rules, nil
+}
+
+func DecodeResourceRules(data []byte) (ResourceRules, error) {
+	var rules ResourceRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return ResourceRules{}, fmt.Errorf("invalid resource rules: %w", err)
+	}
+	return rules, nil
+}
+
 func UnmarshalFlowRules(data []byte) ([]FlowRule) {
 	var rules []FlowRule
 	err := json.Unmarshal(data, &rules)
@@ -246,22 +381,3 @@ func StringToFixed64(s string) [64]byte {
 	copy(arr[:], s)
 	return arr
 }
-
-
-func ConvertToFlowRule(in FlowRuleInput) FlowRule {
-    return FlowRule{
-        SrcIP:       in.SrcIP,
-        DstIP:       in.DstIP,
-        SrcPort:     in.SrcPort,
-        DstPort:     in.DstPort,
-        Protocol:    in.Protocol,
-        Direction:   in.Direction,
-        DpiProtocol: in.DpiProtocol,
-        Action:      in.Action,
-        Method:      StringToFixed8(in.Method),
-        Path:        StringToFixed64(in.Path),
-        QueryName:   StringToFixed64(in.QueryName),
-        QueryType:   in.QueryType,
-        IcmpType:    in.IcmpType,
-    }
-}
\ No newline at end of file
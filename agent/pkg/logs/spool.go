@@ -0,0 +1,404 @@
+package logs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// every record is [len uint32][crc32 uint32][payload] , little endian
+const recordHeaderSize = 8
+
+// Spool_stats is reported in the heartbeat
+type Spool_stats struct {
+	Spooled  uint64 `json:"spooled" bson:"spooled"`
+	Replayed uint64 `json:"replayed" bson:"replayed"`
+	Dropped  uint64 `json:"dropped" bson:"dropped"`
+	Pending  uint64 `json:"pending" bson:"pending"`
+	Bytes    uint64 `json:"bytes" bson:"bytes"`
+}
+
+type spoolSegment struct {
+	seq     uint64
+	path    string
+	size    int64
+	records int
+}
+
+// Spool_pos is where a record returned by Next lies , Commit takes it once the record was published
+type Spool_pos struct {
+	seq    uint64
+	offset int64
+	size   int64
+}
+
+// Spool is a bounded write-ahead log of segment files that buffers messages
+// while the broker is unreachable. Messages are replayed in the order they
+// were appended. When the spool is full the oldest segment is dropped.
+// Next reads ahead of the records committed so far , so several can wait for
+// their publisher confirms at once. Delivery is at-least-once: Rewind , and a
+// restart , replay from the first record not committed.
+//
+// A Spool is owned by the producer goroutine , only Stats may be called from elsewhere.
+type Spool struct {
+	dir          string
+	segmentBytes int64
+	maxBytes     int64
+
+	segments []*spoolSegment // oldest first , the last one is written to
+	tail     *os.File
+
+	// read position: segments[readSeg] at readOffset , after readRecords of its records
+	reader      *os.File
+	readSeg     int
+	readOffset  int64
+	readRecords int
+
+	// records of segments[0] committed so far , and the offset after them
+	committed    int
+	commitOffset int64
+	// records read and not committed yet , oldest first
+	inflight []Spool_pos
+
+	// read by the heartbeat while the producer owns the spool
+	pending atomic.Int64
+	bytes   atomic.Int64
+
+	spooled  atomic.Uint64
+	replayed atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+type spoolRecord struct {
+	Id      int    `json:"id"`
+	AgentID string `json:"agent_id"`
+	Body    []byte `json:"body"`
+}
+
+// OpenSpool opens (or creates) the spool in dir and recovers the segments left by a previous run
+func OpenSpool(dir string, segmentBytes, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create spool dir: %w", err)
+	}
+
+	s := &Spool{dir: dir, segmentBytes: segmentBytes, maxBytes: maxBytes}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read spool dir: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, ".seg") {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg := &spoolSegment{seq: seq, path: filepath.Join(dir, name)}
+		if err := seg.recover(); err != nil {
+			log.Printf(" Spool: dropping unreadable segment %s: %v", name, err)
+			os.Remove(seg.path)
+			continue
+		}
+		if seg.records == 0 {
+			os.Remove(seg.path)
+			continue
+		}
+		s.segments = append(s.segments, seg)
+		s.pending.Add(int64(seg.records))
+		s.bytes.Add(seg.size)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	if s.pending.Load() > 0 {
+		log.Printf(" Spool: recovered %d messages in %d segments", s.pending.Load(), len(s.segments))
+	}
+	return s, nil
+}
+
+// recover counts the valid records of a segment and truncates a torn write at its end
+func (seg *spoolSegment) recover() error {
+	f, err := os.OpenFile(seg.path, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var offset int64
+	for {
+		_, n, err := readRecord(f, offset)
+		if err != nil {
+			break
+		}
+		offset += n
+		seg.records++
+	}
+	seg.size = offset
+	return f.Truncate(offset)
+}
+
+func readRecord(f *os.File, offset int64) ([]byte, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := f.ReadAt(header[:], offset); err != nil {
+		return nil, 0, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	sum := binary.LittleEndian.Uint32(header[4:8])
+
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	return payload, recordHeaderSize + int64(length), nil
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.seg", seq))
+}
+
+// rotate starts a new tail segment
+func (s *Spool) rotate() error {
+	if s.tail != nil {
+		s.tail.Sync()
+		s.tail.Close()
+		s.tail = nil
+	}
+
+	var seq uint64
+	if n := len(s.segments); n > 0 {
+		seq = s.segments[n-1].seq + 1
+	}
+	seg := &spoolSegment{seq: seq, path: s.segmentPath(seq)}
+	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("create segment: %w", err)
+	}
+	s.tail = f
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+// Append writes msg at the end of the spool , dropping the oldest segment if the spool is full
+func (s *Spool) Append(msg Producer_msg) error {
+	payload, err := json.Marshal(spoolRecord{Id: msg.Id, AgentID: msg.AgentID, Body: msg.Body})
+	if err != nil {
+		s.dropped.Add(1)
+		return fmt.Errorf("encode spool record: %w", err)
+	}
+
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+
+	n := len(s.segments)
+	if s.tail == nil || n == 0 || s.segments[n-1].size+int64(len(record)) > s.segmentBytes {
+		if err := s.rotate(); err != nil {
+			s.dropped.Add(1)
+			return err
+		}
+	}
+
+	if _, err := s.tail.Write(record); err != nil {
+		s.dropped.Add(1)
+		return fmt.Errorf("write spool record: %w", err)
+	}
+	tail := s.segments[len(s.segments)-1]
+	tail.size += int64(len(record))
+	tail.records++
+	s.pending.Add(1)
+	s.bytes.Add(int64(len(record)))
+	s.spooled.Add(1)
+
+	for s.bytes.Load() > s.maxBytes && len(s.segments) > 1 {
+		s.dropHead()
+	}
+	return nil
+}
+
+// dropHead discards the oldest segment and counts what was never committed as dropped
+func (s *Spool) dropHead() {
+	seg := s.segments[0]
+	lost := seg.records - s.committed
+	log.Printf(" Spool full: dropping %d messages from %s", lost, filepath.Base(seg.path))
+	s.dropped.Add(uint64(lost))
+	s.pending.Add(-int64(lost))
+	// records of it waiting for their confirm are counted above , their Commit is ignored
+	s.inflight = slices.DeleteFunc(s.inflight, func(pos Spool_pos) bool { return pos.seq == seg.seq })
+	s.removeHead()
+}
+
+func (s *Spool) removeHead() {
+	seg := s.segments[0]
+	if s.readSeg == 0 {
+		s.closeReader()
+		s.readOffset = 0
+		s.readRecords = 0
+	} else {
+		s.readSeg--
+	}
+	if len(s.segments) == 1 && s.tail != nil {
+		s.tail.Close()
+		s.tail = nil
+	}
+	os.Remove(seg.path)
+	s.bytes.Add(-seg.size)
+	s.segments = s.segments[1:]
+	s.committed = 0
+	s.commitOffset = 0
+}
+
+// trimHead removes the oldest segments once all their records are committed , the tail stays for writing
+func (s *Spool) trimHead() {
+	for len(s.segments) > 1 && s.committed >= s.segments[0].records {
+		s.removeHead()
+	}
+}
+
+func (s *Spool) closeReader() {
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+}
+
+// Empty reports whether every message was committed
+func (s *Spool) Empty() bool {
+	return s.pending.Load() == 0
+}
+
+// HasUnread reports whether Next has a message to return
+func (s *Spool) HasUnread() bool {
+	for i := s.readSeg; i < len(s.segments); i++ {
+		read := 0
+		if i == s.readSeg {
+			read = s.readRecords
+		}
+		if s.segments[i].records > read {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the oldest message not read yet , and its position for Commit.
+// It returns io.EOF when every message was read.
+func (s *Spool) Next() (Producer_msg, Spool_pos, error) {
+	for s.readSeg < len(s.segments) {
+		seg := s.segments[s.readSeg]
+		if s.readRecords >= seg.records {
+			if s.readSeg == len(s.segments)-1 {
+				break
+			}
+			s.closeReader()
+			s.readSeg++
+			s.readOffset = 0
+			s.readRecords = 0
+			continue
+		}
+
+		if s.reader == nil {
+			f, err := os.Open(seg.path)
+			if err != nil {
+				s.dropUnread(err)
+				continue
+			}
+			s.reader = f
+		}
+
+		payload, n, err := readRecord(s.reader, s.readOffset)
+		if err != nil {
+			s.dropUnread(err)
+			continue
+		}
+		var rec spoolRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			s.dropUnread(err)
+			continue
+		}
+		pos := Spool_pos{seq: seg.seq, offset: s.readOffset, size: n}
+		s.readOffset += n
+		s.readRecords++
+		s.inflight = append(s.inflight, pos)
+		return Producer_msg{Body: rec.Body, Id: rec.Id, AgentID: rec.AgentID}, pos, nil
+	}
+	return Producer_msg{}, Spool_pos{}, io.EOF
+}
+
+// dropUnread gives up on the records of the segment being read from the read position on
+func (s *Spool) dropUnread(err error) {
+	seg := s.segments[s.readSeg]
+	lost := seg.records - s.readRecords
+	log.Printf(" Spool: segment %s is unreadable , dropping %d messages: %v", filepath.Base(seg.path), lost, err)
+	s.dropped.Add(uint64(lost))
+	s.pending.Add(-int64(lost))
+	seg.records = s.readRecords
+	s.closeReader()
+	// later appends go to a new segment instead of after the unreadable record
+	if s.readSeg == len(s.segments)-1 && s.tail != nil {
+		s.tail.Close()
+		s.tail = nil
+	}
+	s.trimHead()
+}
+
+// Commit removes the message at pos once it was published. Messages are committed in the order
+// Next returned them , a position whose segment was dropped meanwhile is ignored.
+func (s *Spool) Commit(pos Spool_pos) {
+	if len(s.inflight) == 0 || s.inflight[0] != pos {
+		return
+	}
+	s.inflight = s.inflight[1:]
+	s.committed++
+	s.commitOffset = pos.offset + pos.size
+	s.pending.Add(-1)
+	s.replayed.Add(1)
+	s.trimHead()
+}
+
+// Rewind makes Next start over from the oldest message not committed , the ones read after it
+// were not confirmed
+func (s *Spool) Rewind() {
+	s.inflight = nil
+	if s.readSeg != 0 {
+		s.closeReader()
+	}
+	s.readSeg = 0
+	s.readOffset = s.commitOffset
+	s.readRecords = s.committed
+}
+
+func (s *Spool) Stats() Spool_stats {
+	return Spool_stats{
+		Spooled:  s.spooled.Load(),
+		Replayed: s.replayed.Load(),
+		Dropped:  s.dropped.Load(),
+		Pending:  uint64(s.pending.Load()),
+		Bytes:    uint64(s.bytes.Load()),
+	}
+}
+
+func (s *Spool) Close() {
+	if s.tail != nil {
+		s.tail.Sync()
+		s.tail.Close()
+		s.tail = nil
+	}
+	s.closeReader()
+}
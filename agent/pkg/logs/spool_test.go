@@ -0,0 +1,323 @@
+package logs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// spoolMsg is message i , all of them encode to records of the same size
+func spoolMsg(i int) Producer_msg {
+	return Producer_msg{Body: []byte(fmt.Sprintf("message %04d", i)), Id: 1, AgentID: "agent-1"}
+}
+
+func spoolRecordSize(t *testing.T) int64 {
+	t.Helper()
+	msg := spoolMsg(0)
+	payload, err := json.Marshal(spoolRecord{Id: msg.Id, AgentID: msg.AgentID, Body: msg.Body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recordHeaderSize + int64(len(payload))
+}
+
+// drain replays the spool to the end , committing every message
+func drain(t *testing.T, s *Spool) []string {
+	t.Helper()
+	var bodies []string
+	for {
+		msg, pos, err := s.Next()
+		if errors.Is(err, io.EOF) {
+			return bodies
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, string(msg.Body))
+		s.Commit(pos)
+	}
+}
+
+func bodies(from, to int) []string {
+	var out []string
+	for i := from; i < to; i++ {
+		out = append(out, string(spoolMsg(i).Body))
+	}
+	return out
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSpoolReplay(t *testing.T) {
+	size := spoolRecordSize(t)
+	tests := []struct {
+		name         string
+		perSegment   int64 // records per segment
+		maxSegments  int64 // segments the spool holds
+		messages     int
+		want         []string
+		wantDropped  uint64
+		wantSegments int
+	}{
+		{"one segment", 10, 10, 5, bodies(0, 5), 0, 1},
+		{"segment boundary", 4, 10, 4, bodies(0, 4), 0, 1},
+		{"rotated segments", 4, 10, 10, bodies(0, 10), 0, 1},
+		{"full spool drops the oldest segments", 4, 2, 10, bodies(4, 10), 4, 1},
+		{"a record bigger than the spool keeps the tail", 1, 1, 3, bodies(2, 3), 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := OpenSpool(dir, tt.perSegment*size, tt.maxSegments*tt.perSegment*size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			for i := 0; i < tt.messages; i++ {
+				if err := s.Append(spoolMsg(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stats := s.Stats()
+			if want := uint64(len(tt.want)); stats.Pending != want || stats.Spooled != uint64(tt.messages) || stats.Dropped != tt.wantDropped {
+				t.Errorf("stats before replay = %+v , want %d pending , %d spooled , %d dropped", stats, want, tt.messages, tt.wantDropped)
+			}
+
+			if got := drain(t, s); !slices.Equal(got, tt.want) {
+				t.Errorf("replayed %q , want %q", got, tt.want)
+			}
+			if !s.Empty() {
+				t.Errorf("spool not empty after the replay")
+			}
+			stats = s.Stats()
+			if stats.Replayed != uint64(len(tt.want)) || stats.Pending != 0 {
+				t.Errorf("stats after replay = %+v", stats)
+			}
+			// replayed segments are removed , the tail stays for the next append
+			if files := segmentFiles(t, dir); len(files) != tt.wantSegments {
+				t.Errorf("%d segment files left , want %d", len(files), tt.wantSegments)
+			}
+		})
+	}
+}
+
+func TestSpoolRecovery(t *testing.T) {
+	size := spoolRecordSize(t)
+	tests := []struct {
+		name      string
+		messages  int
+		committed int // messages replayed before the restart
+		damage    func(t *testing.T, dir string)
+		want      []string
+	}{
+		{"clean restart", 6, 0, nil, bodies(0, 6)},
+		// at-least-once: the head segment is replayed from its start
+		{"restart mid replay", 6, 2, nil, bodies(0, 6)},
+		{"replayed segment is gone", 6, 4, nil, bodies(4, 6)},
+		{"torn write", 6, 0, func(t *testing.T, dir string) {
+			files := segmentFiles(t, dir)
+			f, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			// a header promising more than was written
+			if _, err := f.Write([]byte{0xff, 0, 0, 0, 1, 2, 3, 4, '{'}); err != nil {
+				t.Fatal(err)
+			}
+		}, bodies(0, 6)},
+		{"corrupt record ends its segment", 6, 0, func(t *testing.T, dir string) {
+			files := segmentFiles(t, dir)
+			data, err := os.ReadFile(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			data[size+recordHeaderSize] ^= 0xff // payload of the second record
+			if err := os.WriteFile(files[0], data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}, append(bodies(0, 1), bodies(4, 6)...)},
+		{"unreadable segment", 6, 0, func(t *testing.T, dir string) {
+			files := segmentFiles(t, dir)
+			if err := os.WriteFile(files[0], []byte{1, 0, 0, 0, 0, 0, 0, 0, 'x'}, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}, bodies(4, 6)},
+		{"stray files", 2, 0, func(t *testing.T, dir string) {
+			for _, name := range []string{"notes.txt", "abc.seg", "00000000000000000099.seg"} {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}, bodies(0, 2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := OpenSpool(dir, 4*size, 100*size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.messages; i++ {
+				if err := s.Append(spoolMsg(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.committed; i++ {
+				_, pos, err := s.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.Commit(pos)
+			}
+			s.Close()
+			if tt.damage != nil {
+				tt.damage(t, dir)
+			}
+
+			s, err = OpenSpool(dir, 4*size, 100*size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if pending := s.Stats().Pending; pending != uint64(len(tt.want)) {
+				t.Errorf("recovered %d messages , want %d", pending, len(tt.want))
+			}
+			if got := drain(t, s); !slices.Equal(got, tt.want) {
+				t.Errorf("replayed %q , want %q", got, tt.want)
+			}
+
+			// appends after a recovery go after the recovered messages
+			if err := s.Append(spoolMsg(99)); err != nil {
+				t.Fatal(err)
+			}
+			if got := drain(t, s); !slices.Equal(got, bodies(99, 100)) {
+				t.Errorf("replayed %q after the recovery , want %q", got, bodies(99, 100))
+			}
+		})
+	}
+}
+
+func TestSpoolReadAhead(t *testing.T) {
+	size := spoolRecordSize(t)
+	tests := []struct {
+		name string
+		// messages read ahead , then committed in order , before the rest is rewound and drained
+		read, commit int
+		want         []string // drained after the rewind
+		wantPending  uint64   // before the rewind
+	}{
+		{"nothing read", 0, 0, bodies(0, 10), 10},
+		{"read without commit", 6, 0, bodies(0, 10), 10},
+		{"partly committed", 6, 3, bodies(3, 10), 7},
+		{"committed across segments", 9, 9, bodies(9, 10), 1},
+		{"everything read", 10, 5, bodies(5, 10), 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := OpenSpool(dir, 4*size, 100*size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			for i := 0; i < 10; i++ {
+				s.Append(spoolMsg(i))
+			}
+
+			var read []Spool_pos
+			for i := 0; i < tt.read; i++ {
+				msg, pos, err := s.Next()
+				if err != nil || string(msg.Body) != string(spoolMsg(i).Body) {
+					t.Fatalf("Next() = %q , %v , want message %d", msg.Body, err, i)
+				}
+				read = append(read, pos)
+			}
+			if s.HasUnread() != (tt.read < 10) {
+				t.Errorf("HasUnread() = %v after reading %d of 10", s.HasUnread(), tt.read)
+			}
+			for _, pos := range read[:tt.commit] {
+				s.Commit(pos)
+			}
+			if pending := s.Stats().Pending; pending != tt.wantPending {
+				t.Errorf("%d pending , want %d", pending, tt.wantPending)
+			}
+
+			s.Rewind()
+			if got := drain(t, s); !slices.Equal(got, tt.want) {
+				t.Errorf("replayed %q after the rewind , want %q", got, tt.want)
+			}
+			if files := segmentFiles(t, dir); len(files) != 1 {
+				t.Errorf("%d segment files left , want the tail", len(files))
+			}
+		})
+	}
+}
+
+func TestSpoolCommitOutOfOrder(t *testing.T) {
+	s, err := OpenSpool(t.TempDir(), 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, _, err := s.Next(); !errors.Is(err, io.EOF) {
+		t.Fatalf("Next() on an empty spool = %v , want io.EOF", err)
+	}
+
+	s.Append(spoolMsg(0))
+	s.Append(spoolMsg(1))
+	msg, first, _ := s.Next()
+	if string(msg.Body) != string(spoolMsg(0).Body) || msg.Id != 1 || msg.AgentID != "agent-1" {
+		t.Fatalf("Next() = %+v , want message 0", msg)
+	}
+	_, second, _ := s.Next()
+
+	// a position not at the front of the ones read is ignored
+	s.Commit(second)
+	if pending := s.Stats().Pending; pending != 2 {
+		t.Errorf("%d pending after an out of order commit , want 2", pending)
+	}
+	s.Commit(first)
+	s.Commit(second)
+	s.Commit(second)
+	if stats := s.Stats(); stats.Pending != 0 || stats.Replayed != 2 {
+		t.Errorf("stats = %+v , want 2 replayed", stats)
+	}
+}
+
+func TestSpoolDropHeadWhileReadAhead(t *testing.T) {
+	size := spoolRecordSize(t)
+	s, err := OpenSpool(t.TempDir(), 2*size, 4*size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 4; i++ {
+		s.Append(spoolMsg(i))
+	}
+	_, pos, _ := s.Next()
+
+	// the segment of the message waiting for its confirm is dropped , its commit is ignored
+	s.Append(spoolMsg(4))
+	s.Commit(pos)
+	stats := s.Stats()
+	if stats.Dropped != 2 || stats.Replayed != 0 || stats.Pending != 3 {
+		t.Errorf("stats = %+v , want 2 dropped and 3 pending", stats)
+	}
+	if got := drain(t, s); !slices.Equal(got, bodies(2, 5)) {
+		t.Errorf("replayed %q , want %q", got, bodies(2, 5))
+	}
+}
@@ -5,6 +5,19 @@ import(
 	"agent/pkg/kube"
 	
 )
+
+// COMMAND_VERSION is the command protocol version this agent speaks.
+// Commands stamped with a newer version are rejected with an error ack.
+const COMMAND_VERSION = 1
+
+// command types, carried in the "arg" header of every command
+const (
+	CommandNetwork  = 1
+	CommandSyscall  = 2
+	CommandResource = 3
+	CommandLockdown = 4
+	CommandCapture  = 5
+)
 type MemoryUsage struct {
 	ContainerID     string    `json:"container_id" bson:"container_id"`
 	Timestamp       time.Time `json:"timestamp" bson:"timestamp"`
@@ -13,7 +26,7 @@ type MemoryUsage struct {
 	RSS             int64     `json:"rss" bson:"rss"`
 	CacheMemory     int64     `json:"cache_memory" bson:"cache_memory"`
 	MemoryUsageRate float64   `json:"memory_usage_rate" bson:"memory_usage_rate"`
-	UID string 					`json : "UID"  bson:"UID"`
+	UID string 					`json:"UID" bson:"UID"`
 }
 
 
@@ -23,7 +36,7 @@ type CPUUsage struct {
 	CPUTime       int64     `json:"cpu_time" bson:"cpu_time"`
 	CPUUsageRate  float64   `json:"cpu_usage_rate" bson:"cpu_usage_rate"`
 	CPULimit      int64     `json:"cpu_limit" bson:"cpu_limit"`
-	UID string `json : "UID  bson:"UID`
+	UID string `json:"UID" bson:"UID"`
 }
 
 type DiskIOUsage struct {
@@ -32,7 +45,7 @@ type DiskIOUsage struct {
 	DiskReadBytes   int64     `json:"disk_read_bytes" bson:"disk_read_bytes"`
 	DiskWriteBytes  int64     `json:"disk_write_bytes" bson:"disk_write_bytes"`
 	DiskUsageRate   float64   `json:"disk_usage_rate" bson:"disk_usage_rate"`
-	UID string `json : "UID  bson:"UID`
+	UID string `json:"UID" bson:"UID"`
 }
 
 type SyscallEvent struct {
@@ -44,25 +57,48 @@ type SyscallEvent struct {
 
 }
 
+// address families of flow events and rules , same values as AF_INET / AF_INET6
+const (
+	FAMILY_IPV4 = 2
+	FAMILY_IPV6 = 10
+)
+
 type FlowEvent struct {
         Timestamp   uint64
-        SrcIP       uint32
-        DstIP       uint32
+        SrcIP       [16]byte // IPv4 uses the first 4 bytes
+        DstIP       [16]byte
         SrcPort     uint16
         DstPort     uint16
         Protocol    uint8
         Direction   uint8
         PayloadLen  uint16
         DpiProtocol uint8
-        Reserved1   uint8
+        Family      uint8    // FAMILY_IPV4 or FAMILY_IPV6
         Reserved2   uint16
         Method      [8]byte
         Path        [64]byte
         QueryName   [64]byte
         QueryType   uint16
         IcmpType    uint8
-			_        [1]byte  // Padding for alignment
+        TcpFlags    uint8    // flags byte of the TCP header
 		IfIndex     uint32   // Network interface index (for container resolution)
+		RuleID      uint32   // matching rule , NO_RULE when none matched
+		Verdict     uint8    // VERDICT_*
+		EventType   uint8    // EVENT_*
+		_           [6]byte  // Padding for alignment
+		Packets     uint64   // counters of the flow up to this event
+		Bytes       uint64
+		NewBytes    uint64   // bytes since the flow's previous event
+		FirstSeen   uint64   // timestamp of the flow's first packet , of the SYN for a connection
+		ReplyBytes  uint64   // bytes the responder sent , connection events only
+		SNI         [64]byte // TLS ClientHello server name
+		ALPN        [16]byte // first ALPN protocol the client offers
+		Host        [64]byte // HTTP Host header
+		UserAgent   [64]byte // HTTP User-Agent header
+		HTTPStatus  uint16   // HTTP response status , Method , Path and Host are then the request's
+		_           [2]byte
+		HTTPLatencyUs uint32 // from the request to its response
+		NewPackets  uint64   // packets since the flow's previous event
 
 }
 
@@ -72,6 +108,9 @@ type Anomaly_log struct {
 	Memory  float64 `json:"memory" bson:"memory"`
 	Network float64 `json:"network" bson:"network"`
 	Syscall float64 `json:"syscall" bson:"syscall"`
+	// HTTP 5xx responses per second , and the user agents first seen in the pod's requests
+	HTTPErrors    float64  `json:"http_errors" bson:"http_errors"`
+	NewUserAgents []string `json:"new_user_agents,omitempty" bson:"new_user_agents,omitempty"`
 	Timestamp time.Time `json:"timestamp" bson:"timestamp"` 
 	Container kube.ContainerMapping `json:"container" bson:"container"`
 }
@@ -97,13 +136,19 @@ type DiskTracker struct {
 	DiskIOUsage 	float64
 }
 
+// Producer_msg is published with the agent ID in the "agent_id" header.
+// AgentID is filled in by the producer when left empty.
 type Producer_msg struct{
 	Body []byte `json:"body"`
 	Id  int  `json:"id"`
+	AgentID string `json:"agent_id"`
 }
 
 
 
+// Type of the openat events , the ones shed first under load
+const SYSCALL_OPEN = 3
+
 type RawSyscallEvent struct {
 	Pid      uint32
 	Type     uint32
@@ -114,11 +159,176 @@ type RawSyscallEvent struct {
 
 
 
+// sizes of the rule store , they must match traffic.h
+const (
+    MAX_FLOW_RULES     = 4096 // rule slots per generation
+    RULE_BUCKET_SIZE   = 16
+    MAX_FALLBACK_RULES = 64
+    NO_RULE            = 0xFFFFFFFF
+    MAX_SCOPE_ENTRIES  = 65536
+    MAX_ALLOW_ENTRIES  = 65536
+    MAX_FQDN_ENTRIES   = 65536
+    MAX_RATE_PPS       = 1000000
+)
+
+// Rule_action is what a rule does with the packets it matches (ACTION_* in traffic.h)
+type Rule_action uint8
+
+const (
+    ACTION_NONE Rule_action = iota // disabled
+    ACTION_DROP
+    ACTION_ALLOW      // pass , and stop looking at later rules
+    ACTION_ALERT      // pass , but flag the event
+    ACTION_RATE_LIMIT // pass while the rule's token bucket has tokens , drop otherwise
+)
+
+// what happened to the packet of a FlowEvent (VERDICT_* in traffic.h)
+const (
+    VERDICT_PASS = iota // no rule matched
+    VERDICT_DROP
+    VERDICT_ALLOW
+    VERDICT_ALERT
+    VERDICT_RATE_LIMITED
+    VERDICT_DENIED // not on the allow-list of a locked down pod
+)
+
+// DIR_FROM_POD is the direction of what a pod sends , seen by tc_ingress on its host veth ,
+// DIR_TO_POD of what it receives , seen by tc_egress
+const (
+    DIR_TO_POD   = 0
+    DIR_FROM_POD = 1
+)
+
+const (
+    TCP_FLAG_FIN = 0x01
+    TCP_FLAG_SYN = 0x02
+    TCP_FLAG_RST = 0x04
+    TCP_FLAG_ACK = 0x10
+)
+
+// kind of a FlowEvent (EVENT_* in traffic.h)
+const (
+    EVENT_PACKET = iota // one packet , TRAFFIC_MODE_PACKETS
+    EVENT_FLOW_START
+    EVENT_FLOW_UPDATE // periodic flush , or the flow's verdict changed
+    EVENT_FLOW_END    // FIN or RST , or idle for traffic.idle_timeout
+    // TCP connection lifecycle , the addresses are the initiator's and the responder's
+    EVENT_CONN_OPENED
+    EVENT_CONN_CLOSED
+    EVENT_CONN_REFUSED
+)
+
+// what the traffic programs send to the ringbuf (TRAFFIC_MODE_* in traffic.h)
+const (
+    TRAFFIC_MODE_FLOWS = iota
+    TRAFFIC_MODE_PACKETS
+)
+
+// how the payload on a port is inspected (DPI_* in traffic.h) , same values as DpiProtocol
+const (
+    DPI_HTTP = 1
+    DPI_DNS  = 2
+    DPI_TLS  = 4
+
+    MAX_DPI_PORTS = 64
+)
+
+// Traffic_config is the single entry of traffic_config
+type Traffic_config struct {
+    Mode    uint32
+    _       [4]byte // Padding for alignment
+    FlushNs uint64
+}
+
+// Flow_key is one direction of a connection on one interface
+type Flow_key struct {
+    Ifindex   uint32
+    Family    uint8
+    Protocol  uint8
+    Direction uint8
+    Reserved  uint8
+    SrcPort   uint16
+    DstPort   uint16
+    SrcIP     [16]byte
+    DstIP     [16]byte
+}
+
+// Flow_stats are the counters of a flow , timestamps are nanoseconds since boot
+type Flow_stats struct {
+    Packets       uint64
+    Bytes         uint64
+    ReportedBytes uint64 // bytes when the last event was sent
+    ReportedPackets uint64
+    FirstSeen     uint64
+    LastSeen      uint64
+    LastReport    uint64
+    RuleID        uint32
+    TcpFlags      uint8 // every flag seen on the flow
+    Verdict       uint8
+    Closed        uint8 // the end was reported
+    Reserved      uint8
+}
+
+// DNS_MAX_PAYLOAD is how much of a DNS response the traffic program copies
+const DNS_MAX_PAYLOAD = 512
+
+// Dns_event is a DNS response on its way to a pod (dns_event_t in traffic.h)
+type Dns_event struct {
+    Timestamp uint64
+    Ifindex   uint32 // host side veth of the pod that asked
+    Family    uint8
+    Reserved  uint8
+    Len       uint16 // bytes of Payload used
+    Payload   [DNS_MAX_PAYLOAD]byte
+}
+
+// states of a TCP connection (CONN_* in traffic.h)
+const (
+    CONN_SYN_SENT = iota + 1
+    CONN_ESTABLISHED
+    CONN_CLOSING // FIN from one side
+)
+
+// Conn is a TCP connection , keyed by the Flow_key of the initiator's side
+type Conn struct {
+    SynNs         uint64
+    EstablishedNs uint64
+    LastSeen      uint64
+    BytesOut      uint64 // sent by the initiator
+    BytesIn       uint64 // sent by the responder
+    State         uint8
+    Fins          uint8
+    _             [6]byte // Padding for alignment
+}
+
+// fields of a FlowRule that must match , every other field is a wildcard (RULE_F_* in traffic.h)
+const (
+    RULE_F_SRC_CIDR = 1 << iota
+    RULE_F_DST_CIDR
+    RULE_F_PROTOCOL
+    RULE_F_SRC_PORT
+    RULE_F_DST_PORT
+    RULE_F_DIRECTION
+    RULE_F_DPI
+    RULE_F_ICMP_TYPE
+    RULE_F_QUERY_TYPE
+    RULE_F_METHOD
+    RULE_F_PATH
+    RULE_F_QUERY_NAME
+    RULE_F_FAMILY
+    RULE_F_SCOPE // only on the interfaces listed in rule_scopes
+    RULE_F_FQDN  // only to the addresses listed in fqdn_ips
+    RULE_F_SNI
+    RULE_F_NEW_FLOW // only packets that open a flow , so replies pass
+)
+
+// FlowRule is the BPF layout of a rule , stored at gen * MAX_FLOW_RULES + its position in the list
 type FlowRule struct {
-    SrcIP       uint32   `json:"src_ip"`
-    DstIP       uint32   `json:"dst_ip"`
-    SrcPort     uint16   `json:"src_port"`
-    DstPort     uint16   `json:"dst_port"`
+    Fields      uint32   `json:"fields"`
+    SrcPortMin  uint16   `json:"src_port_min"`
+    SrcPortMax  uint16   `json:"src_port_max"`
+    DstPortMin  uint16   `json:"dst_port_min"`
+    DstPortMax  uint16   `json:"dst_port_max"`
     Protocol    uint8    `json:"protocol"`
     Direction   uint8    `json:"direction"`
     DpiProtocol uint8    `json:"dpi_protocol"`
@@ -129,33 +339,181 @@ type FlowRule struct {
     QueryName   [64]byte `json:"query_name"`
     QueryType   uint16   `json:"query_type"`
     IcmpType    uint8    `json:"icmp_type"`
-    _           uint8    `json:"-"` // ignored in JSON, used for padding
+    Family      uint8    `json:"family"`
+
+    SrcIP        [16]byte `json:"src_ip"`
+    DstIP        [16]byte `json:"dst_ip"`
+    SrcPrefixlen uint8    `json:"src_prefixlen"`
+    DstPrefixlen uint8    `json:"dst_prefixlen"`
+    Reserved     uint16   `json:"-"`
+    RatePPS      uint32   `json:"rate_pps"`
+    Burst        uint32   `json:"burst"`
+    SNI          [64]byte `json:"sni"` // the name , or the suffix from the dot of a *. wildcard
+    SniLen       uint8    `json:"sni_len"`
+    SniWildcard  uint8    `json:"sni_wildcard"`
+    Reserved2    uint16   `json:"-"`
+}
+
+// Rate_state is the token bucket of a rate limit rule , the lock word belongs to the kernel
+type Rate_state struct {
+    Lock   uint32
+    _      [4]byte // Padding for alignment
+    Tokens uint64
+    LastNs uint64
+}
+
+// Exact_key indexes rules on a full 5-tuple and direction
+type Exact_key struct {
+    Gen       uint32
+    Family    uint8
+    Protocol  uint8
+    Direction uint8
+    Reserved  uint8
+    SrcPort   uint16
+    DstPort   uint16
+    SrcIP     [16]byte
+    DstIP     [16]byte
+}
+
+// Port_key indexes rules on a protocol and a single destination port
+type Port_key struct {
+    Gen       uint32
+    Protocol  uint8
+    Direction uint8
+    DstPort   uint16
+}
+
+// CIDR_key is the key of the CIDR tries , Prefixlen counts the gen and family bytes
+type CIDR_key struct {
+    Prefixlen uint32
+    Gen       uint8
+    Family    uint8
+    Addr      [16]byte
+    _         [2]byte // Padding for alignment
 }
 
+// Rule_bucket lists candidate rule ids in ascending order
+type Rule_bucket struct {
+    Count uint32
+    Ids   [RULE_BUCKET_SIZE]uint32
+}
+
+// Fallback_list holds the rules no index applies to , checked in order
+type Fallback_list struct {
+    Count uint32
+    Ids   [MAX_FALLBACK_RULES]uint32
+}
+
+// Scope_key puts a host veth in the scope of a rule
+type Scope_key struct {
+    Gen     uint32
+    RuleID  uint32
+    Ifindex uint32
+}
+
+// Fqdn_key lets the packets of an FQDN rule's generation go to an address its name resolved to
+type Fqdn_key struct {
+    Gen    uint32
+    RuleID uint32
+    Family uint8
+    _      [3]byte // Padding for alignment
+    Addr   [16]byte
+}
 
+// Allow_key is a lockdown allow-list entry of a pod's veth (allow_key_t in traffic.h).
+// A listen entry has Family 0 and no address , Port is the port the pod serves.
+type Allow_key struct {
+    Ifindex  uint32
+    Family   uint8
+    Protocol uint8
+    Port     uint16
+    Addr     [16]byte
+}
+
+type Rule_state struct {
+    ActiveGen uint32
+}
+
+// Flow_rule_stats tells how a rule set was indexed , reported in the heartbeat
+type Flow_rule_stats struct {
+    Total      int       `json:"total" bson:"total"`
+    Disabled   int       `json:"disabled" bson:"disabled"`
+    Exact      int       `json:"exact" bson:"exact"`
+    Port       int       `json:"port" bson:"port"`
+    DstCIDR    int       `json:"dst_cidr" bson:"dst_cidr"`
+    SrcCIDR    int       `json:"src_cidr" bson:"src_cidr"`
+    Fallback   int       `json:"fallback" bson:"fallback"`
+    Unindexed  int       `json:"unindexed" bson:"unindexed"` // left out , the fallback list was full
+    Scoped     int       `json:"scoped" bson:"scoped"`
+    FQDN       int       `json:"fqdn" bson:"fqdn"`
+    Policy     int       `json:"policy" bson:"policy"` // translated from NetworkPolicies
+    Generation uint32    `json:"generation" bson:"generation"`
+    LoadedAt   time.Time `json:"loaded_at" bson:"loaded_at"`
+}
+
+// FlowRuleInput is a network rule as sent by the server.
+// Unset fields are wildcards; a rule matches when every field it sets matches.
 type FlowRuleInput struct {
-    SrcIP       uint32 `json:"src_ip"`
-    DstIP       uint32 `json:"dst_ip"`
-    SrcPort     uint16 `json:"src_port"`
-    DstPort     uint16 `json:"dst_port"`
-    Protocol    uint8  `json:"protocol"`
-    Direction   uint8  `json:"direction"`
-    DpiProtocol uint8  `json:"dpi_protocol"`
-    Action      uint8  `json:"action"`
+    SrcIP       string    `json:"src_ip"`      // address or CIDR , e.g. "10.0.0.0/8" or "fd00::/8"
+    DstIP       string    `json:"dst_ip"`
+    SrcPort     PortRange `json:"src_port"`    // 443 or "1000-2000"
+    DstPort     PortRange `json:"dst_port"`
+    Protocol    uint8     `json:"protocol"`
+    Direction   *uint8    `json:"direction"`   // 0 is a direction , so omitted means any
+    DpiProtocol uint8     `json:"dpi_protocol"`
+    Action      Rule_action `json:"action"`  // "drop" , "allow" , "alert" or "rate_limit"
+    RatePPS     uint32    `json:"rate_pps"`  // rate_limit only , packets per second
+    Burst       uint32    `json:"burst"`     // rate_limit only , defaults to rate_pps
 
     Method      string `json:"method"`      // Will convert to [8]byte
     Path        string `json:"path"`        // Will convert to [64]byte
     QueryName   string `json:"query_name"`  // Will convert to [64]byte
     QueryType   uint16 `json:"query_type"`
-    IcmpType    uint8  `json:"icmp_type"`
+    IcmpType    *uint8 `json:"icmp_type"`   // 0 is echo reply , so omitted means any
+
+    Scope       *Rule_scope `json:"scope,omitempty"` // omitted means every monitored pod
+    FQDN        string      `json:"fqdn,omitempty"`  // "api.example.com" or "*.amazonaws.com" , the destination must be an address the pods resolved it to
+    SNI         string      `json:"sni,omitempty"`   // TLS server name , "api.example.com" or "*.example.com"
+    NewFlow     bool        `json:"new_flow,omitempty"` // only TCP SYNs , ICMP echo requests and packets whose reply direction has no flow yet
 }
 
+// Rule_scope limits a rule to some pods , every field set must match
+type Rule_scope struct {
+    PodUID    string   `json:"pod_uid,omitempty"`
+    PodUIDs   []string `json:"pod_uids,omitempty"` // any of these pods
+    Namespace string   `json:"namespace,omitempty"`
+    Selector  string   `json:"selector,omitempty"` // pod label selector , e.g. "app=web,tier in (front,api)"
+}
 
+// PortRange is an inclusive port range , the zero value matches any port
+type PortRange struct {
+    Min uint16
+    Max uint16
+}
+
+// Flow_ruleset is a rule list compiled to the BPF maps.
+// Its keys have Gen 0 , the loader sets the generation it writes to.
+type Flow_ruleset struct {
+    Rules     []FlowRule
+    Exact     map[Exact_key]uint32
+    Port      map[Port_key]Rule_bucket
+    DstCIDRs  map[CIDR_key]Rule_bucket
+    SrcCIDRs  map[CIDR_key]Rule_bucket
+    Fallback  Fallback_list
+    Unindexed []uint32 // ids of the rules that fit no index and no fallback slot , they never match
+    Scopes    map[uint32]Pod_scope // scoped rules by id , resolved to interfaces by the agent
+    FQDNs     map[uint32]FQDN_pattern // FQDN rules by id , resolved from DNS answers by the agent
+    Stats     Flow_rule_stats
+}
+
+
+// SyscallEventRule matches syscall events by type, pid, comm and filename prefix.
+// Zero / empty fields are wildcards. Action : 0 = disabled , 1 = alert
 type SyscallEventRule struct {
 	Pid       uint32    `json:"pid" bson:"pid"`
 	Type      uint32    `json:"type" bson:"type"`
-	Comm      [16]byte  `json:"comm" bson:"comm"`
-	Filename  [256]byte `json:"filename" bson:"filename"`
+	Comm      string    `json:"comm" bson:"comm"`
+	Filename  string    `json:"filename" bson:"filename"`
 	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
 	Action    int       `json:"action" bson:"action"`
 }
@@ -192,4 +550,231 @@ type MemoryUsageRule struct {
 	MemoryUsageRate float64   `json:"memory_usage_rate" bson:"memory_usage_rate"`
 	UID             string    `json:"UID" bson:"UID"`
 	Action          int       `json:"action" bson:"action"`
-}
\ No newline at end of file
+}
+
+
+// ResourceRules is the body of a resource command (arg = 3).
+// A rule fires when any of its non-zero thresholds is exceeded for the
+// container with the given UID (empty UID matches every container).
+type ResourceRules struct {
+	Memory []MemoryUsageRule `json:"memory"`
+	Disk   []DiskIOUsageRule `json:"disk"`
+	CPU    []CPUUsageRule    `json:"cpu"`
+}
+
+// The *_cmd types carry a decoded rule set from the command channel to the
+// collector that owns it. The collector replies on Result once the rules are applied.
+type FlowRule_cmd struct {
+	Rules  []FlowRuleInput
+	Result chan error
+}
+
+type SyscallRule_cmd struct {
+	Rules  []SyscallEventRule
+	Result chan error
+}
+
+type ResourceRule_cmd struct {
+	Rules  ResourceRules
+	Result chan error
+}
+
+type Lockdown_cmd struct {
+	Request Lockdown_request
+	Result  chan error
+}
+
+// lockdown modes of a namespace
+const (
+	LOCKDOWN_OFF       = "off"
+	LOCKDOWN_LEARNING  = "learning"  // flows of its pods are recorded
+	LOCKDOWN_LEARNED   = "learned"   // reported , traffic passes until the server approves a list
+	LOCKDOWN_ENFORCING = "enforcing" // default-deny for what its pods send
+)
+
+// Lockdown_request is the body of a lockdown command (arg = 4)
+type Lockdown_request struct {
+	Namespace    string        `json:"namespace"`
+	Mode         string        `json:"mode"`                    // learning , learned (stop learning now) , enforcing or off
+	LearnSeconds int           `json:"learn_seconds,omitempty"` // learning , the agent's default when 0
+	Allow        []Allow_entry `json:"allow,omitempty"`         // enforcing , the approved list
+}
+
+// Allow_entry is a flow a pod of a lockdown namespace may open.
+// An egress entry sets DstIP , a listen entry sets ListenPort: the pod serves it over UDP and may reply from it.
+// Learned entries name the workload , so they still apply to the pods that replace the ones seen while learning.
+type Allow_entry struct {
+	Workload   string    `json:"workload,omitempty" bson:"workload,omitempty"` // the pods of a deployment , statefulset , daemonset or job , empty for every workload
+	Pod        string    `json:"pod,omitempty" bson:"pod,omitempty"`           // empty for every pod of the workload
+	Protocol   uint8     `json:"protocol" bson:"protocol"`
+	DstIP      string    `json:"dst_ip,omitempty" bson:"dst_ip,omitempty"`
+	DstPort    uint16    `json:"dst_port,omitempty" bson:"dst_port,omitempty"`
+	ListenPort uint16    `json:"listen_port,omitempty" bson:"listen_port,omitempty"`
+	Packets    uint64    `json:"packets,omitempty" bson:"packets,omitempty"`
+	LastSeen   time.Time `json:"last_seen,omitempty" bson:"last_seen,omitempty"`
+}
+
+type Capture_cmd struct {
+	Request Capture_request
+	Result  chan error
+}
+
+const (
+	CAPTURE_MAX_SNAPLEN = 65535 // CAPTURE_MAX_SNAPLEN in traffic.h
+	MAX_CAPTURES        = 64
+)
+
+// Capture_request is the body of a capture command (arg = 5): record the packets of a pod
+// to a pcapng file , sent back in Capture_chunks once the capture ends
+type Capture_request struct {
+	CaptureID       string         `json:"capture_id"`
+	Namespace       string         `json:"namespace"`
+	Pod             string         `json:"pod"`
+	DurationSeconds int            `json:"duration_seconds,omitempty"` // capture.max_duration when 0
+	MaxPackets      int            `json:"max_packets,omitempty"`      // 0 stops at the duration or capture.max_bytes only
+	Snaplen         int            `json:"snaplen,omitempty"`          // bytes kept of each packet , whole packets when 0
+	Filter          *FlowRuleInput `json:"filter,omitempty"`           // packets matching it , a network rule without action , scope or fqdn
+}
+
+// Capture_chunk carries a part of the pcapng file of a capture (id = 9) , in order from seq 0.
+// The last chunk has the totals , or the error that ended the capture.
+type Capture_chunk struct {
+	CaptureID string `json:"capture_id"`
+	Seq       int    `json:"seq"`
+	Data      []byte `json:"data,omitempty"`
+	Last      bool   `json:"last,omitempty"`
+	Packets   uint64 `json:"packets,omitempty"`
+	Bytes     uint64 `json:"bytes,omitempty"`     // of the packets , before snaplen
+	Lost      uint64 `json:"lost,omitempty"`      // samples the perf buffer had no room for
+	Truncated bool   `json:"truncated,omitempty"` // stopped at capture.max_bytes
+	Error     string `json:"error,omitempty"`
+}
+
+// Capture_target is the BPF layout of a capture in capture_targets , keyed by veth ifindex
+type Capture_target struct {
+	Snaplen   uint32
+	Remaining int32
+	Filter    FlowRule
+}
+
+// Capture_meta precedes the packet bytes of a capture_events sample
+type Capture_meta struct {
+	Timestamp uint64
+	Ifindex   uint32
+	Len       uint32
+	Caplen    uint32
+	RuleID    uint32
+	Direction uint8
+	Verdict   uint8
+	_         uint16
+	_         uint32
+}
+
+// connection event types
+const (
+	CONN_OPENED  = "opened"
+	CONN_CLOSED  = "closed"
+	CONN_REFUSED = "refused"
+)
+
+// why a connection ended
+const (
+	CONN_REASON_FIN     = "fin"
+	CONN_REASON_RST     = "rst"
+	CONN_REASON_TIMEOUT = "timeout" // idle , or the SYN was never answered
+)
+
+// Conn_event is published (id = 7) when a TCP connection of a pod opens , closes or is refused
+type Conn_event struct {
+	Type          string    `json:"type" bson:"type"`
+	Reason        string    `json:"reason,omitempty" bson:"reason,omitempty"`
+	Pod           string    `json:"pod" bson:"pod"`
+	Namespace     string    `json:"namespace" bson:"namespace"`
+	Outbound      bool      `json:"outbound" bson:"outbound"` // opened by the pod
+	Src           string    `json:"src" bson:"src"`           // initiator
+	Dst           string    `json:"dst" bson:"dst"`           // responder
+	DurationMs    int64     `json:"duration_ms" bson:"duration_ms"` // since the SYN
+	BytesSent     uint64    `json:"bytes_sent" bson:"bytes_sent"`   // by the initiator
+	BytesReceived uint64    `json:"bytes_received" bson:"bytes_received"`
+	Domain        string    `json:"domain,omitempty" bson:"domain,omitempty"` // the pod resolved the other end from it
+	Timestamp     time.Time `json:"timestamp" bson:"timestamp"`
+}
+
+// Lockdown_report is published (id = 6) when a namespace stops learning
+type Lockdown_report struct {
+	Namespace string        `json:"namespace" bson:"namespace"`
+	Learned   []Allow_entry `json:"learned" bson:"learned"`
+	Truncated bool          `json:"truncated" bson:"truncated"` // max_learned was reached
+	StartedAt time.Time     `json:"started_at" bson:"started_at"`
+	EndedAt   time.Time     `json:"ended_at" bson:"ended_at"`
+}
+
+// Command_ack is published back to the server (id = 3) for every command received.
+type Command_ack struct {
+	Version       int       `json:"version" bson:"version"`
+	CorrelationID string    `json:"correlation_id" bson:"correlation_id"`
+	Arg           int       `json:"arg" bson:"arg"`
+	Status        string    `json:"status" bson:"status"` // "applied" , "partial" (some rules left out , see Skipped) or "failed"
+	Error         string    `json:"error,omitempty" bson:"error,omitempty"`
+	Applied       int       `json:"applied" bson:"applied"` // number of rules applied
+	Skipped       []uint32  `json:"skipped,omitempty" bson:"skipped,omitempty"` // ids of the rules that were not applied
+	Timestamp     time.Time `json:"timestamp" bson:"timestamp"`
+}
+
+// Ringbuf_stats counts what the agent did with the records of one ring buffer , and the
+// records lost before or after it read them
+type Ringbuf_stats struct {
+	Read         uint64            `json:"read" bson:"read"`
+	ReadErrors   uint64            `json:"read_errors" bson:"read_errors"`
+	DecodeErrors uint64            `json:"decode_errors" bson:"decode_errors"`
+	Full         map[string]uint64 `json:"full,omitempty" bson:"full,omitempty"` // records that did not fit , by program
+	Shed         map[string]uint64 `json:"shed,omitempty" bson:"shed,omitempty"` // low priority records skipped while it was nearly full , by program
+	Dropped      uint64            `json:"dropped" bson:"dropped"`               // low priority records read but not sent , the producer was behind
+	TimedOut     uint64            `json:"timed_out" bson:"timed_out"`           // high priority records read but not sent , the producer was stuck past the wait
+}
+
+// Ringbuf_drops is the BPF layout of the per-CPU drop counters of a ring buffer
+// (ringbuf_drops_t in traffic.h , syscall_drops_t in syscalls.h)
+type Ringbuf_drops struct {
+	Full uint64
+	Shed uint64
+}
+
+// Unparsed_packets counts the packets whose IP headers the traffic programs could not parse ,
+// it is also the BPF layout of their per-CPU counters (unparsed_t in traffic.h)
+type Unparsed_packets struct {
+	Passed  uint64 `json:"passed" bson:"passed"`
+	Dropped uint64 `json:"dropped" bson:"dropped"` // on the veths of locked down pods
+}
+
+// BPF_program describes a loaded eBPF program
+type BPF_program struct {
+	Name string `json:"name" bson:"name"`
+	ID   uint32 `json:"id" bson:"id"`
+}
+
+// Fqdn_rule_status lists the addresses an FQDN rule currently applies to
+type Fqdn_rule_status struct {
+	RuleID uint32   `json:"rule_id" bson:"rule_id"`
+	FQDN   string   `json:"fqdn" bson:"fqdn"`
+	IPs    []string `json:"ips" bson:"ips"`
+}
+
+// Heartbeat is published periodically (id = 5) so the server can track fleet health
+type Heartbeat struct {
+	AgentID             string                      `json:"agent_id" bson:"agent_id"`
+	NodeName            string                      `json:"node_name" bson:"node_name"`
+	Version             string                      `json:"version" bson:"version"`
+	KernelVersion       string                      `json:"kernel_version" bson:"kernel_version"`
+	Interfaces          []string                    `json:"interfaces" bson:"interfaces"`
+	Programs            []BPF_program               `json:"programs" bson:"programs"`
+	MonitoredContainers int                         `json:"monitored_containers" bson:"monitored_containers"`
+	Ringbufs            map[string]Ringbuf_stats    `json:"ringbufs" bson:"ringbufs"`
+	Unparsed            map[string]Unparsed_packets `json:"unparsed,omitempty" bson:"unparsed,omitempty"` // by program
+	Spool               Spool_stats                 `json:"spool" bson:"spool"`
+	FlowRules           *Flow_rule_stats            `json:"flow_rules,omitempty" bson:"flow_rules,omitempty"`
+	Lockdown            map[string]string           `json:"lockdown,omitempty" bson:"lockdown,omitempty"` // mode by namespace
+	FQDNRules           []Fqdn_rule_status          `json:"fqdn_rules,omitempty" bson:"fqdn_rules,omitempty"`
+	IntervalSeconds     int                         `json:"interval_seconds" bson:"interval_seconds"`
+	Timestamp           time.Time                   `json:"timestamp" bson:"timestamp"`
+}
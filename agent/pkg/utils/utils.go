@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"agent/pkg/config"
 	"agent/pkg/kube"
 	"agent/pkg/logs"
 	
@@ -8,7 +9,6 @@ import (
 	"time"
 )
 
-var TIME_INTERVAL = float64(10.0)
 
 const (
 	IndexAnomaly = iota // 0
@@ -17,9 +17,10 @@ const (
 	IndexDiskIO            // 3
 	IndexNetwork           // 4
 	IndexSyscall           // 5
+	IndexHTTP              // 6
 )
 
-var mu_arr[6]sync.RWMutex
+var mu_arr[7]sync.RWMutex
 
 var Container_uid_map = make(map[string]*logs.Anomaly_log)
 
@@ -28,6 +29,18 @@ var DiskTrackers = make(map[string]logs.DiskTracker)
 var MemoryTrackers = make(map[string]logs.MemoryTracker)
 var SyscallTrackers = make(map[string]int)
 var NetwrokTracker = make(map[string]float64)
+var HTTPErrorTrackers = make(map[string]int)
+var UserAgentTrackers = make(map[string][]string)
+
+const (
+	// a user agent not seen on a pod for this long is new again
+	userAgentMemory = 24 * time.Hour
+	// user agents remembered per pod , later ones are not reported
+	maxUserAgents = 64
+)
+
+// when each pod last used a user agent , kept across anomaly intervals. Guarded by mu_arr[IndexHTTP].
+var seenUserAgents = make(map[string]map[string]time.Time)
 
 func Update_uid_Map(uid string , container kube.ContainerMapping){
 	mu_arr[IndexAnomaly].Lock()
@@ -54,6 +67,47 @@ func Update_network_Tracker(uid string , packet_len float64 ){
 }
 
 
+// Update_http_Tracker counts a 5xx response and records a user agent the pod did not use before ,
+// either may be empty
+func Update_http_Tracker(uid string, status int, userAgent string) {
+	mu_arr[IndexHTTP].Lock()
+	defer mu_arr[IndexHTTP].Unlock()
+
+	if status >= 500 && status < 600 {
+		HTTPErrorTrackers[uid]++
+	}
+	if userAgent == "" {
+		return
+	}
+	seen := seenUserAgents[uid]
+	if seen == nil {
+		seen = make(map[string]time.Time)
+		seenUserAgents[uid] = seen
+	}
+	if _, ok := seen[userAgent]; !ok {
+		if len(seen) >= maxUserAgents {
+			return
+		}
+		UserAgentTrackers[uid] = append(UserAgentTrackers[uid], userAgent)
+	}
+	seen[userAgent] = time.Now()
+}
+
+// expireUserAgents forgets the user agents unused for userAgentMemory. mu_arr[IndexHTTP] must be held.
+func expireUserAgents() {
+	now := time.Now()
+	for uid, seen := range seenUserAgents {
+		for agent, last := range seen {
+			if now.Sub(last) > userAgentMemory {
+				delete(seen, agent)
+			}
+		}
+		if len(seen) == 0 {
+			delete(seenUserAgents, uid)
+		}
+	}
+}
+
 func Update_syscall_Tracker(uid string) {
 	mu_arr[IndexSyscall].Lock()
 	SyscallTrackers[uid]++
@@ -123,7 +177,9 @@ func Update_memory_Tracker(uid string, cur logs.MemoryTracker) {
 }
 
 func Anomaly_log_generator(logCh chan logs.Producer_msg) {
-	rescanTicker := time.NewTicker(time.Duration(TIME_INTERVAL) * time.Second)
+	interval := config.Get().Anomaly.Interval
+	seconds := interval.Seconds()
+	rescanTicker := time.NewTicker(interval)
 	defer rescanTicker.Stop()
 
 	for {
@@ -136,13 +192,19 @@ func Anomaly_log_generator(logCh chan logs.Producer_msg) {
 				mu_arr[IndexNetwork].RLock()
 				netSum := NetwrokTracker[uid]
 				mu_arr[IndexNetwork].RUnlock()
-				a.Network = netSum / float64(TIME_INTERVAL)
+				a.Network = netSum / seconds
 
 				// === Syscalls ===
 				mu_arr[IndexSyscall].RLock()
 				syscalls := SyscallTrackers[uid]
 				mu_arr[IndexSyscall].RUnlock()
-				a.Syscall = float64(syscalls)/ TIME_INTERVAL
+				a.Syscall = float64(syscalls)/ seconds
+
+				// === HTTP ===
+				mu_arr[IndexHTTP].RLock()
+				a.HTTPErrors = float64(HTTPErrorTrackers[uid]) / seconds
+				a.NewUserAgents = UserAgentTrackers[uid]
+				mu_arr[IndexHTTP].RUnlock()
 
 				// === CPU ===
 				mu_arr[IndexCPU].RLock()
@@ -179,7 +241,7 @@ func Anomaly_log_generator(logCh chan logs.Producer_msg) {
 			mu_arr[IndexAnomaly].RUnlock()
 
 			// === Reset All Trackers and Container Map ===
-			for i:=0 ; i < 6 ; i++{
+			for i:=0 ; i < len(mu_arr) ; i++{
 				mu_arr[i].Lock()
 			}
 			Container_uid_map = make(map[string]*logs.Anomaly_log)
@@ -188,8 +250,11 @@ func Anomaly_log_generator(logCh chan logs.Producer_msg) {
 			MemoryTrackers = make(map[string]logs.MemoryTracker)
 			SyscallTrackers = make(map[string]int)
 			NetwrokTracker = make(map[string]float64)
+			HTTPErrorTrackers = make(map[string]int)
+			UserAgentTrackers = make(map[string][]string)
+			expireUserAgents()
 
-			for i:=0 ; i < 6 ; i++{
+			for i:=0 ; i < len(mu_arr) ; i++{
 				mu_arr[i].Unlock()
 			}
 
@@ -1,52 +1,39 @@
 package main
 
 import (
-	// "server/internal/db/models"
-	"time"
-	"server/internal/api/handlers"
-	"fmt"
-	"server/internal/logic"
-
-	
+	"log"
+	"os"
+	"server/internal/api"
+	"server/internal/config"
+	"server/internal/db"
+	"server/internal/kube"
+	"server/internal/rabbitmq"
 )
 
 func main(){
-	namespace := "default"
-	podname := "demo-test"
-	t := time.Now()
-
-	containerName := "nginx"
-
-
-	kube_client , err:= handlers.GetKubernetesClient()
-
-	if err != nil{
-		fmt.Println( err)
-		return
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf(" %v", err)
 	}
+	cfg.LogEffective()
 
-	logs ,err := handlers.FetchPodLogs(kube_client , namespace , podname , containerName , t)
-
-	if err != nil{
-		fmt.Println(" oh no 2lv  , " ,err)
-		return
+	if err := db.InitMongo(); err != nil {
+		log.Fatalf(" Failed to connect to MongoDB: %v", err)
 	}
-	
 
-	logs_arr := logic.CleanRawLogs(logs)
-	
-	struct_logs := logic.ParseLogs(logs_arr)
-
-	items := logic.BuildItemsets(struct_logs)
-
-	res := logic.RunApriori(items )
-
-	
+	if err := rabbitmq.Connect_to_agent(); err != nil {
+		log.Fatalf(" Failed to connect to agents: %v", err)
+	}
+	defer rabbitmq.CloseAgentConnection()
 
-	
-	
+	go db.StartAgentSweeper()
 
+	// service graph reports are dropped until the cluster's pods and services are known
+	go func() {
+		if err := kube.StartResolver(make(chan struct{})); err != nil {
+			log.Printf(" Service graph cannot resolve pods and services: %v", err)
+		}
+	}()
 
+	api.UIInit()
 }
-	
-
@@ -1 +1,34 @@
-package handlers
\ No newline at end of file
+package handlers
+
+import (
+	"server/internal/db/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ListAgents returns the whole fleet with each agent's health.
+// GET /api/agents
+func ListAgents(list func() ([]models.Agent, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		agents, err := list()
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(agents)
+	}
+}
+
+// GetAgent returns one agent with its last heartbeat.
+// GET /api/agents/:id
+func GetAgent(get func(id string) (*models.Agent, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		agent, err := get(c.Params("id"))
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		if agent == nil {
+			return fiber.NewError(fiber.StatusNotFound, "unknown agent: "+c.Params("id"))
+		}
+		return c.JSON(agent)
+	}
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"server/internal/db/models"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+)
+
+// command type of a capture , must match the agent's "arg" header value
+const commandCapture = 5
+
+// at most this many captures are listed , the default when no limit is asked for
+const maxCaptures = 100
+
+// StartCapture asks the agent of the pod's node to capture its packets. The agent sends the
+// pcapng file when the capture ends , it is then downloaded from GET /api/captures/:id/pcap.
+// POST /api/captures  (body: namespace , pod , duration_seconds , max_packets , snaplen , filter)
+func StartCapture(
+	podNode func(namespace, name string) (string, bool),
+	save func(*models.Capture) error,
+	publish func(target string, arg int, payload any, correlationID string) error,
+	target func(agentID, node, group string) string,
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req models.Capture_request
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid capture request: "+err.Error())
+		}
+		if req.Namespace == "" || req.Pod == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "namespace and pod are required")
+		}
+		if req.DurationSeconds < 0 || req.MaxPackets < 0 || req.Snaplen < 0 || req.Snaplen > 65535 {
+			return fiber.NewError(fiber.StatusBadRequest, "duration_seconds and max_packets must not be negative , snaplen is at most 65535")
+		}
+		node, ok := podNode(req.Namespace, req.Pod)
+		if !ok {
+			return fiber.NewError(fiber.StatusNotFound, "pod is not scheduled: "+req.Namespace+"/"+req.Pod)
+		}
+
+		// the command is sent under the capture's ID
+		req.CaptureID = uuid.NewString()
+		capture := &models.Capture{
+			ID:            req.CaptureID,
+			CorrelationID: req.CaptureID,
+			Request:       req,
+			Node:          node,
+			Status:        models.CaptureRequested,
+			RequestedAt:   time.Now(),
+		}
+		// stored first , so neither the agent's refusal nor the file can arrive before its capture
+		if err := save(capture); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+
+		if err := publish(target("", node, ""), commandCapture, req, capture.CorrelationID); err != nil {
+			now := time.Now()
+			capture.Status, capture.Error, capture.FinishedAt = models.CaptureFailed, err.Error(), &now
+			save(capture)
+			return fiber.NewError(fiber.StatusBadGateway, err.Error())
+		}
+		return c.Status(fiber.StatusAccepted).JSON(capture)
+	}
+}
+
+// ListCaptures returns the captures , newest first.
+// GET /api/captures?namespace=shop&limit=20
+func ListCaptures(list func(namespace string, limit int64) ([]models.Capture, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		limit := int64(c.QueryInt("limit", maxCaptures))
+		if limit <= 0 || limit > maxCaptures {
+			limit = maxCaptures
+		}
+		captures, err := list(c.Query("namespace"), limit)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(captures)
+	}
+}
+
+// loadCapture returns the capture of the :id param , or a 404
+func loadCapture(c *fiber.Ctx, get func(id string) (*models.Capture, error)) (*models.Capture, error) {
+	capture, err := get(c.Params("id"))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	if capture == nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, "unknown capture: "+c.Params("id"))
+	}
+	return capture, nil
+}
+
+// GetCapture returns the state of a capture.
+// GET /api/captures/:id
+func GetCapture(get func(id string) (*models.Capture, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		capture, err := loadCapture(c, get)
+		if err != nil {
+			return err
+		}
+		return c.JSON(capture)
+	}
+}
+
+// DownloadCapture sends the pcapng file of a capture that is done.
+// GET /api/captures/:id/pcap
+func DownloadCapture(
+	get func(id string) (*models.Capture, error),
+	open func(id string) (*gridfs.DownloadStream, error),
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		capture, err := loadCapture(c, get)
+		if err != nil {
+			return err
+		}
+		if capture.Status != models.CaptureDone {
+			return fiber.NewError(fiber.StatusConflict, "capture is "+capture.Status)
+		}
+		file, err := open(capture.ID)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		c.Set(fiber.HeaderContentType, "application/x-pcapng")
+		c.Attachment(capture.ID + ".pcapng")
+		// the stream is closed once it was sent
+		return c.SendStream(file, int(file.GetFile().Length))
+	}
+}
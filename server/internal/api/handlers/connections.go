@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"server/internal/db/models"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// at most this many events are returned , the default when no limit is asked for
+const maxConnEvents = 1000
+
+// ListConnections returns TCP connection events , newest first.
+// GET /api/connections?type=refused&namespace=shop&pod=web-1&since=10m&limit=100
+func ListConnections(find func(models.Conn_filter) ([]models.Conn_event, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		filter := models.Conn_filter{
+			Type:      c.Query("type"),
+			Namespace: c.Query("namespace"),
+			Pod:       c.Query("pod"),
+			Limit:     int64(c.QueryInt("limit", maxConnEvents)),
+		}
+		switch filter.Type {
+		case "", models.ConnOpened, models.ConnClosed, models.ConnRefused:
+		default:
+			return fiber.NewError(fiber.StatusBadRequest, "type must be opened , closed or refused")
+		}
+		if filter.Limit <= 0 || filter.Limit > maxConnEvents {
+			filter.Limit = maxConnEvents
+		}
+		if s := c.Query("since"); s != "" {
+			since, err := time.ParseDuration(s)
+			if err != nil || since <= 0 {
+				return fiber.NewError(fiber.StatusBadRequest, "since must be a positive Go duration")
+			}
+			filter.Since = time.Now().Add(-since)
+		}
+
+		events, err := find(filter)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(events)
+	}
+}
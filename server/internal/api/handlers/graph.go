@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"server/internal/db/models"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// the window of a graph when none is asked for
+	defaultGraphSince = time.Hour
+	// at most this many edges are returned , the busiest ones
+	maxGraphEdges = 5000
+)
+
+// GetGraph returns the service dependency graph: which workloads , services and external
+// addresses talked to which , with the bytes , packets and connections of every edge.
+// GET /api/graph?namespace=shop&since=1h&limit=500
+func GetGraph(find func(models.Graph_filter) ([]models.Graph_edge, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		since := defaultGraphSince
+		if s := c.Query("since"); s != "" {
+			var err error
+			since, err = time.ParseDuration(s)
+			if err != nil || since <= 0 {
+				return fiber.NewError(fiber.StatusBadRequest, "since must be a positive Go duration")
+			}
+		}
+		filter := models.Graph_filter{
+			Namespace: c.Query("namespace"),
+			Since:     time.Now().Add(-since),
+			Limit:     int64(c.QueryInt("limit", maxGraphEdges)),
+		}
+		if filter.Limit <= 0 || filter.Limit > maxGraphEdges {
+			filter.Limit = maxGraphEdges
+		}
+
+		edges, err := find(filter)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+
+		nodes := make(map[string]models.Graph_node)
+		for _, e := range edges {
+			nodes[e.Src.ID] = e.Src
+			nodes[e.Dst.ID] = e.Dst
+		}
+		graph := models.Graph{Since: filter.Since, Nodes: make([]models.Graph_node, 0, len(nodes)), Edges: edges}
+		for _, node := range nodes {
+			graph.Nodes = append(graph.Nodes, node)
+		}
+		sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].ID < graph.Nodes[j].ID })
+		return c.JSON(graph)
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
-	
+	"server/internal/config"
 
 	"time"
 
@@ -19,12 +19,12 @@ import (
 
 func GetKubernetesClient() (*kubernetes.Clientset, error) {
 	// If inside cluster
-	config, err := clientcmd.BuildConfigFromFlags("", "/etc/rancher/k3s/k3s.yaml")
+	kubeConfig, err := clientcmd.BuildConfigFromFlags("", config.Get().Kube.Kubeconfig)
 	if err != nil {
 		fmt.Println("nooooooo clientswet")
 		return nil , err
 	}
-	return kubernetes.NewForConfig(config)
+	return kubernetes.NewForConfig(kubeConfig)
 }
 
 
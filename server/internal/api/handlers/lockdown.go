@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"fmt"
+	"net/netip"
+	"server/internal/db/models"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// command type of a lockdown , must match the agent's "arg" header value
+const commandLockdown = 4
+
+// the pods of a namespace can run on any node , so lockdown commands go to every agent
+const lockdownTarget = "all"
+
+// loadLockdown returns the lockdown of the :namespace param , or a 404
+func loadLockdown(c *fiber.Ctx, get func(namespace string) (*models.Lockdown, error)) (*models.Lockdown, error) {
+	lockdown, err := get(c.Params("namespace"))
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	if lockdown == nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, "namespace is not in lockdown: "+c.Params("namespace"))
+	}
+	return lockdown, nil
+}
+
+// sendLockdown publishes req to every agent and stores the namespace's new state
+func sendLockdown(
+	c *fiber.Ctx,
+	lockdown *models.Lockdown,
+	req models.Lockdown_request,
+	save func(*models.Lockdown) error,
+	publish func(target string, arg int, payload any) (string, error),
+) error {
+	correlationID, err := publish(lockdownTarget, commandLockdown, req)
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadGateway, err.Error())
+	}
+	if err := save(lockdown); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"correlation_id": correlationID,
+		"lockdown":       lockdown,
+	})
+}
+
+// LearnLockdown starts the learning phase. Any earlier list of the namespace is discarded
+// and an enforced lockdown is lifted while it learns.
+// POST /api/lockdown/:namespace/learn?duration=30m  (the agents' default when omitted)
+func LearnLockdown(
+	save func(*models.Lockdown) error,
+	publish func(target string, arg int, payload any) (string, error),
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var duration time.Duration
+		if d := c.Query("duration"); d != "" {
+			var err error
+			duration, err = time.ParseDuration(d)
+			if err != nil || duration < time.Second {
+				return fiber.NewError(fiber.StatusBadRequest, "duration must be a Go duration of at least 1s")
+			}
+		}
+
+		lockdown := &models.Lockdown{
+			Namespace: c.Params("namespace"),
+			Status:    models.LockdownLearning,
+			Allow:     []models.Allow_entry{},
+			Reported:  []string{},
+		}
+		if duration > 0 {
+			lockdown.LearnUntil = time.Now().Add(duration)
+		}
+		return sendLockdown(c, lockdown, models.Lockdown_request{
+			Namespace:    lockdown.Namespace,
+			Mode:         "learning",
+			LearnSeconds: int(duration / time.Second),
+		}, save, publish)
+	}
+}
+
+// StopLockdownLearning ends the learning phase now , the agents report what they learned so far.
+// POST /api/lockdown/:namespace/stop
+func StopLockdownLearning(
+	get func(namespace string) (*models.Lockdown, error),
+	save func(*models.Lockdown) error,
+	publish func(target string, arg int, payload any) (string, error),
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		lockdown, err := loadLockdown(c, get)
+		if err != nil {
+			return err
+		}
+		if lockdown.Status != models.LockdownLearning {
+			return fiber.NewError(fiber.StatusConflict, "namespace is "+lockdown.Status+" , not learning")
+		}
+		return sendLockdown(c, lockdown, models.Lockdown_request{Namespace: lockdown.Namespace, Mode: "learned"}, save, publish)
+	}
+}
+
+// GetLockdown previews the allow-list of a namespace.
+// GET /api/lockdown/:namespace
+func GetLockdown(get func(namespace string) (*models.Lockdown, error)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		lockdown, err := loadLockdown(c, get)
+		if err != nil {
+			return err
+		}
+		return c.JSON(lockdown)
+	}
+}
+
+// EditLockdown replaces the allow-list , which is enforced once approved.
+// PUT /api/lockdown/:namespace  (body: the whole list)
+func EditLockdown(
+	get func(namespace string) (*models.Lockdown, error),
+	save func(*models.Lockdown) error,
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		lockdown, err := loadLockdown(c, get)
+		if err != nil {
+			return err
+		}
+		if lockdown.Status == models.LockdownLearning {
+			return fiber.NewError(fiber.StatusConflict, "namespace is still learning")
+		}
+
+		var entries []models.Allow_entry
+		if err := c.BodyParser(&entries); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid allow-list: "+err.Error())
+		}
+		for i, e := range entries {
+			if err := validAllowEntry(e); err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("allow entry %d: %v", i, err))
+			}
+		}
+
+		lockdown.Allow = entries
+		// an enforced list that was edited needs a new approval
+		lockdown.Status = models.LockdownPending
+		if err := save(lockdown); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(lockdown)
+	}
+}
+
+// ApproveLockdown enforces the allow-list: anything else the namespace's pods send is dropped.
+// POST /api/lockdown/:namespace/approve
+func ApproveLockdown(
+	get func(namespace string) (*models.Lockdown, error),
+	save func(*models.Lockdown) error,
+	publish func(target string, arg int, payload any) (string, error),
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		lockdown, err := loadLockdown(c, get)
+		if err != nil {
+			return err
+		}
+		if lockdown.Status != models.LockdownPending && lockdown.Status != models.LockdownEnforcing {
+			return fiber.NewError(fiber.StatusConflict, "namespace is "+lockdown.Status+" , nothing to approve")
+		}
+
+		now := time.Now()
+		lockdown.Status = models.LockdownEnforcing
+		lockdown.ApprovedAt = &now
+		return sendLockdown(c, lockdown, models.Lockdown_request{
+			Namespace: lockdown.Namespace,
+			Mode:      "enforcing",
+			Allow:     lockdown.Allow,
+		}, save, publish)
+	}
+}
+
+// ReleaseLockdown lifts the lockdown , the list is kept so it can be approved again.
+// DELETE /api/lockdown/:namespace
+func ReleaseLockdown(
+	get func(namespace string) (*models.Lockdown, error),
+	save func(*models.Lockdown) error,
+	publish func(target string, arg int, payload any) (string, error),
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		lockdown, err := loadLockdown(c, get)
+		if err != nil {
+			return err
+		}
+		lockdown.Status = models.LockdownOff
+		return sendLockdown(c, lockdown, models.Lockdown_request{Namespace: lockdown.Namespace, Mode: "off"}, save, publish)
+	}
+}
+
+// validAllowEntry applies the checks the agent makes , so a bad list is refused before it is approved
+func validAllowEntry(e models.Allow_entry) error {
+	if e.Protocol == 0 {
+		return fmt.Errorf("protocol is required")
+	}
+	if e.ListenPort != 0 {
+		if e.DstIP != "" || e.DstPort != 0 {
+			return fmt.Errorf("an entry is either a listen port or a destination")
+		}
+		if e.Protocol != 17 {
+			return fmt.Errorf("listen entries are for UDP")
+		}
+		return nil
+	}
+	if _, err := netip.ParseAddr(e.DstIP); err != nil {
+		return fmt.Errorf("dst_ip: %v", err)
+	}
+	return nil
+}
@@ -1 +1,44 @@
-package handlers
\ No newline at end of file
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// command types , must match the agent's "arg" header values
+var ruleKinds = map[string]int{
+	"network":  1,
+	"syscall":  2,
+	"resource": 3,
+}
+
+// PushRules forwards the request body as a rule command to the agents.
+// publish and target are injected by the router so this package stays free of the broker.
+// POST /api/rules/:kind?agent=<id>|node=<name>|group=<group>  (kind = network | syscall | resource)
+// Without a target query the rules go to every agent.
+func PushRules(
+	publish func(target string, arg int, payload any) (string, error),
+	target func(agentID, node, group string) string,
+) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		arg, ok := ruleKinds[c.Params("kind")]
+		if !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "unknown rule kind: "+c.Params("kind"))
+		}
+
+		var payload any
+		if err := c.BodyParser(&payload); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid rule body: "+err.Error())
+		}
+
+		routingKey := target(c.Query("agent"), c.Query("node"), c.Query("group"))
+		correlationID, err := publish(routingKey, arg, payload)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadGateway, err.Error())
+		}
+
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"correlation_id": correlationID,
+			"target":         routingKey,
+		})
+	}
+}
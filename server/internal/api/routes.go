@@ -3,7 +3,12 @@ package api
 import (
 	"encoding/json"
 	"log"
+	"server/internal/api/handlers"
+	"server/internal/config"
+	"server/internal/db"
 	"server/internal/db/models"
+	"server/internal/kube"
+	"server/internal/rabbitmq"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
 )
@@ -26,8 +31,27 @@ func UIInit() {
 		}
 	}))
 
-	log.Println(" WebSocket server running at ws://localhost:8080/ws")
-	log.Fatal(app.Listen(":8080"))
+	app.Get("/api/agents", handlers.ListAgents(db.GetAgents))
+	app.Get("/api/agents/:id", handlers.GetAgent(db.GetAgent))
+	app.Post("/api/rules/:kind", handlers.PushRules(rabbitmq.Publish_command, rabbitmq.Command_target))
+
+	app.Post("/api/lockdown/:namespace/learn", handlers.LearnLockdown(db.SaveLockdown, rabbitmq.Publish_command))
+	app.Post("/api/lockdown/:namespace/stop", handlers.StopLockdownLearning(db.GetLockdown, db.SaveLockdown, rabbitmq.Publish_command))
+	app.Get("/api/lockdown/:namespace", handlers.GetLockdown(db.GetLockdown))
+	app.Put("/api/lockdown/:namespace", handlers.EditLockdown(db.GetLockdown, db.SaveLockdown))
+	app.Post("/api/lockdown/:namespace/approve", handlers.ApproveLockdown(db.GetLockdown, db.SaveLockdown, rabbitmq.Publish_command))
+	app.Delete("/api/lockdown/:namespace", handlers.ReleaseLockdown(db.GetLockdown, db.SaveLockdown, rabbitmq.Publish_command))
+
+	app.Get("/api/connections", handlers.ListConnections(db.FindConnEvents))
+	app.Get("/api/graph", handlers.GetGraph(db.FindGraphEdges))
+
+	app.Post("/api/captures", handlers.StartCapture(kube.PodNode, db.SaveCapture, rabbitmq.Publish_command_with_id, rabbitmq.Command_target))
+	app.Get("/api/captures", handlers.ListCaptures(db.ListCaptures))
+	app.Get("/api/captures/:id", handlers.GetCapture(db.GetCapture))
+	app.Get("/api/captures/:id/pcap", handlers.DownloadCapture(db.GetCapture, db.OpenCaptureFile))
+
+	log.Printf(" WebSocket server running at ws://%s/ws", config.Get().Listen)
+	log.Fatal(app.Listen(config.Get().Listen))
 }
 
 func SendLog(entry models.Consumer_msg) {
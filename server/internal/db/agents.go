@@ -0,0 +1,189 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"server/internal/config"
+	"server/internal/db/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// an agent is stale after STALE_HEARTBEATS missed heartbeats and offline after OFFLINE_HEARTBEATS
+const (
+	STALE_HEARTBEATS   = 2
+	OFFLINE_HEARTBEATS = 5
+
+	// used until an agent has told us its interval
+	DEFAULT_HEARTBEAT_INTERVAL = 15 * time.Second
+	SWEEP_INTERVAL             = 15 * time.Second
+)
+
+// initAgentIndexes lets Mongo drop the heartbeats past agents.heartbeat_retention
+func initAgentIndexes(ctx context.Context) error {
+	_, err := heartbeatCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "timestamp", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(config.Get().Agents.HeartbeatRetention / time.Second)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create heartbeat index: %w", err)
+	}
+	return nil
+}
+
+// AgentStatus derives an agent's health from the time since its last heartbeat
+func AgentStatus(agent *models.Agent, now time.Time) string {
+	interval := DEFAULT_HEARTBEAT_INTERVAL
+	if agent.LastHeartbeat != nil && agent.LastHeartbeat.IntervalSeconds > 0 {
+		interval = time.Duration(agent.LastHeartbeat.IntervalSeconds) * time.Second
+	}
+
+	silent := now.Sub(agent.LastSeen)
+	switch {
+	case silent > OFFLINE_HEARTBEATS*interval:
+		return models.AgentOffline
+	case silent > STALE_HEARTBEATS*interval:
+		return models.AgentStale
+	default:
+		return models.AgentOnline
+	}
+}
+
+// UpsertAgent records an agent registration , keyed by agent ID.
+// Only the registration fields are set , a re-registering agent keeps its last heartbeat.
+func UpsertAgent(agent *models.Agent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	agent.LastSeen = agent.RegisteredAt
+	agent.Status = models.AgentOnline
+	_, err := agentCollection.UpdateOne(ctx,
+		bson.M{"_id": agent.ID},
+		bson.M{
+			"$set": bson.M{
+				"node_name":     agent.NodeName,
+				"group":         agent.Group,
+				"version":       agent.Version,
+				"started_at":    agent.StartedAt,
+				"registered_at": agent.RegisteredAt,
+				"last_seen":     agent.LastSeen,
+				"status":        agent.Status,
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register agent %s: %w", agent.ID, err)
+	}
+	return nil
+}
+
+// RecordHeartbeat stores the heartbeat and refreshes the agent's registry entry.
+// Agents that heartbeat before registering (e.g. the server restarted) are added on the fly.
+func RecordHeartbeat(hb *models.Heartbeat) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	_, err := agentCollection.UpdateOne(ctx,
+		bson.M{"_id": hb.AgentID},
+		bson.M{
+			"$set": bson.M{
+				"node_name":      hb.NodeName,
+				"version":        hb.Version,
+				"last_seen":      now,
+				"status":         models.AgentOnline,
+				"last_heartbeat": hb,
+			},
+			"$setOnInsert": bson.M{
+				"registered_at": now,
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update agent %s: %w", hb.AgentID, err)
+	}
+
+	if _, err := heartbeatCollection.InsertOne(ctx, hb); err != nil {
+		return fmt.Errorf("failed to store heartbeat of %s: %w", hb.AgentID, err)
+	}
+	return nil
+}
+
+func GetAgents() ([]models.Agent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := agentCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"node_name": 1}))
+	if err != nil {
+		return nil, err
+	}
+	agents := []models.Agent{}
+	if err := cursor.All(ctx, &agents); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := range agents {
+		agents[i].Status = AgentStatus(&agents[i], now)
+	}
+	return agents, nil
+}
+
+// GetAgent returns nil , nil when no agent has the given ID
+func GetAgent(id string) (*models.Agent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var agent models.Agent
+	err := agentCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&agent)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	agent.Status = AgentStatus(&agent, time.Now())
+	return &agent, nil
+}
+
+// StartAgentSweeper periodically persists status changes of agents that stopped heartbeating
+func StartAgentSweeper() {
+	ticker := time.NewTicker(SWEEP_INTERVAL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		cursor, err := agentCollection.Find(ctx, bson.M{"status": bson.M{"$ne": models.AgentOffline}})
+		if err != nil {
+			log.Printf(" Agent sweep failed: %v", err)
+			cancel()
+			continue
+		}
+		var agents []models.Agent
+		if err := cursor.All(ctx, &agents); err != nil {
+			log.Printf(" Agent sweep failed: %v", err)
+			cancel()
+			continue
+		}
+
+		now := time.Now()
+		for i := range agents {
+			status := AgentStatus(&agents[i], now)
+			if status == agents[i].Status {
+				continue
+			}
+			log.Printf(" Agent %s (%s) is now %s , last seen %s", agents[i].ID, agents[i].NodeName, status, agents[i].LastSeen.Format(time.RFC3339))
+			_, err := agentCollection.UpdateOne(ctx, bson.M{"_id": agents[i].ID}, bson.M{"$set": bson.M{"status": status}})
+			if err != nil {
+				log.Printf(" Failed to update status of %s: %v", agents[i].ID, err)
+			}
+		}
+		cancel()
+	}
+}
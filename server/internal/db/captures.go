@@ -0,0 +1,182 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"server/internal/db/models"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// captureUpload is the pcapng file of a capture while its chunks arrive
+type captureUpload struct {
+	stream *gridfs.UploadStream
+	next   int // seq of the next chunk
+	size   int64
+}
+
+var (
+	captureUploads = make(map[string]*captureUpload)
+	upload_mu      sync.Mutex
+)
+
+// GetCapture returns nil , nil for an unknown capture
+func GetCapture(id string) (*models.Capture, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var capture models.Capture
+	err := captureCollection.FindOne(ctx, bson.M{"_id": id}).Decode(&capture)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &capture, nil
+}
+
+func SaveCapture(capture *models.Capture) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := captureCollection.ReplaceOne(ctx, bson.M{"_id": capture.ID}, capture, options.Replace().SetUpsert(true))
+	return err
+}
+
+// ListCaptures returns the captures of a namespace , of every namespace when empty , newest first
+func ListCaptures(namespace string, limit int64) ([]models.Capture, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := bson.M{}
+	if namespace != "" {
+		query["request.namespace"] = namespace
+	}
+	opts := options.Find().SetSort(bson.M{"requested_at": -1})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cursor, err := captureCollection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	captures := []models.Capture{}
+	if err := cursor.All(ctx, &captures); err != nil {
+		return nil, err
+	}
+	return captures, nil
+}
+
+// finishCapture stores the end of a capture , the upload of its file must be over
+func finishCapture(capture *models.Capture, status, reason string) error {
+	now := time.Now()
+	capture.Status = status
+	capture.Error = reason
+	capture.FinishedAt = &now
+	if err := SaveCapture(capture); err != nil {
+		return fmt.Errorf("failed to store capture %s: %w", capture.ID, err)
+	}
+	log.Printf(" Capture %s of %s/%s %s: %d packets , %d lost %s", capture.ID, capture.Request.Namespace, capture.Request.Pod, status, capture.Packets, capture.Lost, reason)
+	return nil
+}
+
+// AddCaptureChunk appends a chunk an agent sent to the GridFS file of its capture.
+// Chunks must arrive in order , a missing one fails the capture. A chunk delivered again ,
+// e.g. after the agent's publisher reconnected , is ignored.
+func AddCaptureChunk(chunk *models.Capture_chunk) error {
+	capture, err := GetCapture(chunk.CaptureID)
+	if err != nil {
+		return err
+	}
+	if capture == nil {
+		return fmt.Errorf("chunk of unknown capture %s", chunk.CaptureID)
+	}
+	if capture.Status == models.CaptureDone || capture.Status == models.CaptureFailed {
+		return fmt.Errorf("chunk of capture %s , which is %s", capture.ID, capture.Status)
+	}
+
+	upload_mu.Lock()
+	defer upload_mu.Unlock()
+
+	upload := captureUploads[capture.ID]
+	abort := func(reason string) error {
+		if upload != nil {
+			upload.stream.Abort()
+			delete(captureUploads, capture.ID)
+		}
+		return finishCapture(capture, models.CaptureFailed, reason)
+	}
+
+	if chunk.Error != "" {
+		return abort(chunk.Error)
+	}
+	if upload == nil {
+		if chunk.Seq != 0 {
+			return abort(fmt.Sprintf("upload started at chunk %d", chunk.Seq))
+		}
+		stream, err := captureFiles.OpenUploadStreamWithID(capture.ID, capture.ID+".pcapng")
+		if err != nil {
+			return abort(err.Error())
+		}
+		upload = &captureUpload{stream: stream}
+		captureUploads[capture.ID] = upload
+		capture.Status = models.CaptureUploading
+		if err := SaveCapture(capture); err != nil {
+			return fmt.Errorf("failed to store capture %s: %w", capture.ID, err)
+		}
+	}
+	if chunk.Seq < upload.next {
+		log.Printf(" Ignoring chunk %d of capture %s , it was already written", chunk.Seq, capture.ID)
+		return nil
+	}
+	if chunk.Seq > upload.next {
+		return abort(fmt.Sprintf("chunk %d arrived , expected %d", chunk.Seq, upload.next))
+	}
+
+	upload.stream.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := upload.stream.Write(chunk.Data); err != nil {
+		return abort(err.Error())
+	}
+	upload.next++
+	upload.size += int64(len(chunk.Data))
+	if !chunk.Last {
+		return nil
+	}
+
+	if err := upload.stream.Close(); err != nil {
+		return abort(err.Error())
+	}
+	delete(captureUploads, capture.ID)
+	capture.Packets, capture.Bytes, capture.Lost = chunk.Packets, chunk.Bytes, chunk.Lost
+	capture.Truncated = chunk.Truncated
+	capture.Size = upload.size
+	return finishCapture(capture, models.CaptureDone, "")
+}
+
+// FailCaptureCommand fails the capture a command was sent for when the agent refused it
+func FailCaptureCommand(correlationID, reason string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var capture models.Capture
+	err := captureCollection.FindOne(ctx, bson.M{"correlation_id": correlationID, "status": models.CaptureRequested}).Decode(&capture)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return finishCapture(&capture, models.CaptureFailed, reason)
+}
+
+// OpenCaptureFile opens the pcapng file of a capture that is done
+func OpenCaptureFile(id string) (*gridfs.DownloadStream, error) {
+	return captureFiles.OpenDownloadStream(id)
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"server/internal/db/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func InsertConnEvent(event *models.Conn_event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := connectionCollection.InsertOne(ctx, event); err != nil {
+		return fmt.Errorf("failed to store connection event of %s: %w", event.AgentID, err)
+	}
+	return nil
+}
+
+// FindConnEvents returns the newest connection events matching filter first
+func FindConnEvents(filter models.Conn_filter) ([]models.Conn_event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := bson.M{}
+	if filter.Type != "" {
+		query["type"] = filter.Type
+	}
+	if filter.Namespace != "" {
+		query["namespace"] = filter.Namespace
+	}
+	if filter.Pod != "" {
+		query["pod"] = filter.Pod
+	}
+	if !filter.Since.IsZero() {
+		query["timestamp"] = bson.M{"$gte": filter.Since}
+	}
+
+	opts := options.Find().SetSort(bson.M{"timestamp": -1})
+	if filter.Limit > 0 {
+		opts.SetLimit(filter.Limit)
+	}
+	cursor, err := connectionCollection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	events := []models.Conn_event{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"server/internal/config"
+	"server/internal/db/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// initGraphIndexes lets Mongo drop the windows past graph.retention , and finds the
+// document of an edge's window without a scan
+func initGraphIndexes(ctx context.Context) error {
+	_, err := graphCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "window", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(config.Get().Graph.Retention / time.Second)),
+		},
+		{
+			Keys: bson.D{
+				{Key: "src.id", Value: 1},
+				{Key: "dst.id", Value: 1},
+				{Key: "port", Value: 1},
+				{Key: "protocol", Value: 1},
+				{Key: "window", Value: 1},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create service graph indexes: %w", err)
+	}
+	return nil
+}
+
+// AddGraphEdges adds the counters of edges to their windows
+func AddGraphEdges(edges []models.Graph_edge) error {
+	if len(edges) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	writes := make([]mongo.WriteModel, 0, len(edges))
+	for _, e := range edges {
+		filter := bson.M{
+			"window":   e.Window,
+			"src.id":   e.Src.ID,
+			"dst.id":   e.Dst.ID,
+			"port":     e.Port,
+			"protocol": e.Protocol,
+		}
+		update := bson.M{
+			// a workload's services can change during the window , the last ones are kept
+			"$set": bson.M{"src": e.Src, "dst": e.Dst},
+			"$inc": bson.M{
+				"bytes_sent":       int64(e.BytesSent),
+				"bytes_received":   int64(e.BytesReceived),
+				"packets_sent":     int64(e.PacketsSent),
+				"packets_received": int64(e.PacketsReceived),
+				"connections":      int64(e.Connections),
+			},
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true))
+	}
+	if _, err := graphCollection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+		return fmt.Errorf("failed to store service graph edges: %w", err)
+	}
+	return nil
+}
+
+// FindGraphEdges sums the windows since filter.Since per edge , the busiest edges first
+func FindGraphEdges(filter models.Graph_filter) ([]models.Graph_edge, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	match := bson.M{"window": bson.M{"$gte": filter.Since.Truncate(config.Get().Graph.Window)}}
+	if filter.Namespace != "" {
+		match["$or"] = bson.A{
+			bson.M{"src.namespace": filter.Namespace},
+			bson.M{"dst.namespace": filter.Namespace},
+		}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$sort", Value: bson.M{"window": 1}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":              bson.M{"src": "$src.id", "dst": "$dst.id", "port": "$port", "protocol": "$protocol"},
+			"src":              bson.M{"$last": "$src"},
+			"dst":              bson.M{"$last": "$dst"},
+			"port":             bson.M{"$first": "$port"},
+			"protocol":         bson.M{"$first": "$protocol"},
+			"bytes_sent":       bson.M{"$sum": "$bytes_sent"},
+			"bytes_received":   bson.M{"$sum": "$bytes_received"},
+			"packets_sent":     bson.M{"$sum": "$packets_sent"},
+			"packets_received": bson.M{"$sum": "$packets_received"},
+			"connections":      bson.M{"$sum": "$connections"},
+		}}},
+		{{Key: "$addFields", Value: bson.M{"total": bson.M{"$add": bson.A{"$bytes_sent", "$bytes_received"}}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "total", Value: -1}, {Key: "_id", Value: 1}}}},
+	}
+	if filter.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: filter.Limit}})
+	}
+
+	cursor, err := graphCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	edges := []models.Graph_edge{}
+	if err := cursor.All(ctx, &edges); err != nil {
+		return nil, err
+	}
+	return edges, nil
+}
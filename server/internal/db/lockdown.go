@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"server/internal/db/models"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GetLockdown returns nil , nil when the namespace was never put in lockdown
+func GetLockdown(namespace string) (*models.Lockdown, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var lockdown models.Lockdown
+	err := lockdownCollection.FindOne(ctx, bson.M{"_id": namespace}).Decode(&lockdown)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &lockdown, nil
+}
+
+// EnforcingLockdowns returns the lockdowns every agent has to enforce
+func EnforcingLockdowns() ([]models.Lockdown, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cursor, err := lockdownCollection.Find(ctx, bson.M{"status": models.LockdownEnforcing})
+	if err != nil {
+		return nil, err
+	}
+	var lockdowns []models.Lockdown
+	if err := cursor.All(ctx, &lockdowns); err != nil {
+		return nil, err
+	}
+	return lockdowns, nil
+}
+
+func SaveLockdown(lockdown *models.Lockdown) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lockdown.UpdatedAt = time.Now()
+	_, err := lockdownCollection.ReplaceOne(ctx, bson.M{"_id": lockdown.Namespace}, lockdown, options.Replace().SetUpsert(true))
+	return err
+}
+
+// MergeLockdownReport adds the flows one agent learned to the namespace's allow-list.
+// Every agent reports the pods of its node , the first report makes the lockdown pending.
+func MergeLockdownReport(agentID string, report *models.Lockdown_report) error {
+	lockdown, err := GetLockdown(report.Namespace)
+	if err != nil {
+		return err
+	}
+	if lockdown == nil || (lockdown.Status != models.LockdownLearning && lockdown.Status != models.LockdownPending) {
+		log.Printf(" Ignoring lockdown report of %s for %s , the namespace is not learning", agentID, report.Namespace)
+		return nil
+	}
+
+	type entryKey struct {
+		workload   string
+		pod        string
+		protocol   uint8
+		dstIP      string
+		dstPort    uint16
+		listenPort uint16
+	}
+	index := make(map[entryKey]int, len(lockdown.Allow))
+	for i, e := range lockdown.Allow {
+		index[entryKey{e.Workload, e.Pod, e.Protocol, e.DstIP, e.DstPort, e.ListenPort}] = i
+	}
+	for _, e := range report.Learned {
+		key := entryKey{e.Workload, e.Pod, e.Protocol, e.DstIP, e.DstPort, e.ListenPort}
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(lockdown.Allow)
+			lockdown.Allow = append(lockdown.Allow, e)
+			continue
+		}
+		lockdown.Allow[i].Packets += e.Packets
+		if e.LastSeen.After(lockdown.Allow[i].LastSeen) {
+			lockdown.Allow[i].LastSeen = e.LastSeen
+		}
+	}
+
+	if !slices.Contains(lockdown.Reported, agentID) {
+		lockdown.Reported = append(lockdown.Reported, agentID)
+	}
+	lockdown.Truncated = lockdown.Truncated || report.Truncated
+	lockdown.Status = models.LockdownPending
+	if err := SaveLockdown(lockdown); err != nil {
+		return fmt.Errorf("failed to store lockdown of %s: %w", report.Namespace, err)
+	}
+	log.Printf(" Lockdown of %s: %s reported %d flows , %d entries pending approval", report.Namespace, agentID, len(report.Learned), len(lockdown.Allow))
+	return nil
+}
@@ -10,8 +10,12 @@ type AnomalyLog struct {
 	Memory  float64 `json:"memory" bson:"memory"`
 	Network float64 `json:"network" bson:"network"`
 	Syscall float64 `json:"syscall" bson:"syscall"`
+	// HTTP 5xx responses per second , and the user agents first seen in the pod's requests
+	HTTPErrors    float64  `json:"http_errors" bson:"http_errors"`
+	NewUserAgents []string `json:"new_user_agents,omitempty" bson:"new_user_agents,omitempty"`
 	Timestamp time.Time `json:"timestamp" bson:"timestamp"` 
 	Container ContainerMapping `json:"container" bson:"container"`
+	AgentID string `json:"agent_id" bson:"agent_id"`
 }
 
 type ContainerMapping struct {
@@ -22,6 +26,9 @@ type ContainerMapping struct {
 	PID           int    `json:"pid" bson:"pid"`
 	UID           string `json:"uid" bson:"uid"`
 	Cgroup        string `json:"cgroup" bson:"cgroup"`
+	Image         string            `json:"image,omitempty" bson:"image,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`
+	PodLabels     map[string]string `json:"pod_labels,omitempty" bson:"pod_labels,omitempty"`
 }
 
 
@@ -40,6 +47,324 @@ type Consumer_Anomaly_log struct{
 	Id  int  `json:"id"`
 }
 
+// agent health , derived from how many heartbeats were missed
+const (
+	AgentOnline  = "online"
+	AgentStale   = "stale"
+	AgentOffline = "offline"
+)
+
+// Agent is the registry entry of one agent: its registration (id = 4)
+// plus the last heartbeat (id = 5) it sent.
+type Agent struct {
+	ID            string     `json:"id" bson:"_id"`
+	NodeName      string     `json:"node_name" bson:"node_name"`
+	Group         string     `json:"group" bson:"group"`
+	Version       string     `json:"version" bson:"version"`
+	StartedAt     time.Time  `json:"started_at" bson:"started_at"`
+	RegisteredAt  time.Time  `json:"registered_at" bson:"registered_at"`
+	LastSeen      time.Time  `json:"last_seen" bson:"last_seen"`
+	Status        string     `json:"status" bson:"status"`
+	LastHeartbeat *Heartbeat `json:"last_heartbeat,omitempty" bson:"last_heartbeat,omitempty"`
+}
+
+// Ringbuf_stats are the agent's counters of one ring buffer. Full and Shed are the records its
+// BPF programs lost , by program , Dropped the low priority ones the agent read but did not send.
+type Ringbuf_stats struct {
+	Read         uint64            `json:"read" bson:"read"`
+	ReadErrors   uint64            `json:"read_errors" bson:"read_errors"`
+	DecodeErrors uint64            `json:"decode_errors" bson:"decode_errors"`
+	Full         map[string]uint64 `json:"full,omitempty" bson:"full,omitempty"`
+	Shed         map[string]uint64 `json:"shed,omitempty" bson:"shed,omitempty"`
+	Dropped      uint64            `json:"dropped" bson:"dropped"`
+	TimedOut     uint64            `json:"timed_out" bson:"timed_out"`
+}
+
+// Spool_stats are the agent's producer counters: events spooled to disk while the
+// broker was down , replayed after reconnecting , and dropped
+type Spool_stats struct {
+	Spooled  uint64 `json:"spooled" bson:"spooled"`
+	Replayed uint64 `json:"replayed" bson:"replayed"`
+	Dropped  uint64 `json:"dropped" bson:"dropped"`
+	Pending  uint64 `json:"pending" bson:"pending"`
+	Bytes    uint64 `json:"bytes" bson:"bytes"`
+}
+
+type BPF_program struct {
+	Name string `json:"name" bson:"name"`
+	ID   uint32 `json:"id" bson:"id"`
+}
+
+type Heartbeat struct {
+	AgentID             string                      `json:"agent_id" bson:"agent_id"`
+	NodeName            string                      `json:"node_name" bson:"node_name"`
+	Version             string                      `json:"version" bson:"version"`
+	KernelVersion       string                      `json:"kernel_version" bson:"kernel_version"`
+	Interfaces          []string                    `json:"interfaces" bson:"interfaces"`
+	Programs            []BPF_program               `json:"programs" bson:"programs"`
+	MonitoredContainers int                         `json:"monitored_containers" bson:"monitored_containers"`
+	Ringbufs            map[string]Ringbuf_stats    `json:"ringbufs" bson:"ringbufs"`
+	Unparsed            map[string]Unparsed_packets `json:"unparsed,omitempty" bson:"unparsed,omitempty"` // by program
+	Spool               Spool_stats                 `json:"spool" bson:"spool"`
+	FlowRules           *Flow_rule_stats            `json:"flow_rules,omitempty" bson:"flow_rules,omitempty"`
+	Lockdown            map[string]string           `json:"lockdown,omitempty" bson:"lockdown,omitempty"` // agent side mode by namespace
+	FQDNRules           []Fqdn_rule_status          `json:"fqdn_rules,omitempty" bson:"fqdn_rules,omitempty"`
+	IntervalSeconds     int                         `json:"interval_seconds" bson:"interval_seconds"`
+	Timestamp           time.Time                   `json:"timestamp" bson:"timestamp"`
+}
+
+// Unparsed_packets counts the packets whose IP headers an agent could not parse
+type Unparsed_packets struct {
+	Passed  uint64 `json:"passed" bson:"passed"`
+	Dropped uint64 `json:"dropped" bson:"dropped"` // on the veths of locked down pods
+}
+
+// Fqdn_rule_status lists the addresses an agent currently applies an FQDN rule to
+type Fqdn_rule_status struct {
+	RuleID uint32   `json:"rule_id" bson:"rule_id"`
+	FQDN   string   `json:"fqdn" bson:"fqdn"`
+	IPs    []string `json:"ips" bson:"ips"`
+}
+
+// Flow_rule_stats tells how an agent indexed its network rules
+type Flow_rule_stats struct {
+	Total      int       `json:"total" bson:"total"`
+	Disabled   int       `json:"disabled" bson:"disabled"`
+	Exact      int       `json:"exact" bson:"exact"`
+	Port       int       `json:"port" bson:"port"`
+	DstCIDR    int       `json:"dst_cidr" bson:"dst_cidr"`
+	SrcCIDR    int       `json:"src_cidr" bson:"src_cidr"`
+	Fallback   int       `json:"fallback" bson:"fallback"`
+	Unindexed  int       `json:"unindexed" bson:"unindexed"` // left out , the fallback list was full
+	Scoped     int       `json:"scoped" bson:"scoped"`
+	FQDN       int       `json:"fqdn" bson:"fqdn"`
+	Policy     int       `json:"policy" bson:"policy"` // translated from NetworkPolicies
+	Generation uint32    `json:"generation" bson:"generation"`
+	LoadedAt   time.Time `json:"loaded_at" bson:"loaded_at"`
+}
+
+// Command_ack is what an agent publishes (id = 3) after handling a command
+type Command_ack struct {
+	AgentID       string    `json:"agent_id" bson:"agent_id"`
+	Version       int       `json:"version" bson:"version"`
+	CorrelationID string    `json:"correlation_id" bson:"correlation_id"`
+	Arg           int       `json:"arg" bson:"arg"`
+	Status        string    `json:"status" bson:"status"`
+	Error         string    `json:"error,omitempty" bson:"error,omitempty"`
+	Applied       int       `json:"applied" bson:"applied"`
+	Skipped       []uint32  `json:"skipped,omitempty" bson:"skipped,omitempty"` // ids of the rules that were not applied
+	Timestamp     time.Time `json:"timestamp" bson:"timestamp"`
+}
+
+// lockdown states of a namespace
+const (
+	LockdownLearning  = "learning"  // agents record the flows of its pods
+	LockdownPending   = "pending"   // learned , the allow-list waits for review and approval
+	LockdownEnforcing = "enforcing" // default-deny for what its pods send
+	LockdownOff       = "off"
+)
+
+// Allow_entry is a flow a pod of a lockdown namespace may open.
+// An egress entry sets DstIP , a listen entry sets ListenPort: the pod serves it over UDP and may reply from it.
+// Learned entries name the workload , so they still apply to the pods that replace the ones seen while learning.
+type Allow_entry struct {
+	Workload   string    `json:"workload,omitempty" bson:"workload,omitempty"` // the pods of a deployment , statefulset , daemonset or job , empty for every workload
+	Pod        string    `json:"pod,omitempty" bson:"pod,omitempty"`           // empty for every pod of the workload
+	Protocol   uint8     `json:"protocol" bson:"protocol"`
+	DstIP      string    `json:"dst_ip,omitempty" bson:"dst_ip,omitempty"`
+	DstPort    uint16    `json:"dst_port,omitempty" bson:"dst_port,omitempty"`
+	ListenPort uint16    `json:"listen_port,omitempty" bson:"listen_port,omitempty"`
+	Packets    uint64    `json:"packets,omitempty" bson:"packets,omitempty"`
+	LastSeen   time.Time `json:"last_seen,omitempty" bson:"last_seen,omitempty"`
+}
+
+// Lockdown_report is what an agent publishes (id = 6) when a namespace stops learning
+type Lockdown_report struct {
+	Namespace string        `json:"namespace" bson:"namespace"`
+	Learned   []Allow_entry `json:"learned" bson:"learned"`
+	Truncated bool          `json:"truncated" bson:"truncated"`
+	StartedAt time.Time     `json:"started_at" bson:"started_at"`
+	EndedAt   time.Time     `json:"ended_at" bson:"ended_at"`
+}
+
+// Lockdown_request is the body of a lockdown command (arg = 4)
+type Lockdown_request struct {
+	Namespace    string        `json:"namespace"`
+	Mode         string        `json:"mode"` // learning , learned (stop learning now) , enforcing or off
+	LearnSeconds int           `json:"learn_seconds,omitempty"`
+	Allow        []Allow_entry `json:"allow,omitempty"`
+}
+
+// Lockdown is the lockdown of one namespace. Allow starts as the merged reports of
+// every agent , can be edited while pending , and is enforced once approved.
+type Lockdown struct {
+	Namespace  string        `json:"namespace" bson:"_id"`
+	Status     string        `json:"status" bson:"status"`
+	Allow      []Allow_entry `json:"allow" bson:"allow"`
+	Reported   []string      `json:"reported" bson:"reported"` // agents whose report was merged
+	Truncated  bool          `json:"truncated" bson:"truncated"`
+	LearnUntil time.Time     `json:"learn_until,omitempty" bson:"learn_until,omitempty"`
+	ApprovedAt *time.Time    `json:"approved_at,omitempty" bson:"approved_at,omitempty"`
+	UpdatedAt  time.Time     `json:"updated_at" bson:"updated_at"`
+}
+
+// connection event types
+const (
+	ConnOpened  = "opened"
+	ConnClosed  = "closed"
+	ConnRefused = "refused"
+)
+
+// Conn_event is what an agent publishes (id = 7) when a TCP connection of a pod opens , closes or is refused
+type Conn_event struct {
+	AgentID       string    `json:"agent_id" bson:"agent_id"`
+	Type          string    `json:"type" bson:"type"`
+	Reason        string    `json:"reason,omitempty" bson:"reason,omitempty"` // fin , rst or timeout
+	Pod           string    `json:"pod" bson:"pod"`
+	Namespace     string    `json:"namespace" bson:"namespace"`
+	Outbound      bool      `json:"outbound" bson:"outbound"` // opened by the pod
+	Src           string    `json:"src" bson:"src"`           // initiator
+	Dst           string    `json:"dst" bson:"dst"`           // responder
+	DurationMs    int64     `json:"duration_ms" bson:"duration_ms"`
+	BytesSent     uint64    `json:"bytes_sent" bson:"bytes_sent"` // by the initiator
+	BytesReceived uint64    `json:"bytes_received" bson:"bytes_received"`
+	Domain        string    `json:"domain,omitempty" bson:"domain,omitempty"` // the pod resolved the other end from it
+	Timestamp     time.Time `json:"timestamp" bson:"timestamp"`
+}
+
+// Conn_filter selects connection events , empty fields match everything
+type Conn_filter struct {
+	Type      string
+	Namespace string
+	Pod       string
+	Since     time.Time
+	Limit     int64
+}
+
+// which end of an Edge_report is the pod the agent saw the traffic on
+const (
+	EdgeLocalClient = "client"
+	EdgeLocalServer = "server"
+)
+
+// Edge_report is the traffic between two addresses an agent saw on one pod's veth during a window.
+// The client is the end with the higher port , the server's port is the service port.
+type Edge_report struct {
+	Client          string `json:"client"`
+	Server          string `json:"server"`
+	Port            uint16 `json:"port"`
+	Protocol        uint8  `json:"protocol"`
+	Local           string `json:"local"` // EdgeLocal*
+	BytesToServer   uint64 `json:"bytes_to_server"`
+	BytesToClient   uint64 `json:"bytes_to_client"`
+	PacketsToServer uint64 `json:"packets_to_server"`
+	PacketsToClient uint64 `json:"packets_to_client"`
+	Connections     uint64 `json:"connections"`
+}
+
+// Graph_report is what an agent publishes (id = 8) every graph interval
+type Graph_report struct {
+	Start time.Time     `json:"start"`
+	End   time.Time     `json:"end"`
+	Edges []Edge_report `json:"edges"`
+}
+
+// kinds of service graph nodes
+const (
+	NodeWorkload = "workload" // the pods of a deployment , statefulset , ... or a bare pod
+	NodeService  = "service"  // a service's cluster IP
+	NodeExternal = "external" // an address outside the pods and services , e.g. a node or the internet
+)
+
+// Graph_node is one end of a service graph edge
+type Graph_node struct {
+	ID        string   `json:"id" bson:"id"`
+	Kind      string   `json:"kind" bson:"kind"`
+	Namespace string   `json:"namespace,omitempty" bson:"namespace,omitempty"`
+	Name      string   `json:"name" bson:"name"`
+	Services  []string `json:"services,omitempty" bson:"services,omitempty"` // a workload's pods back these services
+}
+
+// Graph_edge is the traffic from a client to a server port during a window , the stored
+// windows are summed when the graph is read
+type Graph_edge struct {
+	Window          time.Time  `json:"-" bson:"window"`
+	Src             Graph_node `json:"src" bson:"src"`
+	Dst             Graph_node `json:"dst" bson:"dst"`
+	Port            uint16     `json:"port" bson:"port"`
+	Protocol        uint8      `json:"protocol" bson:"protocol"`
+	BytesSent       uint64     `json:"bytes_sent" bson:"bytes_sent"` // by the client
+	BytesReceived   uint64     `json:"bytes_received" bson:"bytes_received"`
+	PacketsSent     uint64     `json:"packets_sent" bson:"packets_sent"`
+	PacketsReceived uint64     `json:"packets_received" bson:"packets_received"`
+	Connections     uint64     `json:"connections" bson:"connections"`
+}
+
+// Graph_filter selects the edges of a graph , edges with either end in Namespace when set
+type Graph_filter struct {
+	Namespace string
+	Since     time.Time
+	Limit     int64
+}
+
+// Graph is the service dependency graph returned by the API
+type Graph struct {
+	Since time.Time    `json:"since"`
+	Nodes []Graph_node `json:"nodes"`
+	Edges []Graph_edge `json:"edges"`
+}
+
+// capture states
+const (
+	CaptureRequested = "requested" // sent to the agent of the pod's node
+	CaptureUploading = "uploading" // the agent is sending the file
+	CaptureDone      = "done"
+	CaptureFailed    = "failed"
+)
+
+// Capture_request is the body of a capture command (arg = 5). Filter is a network rule
+// without action , scope or fqdn , checked by the agent.
+type Capture_request struct {
+	CaptureID       string         `json:"capture_id" bson:"capture_id"`
+	Namespace       string         `json:"namespace" bson:"namespace"`
+	Pod             string         `json:"pod" bson:"pod"`
+	DurationSeconds int            `json:"duration_seconds,omitempty" bson:"duration_seconds,omitempty"`
+	MaxPackets      int            `json:"max_packets,omitempty" bson:"max_packets,omitempty"`
+	Snaplen         int            `json:"snaplen,omitempty" bson:"snaplen,omitempty"`
+	Filter          map[string]any `json:"filter,omitempty" bson:"filter,omitempty"`
+}
+
+// Capture is a packet capture of one pod , its pcapng file is kept in GridFS under the same id
+type Capture struct {
+	ID            string          `json:"id" bson:"_id"`
+	Request       Capture_request `json:"request" bson:"request"`
+	Node          string          `json:"node" bson:"node"`
+	CorrelationID string          `json:"correlation_id" bson:"correlation_id"`
+	Status        string          `json:"status" bson:"status"`
+	Packets       uint64          `json:"packets" bson:"packets"`
+	Bytes         uint64          `json:"bytes" bson:"bytes"`
+	Lost          uint64          `json:"lost" bson:"lost"`
+	Truncated     bool            `json:"truncated" bson:"truncated"`
+	Size          int64           `json:"size" bson:"size"` // of the pcapng file
+	Error         string          `json:"error,omitempty" bson:"error,omitempty"`
+	RequestedAt   time.Time       `json:"requested_at" bson:"requested_at"`
+	FinishedAt    *time.Time      `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+}
+
+// Capture_chunk is a part of the pcapng file of a capture (id = 9) , in order from seq 0.
+// The last chunk has the totals , or the error that ended the capture.
+type Capture_chunk struct {
+	CaptureID string `json:"capture_id"`
+	Seq       int    `json:"seq"`
+	Data      []byte `json:"data,omitempty"`
+	Last      bool   `json:"last,omitempty"`
+	Packets   uint64 `json:"packets,omitempty"`
+	Bytes     uint64 `json:"bytes,omitempty"`
+	Lost      uint64 `json:"lost,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
 type LogItem struct {
 	Timestamp string // optional
 	Method    string
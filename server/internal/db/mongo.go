@@ -3,11 +3,14 @@ package db
 import (
 	"context"
 	
+	"server/internal/config"
 	"server/internal/db/models"
 	"time"
 
 	"server/internal/logic"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -15,6 +18,14 @@ var mongoClient *mongo.Client
 var (
 	anomalyLogCollection    *mongo.Collection
 	LogCollection      		*mongo.Collection
+	commandAckCollection    *mongo.Collection
+	agentCollection         *mongo.Collection
+	heartbeatCollection     *mongo.Collection
+	lockdownCollection      *mongo.Collection
+	connectionCollection    *mongo.Collection
+	graphCollection         *mongo.Collection
+	captureCollection       *mongo.Collection
+	captureFiles            *gridfs.Bucket
 )
 
 
@@ -22,21 +33,48 @@ func InitMongo() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(config.Get().Mongo.URI))
 	if err != nil {
 		return err
 	}
 
 	mongoClient = client
-	LogCollection = client.Database("secureflow").Collection("LogCollection")
-	anomalyLogCollection = client.Database("secureflow").Collection("anomalyLogCollection")
-	return nil
+	database := client.Database(config.Get().Mongo.Database)
+	LogCollection = database.Collection("LogCollection")
+	anomalyLogCollection = database.Collection("anomalyLogCollection")
+	commandAckCollection = database.Collection("commandAckCollection")
+	agentCollection = database.Collection("agentCollection")
+	heartbeatCollection = database.Collection("heartbeatCollection")
+	lockdownCollection = database.Collection("lockdownCollection")
+	connectionCollection = database.Collection("connectionCollection")
+	graphCollection = database.Collection("graphCollection")
+	captureCollection = database.Collection("captureCollection")
+	captureFiles, err = gridfs.NewBucket(database, options.GridFSBucket().SetName("pcaps"))
+	if err != nil {
+		return err
+	}
+	if err := initAgentIndexes(ctx); err != nil {
+		return err
+	}
+	return initGraphIndexes(ctx)
 }
 
-func InsertLog(log string) {
+func InsertLog(agentID string, log string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	LogCollection.InsertOne(ctx, bson.M{
+		"agent_id":  agentID,
+		"log":       log,
+		"timestamp": time.Now(),
+	})
+}
+
+
+
+func InsertCommand_Ack(ack *models.Command_ack) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	LogCollection.InsertOne(ctx, log)
+	commandAckCollection.InsertOne(ctx, ack)
 }
 
 
@@ -0,0 +1,389 @@
+package kube
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"server/internal/config"
+	"server/internal/db/models"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// resync period of the pod , service and endpoint informers
+const resyncPeriod = 10 * time.Minute
+
+type podIdentity struct {
+	namespace string
+	workload  string
+}
+
+type serviceKey struct {
+	namespace, name string
+}
+
+var (
+	podsByIP     = make(map[netip.Addr]podIdentity)
+	servicesByIP = make(map[netip.Addr]serviceKey)
+	// the endpoint addresses of each slice , and the service each address is an endpoint of by slice
+	sliceAddrs       = make(map[string][]netip.Addr)
+	endpointServices = make(map[netip.Addr]map[string]string)
+	// the node of each scheduled pod by namespace/name
+	podNodes      = make(map[string]string)
+	resolver_mu   sync.RWMutex
+	resolverReady bool
+)
+
+func clientset() (*kubernetes.Clientset, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", config.Get().Kube.Kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load kubeconfig: %w", err)
+		}
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// StartResolver watches the pods , services and endpoint slices of the cluster so the addresses
+// agents report are resolved to workloads and services. It blocks until the first lists are applied.
+func StartResolver(stop <-chan struct{}) error {
+	cs, err := clientset()
+	if err != nil {
+		return err
+	}
+	factory := informers.NewSharedInformerFactory(cs, resyncPeriod)
+
+	pods := factory.Core().V1().Pods().Informer()
+	services := factory.Core().V1().Services().Informer()
+	endpointSlices := factory.Discovery().V1().EndpointSlices().Informer()
+
+	handlers := []struct {
+		informer cache.SharedIndexInformer
+		update   func(obj any)
+		remove   func(obj any)
+	}{
+		{pods, updatePod, removePod},
+		{services, updateService, removeService},
+		{endpointSlices, updateSlice, removeSlice},
+	}
+	for _, h := range handlers {
+		_, err := h.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    h.update,
+			UpdateFunc: func(_, obj any) { h.update(obj) },
+			DeleteFunc: func(obj any) {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				h.remove(obj)
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("cannot register handler: %w", err)
+		}
+	}
+
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, pods.HasSynced, services.HasSynced, endpointSlices.HasSynced) {
+		return fmt.Errorf("informers did not sync")
+	}
+
+	resolver_mu.Lock()
+	resolverReady = true
+	log.Printf(" Resolver synced , %d pod IPs and %d service IPs", len(podsByIP), len(servicesByIP))
+	resolver_mu.Unlock()
+	return nil
+}
+
+// workloadOf names the controller of a pod , a deployment through its replicaset
+func workloadOf(pod *corev1.Pod) string {
+	for _, owner := range pod.OwnerReferences {
+		if owner.Controller == nil || !*owner.Controller {
+			continue
+		}
+		if owner.Kind == "ReplicaSet" {
+			if hash := pod.Labels["pod-template-hash"]; hash != "" {
+				return strings.TrimSuffix(owner.Name, "-"+hash)
+			}
+		}
+		return owner.Name
+	}
+	return pod.Name
+}
+
+func podIPs(pod *corev1.Pod) []netip.Addr {
+	var addrs []netip.Addr
+	for _, ip := range pod.Status.PodIPs {
+		if addr, err := netip.ParseAddr(ip.IP); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func updatePod(obj any) {
+	pod, ok := obj.(*corev1.Pod)
+	if ok {
+		updatePodNode(pod)
+	}
+	// host network pods share the node's address
+	if !ok || pod.Spec.HostNetwork {
+		return
+	}
+	id := podIdentity{namespace: pod.Namespace, workload: workloadOf(pod)}
+	done := pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+
+	resolver_mu.Lock()
+	defer resolver_mu.Unlock()
+	for _, addr := range podIPs(pod) {
+		if done {
+			// the address can already belong to a new pod
+			if podsByIP[addr] == id {
+				delete(podsByIP, addr)
+			}
+			continue
+		}
+		podsByIP[addr] = id
+	}
+}
+
+func removePod(obj any) {
+	pod, ok := obj.(*corev1.Pod)
+	if ok {
+		resolver_mu.Lock()
+		delete(podNodes, pod.Namespace+"/"+pod.Name)
+		resolver_mu.Unlock()
+	}
+	if !ok || pod.Spec.HostNetwork {
+		return
+	}
+	id := podIdentity{namespace: pod.Namespace, workload: workloadOf(pod)}
+
+	resolver_mu.Lock()
+	defer resolver_mu.Unlock()
+	for _, addr := range podIPs(pod) {
+		if podsByIP[addr] == id {
+			delete(podsByIP, addr)
+		}
+	}
+}
+
+// updatePodNode records the node of a running pod , host network pods included
+func updatePodNode(pod *corev1.Pod) {
+	key := pod.Namespace + "/" + pod.Name
+	done := pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+
+	resolver_mu.Lock()
+	defer resolver_mu.Unlock()
+	if done || pod.Spec.NodeName == "" {
+		delete(podNodes, key)
+		return
+	}
+	podNodes[key] = pod.Spec.NodeName
+}
+
+// PodNode names the node a pod runs on
+func PodNode(namespace, name string) (string, bool) {
+	resolver_mu.RLock()
+	defer resolver_mu.RUnlock()
+	node, ok := podNodes[namespace+"/"+name]
+	return node, ok
+}
+
+func serviceIPs(svc *corev1.Service) []netip.Addr {
+	var addrs []netip.Addr
+	for _, ip := range svc.Spec.ClusterIPs {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func updateService(obj any) {
+	svc, ok := obj.(*corev1.Service)
+	if !ok {
+		return
+	}
+	key := serviceKey{namespace: svc.Namespace, name: svc.Name}
+
+	resolver_mu.Lock()
+	defer resolver_mu.Unlock()
+	for addr, k := range servicesByIP {
+		if k == key {
+			delete(servicesByIP, addr)
+		}
+	}
+	for _, addr := range serviceIPs(svc) {
+		servicesByIP[addr] = key
+	}
+}
+
+func removeService(obj any) {
+	svc, ok := obj.(*corev1.Service)
+	if !ok {
+		return
+	}
+	key := serviceKey{namespace: svc.Namespace, name: svc.Name}
+
+	resolver_mu.Lock()
+	defer resolver_mu.Unlock()
+	for addr, k := range servicesByIP {
+		if k == key {
+			delete(servicesByIP, addr)
+		}
+	}
+}
+
+func updateSlice(obj any) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return
+	}
+	name := slice.Labels[discoveryv1.LabelServiceName]
+	var addrs []netip.Addr
+	for _, endpoint := range slice.Endpoints {
+		for _, ip := range endpoint.Addresses {
+			if addr, err := netip.ParseAddr(ip); err == nil {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	key := slice.Namespace + "/" + slice.Name
+	resolver_mu.Lock()
+	defer resolver_mu.Unlock()
+	forgetSlice(key)
+	if name == "" {
+		return
+	}
+	sliceAddrs[key] = addrs
+	for _, addr := range addrs {
+		if endpointServices[addr] == nil {
+			endpointServices[addr] = make(map[string]string)
+		}
+		endpointServices[addr][key] = name
+	}
+}
+
+func removeSlice(obj any) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return
+	}
+	resolver_mu.Lock()
+	defer resolver_mu.Unlock()
+	forgetSlice(slice.Namespace + "/" + slice.Name)
+}
+
+// forgetSlice drops the endpoints of a slice , resolver_mu must be held
+func forgetSlice(key string) {
+	for _, addr := range sliceAddrs[key] {
+		delete(endpointServices[addr], key)
+		if len(endpointServices[addr]) == 0 {
+			delete(endpointServices, addr)
+		}
+	}
+	delete(sliceAddrs, key)
+}
+
+// servicesOf lists the services with addr as an endpoint , resolver_mu must be held
+func servicesOf(addr netip.Addr) []string {
+	var names []string
+	for _, name := range endpointServices[addr] {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Resolve names the workload , service or external address behind addr
+func Resolve(addr string) models.Graph_node {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return models.Graph_node{ID: "external/" + addr, Kind: models.NodeExternal, Name: addr}
+	}
+	ip = ip.Unmap()
+
+	resolver_mu.RLock()
+	defer resolver_mu.RUnlock()
+	if svc, ok := servicesByIP[ip]; ok {
+		return models.Graph_node{
+			ID:        "service/" + svc.namespace + "/" + svc.name,
+			Kind:      models.NodeService,
+			Namespace: svc.namespace,
+			Name:      svc.name,
+		}
+	}
+	if pod, ok := podsByIP[ip]; ok {
+		return models.Graph_node{
+			ID:        "workload/" + pod.namespace + "/" + pod.workload,
+			Kind:      models.NodeWorkload,
+			Namespace: pod.namespace,
+			Name:      pod.workload,
+			Services:  servicesOf(ip),
+		}
+	}
+	return models.Graph_node{ID: "external/" + ip.String(), Kind: models.NodeExternal, Name: ip.String()}
+}
+
+// monitored reports whether an agent sees what node sends , only pods outside the
+// unmonitored namespaces have a veth the agents attach to
+func monitored(node models.Graph_node) bool {
+	return node.Kind == models.NodeWorkload && !slices.Contains(config.Get().Graph.UnmonitoredNamespaces, node.Namespace)
+}
+
+// ResolveEdges turns what an agent reported into edges between workloads , services and external
+// addresses. Traffic between two monitored pods is reported by the agents of both , each direction
+// is kept from the agent of the pod that sent it. A connection to a service shows up twice: to the
+// service from the client's veth , before its cluster IP is translated , and to the backend's workload.
+func ResolveEdges(report models.Graph_report) []models.Graph_edge {
+	resolver_mu.RLock()
+	ready := resolverReady
+	resolver_mu.RUnlock()
+	// unresolved addresses would all look external , so nothing is kept until then
+	if !ready {
+		return nil
+	}
+
+	window := report.End.Truncate(config.Get().Graph.Window)
+	edges := make([]models.Graph_edge, 0, len(report.Edges))
+	for _, r := range report.Edges {
+		edge := models.Graph_edge{
+			Window:   window,
+			Src:      Resolve(r.Client),
+			Dst:      Resolve(r.Server),
+			Port:     r.Port,
+			Protocol: r.Protocol,
+		}
+		switch r.Local {
+		case models.EdgeLocalClient:
+			edge.BytesSent, edge.PacketsSent, edge.Connections = r.BytesToServer, r.PacketsToServer, r.Connections
+			if !monitored(edge.Dst) {
+				edge.BytesReceived, edge.PacketsReceived = r.BytesToClient, r.PacketsToClient
+			}
+		case models.EdgeLocalServer:
+			edge.BytesReceived, edge.PacketsReceived = r.BytesToClient, r.PacketsToClient
+			if !monitored(edge.Src) {
+				edge.BytesSent, edge.PacketsSent, edge.Connections = r.BytesToServer, r.PacketsToServer, r.Connections
+			}
+		default:
+			continue
+		}
+		edges = append(edges, edge)
+	}
+	return edges
+}
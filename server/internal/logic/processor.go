@@ -2,13 +2,12 @@ package logic
 import (
 
 	"fmt"
+	"server/internal/config"
 	"server/internal/db/models"
 	"server/internal/api/handlers"
 	
 
 )
-const ANOMALY_THRESHOLD = 0.6
-
 func Anomaly_detection(arr []*models.AnomalyLog){
 
 	cleaned_arr , ok := Data_Cleaning(arr)
@@ -26,7 +25,7 @@ func Anomaly_detection(arr []*models.AnomalyLog){
 		avg_height , reason := Compute_avg_height(forest , sample)
 		score := Compute_anomaly_score(CFactor(NUM_TREES_IN_FOREST),avg_height)
 
-		if score >= ANOMALY_THRESHOLD {
+		if score >= config.Get().Anomaly.Threshold {
 			suspicous_samples[sample] = reason
 		}
 
@@ -40,10 +39,10 @@ func Anomaly_detection(arr []*models.AnomalyLog){
 			return
 		}
 
-		container_logs  , err:= handlers.FetchPodLogs(kube_client , sample.Info.Namespace , sample.Info.PodName , sample.Info.Container_name,sample.Timestamp)
+		container_logs  , err:= handlers.FetchPodLogs(kube_client , sample.Container.Namespace , sample.Container.PodName , sample.Container.ContainerName,sample.Timestamp)
 
 		if err != nil{
-			fmt.Printf("problem fetching container logs from %s\n err = %v\n" , sample.Info.PodName , err)
+			fmt.Printf("problem fetching container logs from %s\n err = %v\n" , sample.Container.PodName , err)
 			return
 		}
 
@@ -54,6 +53,7 @@ func Anomaly_detection(arr []*models.AnomalyLog){
 		items := BuildItemsets(structured_logs)
 
 		frequent_activity := RunApriori(items)
+		_ = frequent_activity
 
 		
 	}
@@ -0,0 +1,61 @@
+package rabbitmq
+
+import (
+	"log"
+	"server/internal/db"
+	"server/internal/db/models"
+	"sync"
+	"time"
+)
+
+// LOCKDOWN_RESEND_INTERVAL keeps a heartbeat sent before the agent applied a resent lockdown from sending it again
+const LOCKDOWN_RESEND_INTERVAL = time.Minute
+
+var (
+	// when each agent was last sent each namespace's lockdown , by agent ID and namespace
+	lockdownResent    = make(map[string]map[string]time.Time)
+	lockdownResent_mu sync.Mutex
+)
+
+// lockdownsToResend returns the enforcing lockdowns an agent does not apply. modes is what its
+// heartbeat reports , nil when it just registered and applies none.
+func lockdownsToResend(enforcing []models.Lockdown, modes map[string]string) []models.Lockdown {
+	var missing []models.Lockdown
+	for _, lockdown := range enforcing {
+		if modes[lockdown.Namespace] != models.LockdownEnforcing {
+			missing = append(missing, lockdown)
+		}
+	}
+	return missing
+}
+
+// resendLockdowns sends an agent the enforcing lockdowns it lost , an agent keeps them in memory
+// only , so after a restart or on a new node its namespaces would be open again
+func resendLockdowns(agentID string, modes map[string]string, registered bool) {
+	enforcing, err := db.EnforcingLockdowns()
+	if err != nil {
+		log.Printf(" Failed to read the enforcing lockdowns for %s: %v", agentID, err)
+		return
+	}
+
+	lockdownResent_mu.Lock()
+	defer lockdownResent_mu.Unlock()
+	resent := lockdownResent[agentID]
+	if resent == nil {
+		resent = make(map[string]time.Time)
+		lockdownResent[agentID] = resent
+	}
+	for _, lockdown := range lockdownsToResend(enforcing, modes) {
+		if !registered && time.Since(resent[lockdown.Namespace]) < LOCKDOWN_RESEND_INTERVAL {
+			continue
+		}
+		req := models.Lockdown_request{Namespace: lockdown.Namespace, Mode: models.LockdownEnforcing, Allow: lockdown.Allow}
+		correlationID, err := Publish_command(Command_target(agentID, "", ""), CommandLockdown, req)
+		if err != nil {
+			log.Printf(" Failed to resend the lockdown of %s to %s: %v", lockdown.Namespace, agentID, err)
+			continue
+		}
+		resent[lockdown.Namespace] = time.Now()
+		log.Printf(" Resent the lockdown of %s to %s (%s)", lockdown.Namespace, agentID, correlationID)
+	}
+}
@@ -0,0 +1,36 @@
+package rabbitmq
+
+import (
+	"server/internal/db/models"
+	"slices"
+	"testing"
+)
+
+func TestLockdownsToResend(t *testing.T) {
+	enforcing := []models.Lockdown{
+		{Namespace: "shop", Status: models.LockdownEnforcing},
+		{Namespace: "billing", Status: models.LockdownEnforcing},
+	}
+	tests := []struct {
+		name  string
+		modes map[string]string
+		want  []string
+	}{
+		{"just registered", nil, []string{"shop", "billing"}},
+		{"applies both", map[string]string{"shop": "enforcing", "billing": "enforcing"}, nil},
+		{"restarted agent", map[string]string{}, []string{"shop", "billing"}},
+		{"one missing", map[string]string{"shop": "enforcing", "other": "learning"}, []string{"billing"}},
+		{"still learning", map[string]string{"shop": "learning", "billing": "enforcing"}, []string{"shop"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, lockdown := range lockdownsToResend(enforcing, tt.modes) {
+				got = append(got, lockdown.Namespace)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("lockdownsToResend() = %q , want %q", got, tt.want)
+			}
+		})
+	}
+}